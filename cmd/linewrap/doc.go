@@ -4,6 +4,7 @@
 
 // This file was auto-generated via go generate.
 // DO NOT UPDATE MANUALLY
+// Generated from v.io/x/lib/cmd/linewrap with args: -h
 
 /*
 Command linewrap formats text from stdin into pretty output on stdout.
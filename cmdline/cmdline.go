@@ -14,8 +14,9 @@
 //   command [flags] [subcommand [flags]]* [args]
 //
 // Each sequence of flags is associated with the command that immediately
-// precedes it.  Flags registered on flag.CommandLine are considered global
-// flags, and are allowed anywhere a command-specific flag is allowed.
+// precedes it.  Flags registered on flag.CommandLine, or on the FlagSet set via
+// SetGlobalFlags, are considered global flags, and are allowed anywhere a
+// command-specific flag is allowed.
 //
 // Pretty usage documentation is automatically generated, and accessible either
 // via the standard -h / -help flags from the Go flag package, or a special help
@@ -39,6 +40,7 @@
 package cmdline
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -46,11 +48,14 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"v.io/x/lib/cmd/flagvar"
 	"v.io/x/lib/envvar"
@@ -94,6 +99,19 @@ type Command struct {
 	// ancestor commands. The flags for the ancestor commands will not be
 	// propagated to the child commands as well.
 	DontInheritFlags bool
+	// ContributeGlobalFlags, if non-nil, is called to define flags on fs that are
+	// treated as global flags, but only when this command or one of its
+	// descendants is being run.  The flags are allowed anywhere a global flag is
+	// allowed after this command on the command line, and are only shown in the
+	// help for this command, along with its own flags, and in the help for its
+	// descendants, along with the global flags.  The function is called at most
+	// once, when dispatch or help first reaches this command.
+	ContributeGlobalFlags func(fs *flag.FlagSet)
+	// UnknownFlags determines how flags that aren't defined for this command
+	// are handled, when they appear on the command line immediately after it.
+	// The default UnknownFlagsError reports a usage error.  See
+	// UnknownFlagsMode for the other modes.
+	UnknownFlags UnknownFlagsMode
 
 	// Children of the command.
 	Children []*Command
@@ -105,7 +123,48 @@ type Command struct {
 	//
 	// All global flags and flags set on ancestor commands are passed through to
 	// the external child.
+	//
+	// The short description of an external child is read from a sibling file
+	// with a ".short" suffix, e.g. "tool-foo.short" for "tool-foo", if it
+	// exists.  Otherwise the child is run with -help to produce it, which is
+	// much slower for tools with many external children.
 	LookPath bool
+	// LookPathDirs are additional directories to look for external subcommands
+	// in when LookPath is true, e.g. a plugin directory like
+	// "/home/me/.tool/plugins".  The directories are consulted before the
+	// directories in PATH, so they take precedence, and directories that are
+	// also in PATH are only consulted once.  Relative directories are relative
+	// to the current working directory, and "~" isn't expanded.
+	LookPathDirs []string
+
+	// CaseInsensitive indicates whether the names of commands and topics are
+	// matched case-insensitively, when dispatching and running help.  A match
+	// with the exact case is always preferred.  Only the setting on the root
+	// command is used, and applies to the entire command tree.
+	CaseInsensitive bool
+
+	// HelpWidth, if non-zero, is the target width in runes of the help for this
+	// command, overriding the terminal width; e.g. to pin help that contains
+	// tables to a fixed width.  If HelpWidth < 0 the width is unlimited.  It
+	// only affects the help for this command, not its children, and is ignored
+	// if the width is set explicitly via the -width flag of the help command or
+	// the CMDLINE_WIDTH environment variable.
+	HelpWidth int
+
+	// ExitCodeFunc, if non-nil, maps errors returned by Runners to exit codes,
+	// e.g. to implement sysexits-style codes.  It's called for every error
+	// except ErrExitCode, which always determines the exit code itself; e.g.
+	// usage errors always exit with code 2.  Non-positive results are replaced
+	// by 1, so that errors never exit with code 0.  Only the setting on the root
+	// command is used.
+	ExitCodeFunc func(err error) int
+
+	// Validate, if non-nil, is called with the env and args that will be passed
+	// to the Runner, after the flags have been parsed and the flag groups have
+	// been checked, but before the Runner is run; e.g. to check that -since is
+	// before -until.  A non-nil error is reported as a usage error by Parse.
+	// Validate isn't called when help is requested, or for external children.
+	Validate func(env *Env, args []string) error
 
 	// Runner that runs the command.
 	// Use RunnerFunc to adapt regular functions into Runners.
@@ -118,8 +177,121 @@ type Command struct {
 
 	// Topics that provide additional info via the default help command.
 	Topics []Topic
+
+	// NoHelpChild indicates whether to prevent the default "help" command from
+	// being added to the children of this command.  Usage is still available
+	// via the -help flag, but Topics can't be shown, since they're only shown by
+	// the help command.
+	NoHelpChild bool
+
+	// CompleteArgs returns the candidates for completing the arg prefix, given
+	// the preceding args, for the shell completion enabled via WithCompletion.
+	// Candidates that don't start with prefix are ignored.
+	CompleteArgs func(args []string, prefix string) []string
+	// CompleteArgsAsFiles indicates whether the shell completion enabled via
+	// WithCompletion also completes args as file paths, using the native file
+	// completion of the shell.  If CompleteArgsExts is non-empty, only
+	// directories and files with one of the given extensions are completed; the
+	// extensions include the leading dot, e.g. ".go".
+	CompleteArgsAsFiles bool
+	CompleteArgsExts    []string
+
+	// runHooks wrap the runner returned by Parse, when called via ParseAndRun on
+	// this command as the root.  The first hook is the outermost wrapper.
+	runHooks []runHook
+	// complete indicates whether the hidden __complete command is enabled, when
+	// this command is the root.  Set by WithCompletion.
+	complete bool
+	// completionScript holds the value of the -completion-script flag, when
+	// this command is the root.  Set by WithCompletion.
+	completionScript *EnumFlag
+	// debugTree holds the value of the -debug-tree flag, when this command is
+	// the root.  Set by WithDebugTree.
+	debugTree *bool
+	// flagsFrom holds the value of the -flags-from flag, when this command is
+	// the root.  Set by WithFlagsFrom.
+	flagsFrom *string
+	// describe holds the value of the -describe flag, when this command is the
+	// root.  Set by WithDescribe.
+	describe *bool
+	// flagRunners are run in place of the command matched by the command line
+	// when their flag is set, when this command is the root.  Set by the With*
+	// functions for leaf roots; see isLeafRoot.
+	flagRunners []flagRunner
+	// contributed holds the flags defined by ContributeGlobalFlags.
+	contributed *flag.FlagSet
+	// flagGroups holds the constraints on which flags may be set together.
+	flagGroups []flagGroup
+	// argSpecs holds the positional args declared via Args, and argSpecsErr
+	// holds the error from an invalid declaration.
+	argSpecs    []argSpec
+	argSpecsErr error
+	// hidden indicates whether the command is omitted from the help of its
+	// parent, and from completion.  It may still be run, and has its own help.
+	hidden bool
+}
+
+// runHook wraps the run of the runner returned by Parse.  The hook must call
+// run at most once, and should return its error.
+type runHook func(env *Env, run func() error) error
+
+func (cmd *Command) addRunHook(hook runHook) {
+	cmd.runHooks = append(cmd.runHooks, hook)
+}
+
+// isLeafRoot returns true iff root has a Runner and no children.  The With*
+// functions that add a child to root register a global flag via addFlagRunner
+// instead for leaf roots, since a child would conflict with the args of the
+// Runner, and would add a help command.
+func isLeafRoot(root *Command) bool {
+	return root.Runner != nil && len(root.Children) == 0
+}
+
+// flagRunner is a Runner that is run in place of the command matched by the
+// command line, when its global flag is set.
+type flagRunner struct {
+	isSet  func() bool
+	runner Runner
+}
+
+func (cmd *Command) addFlagRunner(isSet func() bool, runner Runner) {
+	cmd.flagRunners = append(cmd.flagRunners, flagRunner{isSet, runner})
+}
+
+// flagRunnerFor returns the Runner registered via addFlagRunner on the root of
+// path whose flag is set, or nil if there is none.
+func flagRunnerFor(path []*Command) Runner {
+	for _, fr := range path[0].flagRunners {
+		if fr.isSet() {
+			return fr.runner
+		}
+	}
+	return nil
 }
 
+// UnknownFlagsMode describes how a command handles flags on the command line
+// that aren't defined for it.
+//
+// Flag parsing stops at the first arg that isn't a flag, or after the "--"
+// terminator, which is removed from the args.  The args that follow are never
+// treated as flags, regardless of the mode; e.g. "tool exec -- -x" always runs
+// exec with the args ["-x"].  Unknown flags are recognized by name only, so a
+// value given as a separate arg, e.g. "-x 1" rather than "-x=1", is treated as
+// the first non-flag arg, which stops flag parsing.
+type UnknownFlagsMode int
+
+const (
+	// UnknownFlagsError reports unknown flags as a usage error.
+	UnknownFlagsError UnknownFlagsMode = iota
+	// UnknownFlagsIgnore silently discards unknown flags.
+	UnknownFlagsIgnore
+	// UnknownFlagsPassThrough keeps unknown flags in the args passed to the
+	// Runner, in their original order, e.g. for wrapper commands like
+	// "tool exec -other-flag=1 other-tool".  Commands with children should not
+	// use this mode, since the unknown flags are matched as a child name.
+	UnknownFlagsPassThrough
+)
+
 // FlagDefinitions represents a struct containing flag variables and their
 // associated default values as per RegisterFlagsInStruct.
 type FlagDefinitions struct {
@@ -142,11 +314,24 @@ func (f RunnerFunc) Run(env *Env, args []string) error {
 	return f(env, args)
 }
 
+// RunnerFuncFlags is an adapter that turns functions that read their flags
+// from the parsed FlagSet into Runners, avoiding the need for package-level
+// flag variables or closures.
+type RunnerFuncFlags func(env *Env, flags *flag.FlagSet, args []string) error
+
+// Run implements the Runner interface method by calling f(env, flags, args),
+// where flags is the ParsedFlags of the command most recently parsed with env.
+// The flags are nil if env wasn't used to parse a command.
+func (f RunnerFuncFlags) Run(env *Env, args []string) error {
+	return f(env, env.parsedFlags, args)
+}
+
 // Topic represents a help topic that is accessed via the help command.
 type Topic struct {
-	Name  string // Name of the topic.
-	Short string // Short description, shown in help for the command.
-	Long  string // Long description, shown in help for this topic.
+	Name   string      // Name of the topic.
+	Short  string      // Short description, shown in help for the command.
+	Long   string      // Long description, shown in help for this topic.
+	Format TopicFormat // Format of Long; defaults to TopicPlain.
 }
 
 // Main implements the main function for the command tree rooted at root.
@@ -167,8 +352,19 @@ func Main(root *Command) {
 	if env.Timer != nil && len(env.Timer.Intervals) > 0 {
 		env.Timer.Intervals[0].Name = pathName(env.prefix(), []*Command{root})
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	env.Context = ctx
+	signals := newSignalHandler(env, cancel)
+	env.notifySignals = signals.notify
 	err := ParseAndRun(root, env, os.Args[1:])
-	code := ExitCode(err, env.Stderr)
+	var code int
+	if sig := signals.stop(); sig != 0 && err == context.Canceled {
+		// Follow the shell convention for processes killed by a signal, and don't
+		// report the cancellation as an error.
+		code = 128 + int(sig)
+	} else {
+		code = exitCode(env, err)
+	}
 	if *flagTime && env.Timer != nil {
 		env.Timer.Finish()
 		p := timing.IntervalPrinter{Zero: env.Timer.Zero}
@@ -178,12 +374,111 @@ func Main(root *Command) {
 				code = code2
 			}
 		}
+		fmt.Fprintln(env.Stderr, timeSummary(env.cmdPath, env.Timer.Intervals))
 	}
 	os.Exit(code)
 }
 
+// signalShutdownTimeout is the time that a signalHandler waits for the Runner
+// to return after the context is cancelled, before exiting regardless.
+var signalShutdownTimeout = 5 * time.Second
+
+// signalHandler handles SIGINT and SIGTERM for Main.  The handler is only
+// installed via notify, when the functions registered via Env.OnShutdown or an
+// external child need to be cleaned up; otherwise signals have their default
+// behavior.  When a signal is received, the context of the env is cancelled,
+// and the Runner is given signalShutdownTimeout to return, after which Main
+// exits with the usual exit code.  If the Runner doesn't return in time, the
+// functions registered via OnShutdown are called, and the program exits.  A
+// second signal exits immediately.
+type signalHandler struct {
+	env    *Env
+	cancel func()
+	exit   func(code int)
+	once   sync.Once
+	ch     chan os.Signal
+	done   chan struct{}
+	mu     sync.Mutex
+	sig    syscall.Signal
+}
+
+func newSignalHandler(env *Env, cancel func()) *signalHandler {
+	return &signalHandler{
+		env:    env,
+		cancel: cancel,
+		exit:   os.Exit,
+		ch:     make(chan os.Signal, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// notify installs the handler, if it isn't already installed.
+func (h *signalHandler) notify() {
+	h.once.Do(func() {
+		signal.Notify(h.ch, os.Interrupt, syscall.SIGTERM)
+		go h.handle()
+	})
+}
+
+func (h *signalHandler) handle() {
+	var sig os.Signal
+	select {
+	case sig = <-h.ch:
+	case <-h.done:
+		return
+	}
+	// Restore the default behavior, so that a second signal exits immediately.
+	signal.Stop(h.ch)
+	code := 1
+	if s, ok := sig.(syscall.Signal); ok {
+		h.mu.Lock()
+		h.sig = s
+		h.mu.Unlock()
+		code = 128 + int(s)
+	}
+	h.cancel()
+	select {
+	case <-h.done:
+		// The Runner returned, and Main exits as usual.
+		return
+	case <-time.After(signalShutdownTimeout):
+	}
+	h.env.runShutdown()
+	h.exit(code)
+}
+
+// stop uninstalls the handler after the Runner has returned, and returns the
+// signal that was received, or 0 if none was received.
+func (h *signalHandler) stop() syscall.Signal {
+	signal.Stop(h.ch)
+	close(h.done)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.sig
+}
+
 var flagTime = flag.Bool("time", false, "Dump timing information to stderr before exiting the program.")
 
+// timeSummary returns a compact one-line summary of the total time taken by the
+// command with the given path, broken down into the time spent parsing and
+// running, based on the intervals recorded by ParseAndRun.
+func timeSummary(cmdPath string, intervals []timing.Interval) string {
+	var parse, run time.Duration
+	for _, i := range intervals {
+		if i.Depth != 1 || i.End == timing.InvalidDuration {
+			continue
+		}
+		switch i.Name {
+		case "cmdline parse":
+			parse += i.End - i.Start
+		case "cmdline run":
+			run += i.End - i.Start
+		}
+	}
+	total := intervals[0].End - intervals[0].Start
+	return fmt.Sprintf("%s completed in %.2fs (parse %.2fs, run %.2fs)", cmdPath, total.Seconds(), parse.Seconds(), run.Seconds())
+}
+
 // Parse parses args against the command tree rooted at root down to a leaf
 // command.  A single path through the command tree is traversed, based on the
 // sub-commands specified in args.  Global and command-specific flags are parsed
@@ -216,34 +511,74 @@ var flagTime = flag.Bool("time", false, "Dump timing information to stderr befor
 // Parse merges root flags into flag.CommandLine and sets ContinueOnError, so
 // that subsequent calls to flag.Parsed return true.
 func Parse(root *Command, env *Env, args []string) (Runner, []string, error) {
+	result, err := ParseCommand(root, env, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result.Runner, result.Args, nil
+}
+
+// ParseResult describes the outcome of parsing args against a command tree.
+type ParseResult struct {
+	// Command is the command that was matched, which is the last command in
+	// Path.  It is the help command when help was requested.
+	Command *Command
+	// Path holds the commands from the root to Command.
+	Path []*Command
+	// Flags holds the flags parsed for Command, which is also available as
+	// Command.ParsedFlags.  It is nil when help was requested via -help.
+	Flags *flag.FlagSet
+	// Args holds the positional args remaining after the parse, to be passed
+	// to Runner.
+	Args []string
+	// Runner is the runner for Command, which may also be a runner for help
+	// or for an external child found via LookPath.
+	Runner Runner
+}
+
+// ParseCommand is like Parse, but returns the matched command path and parsed
+// flags along with the runner and args, without running the runner.  Hosts
+// that embed a command tree may use it to perform their own dispatch or
+// validation.
+func ParseCommand(root *Command, env *Env, args []string) (*ParseResult, error) {
 	env.TimerPush("cmdline parse")
 	if err := root.registerFlagDefs(); err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	defer env.TimerPop()
+	env.flagSources = make(map[string]flagSource)
+	env.exitCodeFunc = root.ExitCodeFunc
+	env.notFirstCall = env.Vars["CMDLINE_FIRST_CALL"] != ""
+	env.parsedWidth = env.varsWidth()
 	if globalFlags == nil {
 		// Initialize our global flags to a cleaned copy.  We don't want the merging
 		// in parseFlags to contaminate the global flags, even if Parse is called
 		// multiple times, so we keep a single package-level copy.
-		cleanFlags(flag.CommandLine)
-		globalFlags = copyFlags(flag.CommandLine)
+		cleanFlags(commandLine())
+		globalFlags = copyFlags(commandLine())
 	}
 	// Set env.Usage to the usage of the root command, in case the parse fails.
 	path := []*Command{root}
 	env.Usage = makeHelpRunner(path, env).usageFunc
 	cleanTree(root)
 	if err := checkTreeInvariants(path, env); err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if root.complete && len(args) > 0 && args[0] == completeName {
+		return &ParseResult{Runner: completeRunner{root}, Args: args[1:], Command: root, Path: path}, nil
+	}
+	result, err := root.parse(nil, env, args, make(map[string]string))
+	if root.debugTree != nil && *root.debugTree {
+		writeDebugTree(env, root, result)
 	}
-	runner, args, err := root.parse(nil, env, args, make(map[string]string))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 	// Clear envvars that start with "CMDLINE_" when returning a user-specified
 	// runner, to avoid polluting the environment.  In particular CMDLINE_PREFIX
 	// and CMDLINE_FIRST_CALL are only meant to be passed to external children,
 	// and shouldn't be propagated through the user's runner.
-	switch runner.(type) {
+	switch result.Runner.(type) {
 	case helpRunner, binaryRunner:
 		// The help and binary runners need the envvars to be set.
 	default:
@@ -251,18 +586,46 @@ func Parse(root *Command, env *Env, args []string) (Runner, []string, error) {
 			if strings.HasPrefix(key, "CMDLINE_") {
 				delete(env.Vars, key)
 				if err := os.Unsetenv(key); err != nil {
-					return nil, nil, err
+					return nil, err
 				}
 			}
 		}
 	}
-	return runner, args, nil
+	return result, nil
 }
 
 var globalFlags *flag.FlagSet
 
+// globalFlagSet holds the FlagSet set via SetGlobalFlags, or nil if the global
+// flags are registered on flag.CommandLine.
+var globalFlagSet *flag.FlagSet
+
+// SetGlobalFlags sets the FlagSet that global flags are registered on, in place
+// of flag.CommandLine, which is the default.  The help and parsing of all
+// command trees use fs instead of flag.CommandLine, which isn't modified; e.g.
+// libraries and tests may use their own FlagSet, rather than polluting the
+// process-wide flags.  A nil fs restores the default.
+//
+// SetGlobalFlags must be called before Main or Parse, and before functions
+// that register global flags, like WithProfiling.  Those functions register
+// their flags on fs, or flag.CommandLine by default, and each must be called at
+// most once, before Main or Parse, since a flag can't be defined twice.
+func SetGlobalFlags(fs *flag.FlagSet) {
+	globalFlagSet = fs
+	globalFlags = nil
+}
+
+// commandLine returns the FlagSet that global flags are registered on.
+func commandLine() *flag.FlagSet {
+	if globalFlagSet != nil {
+		return globalFlagSet
+	}
+	return flag.CommandLine
+}
+
 // ParseAndRun is a convenience that calls Parse, and then calls Run on the
-// returned runner with the given env and parsed args.
+// returned runner with the given env and parsed args.  The functions registered
+// via env.OnShutdown are called after Run returns.
 func ParseAndRun(root *Command, env *Env, args []string) error {
 	runner, args, err := Parse(root, env, args)
 	if err != nil {
@@ -270,7 +633,13 @@ func ParseAndRun(root *Command, env *Env, args []string) error {
 	}
 	env.TimerPush("cmdline run")
 	defer env.TimerPop()
-	return runner.Run(env, args)
+	defer env.runShutdown()
+	run := func() error { return runner.Run(env, args) }
+	for i := len(root.runHooks) - 1; i >= 0; i-- {
+		hook, next := root.runHooks[i], run
+		run = func() error { return hook(env, next) }
+	}
+	return run()
 }
 
 func trimSpace(s *string) { *s = strings.TrimSpace(*s) }
@@ -353,6 +722,13 @@ Since both Children and Runner are specified, the Runner cannot take args.
 Otherwise a conflict between child names and runner args is possible.`, cmdPath)
 		return errors.New(msg)
 	}
+	// Check that the positional args declared via Args are valid.
+	if cmd.argSpecsErr != nil {
+		msg := fmt.Sprintf(`%v: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Invalid positional args: %v`, cmdPath, cmd.argSpecsErr)
+		return errors.New(msg)
+	}
 	// Check recursively for all children
 	for _, child := range cmd.Children {
 		if err := checkTreeInvariants(append(path, child), env); err != nil {
@@ -373,68 +749,178 @@ func pathName(prefix string, path []*Command) string {
 	return name
 }
 
+// lookupChild returns the child of cmd with the given name, or nil if there is
+// no such child.  If fold is true and there is no exact match, the name is
+// matched case-insensitively.
+func lookupChild(cmd *Command, name string, fold bool) *Command {
+	for _, child := range cmd.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	if fold {
+		for _, child := range cmd.Children {
+			if strings.EqualFold(child.Name, name) {
+				return child
+			}
+		}
+	}
+	return nil
+}
+
+// lookupTopic is like lookupChild, but returns the topic with the given name.
+func lookupTopic(cmd *Command, name string, fold bool) *Topic {
+	for tx := range cmd.Topics {
+		if cmd.Topics[tx].Name == name {
+			return &cmd.Topics[tx]
+		}
+	}
+	if fold {
+		for tx := range cmd.Topics {
+			if strings.EqualFold(cmd.Topics[tx].Name, name) {
+				return &cmd.Topics[tx]
+			}
+		}
+	}
+	return nil
+}
+
+// matchName returns true iff name matches want, case-insensitively if fold is
+// true.
+func matchName(want, name string, fold bool) bool {
+	return want == name || fold && strings.EqualFold(want, name)
+}
+
 // nolint: gocyclo
-func (cmd *Command) parse(path []*Command, env *Env, args []string, setFlags map[string]string) (Runner, []string, error) {
+func (cmd *Command) parse(path []*Command, env *Env, args []string, setFlags map[string]string) (*ParseResult, error) {
 	path = append(path, cmd)
 	cmdPath := pathName(env.prefix(), path)
 	runHelp := makeHelpRunner(path, env)
 	env.Usage = runHelp.usageFunc
+	env.cmdPath = cmdPath
+	env.args, env.parsedFlags = nil, nil
 	// Parse flags and retrieve the args remaining after the parse, as well as the
 	// flags that were set.
 	args, setF, err := parseFlags(path, env, args)
+	result := func(runner Runner, args []string) (*ParseResult, error) {
+		return &ParseResult{Runner: runner, Args: args, Command: cmd, Path: path, Flags: cmd.ParsedFlags}, nil
+	}
+	// applyFile applies the -flags-from file.
+	applyFile := func() error {
+		fileFlags, err := applyFlagsFile(path, env, setFlags)
+		if err != nil {
+			return env.UsageErrorf("%s: %v", cmdPath, err)
+		}
+		if len(fileFlags) > 0 {
+			if err := validateFlags(path, fileFlags); err != nil {
+				return env.UsageErrorf("%s: %v", cmdPath, err)
+			}
+			for key, val := range fileFlags {
+				setFlags[key] = val
+			}
+		}
+		return nil
+	}
+	// runnerResult also applies the -flags-from file, and parses the positional
+	// args declared via Args.
+	runnerResult := func(args []string) (*ParseResult, error) {
+		if describing(path) {
+			return result(describeRunner{path}, args)
+		}
+		if err := applyFile(); err != nil {
+			return nil, err
+		}
+		// The flag groups are checked once all flags are set, since flags may be
+		// set after descendants on the command line.  The help command is exempt,
+		// so that help is available regardless of the flags.
+		if _, ok := cmd.Runner.(helpRunner); !ok {
+			if err := validateFlagGroups(path, env, setFlags); err != nil {
+				return nil, env.UsageErrorf("%s: %v", cmdPath, err)
+			}
+		}
+		if cmd.argSpecs != nil {
+			values, err := parseArgs(cmd.argSpecs, args)
+			if err != nil {
+				return nil, env.UsageErrorf("%s: %v", cmdPath, err)
+			}
+			env.args = values
+		}
+		env.parsedFlags = cmd.ParsedFlags
+		if cmd.Validate != nil {
+			if err := cmd.Validate(env, args); err != nil {
+				return nil, env.UsageErrorf("%s: %v", cmdPath, err)
+			}
+		}
+		return result(cmd.Runner, args)
+	}
 	switch {
 	case err == flag.ErrHelp:
-		return runHelp, nil, nil
+		return &ParseResult{Runner: runHelp, Command: cmd, Path: path}, nil
 	case err != nil:
-		return nil, nil, env.UsageErrorf("%s: %v", cmdPath, err)
+		return nil, env.UsageErrorf("%s: %v", cmdPath, err)
+	}
+	if err := validateFlags(path, setF); err != nil {
+		return nil, env.UsageErrorf("%s: %v", cmdPath, err)
 	}
 	for key, val := range setF {
 		setFlags[key] = val
 	}
+	// The -completion-script flag is handled as soon as it's set, regardless of
+	// the args.
+	if shell := completionScriptShell(path); shell != "" {
+		return result(completionScriptRunner{shell, path[0].Name}, nil)
+	}
+	// Likewise for the flags registered in place of children for leaf roots,
+	// after applying the -flags-from file, so that -config-dump shows its flags.
+	if runner := flagRunnerFor(path); runner != nil {
+		if err := applyFile(); err != nil {
+			return nil, err
+		}
+		return result(runner, nil)
+	}
 	// First handle the no-args case.
 	if len(args) == 0 {
-		if cmd.Runner != nil {
-			return cmd.Runner, nil, nil
+		if cmd.Runner != nil || describing(path) {
+			return runnerResult(nil)
 		}
-		return nil, nil, env.UsageErrorf("%s: no command specified", cmdPath)
+		return nil, env.UsageErrorf("%s: no command specified", cmdPath)
 	}
 	// INVARIANT: len(args) > 0
 	// Look for matching children.
 	subName, subArgs := args[0], args[1:]
 	if len(cmd.Children) > 0 {
-		for _, child := range cmd.Children {
-			if child.Name == subName {
-				return child.parse(path, env, subArgs, setFlags)
-			}
+		fold := path[0].CaseInsensitive
+		if child := lookupChild(cmd, subName, fold); child != nil {
+			return child.parse(path, env, subArgs, setFlags)
 		}
-		// Every non-leaf command gets a default help command.
-		if helpName == subName {
+		// Every non-leaf command gets a default help command, unless it opts out.
+		if !cmd.NoHelpChild && matchName(helpName, subName, fold) {
 			return runHelp.newCommand().parse(path, env, subArgs, setFlags)
 		}
 	}
 	if cmd.LookPath {
 		// Look for a matching executable in PATH.
-		if subCmd, _ := env.LookPath(cmd.Name + "-" + subName); subCmd != "" {
+		if subCmd, _ := env.lookPath(cmd.LookPathDirs, cmd.Name+"-"+subName); subCmd != "" {
 			extArgs := append(flagsAsArgs(setFlags), subArgs...)
-			return binaryRunner{subCmd, cmdPath}, extArgs, nil
+			return result(binaryRunner{subCmd, cmdPath}, extArgs)
 		}
 	}
 	// No matching subcommands, check various error cases.
 	switch {
 	case cmd.Runner == nil:
-		return nil, nil, env.UsageErrorf("%s: unknown command %q", cmdPath, subName)
+		return nil, env.UsageErrorf("%s: unknown command %q", cmdPath, subName)
 	case cmd.ArgsName == "":
 		if len(cmd.Children) > 0 {
-			return nil, nil, env.UsageErrorf("%s: unknown command %q", cmdPath, subName)
+			return nil, env.UsageErrorf("%s: unknown command %q", cmdPath, subName)
 		}
-		return nil, nil, env.UsageErrorf("%s: doesn't take arguments", cmdPath)
+		return nil, env.UsageErrorf("%s: doesn't take arguments", cmdPath)
 	case reflect.DeepEqual(args, []string{helpName, "..."}):
-		return nil, nil, env.UsageErrorf("%s: unsupported help invocation", cmdPath)
+		return nil, env.UsageErrorf("%s: unsupported help invocation", cmdPath)
 	}
 	// INVARIANT:
 	// cmd.Runner != nil && len(args) > 0 &&
 	// cmd.ArgsName != "" && args != []string{"help", "..."}
-	return cmd.Runner, args, nil
+	return runnerResult(args)
 }
 
 func (cmd *Command) registerFlagDefs() error {
@@ -463,37 +949,78 @@ func parseFlags(path []*Command, env *Env, args []string) ([]string, map[string]
 		// package doc.  Merge into flag.CommandLine and use that for parsing.  This
 		// ensures that subsequent calls to flag.Parsed will return true, so the
 		// user can check whether flags have already been parsed.  Global flags take
-		// precedence over command flags for the root command.
-		flags = flag.CommandLine
+		// precedence over command flags for the root command.  The FlagSet set via
+		// SetGlobalFlags is used in place of flag.CommandLine.
+		flags = commandLine()
 		mergeFlags(flags, &cmd.Flags)
+		if contributed := contributedFlags(path); contributed != nil {
+			mergeFlags(flags, contributed)
+		}
+		if flags.Parsed() {
+			// The flags were already parsed, e.g. for a previous line run via REPL
+			// or RunBatch.  Parse a copy, so that the flags set by the previous
+			// parse aren't reported as set again.
+			flags = copyFlags(flags)
+		}
 	} else {
 		// Command flags take precedence over global flags for non-root commands.
 		flags = pathFlags(path)
-		mergeFlags(flags, globalFlags)
+		mergeFlags(flags, pathGlobalFlags(path))
 	}
 	// Silence the many different ways flags.Parse can produce ugly output; we
 	// just want it to return any errors and handle the output ourselves.
 	//   1) Set flag.ContinueOnError so that Parse() doesn't exit or panic.
 	//   2) Discard all output (can't be nil, that means stderr).
 	//   3) Set an empty Usage (can't be nil, that means use the default).
+	name, handling, output := flags.Name(), flags.ErrorHandling(), flags.Output()
 	flags.Init(cmd.Name, flag.ContinueOnError)
 	flags.SetOutput(ioutil.Discard)
 	flags.Usage = func() {}
 	if isRoot {
 		// If this is the root command, we must remember to undo the above changes
-		// on flag.CommandLine after the parse.  We don't know the original settings
-		// of these values, so we just blindly set back to the default values.
+		// on flag.CommandLine, or the FlagSet set via SetGlobalFlags, after the
+		// parse.  The Usage is set to print the usage of the root command.
 		defer func() {
-			flags.Init(cmd.Name, flag.ExitOnError)
-			flags.SetOutput(nil)
+			flags.Init(name, handling)
+			flags.SetOutput(output)
 			flags.Usage = func() { env.Usage(env, env.Stderr) }
 		}()
 	}
-	if err := flags.Parse(args); err != nil {
+	if err := applyEnvFlags(path, env, flags); err != nil {
+		return nil, nil, err
+	}
+	args, err := parseFlagArgs(flags, args, cmd.UnknownFlags)
+	applyErrorFormat(env, flags)
+	if err != nil {
 		return nil, nil, err
 	}
 	cmd.ParsedFlags = flags
-	return flags.Args(), extractSetFlags(flags), nil
+	setFlags := extractSetFlags(flags)
+	for name := range setFlags {
+		env.flagSources[name] = flagSourceFlag
+	}
+	return args, setFlags, nil
+}
+
+// parseFlagArgs parses args with flags, handling the flags that aren't defined
+// according to mode, and returns the remaining args.
+func parseFlagArgs(flags *flag.FlagSet, args []string, mode UnknownFlagsMode) ([]string, error) {
+	var unknown []string
+	for {
+		err := flags.Parse(args)
+		switch {
+		case err == nil:
+			return append(unknown, flags.Args()...), nil
+		case mode == UnknownFlagsError || !strings.HasPrefix(err.Error(), "flag provided but not defined: "):
+			return nil, err
+		}
+		// The unknown flag is the arg immediately before the remaining args.
+		rest := flags.Args()
+		if mode == UnknownFlagsPassThrough {
+			unknown = append(unknown, args[len(args)-len(rest)-1])
+		}
+		args = rest
+	}
 }
 
 func mergeFlags(dst, src *flag.FlagSet) {
@@ -516,21 +1043,68 @@ func copyFlags(flags *flag.FlagSet) *flag.FlagSet {
 // pathFlags returns the flags that are allowed for the last command in the
 // path.  Flags defined on ancestors are also allowed, except on "help".
 func pathFlags(path []*Command) *flag.FlagSet {
+	flags := copyFlags(&path[len(path)-1].Flags)
+	for _, p := range inheritedFlagLevels(path) {
+		mergeFlags(flags, &path[p].Flags)
+	}
+	return flags
+}
+
+// inheritedFlagLevels returns the indices in path of the ancestors whose flags
+// are inherited by the last command in path, starting with the parent.  Flags
+// defined by closer ancestors take precedence.
+func inheritedFlagLevels(path []*Command) []int {
 	cmd := path[len(path)-1]
-	flags := copyFlags(&cmd.Flags)
-	if cmd.Name != helpName && !cmd.DontInheritFlags {
-		// Walk backwards to merge flags up to the root command.  If this takes too
-		// long, we could consider memoizing previous results.
-		for p := len(path) - 2; p >= 0; p-- {
-			if path[p].DontPropagateFlags {
-				break
-			}
-			mergeFlags(flags, &path[p].Flags)
-			if path[p].DontInheritFlags {
-				break
-			}
+	if cmd.Name == helpName || cmd.DontInheritFlags {
+		return nil
+	}
+	var levels []int
+	// Walk backwards to merge flags up to the root command.  If this takes too
+	// long, we could consider memoizing previous results.
+	for p := len(path) - 2; p >= 0; p-- {
+		if path[p].DontPropagateFlags {
+			break
+		}
+		levels = append(levels, p)
+		if path[p].DontInheritFlags {
+			break
 		}
 	}
+	return levels
+}
+
+// contributedFlags returns the flags defined via ContributeGlobalFlags by the
+// commands in path, or nil if there are no such flags.  Flags contributed by
+// descendants take precedence over flags contributed by ancestors.
+func contributedFlags(path []*Command) *flag.FlagSet {
+	var flags *flag.FlagSet
+	for p := len(path) - 1; p >= 0; p-- {
+		cmd := path[p]
+		if cmd.ContributeGlobalFlags == nil {
+			continue
+		}
+		if cmd.contributed == nil {
+			cmd.contributed = new(flag.FlagSet)
+			cmd.ContributeGlobalFlags(cmd.contributed)
+			cleanFlags(cmd.contributed)
+		}
+		if flags == nil {
+			flags = new(flag.FlagSet)
+		}
+		mergeFlags(flags, cmd.contributed)
+	}
+	return flags
+}
+
+// pathGlobalFlags returns the global flags for the last command in path,
+// including the flags defined via ContributeGlobalFlags.
+func pathGlobalFlags(path []*Command) *flag.FlagSet {
+	contributed := contributedFlags(path)
+	if contributed == nil {
+		return globalFlags
+	}
+	flags := copyFlags(globalFlags)
+	mergeFlags(flags, contributed)
 	return flags
 }
 
@@ -594,6 +1168,47 @@ func ExitCode(err error, w io.Writer) int {
 	return 1
 }
 
+// exitCode is like ExitCode, but writes the error message to env.Stderr in the
+// format specified by env.ErrorFormat.
+// If the root command set ExitCodeFunc, it determines the exit code for errors
+// other than ErrExitCode.
+func exitCode(env *Env, err error) int {
+	code := 0
+	switch {
+	case env.ErrorFormat == errorFormatJSON:
+		if code = ExitCode(err, nil); code == 1 {
+			env.writeJSONError(err.Error(), false)
+		}
+	case env.ColorEnabled(env.Stderr):
+		// Like ExitCode, but with a colored label.
+		if code = ExitCode(err, nil); code == 1 {
+			if _, ok := err.(ErrExitCode); !ok {
+				fmt.Fprintf(env.Stderr, "%s %v\n", env.errorLabel(), err)
+			}
+		}
+	default:
+		code = ExitCode(err, env.Stderr)
+	}
+	return env.mapExitCode(err, code)
+}
+
+// mapExitCode returns the exit code for err, given the code returned by
+// ExitCode, mapped via the ExitCodeFunc of the root command.
+func (e *Env) mapExitCode(err error, code int) int {
+	if _, ok := err.(ErrExitCode); ok || err == nil || e.exitCodeFunc == nil {
+		return code
+	}
+	if code = e.exitCodeFunc(err); code <= 0 {
+		code = 1
+	}
+	return code
+}
+
+// binaryRunner runs an external child found via LookPath, connecting it to the
+// Stdin, Stdout and Stderr of the env.  Help and usage invocations of external
+// children use an env with a nil Stdin, so that they read from the null device
+// and never block on stdin.  The child is killed if the env's Context is
+// cancelled.
 type binaryRunner struct {
 	subCmd  string
 	cmdPath string
@@ -604,12 +1219,21 @@ func (b binaryRunner) Run(env *Env, args []string) error {
 	defer env.TimerPop()
 	vars := envvar.CopyMap(env.Vars)
 	vars["CMDLINE_PREFIX"] = b.cmdPath
-	cmd := exec.Command(b.subCmd, args...)
+	if env.notifySignals != nil {
+		// Make sure the child is killed and waited for on SIGINT or SIGTERM.
+		env.notifySignals()
+	}
+	ctx := env.ctx()
+	cmd := exec.CommandContext(ctx, b.subCmd, args...)
 	cmd.Stdin = env.Stdin
 	cmd.Stdout = env.Stdout
 	cmd.Stderr = env.Stderr
 	cmd.Env = envvar.MapToSlice(vars)
 	err := cmd.Run()
+	// Report the cancellation, rather than the signal that killed the binary.
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
 	// Make sure we return the exit code from the binary, if it exited.
 	if exitError, ok := err.(*exec.ExitError); ok {
 		if status, ok := exitError.Sys().(syscall.WaitStatus); ok {
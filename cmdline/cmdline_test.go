@@ -6,6 +6,7 @@ package cmdline
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -17,9 +18,13 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"v.io/x/lib/envvar"
+	"v.io/x/lib/timing"
 )
 
 var (
@@ -54,6 +59,12 @@ func runEcho(env *Env, args []string) error {
 	return nil
 }
 
+// resetFlags resets the global flags and the flags of the command tree rooted
+// at root to their default values, between parses in tests.
+func resetFlags(root *Command) {
+	flagSnapshot{}.restore(root)
+}
+
 // runHello is another function for test commands.
 func runHello(env *Env, args []string) error {
 	if flagTopLevelExtra {
@@ -273,6 +284,30 @@ Saw "duplicate" multiple times.`
 	runTestCases(t, grandparent, tests)
 }
 
+func TestDuplicateTopicNames(t *testing.T) {
+	topic := Topic{
+		Name:  "duplicate",
+		Short: "Dup topic name",
+		Long:  "Dup topic name.",
+	}
+	parent := &Command{
+		Name:   "parent",
+		Short:  "parent",
+		Long:   "parent",
+		Runner: RunnerFunc(runHello),
+		Topics: []Topic{topic, topic},
+	}
+	wantErr := `parent: CODE INVARIANT BROKEN; FIX YOUR CODE
+
+Each command must have unique children and topic names.
+Saw "duplicate" multiple times.`
+	tests := []testCase{
+		{Args: []string{}, Err: wantErr},
+		{Args: []string{"help", "duplicate"}, Err: wantErr},
+	}
+	runTestCases(t, parent, tests)
+}
+
 func TestNoChildrenOrRunner(t *testing.T) {
 	neither := &Command{
 		Name:  "neither",
@@ -467,7 +502,9 @@ The cmdrun help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -646,7 +683,9 @@ The onecmd help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -706,7 +745,9 @@ The onecmd help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -920,7 +961,9 @@ The multi help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -1321,7 +1364,9 @@ The toplevelprog help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -1451,7 +1496,9 @@ The toplevelprog echoprog help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -1888,7 +1935,9 @@ The prog1 help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -1982,7 +2031,9 @@ The prog1 prog2 help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2046,7 +2097,9 @@ The prog1 prog2 prog3 help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2110,7 +2163,9 @@ The prog1 prog2 prog3 help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2233,7 +2288,9 @@ The prog1 help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=<terminal width>
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2390,7 +2447,7 @@ The global flags are:
 		},
 	}
 	runTestCases(t, prog, tests)
-	nonHiddenGlobalFlags = nil
+	globalFlagsPolicy = GlobalFlagsPolicy{}
 }
 
 func TestHideGlobalFlagsRootNoChildren(t *testing.T) {
@@ -2434,7 +2491,142 @@ The global flags are:
 		},
 	}
 	runTestCases(t, prog, tests)
-	nonHiddenGlobalFlags = nil
+	globalFlagsPolicy = GlobalFlagsPolicy{}
+}
+
+func TestHideAllGlobalFlags(t *testing.T) {
+	HideGlobalFlagsExcept(regexp.MustCompile(`^global2$`))
+	HideAllGlobalFlags()
+	defer func() {
+		globalFlagsPolicy = GlobalFlagsPolicy{}
+	}()
+	prog := &Command{
+		Name:   "program",
+		Short:  "Test hiding all global flags.",
+		Long:   "Test hiding all global flags.",
+		Runner: RunnerFunc(runEcho),
+	}
+	want := `Test hiding all global flags.
+
+Usage:
+   program
+`
+	var tests = []testCase{
+		{Args: []string{"-help"}, Stdout: want},
+		{Args: []string{"-help"}, Vars: map[string]string{"CMDLINE_STYLE": "full"}, Stdout: want},
+		{Args: []string{"-help"}, Vars: map[string]string{"CMDLINE_STYLE": "godoc"}, Stdout: want},
+		// The global flags may still be set.
+		{Args: []string{"-global1=x"}, Stdout: "[]\n", GlobalFlag1: "x"},
+	}
+	runTestCases(t, prog, tests)
+}
+
+func TestGlobalFlagsPolicy(t *testing.T) {
+	defer SetGlobalFlagsPolicy(GlobalFlagsPolicy{})
+	prog := &Command{
+		Name:   "program",
+		Short:  "Test the global flags policy.",
+		Long:   "Test the global flags policy.",
+		Runner: RunnerFunc(runEcho),
+	}
+	// Never show -global1, and only show -global2 in the full style.
+	SetGlobalFlagsPolicy(GlobalFlagsPolicy{
+		Compact: GlobalFlagsFilter{Include: []*regexp.Regexp{}},
+		Full:    GlobalFlagsFilter{Exclude: []*regexp.Regexp{regexp.MustCompile(`^global1$`)}},
+	})
+	runTestCases(t, prog, []testCase{
+		{
+			Args: []string{"-help"},
+			Stdout: `Test the global flags policy.
+
+Usage:
+   program [flags]
+
+Run "CMDLINE_STYLE=full program -help" to show all flags.
+`,
+		},
+		{
+			Args: []string{"-help"},
+			Vars: map[string]string{"CMDLINE_STYLE": "full"},
+			Stdout: `Test the global flags policy.
+
+Usage:
+   program [flags]
+
+The global flags are:
+ -global2=0
+   global test flag 2
+`,
+		},
+	})
+	// HideGlobalFlagsExcept adds to the compact filter of the policy.
+	HideGlobalFlagsExcept(regexp.MustCompile(`^global2$`))
+	runTestCases(t, prog, []testCase{
+		{
+			Args: []string{"-help"},
+			Stdout: `Test the global flags policy.
+
+Usage:
+   program [flags]
+
+The global flags are:
+ -global2=0
+   global test flag 2
+`,
+		},
+	})
+}
+
+func TestNoHelpChild(t *testing.T) {
+	prog := &Command{
+		Name:        "program",
+		Short:       "Test no help child.",
+		Long:        "Test no help child.",
+		NoHelpChild: true,
+		Children: []*Command{{
+			Name:   "echo",
+			Short:  "Print strings on stdout",
+			Long:   "Echo prints any strings passed in to stdout.",
+			Runner: RunnerFunc(runEcho),
+		}},
+	}
+	usage := `Test no help child.
+
+Usage:
+   program [flags] <command>
+
+The program commands are:
+   echo        Print strings on stdout
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`
+	var tests = []testCase{
+		{Args: []string{"-help"}, Stdout: usage},
+		{
+			Args:   []string{"help"},
+			Err:    errUsageStr,
+			Stderr: "ERROR: program: unknown command \"help\"\n\n" + usage,
+		},
+		{
+			Args: []string{"echo", "-help"},
+			Stdout: `Echo prints any strings passed in to stdout.
+
+Usage:
+   program echo [flags]
+
+The global flags are:
+ -global1=
+   global test flag 1
+ -global2=0
+   global test flag 2
+`,
+		},
+	}
+	runTestCases(t, prog, tests)
 }
 
 func TestRootCommandFlags(t *testing.T) {
@@ -2670,7 +2862,9 @@ The unlikely help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=80
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2804,7 +2998,9 @@ The unlikely help flags are:
       compact   - Good for compact cmdline output.
       full      - Good for cmdline output, shows all global flags.
       godoc     - Good for godoc processing.
-      shortonly - Only output short description.
+      short     - Only output the short description, e.g. for scripting.
+      rst       - Good for reStructuredText processing.
+      json      - Only output a JSON description of the command, e.g. for tools.
    Override the default by setting the CMDLINE_STYLE environment variable.
  -width=<terminal width>
    Format output to this target width in runes, or unlimited if width < 0.
@@ -2972,6 +3168,52 @@ The global flags are:
 		},
 	}
 	runTestCases(t, cmd, tests)
+
+	// The placeholder for external commands without -help may be overridden.
+	defer SetHelpOptions(HelpOptions{})
+	SetHelpOptions(HelpOptions{Messages: HelpMessages{MissingDescription: "Sin descripción"}})
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{
+		"PATH": strings.Join(tokens, string(os.PathListSeparator)),
+	}}
+	if err := ParseAndRun(cmd, env, []string{"help"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, want := stdout.String(), "   foreign     Sin descripción\n"; !strings.Contains(got, want) {
+		t.Errorf("got %q, want substring %q", got, want)
+	}
+	// External commands may be merged with the children, sorted by name.
+	SetHelpOptions(HelpOptions{MergeExternalCommands: true})
+	stdout.Reset()
+	if err := ParseAndRun(cmd, env, []string{"help"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, want := stdout.String(), `The unlikely commands are:
+   dumpenv     Short description of command dumpenv
+   exitcode    Short description of command exitcode
+   flags       Short description of command flags
+   flat        Short description of command flat
+   foreign     No description available
+   nested      Short description of command nested
+   repeated    Repeated appears as both a child and as a binary
+   help        Display help for commands or topics
+Run "unlikely help [command]" for command usage.
+`; !strings.Contains(got, want) {
+		t.Errorf("got %q, want substring %q", got, want)
+	}
+	stdout.Reset()
+	if err := ParseAndRun(cmd, env, []string{"help", "..."}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	var headers []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if strings.HasPrefix(line, "Unlikely ") && !strings.HasPrefix(line, "Unlikely nested child") {
+			headers = append(headers, strings.SplitN(line, " - ", 2)[0])
+		}
+	}
+	if got, want := headers, []string{"Unlikely dumpenv", "Unlikely exitcode", "Unlikely flags", "Unlikely flat", "Unlikely foreign", "Unlikely nested", "Unlikely repeated", "Unlikely help"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
 }
 
 func TestParsedFlags(t *testing.T) {
@@ -3134,3 +3376,792 @@ func createCommandTree(flagConfigs []fc) []*Command {
 
 	return result
 }
+
+func TestTimeSummary(t *testing.T) {
+	intervals := []timing.Interval{
+		{Name: "root", Depth: 0, Start: 0, End: 1500 * time.Millisecond},
+		{Name: "cmdline parse", Depth: 1, Start: 0, End: 10 * time.Millisecond},
+		{Name: "cmdline run", Depth: 1, Start: 20 * time.Millisecond, End: 1490 * time.Millisecond},
+		{Name: "run root-foo", Depth: 2, Start: 30 * time.Millisecond, End: 1480 * time.Millisecond},
+	}
+	if got, want := timeSummary("root foo", intervals), "root foo completed in 1.50s (parse 0.01s, run 1.47s)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	newCmd := func(name string) *Command {
+		return &Command{
+			Name:  name,
+			Short: name,
+			Long:  name + ".",
+			Runner: RunnerFunc(func(env *Env, args []string) error {
+				fmt.Fprintln(env.Stdout, name, args)
+				return nil
+			}),
+			ArgsName: "[args]",
+		}
+	}
+	root := &Command{
+		Name:            "tool",
+		Short:           "tool",
+		Long:            "tool.",
+		Children:        []*Command{newCmd("echo"), newCmd("go"), newCmd("GO")},
+		Topics:          []Topic{{Name: "topic", Short: "topic", Long: "Topic long."}},
+		CaseInsensitive: true,
+	}
+	tests := []testCase{
+		{Args: []string{"echo", "x"}, Stdout: "echo [x]\n"},
+		{Args: []string{"ECHO", "x"}, Stdout: "echo [x]\n"},
+		{Args: []string{"Echo"}, Stdout: "echo []\n"},
+		// Exact matches are preferred.
+		{Args: []string{"go"}, Stdout: "go []\n"},
+		{Args: []string{"GO"}, Stdout: "GO []\n"},
+		{Args: []string{"Go"}, Stdout: "go []\n"},
+		// Help and topics.
+		{Args: []string{"help", "TOPIC"}, Stdout: "Topic long.\n"},
+		{Args: []string{"HELP", "Topic"}, Stdout: "Topic long.\n"},
+	}
+	runTestCases(t, root, tests)
+
+	// Matching is case-sensitive by default.
+	root.CaseInsensitive = false
+	for _, args := range [][]string{{"ECHO"}, {"help", "TOPIC"}} {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, args); err != ErrUsage {
+			t.Errorf("%q: got error %v, want %v", args, err, ErrUsage)
+		}
+	}
+}
+
+func TestContributeGlobalFlags(t *testing.T) {
+	var region string
+	runEcho := RunnerFunc(func(env *Env, args []string) error {
+		fmt.Fprintln(env.Stdout, region, args)
+		return nil
+	})
+	now := &Command{Name: "now", Short: "now", Long: "now.", Runner: runEcho, ArgsName: "[args]"}
+	deploy := &Command{
+		Name:     "deploy",
+		Short:    "deploy",
+		Long:     "deploy.",
+		Children: []*Command{now},
+		ContributeGlobalFlags: func(fs *flag.FlagSet) {
+			fs.StringVar(&region, "region", "us", "Deployment region.")
+		},
+	}
+	echo := &Command{Name: "echo", Short: "echo", Long: "echo.", Runner: runEcho}
+	root := &Command{
+		Name:     "tool",
+		Short:    "tool",
+		Long:     "tool.",
+		Children: []*Command{deploy, echo},
+	}
+	tests := []struct {
+		args       []string
+		wantErr    error
+		wantStdout string
+	}{
+		{[]string{"deploy", "now"}, nil, "us []\n"},
+		{[]string{"deploy", "-region=eu", "now"}, nil, "eu []\n"},
+		{[]string{"deploy", "now", "-region=asia", "x"}, nil, "asia [x]\n"},
+		// Only the contributor and its descendants accept the flag.
+		{[]string{"echo", "-region=eu"}, ErrUsage, ""},
+		{[]string{"-region=eu", "deploy", "now"}, ErrUsage, ""},
+	}
+	for _, test := range tests {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if got, want := ParseAndRun(root, env, test.args), test.wantErr; got != want {
+			t.Errorf("%q: got error %v, want %v", test.args, got, want)
+		}
+		if got, want := stdout.String(), test.wantStdout; got != want {
+			t.Errorf("%q: got stdout %q, want %q", test.args, got, want)
+		}
+		resetFlags(root)
+	}
+
+	// The flag is only shown in the help for the contributor and its descendants.
+	for _, test := range []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"help"}, false},
+		{[]string{"help", "echo"}, false},
+		{[]string{"help", "deploy"}, true},
+		{[]string{"help", "deploy", "now"}, true},
+	} {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, test.args); err != nil {
+			t.Errorf("%q: unexpected error: %v", test.args, err)
+		}
+		if got, want := strings.Contains(stdout.String(), "-region="), test.want; got != want {
+			t.Errorf("%q: got -region shown %v, want %v\n%s", test.args, got, want, stdout.String())
+		}
+	}
+
+	// The flag is shown with the flags of the contributor, including in the help
+	// for all commands, rather than with the global flags.
+	for _, args := range [][]string{
+		{"help", "deploy"},
+		{"help", "..."},
+		{"help", "-style=godoc", "..."},
+	} {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, args); err != nil {
+			t.Errorf("%q: unexpected error: %v", args, err)
+		}
+		want := "The tool deploy flags are:\n -region=us\n   Deployment region.\n"
+		if got := stdout.String(); !strings.Contains(got, want) || strings.Count(got, "-region=") != 1 {
+			t.Errorf("%q: got %q, want -region once, in %q", args, got, want)
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	leaf := &Command{Name: "leaf", Short: "leaf", Long: "leaf.", ArgsName: "[args]", Runner: RunnerFunc(runHello)}
+	var verbose bool
+	leaf.Flags.BoolVar(&verbose, "v", false, "verbose")
+	mid := &Command{Name: "mid", Short: "mid", Long: "mid.", Children: []*Command{leaf}}
+	root := &Command{Name: "root", Short: "root", Long: "root.", Children: []*Command{mid}}
+
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	result, err := ParseCommand(root, env, []string{"mid", "leaf", "-v", "a", "b"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := result.Command, leaf; got != want {
+		t.Errorf("got command %v, want %v", got.Name, want.Name)
+	}
+	if got, want := result.Path, []*Command{root, mid, leaf}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got path %v, want %v", got, want)
+	}
+	if got, want := result.Args, []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got args %q, want %q", got, want)
+	}
+	if result.Flags == nil || result.Flags.Lookup("v") == nil || !verbose {
+		t.Errorf("got flags %v, want -v to be parsed", result.Flags)
+	}
+	if result.Runner == nil {
+		t.Errorf("got nil runner")
+	}
+	// The runner isn't run by ParseCommand.
+	if got := stdout.String(); got != "" {
+		t.Errorf("got stdout %q, want empty", got)
+	}
+	resetFlags(root)
+}
+
+func TestSetGlobalFlags(t *testing.T) {
+	oldGlobalFlags, oldGlobalFlagSet := globalFlags, globalFlagSet
+	defer func() { globalFlags, globalFlagSet = oldGlobalFlags, oldGlobalFlagSet }()
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	flag.String("global1", "", "global test flag 1")
+	fs := flag.NewFlagSet("custom", flag.ContinueOnError)
+	verbosity := fs.Int("verbosity", 0, "Verbosity level.")
+	SetGlobalFlags(fs)
+
+	root := &Command{
+		Name:  "root",
+		Short: "Short description of root",
+		Long:  "Long description of root.",
+		Children: []*Command{{
+			Name:   "hello",
+			Short:  "Short description of hello",
+			Long:   "Long description of hello.",
+			Runner: RunnerFunc(runHello),
+		}},
+	}
+	for _, args := range [][]string{{"-verbosity=2", "hello"}, {"hello", "-verbosity=2"}} {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: baseVars}
+		*verbosity = 0
+		if err := ParseAndRun(root, env, args); err != nil {
+			t.Errorf("%q: unexpected error: %v\n%s", args, err, stderr.String())
+		}
+		if got, want := *verbosity, 2; got != want {
+			t.Errorf("%q: got verbosity %v, want %v", args, got, want)
+		}
+		resetFlags(root)
+	}
+
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: baseVars}
+	if err := ParseAndRun(root, env, []string{"help", "hello"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, want := stdout.String(), "The global flags are:\n -verbosity=0\n   Verbosity level.\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want suffix %q", got, want)
+	}
+	// Flags on flag.CommandLine aren't global flags, and it isn't modified.
+	if err := ParseAndRun(root, env, []string{"-global1=x", "hello"}); err == nil {
+		t.Errorf("got no error, want error for flag.CommandLine flag")
+	}
+	if flag.CommandLine.Parsed() {
+		t.Errorf("got parsed flag.CommandLine, want unparsed")
+	}
+	resetFlags(root)
+}
+
+func TestExternalSubcommandStdin(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cmdline-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	cmd := exec.Command("go", "build", "-o", filepath.Join(tmpDir, "unlikely-stdin"), filepath.Join(".", "testdata", "stdin.go"))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v, %v", string(out), err)
+	}
+	root := &Command{
+		Name:     "unlikely",
+		Short:    "Short description of command unlikely",
+		Long:     "Long description of command unlikely.",
+		LookPath: true,
+		Children: []*Command{{
+			Name:   "hello",
+			Short:  "Short description of command hello",
+			Long:   "Long description of command hello.",
+			Runner: RunnerFunc(runHello),
+		}},
+	}
+	run := func(args ...string) string {
+		var stdout, stderr bytes.Buffer
+		env := &Env{
+			Stdin:  strings.NewReader("input"),
+			Stdout: &stdout,
+			Stderr: &stderr,
+			Vars:   map[string]string{"PATH": tmpDir},
+		}
+		if err := ParseAndRun(root, env, args); err != nil {
+			t.Errorf("%q: unexpected error: %v\n%s", args, err, stderr.String())
+		}
+		return stdout.String()
+	}
+	// Stdin is connected when running the external child.
+	if got, want := run("stdin"), "input"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Stdin is closed when capturing the help of the external child.
+	if got, want := run("-help"), "   stdin       Read 0 bytes from stdin\n"; !strings.Contains(got, want) {
+		t.Errorf("got %q, want substring %q", got, want)
+	}
+	if got, want := run("help", "stdin"), "Read 0 bytes from stdin\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestExternalSubcommandShortManifest(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cmdline-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// The external children fail if they're run.
+	for _, name := range []string{"unlikely-fast", "unlikely-slow"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "unlikely-fast.short"), []byte("Short description from manifest\n\nIgnored.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := &Command{
+		Name:     "unlikely",
+		Short:    "Short description of command unlikely",
+		Long:     "Long description of command unlikely.",
+		LookPath: true,
+		Children: []*Command{{
+			Name:   "hello",
+			Short:  "Short description of command hello",
+			Long:   "Long description of command hello.",
+			Runner: RunnerFunc(runHello),
+		}},
+	}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{"PATH": tmpDir}}
+	if err := ParseAndRun(root, env, []string{"-help"}); err != nil {
+		t.Errorf("unexpected error: %v\n%s", err, stderr.String())
+	}
+	want := `The unlikely external commands are:
+   fast        Short description from manifest
+   slow        No description available
+`
+	if got := stdout.String(); !strings.Contains(got, want) {
+		t.Errorf("got %q, want substring %q", got, want)
+	}
+}
+
+func BenchmarkUsageAllExternal(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "cmdline-test")
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// Each stub external child takes a while to print its help.
+	const stub = "#!/bin/sh\nsleep 0.01\necho \"Stub $0\"\n"
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("unlikely-stub%d", i)
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(stub), 0755); err != nil {
+			b.Fatal(err)
+		}
+	}
+	root := &Command{
+		Name:     "unlikely",
+		Short:    "Short description of command unlikely",
+		Long:     "Long description of command unlikely.",
+		LookPath: true,
+		Children: []*Command{{
+			Name:   "hello",
+			Short:  "Short description of command hello",
+			Long:   "Long description of command hello.",
+			Runner: RunnerFunc(runHello),
+		}},
+	}
+	vars := map[string]string{"PATH": tmpDir + string(os.PathListSeparator) + os.Getenv("PATH")}
+	defer func(workers int) { maxExternalHelpWorkers = workers }(maxExternalHelpWorkers)
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			maxExternalHelpWorkers = workers
+			for i := 0; i < b.N; i++ {
+				env := &Env{Stdout: ioutil.Discard, Stderr: ioutil.Discard, Vars: vars}
+				if err := ParseAndRun(root, env, []string{"help", "..."}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRunnerFuncFlags(t *testing.T) {
+	var got []string
+	child := &Command{
+		Name:  "child",
+		Short: "child",
+		Long:  "child.",
+		Runner: RunnerFuncFlags(func(env *Env, flags *flag.FlagSet, args []string) error {
+			got = []string{flags.Lookup("root-flag").Value.String(), flags.Lookup("child-flag").Value.String()}
+			got = append(got, args...)
+			return nil
+		}),
+		ArgsName: "<args>",
+	}
+	root := &Command{Name: "root", Short: "root", Long: "root.", Children: []*Command{child}}
+	root.Flags.String("root-flag", "a", "root flag")
+	child.Flags.Int("child-flag", 1, "child flag")
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{"-root-flag=b", "child", "-child-flag=2", "x"}); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+	}
+	if want := []string{"b", "2", "x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUnknownFlags(t *testing.T) {
+	var got []string
+	var verbose bool
+	exec := &Command{
+		Name:  "exec",
+		Short: "exec",
+		Long:  "exec.",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			got = append([]string{fmt.Sprint(verbose)}, args...)
+			return nil
+		}),
+		ArgsName: "<args>",
+	}
+	exec.Flags.BoolVar(&verbose, "v", false, "verbose")
+	root := &Command{Name: "root", Short: "root", Long: "root.", Children: []*Command{exec}}
+	tests := []struct {
+		mode UnknownFlagsMode
+		args []string
+		want []string
+		err  string
+	}{
+		{UnknownFlagsError, []string{"exec", "-v", "-x=1", "a"}, nil, "root exec: flag provided but not defined: -x"},
+		{UnknownFlagsError, []string{"exec", "-v", "--", "-x=1", "a"}, []string{"true", "-x=1", "a"}, ""},
+		{UnknownFlagsIgnore, []string{"exec", "-x=1", "-v", "--y", "a", "-z"}, []string{"true", "a", "-z"}, ""},
+		{UnknownFlagsIgnore, []string{"exec", "-x", "1", "-v"}, []string{"false", "1", "-v"}, ""},
+		{UnknownFlagsPassThrough, []string{"exec", "-x=1", "-v", "--y", "a", "-z"}, []string{"true", "-x=1", "--y", "a", "-z"}, ""},
+		{UnknownFlagsPassThrough, []string{"exec", "-x=1", "--", "-v"}, []string{"false", "-x=1", "-v"}, ""},
+		{UnknownFlagsPassThrough, []string{"exec", "-v=oops"}, nil, `root exec: invalid boolean value "oops" for -v: parse error`},
+	}
+	for _, test := range tests {
+		got, verbose = nil, false
+		exec.UnknownFlags = test.mode
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		err := ParseAndRun(root, env, test.args)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v\n%s", test.args, err, stderr.String())
+			}
+		} else {
+			if err != ErrUsage {
+				t.Errorf("%v: got error %v, want %v", test.args, err, ErrUsage)
+			}
+			if got, want := stderr.String(), "ERROR: "+test.err+"\n"; !strings.HasPrefix(got, want) {
+				t.Errorf("%v: got stderr %q, want prefix %q", test.args, got, want)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.args, got, test.want)
+		}
+	}
+}
+
+func TestFlagParseErrorNotDuplicated(t *testing.T) {
+	child := &Command{Name: "child", Short: "child", Long: "child.", Runner: RunnerFunc(runHello)}
+	child.Flags.Int("n", 1, "count")
+	root := &Command{Name: "root", Short: "root", Long: "root.", Children: []*Command{child}}
+	root.Flags.Bool("v", false, "verbose")
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"-x", "child"}, "root: flag provided but not defined: -x"},
+		{[]string{"-v=oops", "child"}, `root: invalid boolean value "oops" for -v: parse error`},
+		{[]string{"child", "-x"}, "root child: flag provided but not defined: -x"},
+		{[]string{"child", "-n=oops"}, `root child: invalid value "oops" for flag -n: parse error`},
+		{[]string{"child", "-n"}, "root child: flag needs an argument: -n"},
+	}
+	for _, test := range tests {
+		// Anything written by the FlagSet itself ends up in flagOutput.
+		var flagOutput bytes.Buffer
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		flag.CommandLine.SetOutput(&flagOutput)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, test.args); err != ErrUsage {
+			t.Errorf("%v: got error %v, want %v", test.args, err, ErrUsage)
+		}
+		if got, want := stderr.String(), "ERROR: "+test.err+"\n\n"; !strings.HasPrefix(got, want) {
+			t.Errorf("%v: got stderr %q, want prefix %q", test.args, got, want)
+		}
+		msg := test.err[strings.Index(test.err, ": ")+2:]
+		if got := strings.Count(stderr.String(), msg); got != 1 {
+			t.Errorf("%v: got %d copies of %q in stderr, want 1:\n%s", test.args, got, msg, stderr.String())
+		}
+		if got := flagOutput.String(); got != "" {
+			t.Errorf("%v: got FlagSet output %q, want none", test.args, got)
+		}
+	}
+}
+
+func TestLookPathDirs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cmdline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pluginDir, pathDir := filepath.Join(tmpDir, "plugins"), filepath.Join(tmpDir, "bin")
+	for _, file := range []struct {
+		dir, name string
+	}{
+		{pluginDir, "unlikely-a"},
+		{pluginDir, "unlikely-c"},
+		{pathDir, "unlikely-a"},
+		{pathDir, "unlikely-b"},
+	} {
+		if err := os.MkdirAll(file.dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		script := fmt.Sprintf("#!/bin/sh\necho %s\n", filepath.Base(file.dir))
+		if err := ioutil.WriteFile(filepath.Join(file.dir, file.name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(file.dir, file.name+".short"), []byte(file.name+" in "+filepath.Base(file.dir)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := &Command{
+		Name:         "unlikely",
+		Short:        "Short description of command unlikely",
+		Long:         "Long description of command unlikely.",
+		LookPath:     true,
+		LookPathDirs: []string{pluginDir},
+		Runner:       RunnerFunc(runHello),
+	}
+	run := func(args ...string) string {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{"PATH": pathDir, "CMDLINE_WIDTH": "80"}}
+		if err := ParseAndRun(root, env, args); err != nil {
+			t.Errorf("%q: unexpected error: %v\n%s", args, err, stderr.String())
+		}
+		return stdout.String()
+	}
+	// The plugin dir takes precedence over PATH.
+	for _, test := range []struct {
+		name, want string
+	}{
+		{"a", "plugins\n"},
+		{"b", "bin\n"},
+		{"c", "plugins\n"},
+	} {
+		if got := run(test.name); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+	want := `The unlikely external commands are:
+   a           unlikely-a in plugins
+   b           unlikely-b in bin
+   c           unlikely-c in plugins
+`
+	if got := run("-help"); !strings.Contains(got, want) {
+		t.Errorf("got help %q, want substring %q", got, want)
+	}
+}
+
+func TestLookPathVars(t *testing.T) {
+	sep := string(filepath.ListSeparator)
+	env := &Env{Vars: map[string]string{"PATH": strings.Join([]string{"/bin", "/plugins/", "/usr/bin"}, sep)}}
+	if got, want := env.lookPathVars(nil)["PATH"], env.Vars["PATH"]; got != want {
+		t.Errorf("got PATH %q, want %q", got, want)
+	}
+	dirs := []string{"/plugins", "/opt/bin", "/plugins"}
+	if got, want := env.lookPathVars(dirs)["PATH"], strings.Join([]string{"/plugins", "/opt/bin", "/bin", "/usr/bin"}, sep); got != want {
+		t.Errorf("got PATH %q, want %q", got, want)
+	}
+	if got, want := env.Vars["PATH"], strings.Join([]string{"/bin", "/plugins/", "/usr/bin"}, sep); got != want {
+		t.Errorf("got modified PATH %q, want %q", got, want)
+	}
+}
+
+func TestLookPathDebug(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cmdline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dirA, dirB := filepath.Join(tmpDir, "a"), filepath.Join(tmpDir, "b")
+	for _, dir := range []string{dirA, dirB} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aExe, bExe := filepath.Join(dirA, "unlikely-exe"), filepath.Join(dirB, "unlikely-exe")
+	if err := ioutil.WriteFile(aExe, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(bExe, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := dirA + string(filepath.ListSeparator) + dirB
+	for _, debug := range []string{"", "1"} {
+		var stderr bytes.Buffer
+		env := &Env{Stderr: &stderr, Vars: map[string]string{"PATH": path, "CMDLINE_DEBUG_LOOKPATH": debug}}
+		if got, err := env.LookPath("unlikely-exe"); err != nil || got != bExe {
+			t.Errorf("%q: got (%v, %v), want %v", debug, got, err, bExe)
+		}
+		want := ""
+		if debug != "" {
+			want = "lookpath: skipped " + aExe + ": not executable\nlookpath: found " + bExe + "\n"
+		}
+		if got := stderr.String(); got != want {
+			t.Errorf("%q: got stderr %q, want %q", debug, got, want)
+		}
+		stderr.Reset()
+		if got, err := env.LookPathPrefix("unlikely-", nil); err != nil || !reflect.DeepEqual(got, []string{bExe}) {
+			t.Errorf("%q: got (%v, %v), want %v", debug, got, err, bExe)
+		}
+		if got := stderr.String(); got != want {
+			t.Errorf("%q: got stderr %q, want %q", debug, got, want)
+		}
+	}
+}
+
+func TestBinaryRunnerContext(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cmdline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "unlikely-sleep"), []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := &Command{
+		Name:     "unlikely",
+		Short:    "Short description of command unlikely",
+		Long:     "Long description of command unlikely.",
+		LookPath: true,
+		Runner:   RunnerFunc(runHello),
+	}
+	path := tmpDir + string(filepath.ListSeparator) + os.Getenv("PATH")
+	// Both running the child and capturing its help stop when the context is
+	// cancelled, rather than waiting for the child to exit.
+	for _, args := range [][]string{{"sleep"}, {"help", "sleep"}, {"help", "..."}} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{"PATH": path, "CMDLINE_WIDTH": "80"}, Context: ctx}
+		start := time.Now()
+		err := ParseAndRun(root, env, args)
+		cancel()
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%q: took %v, want the child to be killed", args, elapsed)
+		}
+		if len(args) == 1 && err != context.DeadlineExceeded {
+			t.Errorf("%q: got error %v, want %v", args, err, context.DeadlineExceeded)
+		}
+	}
+}
+
+// runWithSignalHandler runs root with args via ParseAndRun, with the signal
+// handler of Main installed on env, and sends SIGTERM to the process once ready
+// is closed.  Returns the signal reported by the handler, the exit code passed
+// to its exit func, or -1 if it wasn't called, and the error from ParseAndRun.
+func runWithSignalHandler(root *Command, env *Env, args []string, ready chan struct{}) (syscall.Signal, int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	env.Context = ctx
+	h := newSignalHandler(env, cancel)
+	exited := make(chan int, 1)
+	h.exit = func(code int) { exited <- code }
+	env.notifySignals = h.notify
+	go func() {
+		<-ready
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+	err := ParseAndRun(root, env, args)
+	// Give a handler that timed out the chance to exit.
+	code := -1
+	select {
+	case code = <-exited:
+	case <-time.After(50 * time.Millisecond):
+	}
+	return h.stop(), code, err
+}
+
+func TestSignalHandler(t *testing.T) {
+	var got []string
+	ready := make(chan struct{})
+	root := &Command{
+		Name:  "root",
+		Short: "root",
+		Long:  "root.",
+		Runner: RunnerFunc(func(env *Env, _ []string) error {
+			env.OnShutdown(func() { got = append(got, "shutdown") })
+			close(ready)
+			<-env.Context.Done()
+			got = append(got, "runner")
+			return env.Context.Err()
+		}),
+	}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{}}
+	sig, code, err := runWithSignalHandler(root, env, nil, ready)
+	if err != context.Canceled {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if sig != syscall.SIGTERM {
+		t.Errorf("got signal %v, want %v", sig, syscall.SIGTERM)
+	}
+	if code != -1 {
+		t.Errorf("got exit code %v, want no exit", code)
+	}
+	// The Runner finishes before the functions registered via OnShutdown run.
+	if want := []string{"runner", "shutdown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSignalHandlerTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { signalShutdownTimeout = timeout }(signalShutdownTimeout)
+	signalShutdownTimeout = 10 * time.Millisecond
+	var got []string
+	var mu sync.Mutex
+	ready, block := make(chan struct{}), make(chan struct{})
+	root := &Command{
+		Name:  "root",
+		Short: "root",
+		Long:  "root.",
+		Runner: RunnerFunc(func(env *Env, _ []string) error {
+			env.OnShutdown(func() {
+				mu.Lock()
+				got = append(got, "shutdown")
+				mu.Unlock()
+				close(block)
+			})
+			close(ready)
+			// Ignore the cancellation, until the shutdown functions are run.
+			<-block
+			return nil
+		}),
+	}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{}}
+	_, code, _ := runWithSignalHandler(root, env, nil, ready)
+	if got, want := code, 128+int(syscall.SIGTERM); got != want {
+		t.Errorf("got exit code %v, want %v", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"shutdown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSignalHandlerKillsChild(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cmdline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pidFile := filepath.Join(tmpDir, "pid")
+	script := fmt.Sprintf("#!/bin/sh\necho $$ > %s.tmp\nmv %s.tmp %s\nexec sleep 10\n", pidFile, pidFile, pidFile)
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "unlikely-sleep"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := &Command{
+		Name:     "unlikely",
+		Short:    "Short description of command unlikely",
+		Long:     "Long description of command unlikely.",
+		LookPath: true,
+		Runner:   RunnerFunc(runHello),
+	}
+	// The signal is sent once the child has written its pid.
+	ready := make(chan struct{})
+	go func() {
+		for {
+			if _, err := os.Stat(pidFile); err == nil {
+				close(ready)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	var stdout, stderr bytes.Buffer
+	path := tmpDir + string(filepath.ListSeparator) + os.Getenv("PATH")
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{"PATH": path}}
+	start := time.Now()
+	sig, code, err := runWithSignalHandler(root, env, []string{"sleep"}, ready)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v, want the child to be killed", elapsed)
+	}
+	if err != context.Canceled || sig != syscall.SIGTERM || code != -1 {
+		t.Errorf("got (%v, %v, %v), want (%v, %v, -1)", err, sig, code, context.Canceled, syscall.SIGTERM)
+	}
+	data, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The child has been killed and waited for, so it no longer exists.
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		t.Errorf("got error %v from signalling the child, want %v", err, syscall.ESRCH)
+	}
+}
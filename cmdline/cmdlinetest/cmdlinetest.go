@@ -0,0 +1,82 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cmdlinetest implements utilities for testing programs that use the
+// cmdline package.
+//
+// The help output is produced with a fixed width and style, so that tests
+// aren't affected by the terminal or environment:
+//
+//   func TestHelp(t *testing.T) {
+//     cmdlinetest.AssertHelpContains(t, root, []string{"help", "net", "status"},
+//       "The root net status flags are:")
+//   }
+package cmdlinetest
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/cmdline"
+)
+
+// Width is the width in runes of the help output produced by Help.
+const Width = 80
+
+// Help returns the output written to stdout by running the command tree rooted
+// at root with args, e.g. {"help", "net"} or {"net", "-help"}.  The output is
+// formatted in the compact style with the given Width.  An error is returned
+// if parsing or running fails, which includes the output written to stderr.
+//
+// Like cmdline.Main, Help uses the global flags registered on flag.CommandLine,
+// or on the FlagSet set via cmdline.SetGlobalFlags.
+func Help(root *cmdline.Command, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	env := &cmdline.Env{
+		Stdout: &stdout,
+		Stderr: &stderr,
+		Vars: map[string]string{
+			"CMDLINE_WIDTH": strconv.Itoa(Width),
+			"CMDLINE_STYLE": "compact",
+		},
+	}
+	if err := cmdline.ParseAndRun(root, env, args); err != nil {
+		return stdout.String(), fmt.Errorf("%v: %v\n%s", args, err, stderr.String())
+	}
+	return stdout.String(), nil
+}
+
+// AssertHelpContains runs the command tree rooted at root with args via Help,
+// and reports an error via t for each of the substrings that isn't contained
+// in the output.  Fails the test immediately if Help returns an error.
+func AssertHelpContains(t testing.TB, root *cmdline.Command, args []string, substrings ...string) {
+	t.Helper()
+	got, err := Help(root, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range substrings {
+		if !strings.Contains(got, sub) {
+			t.Errorf("%v: help doesn't contain %q, got:\n%s", args, sub, got)
+		}
+	}
+}
+
+// AssertHelpMatches runs the command tree rooted at root with args via Help,
+// and reports an error via t if the output doesn't match re.  Fails the test
+// immediately if Help returns an error.
+func AssertHelpMatches(t testing.TB, root *cmdline.Command, args []string, re *regexp.Regexp) {
+	t.Helper()
+	got, err := Help(root, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !re.MatchString(got) {
+		t.Errorf("%v: help doesn't match %q, got:\n%s", args, re, got)
+	}
+}
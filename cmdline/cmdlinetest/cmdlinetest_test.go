@@ -0,0 +1,86 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdlinetest_test
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/cmdline"
+	"v.io/x/lib/cmdline/cmdlinetest"
+)
+
+func newRoot() *cmdline.Command {
+	status := &cmdline.Command{
+		Name:   "status",
+		Short:  "Show the network status",
+		Long:   "Show the network status.",
+		Runner: cmdline.RunnerFunc(func(*cmdline.Env, []string) error { return nil }),
+	}
+	status.Flags.Bool("json", false, "Print the status as JSON.")
+	net := &cmdline.Command{
+		Name:     "net",
+		Short:    "Manage the network",
+		Long:     "Manage the network.",
+		Children: []*cmdline.Command{status},
+	}
+	return &cmdline.Command{
+		Name:     "tool",
+		Short:    "Tool",
+		Long:     "Tool.",
+		Children: []*cmdline.Command{net},
+	}
+}
+
+// fakeTB records the failures reported via the testing.TB methods.
+type fakeTB struct {
+	testing.TB
+	errors []string
+	fatal  bool
+}
+
+func (f *fakeTB) Helper() {}
+
+func (f *fakeTB) Errorf(format string, args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeTB) Fatal(args ...interface{}) {
+	f.errors = append(f.errors, fmt.Sprint(args...))
+	f.fatal = true
+}
+
+func TestAssertHelpContains(t *testing.T) {
+	root := newRoot()
+	cmdlinetest.AssertHelpContains(t, root, []string{"help", "net", "status"},
+		"The tool net status flags are:",
+		" -json=false\n   Print the status as JSON.\n",
+	)
+	cmdlinetest.AssertHelpContains(t, root, []string{"net", "-help"}, "status      Show the network status")
+
+	fake := &fakeTB{}
+	cmdlinetest.AssertHelpContains(fake, root, []string{"help", "net"}, "Manage the network.", "missing", "also missing")
+	if got, want := len(fake.errors), 2; got != want || fake.fatal {
+		t.Errorf("got errors %q, want %d non-fatal errors", fake.errors, want)
+	}
+	fake = &fakeTB{}
+	cmdlinetest.AssertHelpContains(fake, root, []string{"help", "unknown"}, "anything")
+	if !fake.fatal || !strings.Contains(fake.errors[0], `unknown command or topic "unknown"`) {
+		t.Errorf("got errors %q, want fatal unknown command", fake.errors)
+	}
+}
+
+func TestAssertHelpMatches(t *testing.T) {
+	root := newRoot()
+	cmdlinetest.AssertHelpMatches(t, root, []string{"help", "..."}, regexp.MustCompile(`(?m)^Tool net status - Show the network status$`))
+
+	fake := &fakeTB{}
+	cmdlinetest.AssertHelpMatches(fake, root, []string{"help"}, regexp.MustCompile(`^missing`))
+	if got, want := len(fake.errors), 1; got != want || fake.fatal {
+		t.Errorf("got errors %q, want %d non-fatal error", fake.errors, want)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"io"
+	"os"
+
+	"v.io/x/lib/textutil"
+)
+
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// colorMode holds the value of the -color global flag registered via
+// RegisterColorFlag, or nil if it isn't registered.
+var colorMode *EnumFlag
+
+// RegisterColorFlag registers the -color global flag (see SetGlobalFlags),
+// which controls whether output is colored; see Env.ColorEnabled.  Error
+// messages are colored when enabled.
+func RegisterColorFlag() {
+	colorMode = NewEnumFlag(colorAuto, colorAuto, colorAlways, colorNever)
+	commandLine().Var(colorMode, "color", `Whether to color the output; one of "auto", "always" or "never".`)
+}
+
+// ColorEnabled returns true iff output written to w should be colored.  The
+// -color global flag registered via RegisterColorFlag takes precedence; "always"
+// and "never" enable and disable color regardless of w.  Otherwise color is
+// enabled iff w is a terminal, the NO_COLOR environment variable is empty, and
+// the TERM environment variable isn't "dumb".
+func (e *Env) ColorEnabled(w io.Writer) bool {
+	switch colorMode.String() {
+	case colorAlways:
+		return true
+	case colorNever:
+		return false
+	}
+	if e.Vars["NO_COLOR"] != "" || e.Vars["TERM"] == "dumb" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	return ok && textutil.IsTerminal(f.Fd())
+}
+
+// errorLabel returns the label that precedes error messages written to
+// e.Stderr, which is red if color is enabled.
+func (e *Env) errorLabel() string {
+	if e.ColorEnabled(e.Stderr) {
+		return "\x1b[1;31mERROR:\x1b[0m"
+	}
+	return "ERROR:"
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"testing"
+)
+
+func TestColorEnabled(t *testing.T) {
+	oldGlobalFlags, oldGlobalFlagSet, oldColorMode := globalFlags, globalFlagSet, colorMode
+	defer func() { globalFlags, globalFlagSet, colorMode = oldGlobalFlags, oldGlobalFlagSet, oldColorMode }()
+	SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+
+	var stderr bytes.Buffer
+	env := &Env{Stderr: &stderr, Vars: map[string]string{}}
+	// Buffers aren't terminals, so color is disabled by default.
+	if env.ColorEnabled(&stderr) {
+		t.Errorf("got color enabled, want disabled")
+	}
+
+	RegisterColorFlag()
+	root := &Command{
+		Name:   "root",
+		Short:  "Short description of root",
+		Long:   "Long description of root.",
+		Runner: RunnerFunc(func(*Env, []string) error { return errors.New("oops") }),
+	}
+	tests := []struct {
+		args []string
+		vars map[string]string
+		want string
+	}{
+		{nil, nil, "ERROR: oops\n"},
+		{[]string{"-color=auto"}, nil, "ERROR: oops\n"},
+		{[]string{"-color=never"}, nil, "ERROR: oops\n"},
+		{[]string{"-color=always"}, nil, "\x1b[1;31mERROR:\x1b[0m oops\n"},
+		{[]string{"-color=always"}, map[string]string{"NO_COLOR": "1"}, "\x1b[1;31mERROR:\x1b[0m oops\n"},
+	}
+	for _, test := range tests {
+		stderr.Reset()
+		env := &Env{Stderr: &stderr, Vars: test.vars}
+		err := ParseAndRun(root, env, test.args)
+		if got, want := exitCode(env, err), 1; got != want {
+			t.Errorf("%q: got exit code %v, want %v", test.args, got, want)
+		}
+		if got, want := stderr.String(), test.want; got != want {
+			t.Errorf("%q: got %q, want %q", test.args, got, want)
+		}
+		colorMode.Set(colorAuto)
+	}
+
+	// Usage errors are also colored.
+	colorMode.Set(colorAlways)
+	stderr.Reset()
+	env.UsageErrorf("bad")
+	if got, want := stderr.String(), "\x1b[1;31mERROR:\x1b[0m bad\n\nusage error\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
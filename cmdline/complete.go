@@ -0,0 +1,493 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+	completeName   = "__complete"
+	completionName = "completion"
+
+	completionScriptName = "completion-script"
+)
+
+// flagCompletions holds the functions registered via RegisterFlagCompletion,
+// keyed by the FlagSet and then by the flag name.
+var flagCompletions = make(map[*flag.FlagSet]map[string]func(string) []string)
+
+// RegisterFlagCompletion registers fn to complete the values of the flag with
+// the given name defined in fs.  The flag may be defined in the Flags of a
+// Command, or in flag.CommandLine for global flags.
+//
+// The fn is called with the partial value being completed, and returns the
+// candidate values; candidates that don't start with the partial value are
+// ignored, so fn may simply return all valid values.
+func RegisterFlagCompletion(fs *flag.FlagSet, name string, fn func(prefix string) []string) {
+	completions := flagCompletions[fs]
+	if completions == nil {
+		completions = make(map[string]func(string) []string)
+		flagCompletions[fs] = completions
+	}
+	completions[name] = fn
+}
+
+// WithCompletion adds a "completion" child to root, which prints a script that
+// enables tab completion of commands, flags and flag values in the bash, zsh
+// and fish shells, or installs the script via "completion install".  The
+// scripts invoke the program with the hidden __complete command, which prints
+// the candidates for the last argument, one per line.
+//
+// WithCompletion also registers the hidden -completion-script global flag (see
+// SetGlobalFlags), which prints the same script as the "completion" child
+// instead of running a command, for packaging scripts; e.g.:
+//
+//   tool -completion-script=bash > /etc/bash_completion.d/tool
+func WithCompletion(root *Command) {
+	root.complete = true
+	root.completionScript = NewEnumFlag("", completionShells...)
+	commandLine().Var(root.completionScript, completionScriptName, "Print the completion script for the given shell, one of "+strings.Join(completionShells, ", ")+".")
+	hiddenGlobalFlags[completionScriptName] = true
+	completion := &Command{
+		Name:  completionName,
+		Short: "Print or install a shell completion script",
+		Long: `
+Print a script that enables tab completion for ` + root.Name + ` in the given
+shell.  To enable completion in the current shell session, source the output of
+the command for your shell, e.g.:
+
+  source <(` + ShellQuote(root.Name, completionName, "bash") + `)
+
+To enable completion in all future sessions, run "` + ShellQuote(root.Name, completionName, "install") + `".
+`,
+	}
+	for _, shell := range completionShells {
+		completion.Children = append(completion.Children, &Command{
+			Name:   shell,
+			Short:  "Print the completion script for " + shell,
+			Long:   "Print the completion script for " + shell + ".",
+			Runner: completionScriptRunner{shell, root.Name},
+		})
+	}
+	install := &Command{
+		Name:  "install",
+		Short: "Install the completion script",
+		Long: `
+Install the completion script for the given shell in the conventional location
+for the current user:
+
+  bash: $XDG_DATA_HOME/bash-completion/completions/` + root.Name + `
+  fish: $XDG_CONFIG_HOME/fish/completions/` + root.Name + `.fish
+  zsh:  $ZDOTDIR/.zfunc/_` + root.Name + `
+
+If $XDG_DATA_HOME, $XDG_CONFIG_HOME or $ZDOTDIR aren't set, they default to
+$HOME/.local/share, $HOME/.config and $HOME respectively.
+`,
+		ArgsName: "[shell]",
+		ArgsLong: `
+[shell] is one of ` + strings.Join(completionShells, ", ") + `.  If not specified, the shell
+is detected from $SHELL.
+`,
+	}
+	var dryRun bool
+	var path string
+	install.Flags.BoolVar(&dryRun, "dry-run", false, "Print what would be installed, without installing it.")
+	install.Flags.StringVar(&path, "path", "", "Install the script at the given path, rather than the conventional location.")
+	install.Runner = RunnerFunc(func(env *Env, args []string) error {
+		return installCompletionScript(env, args, root.Name, path, dryRun)
+	})
+	completion.Children = append(completion.Children, install)
+	root.Children = append(root.Children, completion)
+}
+
+// installCompletionScript installs the completion script for the program with
+// the given name, for the shell specified in args or detected from $SHELL.  The
+// script is installed at path, or the conventional location if path is empty.
+func installCompletionScript(env *Env, args []string, name, path string, dryRun bool) error {
+	var shell string
+	switch len(args) {
+	case 0:
+		shell = filepath.Base(env.Vars["SHELL"])
+		if completionScripts[shell] == nil {
+			return env.UsageErrorf("%s: can't detect the shell from $SHELL=%q, specify one of %s", env.cmdPath, env.Vars["SHELL"], strings.Join(completionShells, ", "))
+		}
+	case 1:
+		shell = args[0]
+		if completionScripts[shell] == nil {
+			return env.UsageErrorf("%s: unsupported shell %q, must be one of %s", env.cmdPath, shell, strings.Join(completionShells, ", "))
+		}
+	default:
+		return env.UsageErrorf("%s: takes at most one argument", env.cmdPath)
+	}
+	if path == "" {
+		var err error
+		if path, err = completionInstallPath(env, shell, name); err != nil {
+			return fmt.Errorf("%v; use -path, or redirect the output of %q to a file", err, name+" "+completionName+" "+shell)
+		}
+	}
+	if dryRun {
+		fmt.Fprintf(env.Stdout, "Would install the %s completion script at %s\n", shell, path)
+		return nil
+	}
+	var script bytes.Buffer
+	if err := writeCompletionScript(&script, shell, name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, script.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(env.Stdout, "Installed the %s completion script at %s\n", shell, path)
+	if shell == "zsh" {
+		fmt.Fprintf(env.Stdout, "Ensure %s is in your $fpath before compinit is called in your .zshrc\n", filepath.Dir(path))
+	}
+	fmt.Fprintln(env.Stdout, "Completion is enabled in new shell sessions")
+	return nil
+}
+
+// completionInstallPath returns the conventional location of the completion
+// script for the program with the given name in the given shell.
+func completionInstallPath(env *Env, shell, name string) (string, error) {
+	var envVar, homeDir, file string
+	switch shell {
+	case "bash":
+		envVar, homeDir, file = "XDG_DATA_HOME", filepath.Join(".local", "share"), filepath.Join("bash-completion", "completions", name)
+	case "fish":
+		envVar, homeDir, file = "XDG_CONFIG_HOME", ".config", filepath.Join("fish", "completions", name+".fish")
+	default:
+		envVar, homeDir, file = "ZDOTDIR", "", filepath.Join(".zfunc", "_"+name)
+	}
+	if dir := env.Vars[envVar]; dir != "" {
+		return filepath.Join(dir, file), nil
+	}
+	home := env.Vars["HOME"]
+	if home == "" {
+		return "", fmt.Errorf("can't determine where to install the %s completion script, neither $%s nor $HOME are set", shell, envVar)
+	}
+	return filepath.Join(home, homeDir, file), nil
+}
+
+// completeRunner prints the completion candidates for the last of its args,
+// given the preceding args.  The candidates are printed one per line, followed
+// by a final ":files" line if the shell should also complete file paths.  The
+// ":files" line is followed by the allowed file extensions, if any, separated
+// by spaces.
+type completeRunner struct {
+	root *Command
+}
+
+func (c completeRunner) Run(env *Env, args []string) error {
+	result := complete(c.root, args)
+	for _, candidate := range result.candidates {
+		fmt.Fprintln(env.Stdout, candidate)
+	}
+	if result.files {
+		fmt.Fprintln(env.Stdout, strings.Join(append([]string{":files"}, result.exts...), " "))
+	}
+	return nil
+}
+
+// completion holds the result of completing an arg.
+type completion struct {
+	candidates []string
+	files      bool     // Also complete file paths.
+	exts       []string // Allowed file extensions; all files if empty.
+}
+
+// completionFlags returns the flags that are allowed for the last command in
+// path, mirroring the merging performed by parseFlags.
+func completionFlags(path []*Command) *flag.FlagSet {
+	if len(path) == 1 {
+		flags := copyFlags(commandLine())
+		mergeFlags(flags, &path[0].Flags)
+		if contributed := contributedFlags(path); contributed != nil {
+			mergeFlags(flags, contributed)
+		}
+		return flags
+	}
+	flags := pathFlags(path)
+	mergeFlags(flags, pathGlobalFlags(path))
+	return flags
+}
+
+// lookupFlag returns the flag named by arg, which must start with a dash and
+// may include a value, along with the value and whether the value was present.
+func lookupFlag(flags *flag.FlagSet, arg string) (*flag.Flag, string, bool) {
+	name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+	name, value, hasValue := cutString(name, "=")
+	return flags.Lookup(name), value, hasValue
+}
+
+func cutString(s, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface {
+		IsBoolFlag() bool
+	})
+	return ok && b.IsBoolFlag()
+}
+
+// complete returns the completion for the last of args, given the preceding
+// args.
+func complete(root *Command, args []string) completion {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+	path := []*Command{root}
+	flags := completionFlags(path)
+	var valueFlag *flag.Flag
+	var cmdArgs []string
+	noFlags := false
+	for _, arg := range args[:len(args)-1] {
+		switch {
+		case valueFlag != nil:
+			valueFlag = nil
+		case arg == "--" && !noFlags:
+			noFlags = true
+		case strings.HasPrefix(arg, "-") && !noFlags:
+			if f, _, hasValue := lookupFlag(flags, arg); f != nil && !hasValue && !isBoolFlag(f) {
+				valueFlag = f
+			}
+		default:
+			if cmdArgs == nil {
+				if child := lookupChild(path[len(path)-1], arg, root.CaseInsensitive); child != nil {
+					path = append(path, child)
+					flags = completionFlags(path)
+					noFlags = false
+					continue
+				}
+			}
+			// Flags are not parsed after the first arg.
+			cmdArgs = append(cmdArgs, arg)
+			noFlags = true
+		}
+	}
+	cur := args[len(args)-1]
+	switch {
+	case valueFlag != nil:
+		return completion{candidates: completeFlagValue(path, valueFlag.Name, "", cur)}
+	case strings.HasPrefix(cur, "-") && !noFlags:
+		if f, value, hasValue := lookupFlag(flags, cur); hasValue {
+			if f == nil {
+				return completion{}
+			}
+			return completion{candidates: completeFlagValue(path, f.Name, cur[:len(cur)-len(value)], value)}
+		}
+		dash := "-"
+		if strings.HasPrefix(cur, "--") {
+			dash = "--"
+		}
+		var candidates []string
+		flags.VisitAll(func(f *flag.Flag) {
+			if !hiddenGlobalFlags[f.Name] {
+				candidates = append(candidates, dash+f.Name)
+			}
+		})
+		return completion{candidates: filterCandidates(candidates, "", cur)}
+	}
+	cmd := path[len(path)-1]
+	if len(cmd.Children) == 0 {
+		return completeArgs(cmd, cmdArgs, cur)
+	}
+	if cmdArgs != nil {
+		// The command has children, but the first arg isn't one of them.
+		return completion{}
+	}
+	var candidates []string
+	for _, child := range visibleChildren(cmd) {
+		candidates = append(candidates, child.Name)
+	}
+	if needsHelpChild(cmd) {
+		candidates = append(candidates, helpName)
+	}
+	return completion{candidates: filterCandidates(candidates, "", cur)}
+}
+
+// completeArgs returns the completion for cur, which is an arg of cmd following
+// the given args.
+func completeArgs(cmd *Command, args []string, cur string) completion {
+	var result completion
+	if cmd.CompleteArgs != nil {
+		result.candidates = filterCandidates(cmd.CompleteArgs(args, cur), "", cur)
+	}
+	if cmd.CompleteArgsAsFiles {
+		result.files = true
+		result.exts = cmd.CompleteArgsExts
+	}
+	return result
+}
+
+// completeFlagValue returns the candidates for the value of the named flag,
+// using the completion function registered for the flag in the same order of
+// precedence as flag validators.  Each candidate is prepended with prefix.
+func completeFlagValue(path []*Command, name, prefix, value string) []string {
+	for _, fs := range validatorFlagSets(path) {
+		if fn := flagCompletions[fs][name]; fn != nil {
+			return filterCandidates(fn(value), prefix, value)
+		}
+	}
+	return nil
+}
+
+// filterCandidates returns the sorted candidates that start with cur, each
+// prepended with prefix.
+func filterCandidates(candidates []string, prefix, cur string) []string {
+	var result []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, cur) {
+			result = append(result, prefix+candidate)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+var completionShells = []string{"bash", "fish", "zsh"}
+
+// writeCompletionScript writes the completion script for the program with the
+// given name in the given shell to w.
+func writeCompletionScript(w io.Writer, shell, name string) error {
+	tmpl := completionScripts[shell]
+	if tmpl == nil {
+		return fmt.Errorf("unsupported shell %q, must be one of %s", shell, strings.Join(completionShells, ", "))
+	}
+	return tmpl.Execute(w, struct{ Name, Quoted, Func string }{
+		Name:   name,
+		Quoted: ShellQuote(name),
+		Func:   nonIdentRunes.ReplaceAllString(name, "_"),
+	})
+}
+
+// completionScriptShell returns the shell set via the -completion-script flag
+// for the tree containing path, or "" if it isn't set.
+func completionScriptShell(path []*Command) string {
+	return path[0].completionScript.String()
+}
+
+// completionScriptRunner is a Runner that prints the completion script for the
+// program with the given name, requested via -completion-script.
+type completionScriptRunner struct {
+	shell, name string
+}
+
+func (c completionScriptRunner) Run(env *Env, _ []string) error {
+	return writeCompletionScript(env.Stdout, c.shell, c.name)
+}
+
+var nonIdentRunes = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+var completionScripts = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Parse(`# bash completion for {{.Name}}
+_{{.Func}}_complete() {
+  local line="${COMP_LINE:0:COMP_POINT}"
+  local -a words
+  read -r -a words <<< "$line"
+  if [[ "$line" == *[[:space:]] ]]; then
+    words+=("")
+  fi
+  local cur="${words[${#words[@]}-1]}"
+  local IFS=$'\n'
+  local -a out exts
+  local c f e
+  out=($("${words[0]}" __complete "${words[@]:1}" 2>/dev/null))
+  COMPREPLY=()
+  for c in "${out[@]}"; do
+    if [[ "$c" != :files* ]]; then
+      COMPREPLY+=("$c")
+      continue
+    fi
+    # Complete file paths, keeping directories and the allowed extensions.
+    IFS=' ' read -r -a exts <<< "${c#:files}"
+    compopt -o filenames 2>/dev/null
+    for f in $(compgen -f -- "$cur"); do
+      if [[ -d "$f" || ${#exts[@]} -eq 0 ]]; then
+        COMPREPLY+=("$f")
+        continue
+      fi
+      for e in "${exts[@]}"; do
+        if [[ "$f" == *"$e" ]]; then
+          COMPREPLY+=("$f")
+          break
+        fi
+      done
+    done
+  done
+  # Bash splits words at "=", so only the text after it is replaced.
+  if [[ "$cur" == *=* && "$COMP_WORDBREAKS" == *=* ]]; then
+    COMPREPLY=("${COMPREPLY[@]#*=}")
+  fi
+}
+complete -F _{{.Func}}_complete {{.Quoted}}
+`)),
+	"fish": template.Must(template.New("fish").Parse(`# fish completion for {{.Name}}
+function __{{.Func}}_complete
+    set -l tokens (commandline -opc)
+    set -l cur (commandline -ct)
+    for c in ($tokens[1] __complete $tokens[2..-1] $cur 2>/dev/null)
+        if not string match -q -- ':files*' $c
+            echo $c
+            continue
+        end
+        # Complete file paths, keeping directories and the allowed extensions.
+        set -l exts (string split -n ' ' -- (string replace -- ':files' '' $c))
+        for f in (__fish_complete_path $cur)
+            if test -d $f; or test (count $exts) -eq 0
+                echo $f
+                continue
+            end
+            for e in $exts
+                if string match -q -- "*$e" $f
+                    echo $f
+                    break
+                end
+            end
+        end
+    end
+end
+complete -c {{.Quoted}} -f -a '(__{{.Func}}_complete)'
+`)),
+	"zsh": template.Must(template.New("zsh").Parse(`#compdef {{.Name}}
+# zsh completion for {{.Name}}
+_{{.Func}}() {
+  local -a out candidates exts
+  local c files
+  out=("${(@f)$("${words[1]}" __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+  for c in "${out[@]}"; do
+    case "$c" in
+      :files*) files=1; exts=(${=c#:files}) ;;
+      ?*) candidates+=("$c") ;;
+    esac
+  done
+  compadd -Q -- "${candidates[@]}"
+  # Complete file paths, keeping directories and the allowed extensions.
+  if [[ -n "$files" ]]; then
+    if (( ${#exts} )); then
+      _files -g "*(${(j:|:)exts})"
+    else
+      _files
+    fi
+  fi
+}
+compdef _{{.Func}} {{.Quoted}}
+`)),
+}
@@ -0,0 +1,324 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
+
+func newCompletionTree() *Command {
+	deploy := &Command{
+		Name:     "deploy",
+		Short:    "deploy",
+		Long:     "deploy.",
+		ArgsName: "<target> ...",
+		Runner:   RunnerFunc(runHello),
+		CompleteArgs: func(args []string, _ string) []string {
+			// Each target may only be specified once.
+			var targets []string
+		targetLoop:
+			for _, target := range []string{"web", "worker"} {
+				for _, arg := range args {
+					if arg == target {
+						continue targetLoop
+					}
+				}
+				targets = append(targets, target)
+			}
+			return targets
+		},
+		CompleteArgsAsFiles: true,
+	}
+	apply := &Command{
+		Name:                "apply",
+		Short:               "apply",
+		Long:                "apply.",
+		ArgsName:            "<file>",
+		Runner:              RunnerFunc(runHello),
+		CompleteArgsAsFiles: true,
+		CompleteArgsExts:    []string{".yaml", ".json"},
+	}
+	status := &Command{
+		Name:   "status",
+		Short:  "status",
+		Long:   "status.",
+		Runner: RunnerFunc(runHello),
+	}
+	root := &Command{
+		Name:     "tool",
+		Short:    "tool",
+		Long:     "tool.",
+		Children: []*Command{apply, deploy, status},
+	}
+	root.Flags.String("env", "", "env")
+	root.Flags.Bool("enable", false, "enable")
+	deploy.Flags.String("region", "", "region")
+	deploy.Flags.String("replicas", "", "replicas")
+	RegisterFlagCompletion(&root.Flags, "env", func(string) []string {
+		return []string{"prod", "staging", "dev"}
+	})
+	RegisterFlagCompletion(&deploy.Flags, "region", func(prefix string) []string {
+		return []string{prefix + "-1", "us-east", "us-west"}
+	})
+	// WithCompletion registers global flags.
+	SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	WithCompletion(root)
+	return root
+}
+
+func TestComplete(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	root := newCompletionTree()
+	defer delete(flagCompletions, &root.Flags)
+	defer delete(flagCompletions, &root.Children[1].Flags)
+
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"apply", "completion", "deploy", "help", "status"}},
+		{[]string{""}, []string{"apply", "completion", "deploy", "help", "status"}},
+		{[]string{"d"}, []string{"deploy"}},
+		{[]string{"x"}, nil},
+		{[]string{"-en"}, []string{"-enable", "-env"}},
+		{[]string{"--en"}, []string{"--enable", "--env"}},
+		{[]string{"-env", ""}, []string{"dev", "prod", "staging"}},
+		{[]string{"--env", "s"}, []string{"staging"}},
+		{[]string{"-env=p"}, []string{"-env=prod"}},
+		{[]string{"--env=p"}, []string{"--env=prod"}},
+		{[]string{"-enable", ""}, []string{"apply", "completion", "deploy", "help", "status"}},
+		{[]string{"-env", "dev", "st"}, []string{"status"}},
+		{[]string{"-unknown=x"}, nil},
+		{[]string{"deploy", "-re"}, []string{"-region", "-replicas"}},
+		{[]string{"deploy", "-region", "us"}, []string{"us-1", "us-east", "us-west"}},
+		{[]string{"deploy", "-region=us-w"}, []string{"-region=us-w-1", "-region=us-west"}},
+		{[]string{"deploy", "-replicas", ""}, nil},
+		{[]string{"deploy", "-env", "d"}, []string{"dev"}},
+		{[]string{"x", ""}, nil},
+		// Args completion.
+		{[]string{"deploy", ""}, []string{"web", "worker", ":files"}},
+		{[]string{"deploy", "-env", "dev", "w"}, []string{"web", "worker", ":files"}},
+		{[]string{"deploy", "web", "w"}, []string{"worker", ":files"}},
+		{[]string{"deploy", "x", "-e"}, []string{":files"}},
+		{[]string{"deploy", "--", "-e"}, []string{":files"}},
+		{[]string{"-env", "dev", "--", "deploy", "x"}, []string{":files"}},
+		{[]string{"apply", ""}, []string{":files .yaml .json"}},
+		{[]string{"status", ""}, nil},
+		{[]string{"completion", ""}, []string{"bash", "fish", "help", "install", "zsh"}},
+		{[]string{"completion", "install", "-d"}, []string{"-dry-run"}},
+	}
+	for _, test := range tests {
+		// Start with a fresh flag.CommandLine, since it records the set flags.
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, append([]string{completeName}, test.args...)); err != nil {
+			t.Errorf("%q: unexpected error: %v", test.args, err)
+			continue
+		}
+		var got []string
+		if out := stdout.String(); out != "" {
+			got = strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestCompleteDisabled(t *testing.T) {
+	root := &Command{
+		Name:     "tool",
+		Short:    "tool",
+		Long:     "tool.",
+		ArgsName: "<args>",
+		Runner:   RunnerFunc(runEcho),
+	}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{completeName, "x"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, want := stdout.String(), "[__complete x]\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCompletionScript(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	for _, shell := range completionShells {
+		root := newCompletionTree()
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, []string{completionName, shell}); err != nil {
+			t.Errorf("%s: unexpected error: %v", shell, err)
+		}
+		if got, want := stdout.String(), "# "+shell+" completion for tool\n"; !strings.Contains(got, want) {
+			t.Errorf("%s: got %q, want substring %q", shell, got, want)
+		}
+		if got, want := stdout.String(), completeName; !strings.Contains(got, want) {
+			t.Errorf("%s: got %q, want substring %q", shell, got, want)
+		}
+		delete(flagCompletions, &root.Flags)
+		delete(flagCompletions, &root.Children[1].Flags)
+	}
+	if err := writeCompletionScript(&bytes.Buffer{}, "csh", "tool"); err == nil {
+		t.Errorf("got nil error for unsupported shell")
+	}
+}
+
+func TestCompletionScriptFlag(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	run := func(args ...string) (string, string, error) {
+		root := newCompletionTree()
+		defer delete(flagCompletions, &root.Flags)
+		defer delete(flagCompletions, &root.Children[1].Flags)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		err := ParseAndRun(root, env, args)
+		return stdout.String(), stderr.String(), err
+	}
+	for _, shell := range completionShells {
+		// The flag prints the same script as the subcommand, and the args are
+		// ignored.
+		want, _, err := run(completionName, shell)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", shell, err)
+		}
+		for _, args := range [][]string{
+			{"-completion-script=" + shell},
+			{"--completion-script", shell, "deploy", "x"},
+			{"status", "-completion-script=" + shell},
+		} {
+			got, stderr, err := run(args...)
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v\n%s", args, err, stderr)
+			}
+			if got != want {
+				t.Errorf("%v: got %q, want %q", args, got, want)
+			}
+		}
+	}
+	_, stderr, err := run("-completion-script=csh")
+	if err != ErrUsage {
+		t.Errorf("got error %v, want %v", err, ErrUsage)
+	}
+	if got, want := stderr, `ERROR: tool: invalid value "csh" for flag -completion-script: invalid value "csh", must be one of bash, fish, zsh`; !strings.HasPrefix(got, want) {
+		t.Errorf("got stderr %q, want prefix %q", got, want)
+	}
+	// The flag is hidden from help and completion.
+	for _, args := range [][]string{{"help", "-style=full"}, {completeName, "-comp"}} {
+		got, _, err := run(args...)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", args, err)
+		}
+		if strings.Contains(got, "completion-script") {
+			t.Errorf("%v: got %q, want no -completion-script", args, got)
+		}
+	}
+}
+
+func TestCompletionInstall(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	tmpDir, err := ioutil.TempDir("", "cmdline-completion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	installPath := filepath.Join(tmpDir, "dir", "tool.bash")
+
+	tests := []struct {
+		args    []string
+		vars    map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			[]string{"-dry-run"},
+			map[string]string{"SHELL": "/bin/bash", "HOME": "/home/user"},
+			"Would install the bash completion script at /home/user/.local/share/bash-completion/completions/tool\n",
+			"",
+		},
+		{
+			[]string{"-dry-run", "bash"},
+			map[string]string{"XDG_DATA_HOME": "/data"},
+			"Would install the bash completion script at /data/bash-completion/completions/tool\n",
+			"",
+		},
+		{
+			[]string{"-dry-run", "fish"},
+			map[string]string{"SHELL": "/bin/bash", "HOME": "/home/user"},
+			"Would install the fish completion script at /home/user/.config/fish/completions/tool.fish\n",
+			"",
+		},
+		{
+			[]string{"-dry-run"},
+			map[string]string{"SHELL": "/usr/bin/zsh", "HOME": "/home/user", "ZDOTDIR": "/zdot"},
+			"Would install the zsh completion script at /zdot/.zfunc/_tool\n",
+			"",
+		},
+		{
+			[]string{"-dry-run", "-path=/tmp/x", "zsh"},
+			nil,
+			"Would install the zsh completion script at /tmp/x\n",
+			"",
+		},
+		{
+			[]string{"-path=" + installPath, "bash"},
+			nil,
+			"Installed the bash completion script at " + installPath + "\nCompletion is enabled in new shell sessions\n",
+			"",
+		},
+		{[]string{}, map[string]string{"SHELL": "/bin/csh"}, "", "ERROR: tool completion install: can't detect the shell"},
+		{[]string{"csh"}, nil, "", "ERROR: tool completion install: unsupported shell"},
+		{[]string{"bash", "zsh"}, nil, "", "ERROR: tool completion install: takes at most one argument"},
+		{[]string{"fish"}, nil, "", `neither $XDG_CONFIG_HOME nor $HOME are set; use -path, or redirect the output of "tool completion fish" to a file`},
+	}
+	for _, test := range tests {
+		// Start with a fresh tree and flag.CommandLine, since they record the set
+		// flags.
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		root := newCompletionTree()
+		var stdout, stderr bytes.Buffer
+		vars := envvar.CopyMap(baseVars)
+		for key, val := range test.vars {
+			vars[key] = val
+		}
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: vars}
+		err := ParseAndRun(root, env, append([]string{completionName, "install"}, test.args...))
+		delete(flagCompletions, &root.Flags)
+		delete(flagCompletions, &root.Children[1].Flags)
+		if test.wantErr != "" {
+			if got := fmt.Sprint(err) + stderr.String(); !strings.Contains(got, test.wantErr) {
+				t.Errorf("%q: got error %q, want substring %q", test.args, got, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.args, err)
+		}
+		if got, want := stdout.String(), test.want; got != want {
+			t.Errorf("%q: got %q, want %q", test.args, got, want)
+		}
+	}
+	// Check the installed script.
+	var want bytes.Buffer
+	if err := writeCompletionScript(&want, "bash", "tool"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ioutil.ReadFile(installPath); err != nil || string(got) != want.String() {
+		t.Errorf("got installed script %q, %v, want %q", got, err, want.String())
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+const (
+	configName = "config"
+	redacted   = "<redacted>"
+)
+
+// sensitiveFlags holds the flags marked via MarkFlagSensitive, keyed by the
+// FlagSet and then by the flag name.
+var sensitiveFlags = make(map[*flag.FlagSet]map[string]bool)
+
+// MarkFlagSensitive marks the flag with the given name defined in fs as
+// sensitive, e.g. because its value is a password or token.  The values of
+// sensitive flags are redacted by "config dump".  The flag may be defined in
+// the Flags of a Command, or in flag.CommandLine for global flags.
+func MarkFlagSensitive(fs *flag.FlagSet, name string) {
+	names := sensitiveFlags[fs]
+	if names == nil {
+		names = make(map[string]bool)
+		sensitiveFlags[fs] = names
+	}
+	names[name] = true
+}
+
+// isSensitiveFlag returns true iff the flag with the given name is marked as
+// sensitive, for the last command in path.
+func isSensitiveFlag(path []*Command, name string) bool {
+	for _, fs := range validatorFlagSets(path) {
+		if sensitive, ok := sensitiveFlags[fs][name]; ok {
+			return sensitive
+		}
+	}
+	return false
+}
+
+// WithConfigDump adds a "config dump" command to root, which prints the
+// effective value of every flag in the tree rooted at root, and every global
+// flag, along with the source of the value, which is one of:
+//
+//   default: the default value of the flag
+//   env:     the environment variable bound via BindEnv
+//   flag:    the command line
+//   file:    the file given by -flags-from, see WithFlagsFrom
+//
+// The flags of root and the global flags are set before the command, e.g.
+// "tool -port=80 config dump".  The flags of the descendants of root are
+// qualified by the path of their command relative to root, e.g.
+// "net status: json=false (default)", and their values only come from the
+// default or the environment.  Hidden commands are skipped.  The values of
+// flags marked via MarkFlagSensitive are redacted.  If root doesn't already
+// have a "config" child, a hidden one is added, which isn't listed in the help
+// of root.
+//
+// If root has a Runner and no children, a hidden -config-dump=<format> global
+// flag is registered instead of the command, since a child would conflict with
+// the args of the Runner.  The children of root must be set before calling
+// WithConfigDump.
+//
+// WithConfigDump must be called at most once, before Main or Parse.
+func WithConfigDump(root *Command) {
+	if isLeafRoot(root) {
+		format := addConfigFlag(root, "config-dump", "Print the effective flag values")
+		root.addFlagRunner(func() bool { return format.String() != "" }, RunnerFunc(func(env *Env, _ []string) error {
+			return dumpConfig(env, root, format.String())
+		}))
+		return
+	}
+	dump := &Command{
+		Name:  "dump",
+		Short: "Print the effective flag values",
+		Long: `
+Print the effective value of every ` + root.Name + ` flag and global flag, along
+with where the value came from: the default value ("default"), an environment
+variable ("env"), the command line ("flag"), or the file given by -flags-from
+("file").  The flags of subcommands are qualified by the path of the
+subcommand.
+`,
+	}
+	var format string
+	dump.Flags.StringVar(&format, "format", "text", `The output format, either "text" or "json".`)
+	dump.Runner = RunnerFunc(func(env *Env, _ []string) error {
+		return dumpConfig(env, root, format)
+	})
+	addConfigChild(root, dump)
+}
+
+// WithConfigGenerate adds a "config generate" command to root, which prints a
+// template config file with the default value of every root and global flag,
+// each preceded by its usage as a comment.  The -format flag selects either
+// key=value lines ("text"), or a JSON array of objects with the name, default
+// value and usage of each flag ("json").  Flags marked via MarkFlagSensitive,
+// and global flags that are never shown in usage messages, are skipped.  If
+// root doesn't already have a "config" child, a hidden one is added, which
+// isn't listed in the help of root.
+//
+// If root has a Runner and no children, a hidden -config-generate=<format>
+// global flag is registered instead of the command, as for WithConfigDump.
+//
+// WithConfigGenerate must be called at most once, before Main or Parse.
+func WithConfigGenerate(root *Command) {
+	if isLeafRoot(root) {
+		format := addConfigFlag(root, "config-generate", "Print a template config file")
+		root.addFlagRunner(func() bool { return format.String() != "" }, RunnerFunc(func(env *Env, _ []string) error {
+			return generateConfig(env, root, format.String())
+		}))
+		return
+	}
+	generate := &Command{
+		Name:  "generate",
+		Short: "Print a template config file",
+		Long: `
+Print a template config file, with the default value of every ` + root.Name + `
+flag and global flag, each preceded by its usage as a comment.
+`,
+	}
+	var format string
+	generate.Flags.StringVar(&format, "format", "text", `The output format, either "text" or "json".`)
+	generate.Runner = RunnerFunc(func(env *Env, _ []string) error {
+		return generateConfig(env, root, format)
+	})
+	addConfigChild(root, generate)
+}
+
+// addConfigChild adds child to the "config" child of root, which is added as a
+// hidden command if it doesn't already exist.
+func addConfigChild(root, child *Command) {
+	if config := lookupChild(root, configName, false); config != nil {
+		config.Children = append(config.Children, child)
+		return
+	}
+	root.Children = append(root.Children, &Command{
+		Name:     configName,
+		Short:    "Inspect the effective configuration",
+		Long:     "Inspect the effective configuration.",
+		Children: []*Command{child},
+		hidden:   true,
+	})
+}
+
+// addConfigFlag registers the hidden global flag with the given name that
+// replaces a "config" command for leaf roots, and returns its value, which is
+// empty unless the flag is set to one of the output formats.
+func addConfigFlag(root *Command, name, short string) *EnumFlag {
+	format := NewEnumFlag("", "", "text", "json")
+	commandLine().Var(format, name, short+" of "+root.Name+`, in the given format; either "text" or "json".`)
+	hiddenGlobalFlags[name] = true
+	return format
+}
+
+// configFlags returns the flags of root and the global flags.
+func configFlags(root *Command) *flag.FlagSet {
+	flags := copyFlags(globalFlags)
+	mergeFlags(flags, &root.Flags)
+	if contributed := contributedFlags([]*Command{root}); contributed != nil {
+		mergeFlags(flags, contributed)
+	}
+	return flags
+}
+
+// configEntry describes the effective value of a flag, for "config dump".
+type configEntry struct {
+	Command string     `json:"command,omitempty"`
+	Name    string     `json:"name"`
+	Value   string     `json:"value"`
+	Source  flagSource `json:"source"`
+}
+
+// dumpConfig prints the effective values of the flags in the tree rooted at
+// root and the global flags to env.Stdout, in the given format.
+func dumpConfig(env *Env, root *Command, format string) error {
+	path := []*Command{root}
+	var entries []configEntry
+	configFlags(root).VisitAll(func(f *flag.Flag) {
+		// Skip the hidden flags registered by this package, e.g. -config-dump.
+		if hiddenGlobalFlags[f.Name] && root.Flags.Lookup(f.Name) == nil {
+			return
+		}
+		entry := configEntry{"", f.Name, f.Value.String(), env.flagSources[f.Name]}
+		if entry.Source == "" {
+			entry.Source = flagSourceDefault
+		}
+		if isSensitiveFlag(path, f.Name) {
+			entry.Value = redacted
+		}
+		entries = append(entries, entry)
+	})
+	entries = append(entries, descendantConfig(env, path)...)
+	switch format {
+	case "text":
+		for _, entry := range entries {
+			if entry.Command != "" {
+				fmt.Fprintf(env.Stdout, "%s: ", entry.Command)
+			}
+			fmt.Fprintf(env.Stdout, "%s=%s (%s)\n", entry.Name, entry.Value, entry.Source)
+		}
+		return nil
+	case "json":
+		if entries == nil {
+			entries = []configEntry{}
+		}
+		enc := json.NewEncoder(env.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	return env.UsageErrorf("%s: unknown -format %q, want text or json", env.cmdPath, format)
+}
+
+// descendantConfig returns the entries for the flags of the visible descendants
+// of the last command in path, in depth-first order.  The descendants aren't
+// parsed, so the value of each flag is its default, or the value of the
+// environment variable bound via BindEnv.
+func descendantConfig(env *Env, path []*Command) []configEntry {
+	var entries []configEntry
+	for _, child := range visibleChildren(path[len(path)-1]) {
+		childPath := append(append([]*Command(nil), path...), child)
+		name := pathName("", childPath[1:])
+		flags := copyFlags(&child.Flags)
+		if contributed := contributedFlags([]*Command{child}); contributed != nil {
+			mergeFlags(flags, contributed)
+		}
+		flags.VisitAll(func(f *flag.Flag) {
+			entry := configEntry{name, f.Name, f.Value.String(), flagSourceDefault}
+			if envVar := flagEnvVar(childPath, f.Name); envVar != "" && env.Vars[envVar] != "" {
+				entry.Value, entry.Source = env.Vars[envVar], flagSourceEnv
+			}
+			if isSensitiveFlag(childPath, f.Name) {
+				entry.Value = redacted
+			}
+			entries = append(entries, entry)
+		})
+		entries = append(entries, descendantConfig(env, childPath)...)
+	}
+	return entries
+}
+
+// configTemplateEntry describes the default value of a flag, for
+// "config generate".
+type configTemplateEntry struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	Usage string `json:"usage,omitempty"`
+}
+
+// generateConfig prints a template config file with the default values of the
+// flags of root and the global flags to env.Stdout, in the given format.
+func generateConfig(env *Env, root *Command, format string) error {
+	path := []*Command{root}
+	var entries []configTemplateEntry
+	configFlags(root).VisitAll(func(f *flag.Flag) {
+		if isSensitiveFlag(path, f.Name) {
+			return
+		}
+		if globalFlags.Lookup(f.Name) != nil && !showGlobalFlag(f.Name) {
+			return
+		}
+		// Remove the back quotes around the name of the value, if any, as in
+		// help.
+		_, usage := flag.UnquoteUsage(f)
+		entries = append(entries, configTemplateEntry{f.Name, defaultFlagValue(f), usage})
+	})
+	switch format {
+	case "text":
+		for i, entry := range entries {
+			if i > 0 {
+				fmt.Fprintln(env.Stdout)
+			}
+			if entry.Usage != "" {
+				fmt.Fprintln(env.Stdout, "# "+strings.Replace(entry.Usage, "\n", "\n# ", -1))
+			}
+			fmt.Fprintf(env.Stdout, "%s=%s\n", entry.Name, entry.Value)
+		}
+		return nil
+	case "json":
+		if entries == nil {
+			entries = []configTemplateEntry{}
+		}
+		enc := json.NewEncoder(env.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+	return env.UsageErrorf("%s: unknown -format %q, want text or json", env.cmdPath, format)
+}
@@ -0,0 +1,225 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
+
+// newConfigTestRoot returns a root with a Runner, and a "net status"
+// descendant with its own flags.
+func newConfigTestRoot() *Command {
+	status := &Command{
+		Name:   "status",
+		Short:  "status",
+		Long:   "status.",
+		Runner: RunnerFunc(runHello),
+	}
+	status.Flags.Bool("json", false, "json")
+	status.Flags.String("addr", "localhost", "addr")
+	status.Flags.String("key", "", "key")
+	return &Command{
+		Name:   "root",
+		Short:  "root",
+		Long:   "root.",
+		Runner: RunnerFunc(runHello),
+		Children: []*Command{{
+			Name:     "net",
+			Short:    "net",
+			Long:     "net.",
+			Children: []*Command{status},
+		}},
+	}
+}
+
+func TestConfigDump(t *testing.T) {
+	root := newConfigTestRoot()
+	status := root.Children[0].Children[0]
+	var port, name, token string
+	root.Flags.StringVar(&port, "port", "80", "port")
+	root.Flags.StringVar(&name, "name", "x", "name")
+	root.Flags.StringVar(&token, "token", "", "token")
+	BindEnv(&root.Flags, "port", "ROOT_PORT")
+	BindEnv(&status.Flags, "addr", "STATUS_ADDR")
+	MarkFlagSensitive(&root.Flags, "token")
+	MarkFlagSensitive(&status.Flags, "key")
+	defer delete(flagEnvVars, &root.Flags)
+	defer delete(flagEnvVars, &status.Flags)
+	defer delete(sensitiveFlags, &root.Flags)
+	defer delete(sensitiveFlags, &status.Flags)
+	WithConfigDump(root)
+
+	run := func(args ...string) string {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		vars := envvar.MergeMaps(baseVars, map[string]string{"ROOT_PORT": "8080", "STATUS_ADDR": "example.com"})
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: vars}
+		if err := ParseAndRun(root, env, args); err != nil {
+			t.Errorf("%q: unexpected error: %v\n%s", args, err, stderr.String())
+		}
+		resetFlags(root)
+		return stdout.String()
+	}
+
+	got := run("-name=y", "-token=secret", "config", "dump")
+	for _, want := range []string{
+		"name=y (flag)\n",
+		"port=8080 (env)\n",
+		"token=<redacted> (flag)\n",
+		"net status: addr=example.com (env)\n",
+		"net status: json=false (default)\n",
+		"net status: key=<redacted> (default)\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("got %q, want substring %q", got, want)
+		}
+	}
+	if strings.Contains(got, "secret") {
+		t.Errorf("got %q, want sensitive value to be redacted", got)
+	}
+
+	var entries []configEntry
+	if err := json.Unmarshal([]byte(run("config", "dump", "-format=json")), &entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sources := make(map[string]flagSource)
+	for _, entry := range entries {
+		sources[strings.TrimSpace(entry.Command+" "+entry.Name)] = entry.Source
+	}
+	if got, want := sources["name"], flagSourceDefault; got != want {
+		t.Errorf("got source %q for -name, want %q", got, want)
+	}
+	if got, want := sources["port"], flagSourceEnv; got != want {
+		t.Errorf("got source %q for -port, want %q", got, want)
+	}
+	if got, want := sources["net status addr"], flagSourceEnv; got != want {
+		t.Errorf("got source %q for net status -addr, want %q", got, want)
+	}
+	// The hidden config command isn't dumped.
+	for key := range sources {
+		if strings.HasPrefix(key, configName+" ") {
+			t.Errorf("got entry %q, want no %q entries", key, configName)
+		}
+	}
+
+	// The config command is hidden from the help of root.
+	if got := run("help"); strings.Contains(got, configName) {
+		t.Errorf("got help %q, want no %q command", got, configName)
+	}
+}
+
+func TestConfigGenerate(t *testing.T) {
+	root := newConfigTestRoot()
+	var port, token string
+	var verbose, internal bool
+	root.Flags.StringVar(&port, "port", "80", "The `port` to listen on.\nDefaults to http.")
+	root.Flags.StringVar(&token, "token", "", "token")
+	MarkFlagSensitive(&root.Flags, "token")
+	defer delete(sensitiveFlags, &root.Flags)
+	WithConfigDump(root)
+	WithConfigGenerate(root)
+
+	oldGlobalFlags, oldPolicy := globalFlags, globalFlagsPolicy
+	defer func() { globalFlags, globalFlagsPolicy = oldGlobalFlags, oldPolicy }()
+	globalFlags = new(flag.FlagSet)
+	globalFlags.BoolVar(&verbose, "v", false, "Verbose output.")
+	globalFlags.BoolVar(&internal, "internal", false, "Internal flag.")
+	SetGlobalFlagsPolicy(GlobalFlagsPolicy{
+		Full: GlobalFlagsFilter{Exclude: []*regexp.Regexp{regexp.MustCompile(`^internal$`)}},
+	})
+
+	run := func(args ...string) string {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: baseVars}
+		if err := ParseAndRun(root, env, args); err != nil {
+			t.Errorf("%q: unexpected error: %v\n%s", args, err, stderr.String())
+		}
+		resetFlags(root)
+		return stdout.String()
+	}
+
+	if got, want := run("-port=8080", "config", "generate"), `# The port to listen on.
+# Defaults to http.
+port=80
+
+# Verbose output.
+v=false
+`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	var entries []configTemplateEntry
+	if err := json.Unmarshal([]byte(run("config", "generate", "-format=json")), &entries); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := entries, []configTemplateEntry{
+		{"port", "80", "The port to listen on.\nDefaults to http."},
+		{"v", "false", "Verbose output."},
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Both config commands share the hidden config command.
+	if got, want := len(root.Children), 2; got != want {
+		t.Errorf("got %d children, want %d", got, want)
+	}
+}
+
+func TestConfigLeafRoot(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	var gotArgs []string
+	root := &Command{
+		Name:     "root",
+		Short:    "root",
+		Long:     "root.",
+		ArgsName: "<arg>",
+		Runner: RunnerFunc(func(_ *Env, args []string) error {
+			gotArgs = args
+			return nil
+		}),
+	}
+	var port string
+	root.Flags.StringVar(&port, "port", "80", "port")
+	WithConfigDump(root)
+	WithConfigGenerate(root)
+	if len(root.Children) != 0 {
+		t.Fatalf("got children %v, want none", root.Children)
+	}
+
+	run := func(args ...string) string {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, args); err != nil {
+			t.Errorf("%q: unexpected error: %v\n%s", args, err, stderr.String())
+		}
+		resetFlags(root)
+		return stdout.String()
+	}
+
+	// The args are still passed to the Runner, including "config".
+	run("config", "dump")
+	if got, want := gotArgs, []string{"config", "dump"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got args %v, want %v", got, want)
+	}
+	if got, want := run("-port=8080", "-config-dump=text"), "port=8080 (flag)\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := run("-config-generate=text"), "# port\nport=80\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// The hidden flags aren't shown in the help.
+	if got := run("-help"); strings.Contains(got, "config-") {
+		t.Errorf("got help %q, want no config flags", got)
+	}
+}
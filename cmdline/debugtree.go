@@ -0,0 +1,88 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// WithDebugTree registers the -debug-tree global flag (see SetGlobalFlags), and
+// arranges for Parse and Main with the given root command to print the
+// resolved command tree to stderr when the flag is set, before the command is
+// run.  The tree includes the compiled-in children, the external children found
+// via LookPath, and the default help commands, and marks the commands that were
+// matched by the command line with "*".  The tree is also printed if the parse
+// fails, without marks, which helps to debug why a command doesn't match.
+func WithDebugTree(root *Command) {
+	root.debugTree = commandLine().Bool("debug-tree", false, "Print the resolved command tree to stderr before running the command.")
+}
+
+// writeDebugTree writes the tree rooted at root to env.Stderr, marking the
+// commands matched by result, which is nil if the parse failed.
+func writeDebugTree(env *Env, root *Command, result *ParseResult) {
+	var matched []string
+	if result != nil {
+		for _, cmd := range result.Path {
+			matched = append(matched, cmd.Name)
+		}
+		if binary, ok := result.Runner.(binaryRunner); ok {
+			matched = append(matched, strings.TrimPrefix(filepath.Base(binary.subCmd), result.Command.Name+"-"))
+		}
+	}
+	bold := env.ColorEnabled(env.Stderr)
+	fmt.Fprintln(env.Stderr, "Command tree:")
+	writeDebugTreeNode(env, root, debugTreeNode{name: root.Name}, 0, matched, bold)
+}
+
+// debugTreeNode describes a single command in the tree printed by
+// writeDebugTree.
+type debugTreeNode struct {
+	name, note string
+}
+
+// writeDebugTreeNode writes node at the given depth, and recursively the
+// children of cmd, which is nil for external and help commands.  The node is
+// marked iff the names of its path from the root are a prefix of matched.
+func writeDebugTreeNode(env *Env, cmd *Command, node debugTreeNode, depth int, matched []string, bold bool) {
+	isMatched := depth < len(matched) && matched[depth] == node.name
+	line := strings.Repeat("  ", depth) + node.name
+	if node.note != "" {
+		line += " [" + node.note + "]"
+	}
+	switch {
+	case isMatched && bold:
+		fmt.Fprintf(env.Stderr, "* \x1b[1m%s\x1b[0m\n", line)
+	case isMatched:
+		fmt.Fprintf(env.Stderr, "* %s\n", line)
+	default:
+		fmt.Fprintf(env.Stderr, "  %s\n", line)
+	}
+	if cmd == nil {
+		return
+	}
+	if !isMatched {
+		matched = nil
+	}
+	for _, child := range cmd.Children {
+		var note string
+		if child.hidden {
+			note = "hidden"
+		}
+		writeDebugTreeNode(env, child, debugTreeNode{name: child.Name, note: note}, depth+1, matched, bold)
+	}
+	if cmd.LookPath {
+		cmdPrefix := cmd.Name + "-"
+		subCmds, _ := env.lookPathPrefix(cmd.LookPathDirs, cmdPrefix, cmd.subNames(cmdPrefix))
+		for _, subCmd := range subCmds {
+			subName := strings.TrimPrefix(filepath.Base(subCmd), cmdPrefix)
+			writeDebugTreeNode(env, nil, debugTreeNode{name: subName, note: "external " + subCmd}, depth+1, matched, bold)
+		}
+	}
+	if len(cmd.Children) > 0 && !cmd.NoHelpChild {
+		writeDebugTreeNode(env, nil, debugTreeNode{name: helpName, note: "default help"}, depth+1, matched, bold)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDebugTree(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	tmpDir, err := ioutil.TempDir("", "cmdline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ext := filepath.Join(tmpDir, "root-ext")
+	if err := ioutil.WriteFile(ext, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	newRoot := func() *Command {
+		child := &Command{Name: "child", Short: "child", Long: "child.", Runner: RunnerFunc(runHello)}
+		secret := &Command{Name: "secret", Short: "secret", Long: "secret.", Runner: RunnerFunc(runHello), hidden: true}
+		return &Command{
+			Name:     "root",
+			Short:    "root",
+			Long:     "root.",
+			LookPath: true,
+			Children: []*Command{child, secret},
+		}
+	}
+	tests := []struct {
+		args []string
+		err  error
+		want string
+	}{
+		{[]string{"child"}, nil, `Command tree:
+* root
+*   child
+    secret [hidden]
+    ext [external ` + ext + `]
+    help [default help]
+`},
+		{[]string{"ext"}, nil, `Command tree:
+* root
+    child
+    secret [hidden]
+*   ext [external ` + ext + `]
+    help [default help]
+`},
+		{[]string{"unknown"}, ErrUsage, `Command tree:
+  root
+    child
+    secret [hidden]
+    ext [external ` + ext + `]
+    help [default help]
+`},
+	}
+	for _, test := range tests {
+		SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+		root := newRoot()
+		WithDebugTree(root)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{"PATH": tmpDir}}
+		if _, err := ParseCommand(root, env, append([]string{"-debug-tree"}, test.args...)); err != test.err {
+			t.Errorf("%v: got error %v, want %v", test.args, err, test.err)
+		}
+		if got := stderr.String(); !strings.HasSuffix(got, test.want) {
+			t.Errorf("%v: got stderr %q, want suffix %q", test.args, got, test.want)
+		}
+	}
+	// Nothing is printed without the flag.
+	SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	root := newRoot()
+	WithDebugTree(root)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{"PATH": tmpDir}}
+	if _, err := ParseCommand(root, env, []string{"child"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := stderr.String(); got != "" {
+		t.Errorf("got stderr %q, want empty", got)
+	}
+}
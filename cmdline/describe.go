@@ -0,0 +1,139 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"strings"
+
+	"v.io/x/lib/textutil"
+)
+
+// WithDescribe registers the -describe global flag (see SetGlobalFlags), and
+// arranges for Parse and Main with the given root command to print a JSON
+// description of the command matched by the command line when the flag is
+// set, instead of running it; e.g. "tool net status -describe".  The
+// description has the name, path, descriptions, positional args, flags, global
+// flags and visible children of the single command, using the same keys as
+// MarshalCommandTreeJSON, which describes the whole tree.  The description may
+// be requested for commands without a Runner, and the positional args of the
+// command aren't validated.
+//
+// External children receive the -describe flag like other global flags, and
+// describe themselves if they also use WithDescribe.
+func WithDescribe(root *Command) {
+	root.describe = commandLine().Bool("describe", false, "Print a JSON description of the command, instead of running it.")
+}
+
+// describing returns true iff the -describe flag is set for the tree
+// containing path.
+func describing(path []*Command) bool {
+	return path[0].describe != nil && *path[0].describe
+}
+
+// describeCommand is the JSON description of a single command, printed by
+// describeRunner.
+type describeCommand struct {
+	Name        string         `json:"name"`
+	Path        string         `json:"path"`
+	Short       string         `json:"short,omitempty"`
+	Long        string         `json:"long,omitempty"`
+	ArgsName    string         `json:"argsName,omitempty"`
+	ArgsLong    string         `json:"argsLong,omitempty"`
+	Args        []describeArg  `json:"args,omitempty"`
+	Flags       []treeFlag     `json:"flags,omitempty"`
+	GlobalFlags []treeFlag     `json:"globalFlags,omitempty"`
+	Children    []describeName `json:"children,omitempty"`
+}
+
+// describeArg describes a positional arg declared via Command.Args.
+type describeArg struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Optional bool   `json:"optional,omitempty"`
+	Variadic bool   `json:"variadic,omitempty"`
+}
+
+// describeName describes a child of the command.
+type describeName struct {
+	Name  string `json:"name"`
+	Short string `json:"short,omitempty"`
+}
+
+// describeRunner is a Runner that prints the description of the last command
+// in path, requested via -describe.
+type describeRunner struct {
+	path []*Command
+}
+
+func (d describeRunner) Run(env *Env, _ []string) error {
+	// Don't escape HTML characters, which are common in ArgsName, e.g. "<dir>".
+	enc := json.NewEncoder(env.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(newDescribeCommand(env, d.path))
+}
+
+// newDescribeCommand returns the description of the last command in path.  The
+// flags include the flags inherited from ancestors.
+func newDescribeCommand(env *Env, path []*Command) *describeCommand {
+	cmd := path[len(path)-1]
+	dc := &describeCommand{
+		Name:        strings.TrimSpace(cmd.Name),
+		Path:        pathName(env.prefix(), path),
+		Short:       strings.TrimSpace(cmd.Short),
+		Long:        strings.TrimSpace(cmd.Long),
+		ArgsName:    strings.TrimSpace(cmd.ArgsName),
+		ArgsLong:    strings.TrimSpace(cmd.ArgsLong),
+		Flags:       describeFlags(pathFlags(path)),
+		GlobalFlags: describeFlags(pathGlobalFlags(path)),
+	}
+	for _, a := range cmd.argSpecs {
+		dc.Args = append(dc.Args, describeArg{a.name, a.typ, a.optional, a.variadic})
+	}
+	for _, child := range visibleChildren(cmd) {
+		dc.Children = append(dc.Children, describeName{child.Name, strings.TrimSpace(child.Short)})
+	}
+	return dc
+}
+
+// usageJSON prints the description of the last command in path to w, for the
+// json style of help.  Unlike -describe, the children include the external
+// children found via LookPath, without their short descriptions, so that tools
+// like gendoc can walk the whole tree.
+func usageJSON(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig) {
+	cmd := path[len(path)-1]
+	dc := newDescribeCommand(env, path)
+	dc.Path = pathName(config.prefix, path)
+	if cmd.LookPath {
+		cmdPrefix := cmd.Name + "-"
+		binaries, _ := env.lookPathPrefix(cmd.LookPathDirs, cmdPrefix, cmd.subNames(cmdPrefix))
+		for _, sub := range externalSubcommands(cmd, binaries) {
+			dc.Children = append(dc.Children, describeName{Name: sub.name})
+		}
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(dc); err != nil {
+		// This can't happen, since describeCommand only contains strings and
+		// bools.
+		panic(err)
+	}
+	w.ForceVerbatim(true)
+	w.Write(buf.Bytes())
+	w.ForceVerbatim(false)
+}
+
+func describeFlags(flags *flag.FlagSet) []treeFlag {
+	var result []treeFlag
+	flags.VisitAll(func(f *flag.Flag) {
+		result = append(result, treeFlag{f.Name, f.DefValue, strings.TrimSpace(f.Usage)})
+	})
+	return result
+}
@@ -0,0 +1,194 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
+
+func TestDescribe(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	ran := false
+	newRoot := func() *Command {
+		status := &Command{
+			Name:  "status",
+			Short: "Print the status",
+			Long:  "Print the status of the network.",
+			Runner: RunnerFunc(func(*Env, []string) error {
+				ran = true
+				return nil
+			}),
+		}
+		status.Args("host string", "ports?... int")
+		status.Flags.Bool("json", false, "Print JSON.")
+		net := &Command{Name: "net", Short: "Manage the network", Long: "Manage the network.", Children: []*Command{status}}
+		net.Flags.String("iface", "eth0", "The interface.")
+		return &Command{Name: "root", Short: "Root", Long: "Root.", Children: []*Command{net}}
+	}
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"net", "status", "-describe"}, `{
+  "name": "status",
+  "path": "root net status",
+  "short": "Print the status",
+  "long": "Print the status of the network.",
+  "argsName": "<host> [<ports> ...]",
+  "args": [
+    {
+      "name": "host",
+      "type": "string"
+    },
+    {
+      "name": "ports",
+      "type": "int",
+      "optional": true,
+      "variadic": true
+    }
+  ],
+  "flags": [
+    {
+      "name": "iface",
+      "default": "eth0",
+      "usage": "The interface."
+    },
+    {
+      "name": "json",
+      "default": "false",
+      "usage": "Print JSON."
+    }
+  ],
+  "globalFlags": [
+    {
+      "name": "describe",
+      "default": "false",
+      "usage": "Print a JSON description of the command, instead of running it."
+    }
+  ]
+}
+`},
+		{[]string{"-describe", "net"}, `{
+  "name": "net",
+  "path": "root net",
+  "short": "Manage the network",
+  "long": "Manage the network.",
+  "flags": [
+    {
+      "name": "iface",
+      "default": "eth0",
+      "usage": "The interface."
+    }
+  ],
+  "globalFlags": [
+    {
+      "name": "describe",
+      "default": "false",
+      "usage": "Print a JSON description of the command, instead of running it."
+    }
+  ],
+  "children": [
+    {
+      "name": "status",
+      "short": "Print the status"
+    }
+  ]
+}
+`},
+	}
+	for _, test := range tests {
+		ran = false
+		SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+		root := newRoot()
+		WithDescribe(root)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, test.args); err != nil {
+			t.Errorf("%v: unexpected error: %v\n%s", test.args, err, stderr.String())
+		}
+		if ran {
+			t.Errorf("%v: the runner was run", test.args)
+		}
+		if got := stdout.String(); got != test.want {
+			t.Errorf("%v: got %s, want %s", test.args, got, test.want)
+		}
+	}
+	// The command is run as usual without the flag.
+	SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	root := newRoot()
+	WithDescribe(root)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{"net", "status", "host"}); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+	}
+	if !ran || stdout.Len() != 0 {
+		t.Errorf("got ran %v, stdout %q, want the runner to be run", ran, stdout.String())
+	}
+}
+
+func TestHelpJSONStyle(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cmdline-describe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "root-ext"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	status := &Command{
+		Name:   "status",
+		Short:  "Print the status",
+		Long:   "Print the status of the network.",
+		Runner: RunnerFunc(runHello),
+	}
+	net := &Command{Name: "net", Short: "Manage the network", Long: "Manage the network.", Children: []*Command{status}}
+	root := &Command{Name: "root", Short: "Root", Long: "Root.", Children: []*Command{net}, LookPath: true}
+	for _, test := range []struct {
+		args []string
+		want describeCommand
+	}{
+		{[]string{"help", "-style=json"}, describeCommand{
+			Name:     "root",
+			Path:     "root",
+			Short:    "Root",
+			Long:     "Root.",
+			Children: []describeName{{"net", "Manage the network"}, {"ext", ""}},
+		}},
+		{[]string{"help", "-style=json", "net"}, describeCommand{
+			Name:     "net",
+			Path:     "root net",
+			Short:    "Manage the network",
+			Long:     "Manage the network.",
+			Children: []describeName{{"status", "Print the status"}},
+		}},
+	} {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		vars := envvar.MergeMaps(baseVars, map[string]string{"PATH": tmpDir})
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: vars}
+		if err := ParseAndRun(root, env, test.args); err != nil {
+			t.Fatalf("%v: unexpected error: %v\n%s", test.args, err, stderr.String())
+		}
+		resetFlags(root)
+		var got describeCommand
+		if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+			t.Fatalf("%v: unexpected error: %v\n%s", test.args, err, stdout.String())
+		}
+		got.GlobalFlags = nil
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got %+v, want %+v", test.args, got, test.want)
+		}
+	}
+}
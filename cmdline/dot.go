@@ -0,0 +1,79 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// DOTOptions configures the graph written by WriteDOT.
+type DOTOptions struct {
+	// Topics causes topics to be included in the graph, as note-shaped nodes.
+	Topics bool
+	// Env, if non-nil, is used to look for external children of commands that
+	// have LookPath set, which are included in the graph as dashed nodes.
+	Env *Env
+}
+
+// WriteDOT writes the command tree rooted at root to w, as a Graphviz digraph.
+// Each command is a node labeled with its name and short description, with an
+// edge from each command to each of its children.  The node IDs are the dashed
+// command paths, e.g. "root-child", so the output is stable.
+func WriteDOT(w io.Writer, root *Command, opts DOTOptions) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph %s {\n", dotQuote(root.Name))
+	fmt.Fprintln(bw, "  node [shape=box];")
+	writeDOTNode(bw, []*Command{root}, opts)
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// writeDOTNode writes the node for the last command in path, and recursively
+// its children, via DFS in the same order as usageAll.
+func writeDOTNode(w io.Writer, path []*Command, opts DOTOptions) {
+	cmd := path[len(path)-1]
+	id := dotID(path)
+	fmt.Fprintf(w, "  %s [label=%s];\n", dotQuote(id), dotQuote(cmd.Name+"\n"+strings.TrimSpace(cmd.Short)))
+	for _, child := range visibleChildren(cmd) {
+		fmt.Fprintf(w, "  %s -> %s;\n", dotQuote(id), dotQuote(dotID(append(path, child))))
+		writeDOTNode(w, append(path, child), opts)
+	}
+	if cmd.LookPath && opts.Env != nil {
+		cmdPrefix := cmd.Name + "-"
+		subCmds, _ := opts.Env.lookPathPrefix(cmd.LookPathDirs, cmdPrefix, cmd.subNames(cmdPrefix))
+		for _, subCmd := range subCmds {
+			subName := strings.TrimPrefix(filepath.Base(subCmd), cmdPrefix)
+			subID := id + "-" + subName
+			fmt.Fprintf(w, "  %s [label=%s, style=dashed];\n", dotQuote(subID), dotQuote(subName))
+			fmt.Fprintf(w, "  %s -> %s [style=dashed];\n", dotQuote(id), dotQuote(subID))
+		}
+	}
+	if opts.Topics {
+		for _, topic := range cmd.Topics {
+			topicID := id + "-" + topic.Name
+			fmt.Fprintf(w, "  %s [label=%s, shape=note];\n", dotQuote(topicID), dotQuote(topic.Name+"\n"+strings.TrimSpace(topic.Short)))
+			fmt.Fprintf(w, "  %s -> %s;\n", dotQuote(id), dotQuote(topicID))
+		}
+	}
+}
+
+// dotID returns the node ID of the last command in path.
+func dotID(path []*Command) string {
+	var names []string
+	for _, cmd := range path {
+		names = append(names, cmd.Name)
+	}
+	return strings.Join(names, "-")
+}
+
+// dotQuote returns s as a quoted DOT string.
+func dotQuote(s string) string {
+	s = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+	return `"` + s + `"`
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteDOT(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cmdline-dot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "root-ext"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	leaf := &Command{
+		Name:   "leaf",
+		Short:  `Leaf with "quotes"`,
+		Long:   "Leaf.",
+		Runner: RunnerFunc(runHello),
+	}
+	child := &Command{
+		Name:     "child",
+		Short:    "Child",
+		Long:     "Child.",
+		Children: []*Command{leaf},
+		Topics:   []Topic{{Name: "topic", Short: "Topic", Long: "Topic."}},
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "Root",
+		Long:     "Root.",
+		Children: []*Command{child},
+		LookPath: true,
+	}
+	tests := []struct {
+		opts DOTOptions
+		want string
+	}{
+		{DOTOptions{}, `digraph "root" {
+  node [shape=box];
+  "root" [label="root\nRoot"];
+  "root" -> "root-child";
+  "root-child" [label="child\nChild"];
+  "root-child" -> "root-child-leaf";
+  "root-child-leaf" [label="leaf\nLeaf with \"quotes\""];
+}
+`},
+		{DOTOptions{Topics: true, Env: &Env{Vars: map[string]string{"PATH": tmpDir}}}, `digraph "root" {
+  node [shape=box];
+  "root" [label="root\nRoot"];
+  "root" -> "root-child";
+  "root-child" [label="child\nChild"];
+  "root-child" -> "root-child-leaf";
+  "root-child-leaf" [label="leaf\nLeaf with \"quotes\""];
+  "root-child-topic" [label="topic\nTopic", shape=note];
+  "root-child" -> "root-child-topic";
+  "root-ext" [label="ext", style=dashed];
+  "root" -> "root-ext" [style=dashed];
+}
+`},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := WriteDOT(&buf, root, test.opts); err != nil {
+			t.Errorf("%+v: unexpected error: %v", test.opts, err)
+		}
+		if got, want := buf.String(), test.want; got != want {
+			t.Errorf("%+v: got\n%s\nwant\n%s", test.opts, got, want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EnumFlag is a flag.Value that only accepts one of a fixed set of options.
+//
+//   level := cmdline.NewEnumFlag("info", "debug", "info", "error")
+//   cmd.Flags.Var(level, "level", "Log level; one of "+strings.Join(level.Options(), ", "))
+type EnumFlag struct {
+	value   string
+	options []string
+}
+
+// NewEnumFlag returns an EnumFlag with the given default value and options.
+func NewEnumFlag(value string, options ...string) *EnumFlag {
+	return &EnumFlag{value: value, options: options}
+}
+
+// String implements the flag.Value interface method.
+func (f *EnumFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+// Set implements the flag.Value interface method.
+func (f *EnumFlag) Set(value string) error {
+	for _, option := range f.options {
+		if value == option {
+			f.value = value
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value %q, must be one of %s", value, strings.Join(f.options, ", "))
+}
+
+// Get implements the flag.Getter interface method.
+func (f *EnumFlag) Get() interface{} {
+	return f.value
+}
+
+// Options returns the options accepted by Set.
+func (f *EnumFlag) Options() []string {
+	return f.options
+}
+
+// enumOptions is implemented by flag.Value types that only accept a fixed set
+// of options, like EnumFlag and OutputFormat.
+type enumOptions interface {
+	Options() []string
+}
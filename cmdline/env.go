@@ -5,10 +5,17 @@
 package cmdline
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 
 	"v.io/x/lib/envvar"
 	"v.io/x/lib/lookpath"
@@ -24,6 +31,8 @@ func EnvFromOS() *Env {
 		Stderr: os.Stderr,
 		Vars:   envvar.SliceToMap(os.Environ()),
 		Timer:  timing.NewTimer("root"),
+
+		ErrorFormat: os.Getenv("CMDLINE_ERROR_FORMAT"),
 	}
 }
 
@@ -40,17 +49,99 @@ type Env struct {
 	// Usage is a function that prints usage information to w.  Typically set by
 	// calls to Main or Parse to print usage of the leaf command.
 	Usage func(env *Env, w io.Writer)
+
+	// ErrorFormat is the format used to report errors to Stderr.  If "json",
+	// each error is written as a single JSON object; otherwise errors are
+	// written as human-readable text.  EnvFromOS sets it from the
+	// CMDLINE_ERROR_FORMAT environment variable; the -error-format flag
+	// registered via RegisterErrorFormatFlag takes precedence.
+	ErrorFormat string
+
+	// Context is the context for running the command.  When it's cancelled,
+	// e.g. on timeout, or by Main on SIGINT or SIGTERM, external children run
+	// via the env are killed, including those run to capture their help.  Main
+	// waits for the children to exit before exiting itself.  If nil,
+	// context.Background is used.
+	Context context.Context
+
+	// cmdPath is the path of the command most recently parsed, used when
+	// reporting errors.
+	cmdPath string
+
+	// flagSources records where the value of each flag came from, for the flags
+	// that were set from the command line or environment by the most recent
+	// Parse, keyed by flag name.
+	flagSources map[string]flagSource
+
+	// args holds the positional args declared via Command.Args, as parsed by
+	// the most recent Parse, keyed by arg name.
+	args map[string]interface{}
+
+	// parsedFlags holds the ParsedFlags of the command most recently parsed,
+	// passed to RunnerFuncFlags.
+	parsedFlags *flag.FlagSet
+
+	// notFirstCall records that CMDLINE_FIRST_CALL was set when parsing; see
+	// FirstCall.
+	notFirstCall bool
+
+	// parsedWidth records the width set via CMDLINE_WIDTH when parsing, or 0
+	// if it wasn't set; see Width.
+	parsedWidth int
+
+	// exitCodeFunc is the ExitCodeFunc of the root command most recently
+	// parsed, used to determine exit codes for errors.
+	exitCodeFunc func(error) int
+
+	// shutdown holds the functions registered via OnShutdown.
+	shutdownMu sync.Mutex
+	shutdown   []func()
+
+	// notifySignals, if non-nil, installs the signal handler of Main; it's
+	// called when cleanup is needed on SIGINT or SIGTERM.
+	notifySignals func()
 }
 
+// clone returns a copy of e, which may be modified without affecting e; the Vars
+// and flag sources are copied, and the copy has the same FirstCall and Width.
+// The Timer is shared, and the functions registered via OnShutdown aren't
+// copied.
 func (e *Env) clone() *Env {
+	var sources map[string]flagSource
+	if e.flagSources != nil {
+		sources = make(map[string]flagSource, len(e.flagSources))
+		for name, source := range e.flagSources {
+			sources[name] = source
+		}
+	}
 	return &Env{
-		Stdin:  e.Stdin,
-		Stdout: e.Stdout,
-		Stderr: e.Stderr,
-		Vars:   envvar.CopyMap(e.Vars),
-		Usage:  e.Usage,
-		Timer:  e.Timer, // use the same timer for all operations
+		Stdin:       e.Stdin,
+		Stdout:      e.Stdout,
+		Stderr:      e.Stderr,
+		Vars:        envvar.CopyMap(e.Vars),
+		Usage:       e.Usage,
+		Timer:       e.Timer, // use the same timer for all operations
+		ErrorFormat: e.ErrorFormat,
+		Context:     e.Context,
+		cmdPath:     e.cmdPath,
+		flagSources: sources,
+		args:        e.args, // never modified after parsing
+		parsedFlags: e.parsedFlags,
+
+		notFirstCall: e.notFirstCall,
+		parsedWidth:  e.parsedWidth,
+		exitCodeFunc: e.exitCodeFunc,
+
+		notifySignals: e.notifySignals,
+	}
+}
+
+// ctx returns e.Context, or context.Background if it's nil.
+func (e *Env) ctx() context.Context {
+	if e.Context == nil {
+		return context.Background()
 	}
+	return e.Context
 }
 
 // UsageErrorf prints the error message represented by the printf-style format
@@ -74,47 +165,230 @@ func (e *Env) TimerPop() {
 	}
 }
 
+// OnShutdown registers fn to be called when the command finishes.  Registered
+// functions are called in LIFO order by ParseAndRun after the Runner returns,
+// regardless of whether it returned an error.  When running via Main, they are
+// also called if the program is interrupted by SIGINT or SIGTERM; the Context
+// is cancelled, and the functions are called after the Runner returns, or after
+// a timeout if it doesn't return, before the program exits.
+//
+// Each registered function is called at most once.
+func (e *Env) OnShutdown(fn func()) {
+	e.shutdownMu.Lock()
+	e.shutdown = append(e.shutdown, fn)
+	e.shutdownMu.Unlock()
+	if e.notifySignals != nil {
+		e.notifySignals()
+	}
+}
+
+// runShutdown calls the functions registered via OnShutdown in LIFO order, and
+// clears the registered functions.
+func (e *Env) runShutdown() {
+	e.shutdownMu.Lock()
+	fns := e.shutdown
+	e.shutdown = nil
+	e.shutdownMu.Unlock()
+	for i := len(fns) - 1; i >= 0; i-- {
+		fns[i]()
+	}
+}
+
 // LookPath returns the absolute path of the executable with the given name,
 // based on the directories in PATH.  Calls lookpath.Look.
 func (e *Env) LookPath(name string) (string, error) {
-	e.TimerPush("lookpath " + name)
-	defer e.TimerPop()
-	return lookpath.Look(e.Vars, name)
+	return e.lookPath(nil, name)
 }
 
 // LookPathPrefix returns the absolute paths of all executables with the given
 // name prefix, based on the directories in PATH.  Calls lookpath.LookPrefix.
 func (e *Env) LookPathPrefix(prefix string, names map[string]bool) ([]string, error) {
+	return e.lookPathPrefix(nil, prefix, names)
+}
+
+// lookPath is like LookPath, but also consults dirs, before PATH.
+func (e *Env) lookPath(dirs []string, name string) (string, error) {
+	e.TimerPush("lookpath " + name)
+	defer e.TimerPop()
+	return lookpath.LookFunc(e.lookPathVars(dirs), name, e.lookPathReport())
+}
+
+// lookPathPrefix is like LookPathPrefix, but also consults dirs, before PATH.
+func (e *Env) lookPathPrefix(dirs []string, prefix string, names map[string]bool) ([]string, error) {
 	e.TimerPush("lookpathprefix " + prefix)
 	defer e.TimerPop()
-	return lookpath.LookPrefix(e.Vars, prefix, names)
+	return lookpath.LookPrefixFunc(e.lookPathVars(dirs), prefix, names, e.lookPathReport())
+}
+
+// lookPathReport returns a function that logs each candidate considered by
+// LookPath and LookPathPrefix to Stderr, along with the reason it was skipped,
+// if the CMDLINE_DEBUG_LOOKPATH environment variable is set to a non-empty
+// value.  Otherwise returns nil, and nothing is logged.  This helps diagnose
+// why an external child isn't found, e.g. because it isn't executable.
+func (e *Env) lookPathReport() func(string, error) {
+	if e.Vars["CMDLINE_DEBUG_LOOKPATH"] == "" || e.Stderr == nil {
+		return nil
+	}
+	return func(file string, err error) {
+		if err != nil {
+			fmt.Fprintf(e.Stderr, "lookpath: skipped %s: %v\n", file, err)
+		} else {
+			fmt.Fprintf(e.Stderr, "lookpath: found %s\n", file)
+		}
+	}
+}
+
+// lookPathVars returns e.Vars, with PATH set to dirs followed by the existing
+// PATH.  Each directory is only included once, at its first position.
+func (e *Env) lookPathVars(dirs []string) map[string]string {
+	if len(dirs) == 0 {
+		return e.Vars
+	}
+	var path []string
+	seen := make(map[string]bool)
+	for _, dir := range append(append([]string(nil), dirs...), filepath.SplitList(e.Vars["PATH"])...) {
+		if dir == "" || seen[filepath.Clean(dir)] {
+			continue
+		}
+		seen[filepath.Clean(dir)] = true
+		path = append(path, dir)
+	}
+	vars := envvar.CopyMap(e.Vars)
+	vars["PATH"] = strings.Join(path, string(filepath.ListSeparator))
+	return vars
 }
 
 func usageErrorf(env *Env, usage func(*Env, io.Writer), format string, args ...interface{}) error {
-	fmt.Fprint(env.Stderr, "ERROR: ")
-	fmt.Fprintf(env.Stderr, format, args...)
-	fmt.Fprint(env.Stderr, "\n\n")
-	if usage != nil {
-		usage(env, env.Stderr)
+	if env.ErrorFormat == errorFormatJSON {
+		env.writeJSONError(fmt.Sprintf(format, args...), true)
+		return ErrUsage
+	}
+	// With HelpOptions.Atomic the whole message, including the usage, is
+	// rendered into a buffer and written in a single call.
+	w, buffer := env.Stderr, (*bytes.Buffer)(nil)
+	if helpOptions.Atomic {
+		buffer = new(bytes.Buffer)
+		w = buffer
+	}
+	fmt.Fprint(w, env.errorLabel()+" ")
+	fmt.Fprintf(w, format, args...)
+	if helpOptions.SuppressUsageOnError && env.cmdPath != "" {
+		fmt.Fprintf(w, "\n"+helpOptions.Messages.UsageReminder+"\n", env.cmdPath+" -help")
 	} else {
-		fmt.Fprint(env.Stderr, "usage error\n")
+		fmt.Fprint(w, "\n\n")
+		if usage != nil {
+			usage(env, w)
+		} else {
+			fmt.Fprint(w, "usage error\n")
+		}
+	}
+	if buffer != nil {
+		env.Stderr.Write(buffer.Bytes())
 	}
 	return ErrUsage
 }
 
+const (
+	errorFormatName = "error-format"
+	errorFormatText = "text"
+	errorFormatJSON = "json"
+)
+
+// errorFormat holds the value of the -error-format global flag registered via
+// RegisterErrorFormatFlag, or nil if it isn't registered.
+var errorFormat *EnumFlag
+
+// RegisterErrorFormatFlag registers the -error-format global flag (see
+// SetGlobalFlags), which sets Env.ErrorFormat to either "text" or "json".  The
+// flag is bound to the CMDLINE_ERROR_FORMAT environment variable via BindEnv;
+// if neither is set, Env.ErrorFormat is left unchanged.
+func RegisterErrorFormatFlag() {
+	errorFormat = NewEnumFlag(errorFormatText, errorFormatText, errorFormatJSON)
+	commandLine().Var(errorFormat, errorFormatName, `The format used to report errors; either "text" or "json".`)
+	BindEnv(commandLine(), errorFormatName, "CMDLINE_ERROR_FORMAT")
+}
+
+// applyErrorFormat sets env.ErrorFormat from the -error-format flag, if it's
+// registered and was set in flags, or from the environment.  It's called even
+// if flags failed to parse, so that the error is reported in the requested
+// format.
+func applyErrorFormat(env *Env, flags *flag.FlagSet) {
+	if errorFormat == nil || flags.Lookup(errorFormatName) == nil {
+		return
+	}
+	set := env.flagSources[errorFormatName] == flagSourceEnv
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == errorFormatName {
+			set = true
+		}
+	})
+	if set {
+		env.ErrorFormat = errorFormat.String()
+	}
+}
+
+// jsonError is the representation of errors reported in the JSON error format.
+type jsonError struct {
+	Error      string `json:"error"`
+	Command    string `json:"command,omitempty"`
+	UsageError bool   `json:"usageError"`
+}
+
+// writeJSONError writes msg to e.Stderr as a single line JSON object.
+func (e *Env) writeJSONError(msg string, usageError bool) {
+	data, err := json.Marshal(jsonError{msg, e.cmdPath, usageError})
+	if err != nil {
+		// This can't happen, since jsonError only contains strings and bools.
+		panic(err)
+	}
+	fmt.Fprintf(e.Stderr, "%s\n", data)
+}
+
+// NewProgress returns a progress bar for total units of work, which is drawn on
+// e.Stderr if it is a terminal, and is silent otherwise.  The bar fits the same
+// width as the help output.
+func (e *Env) NewProgress(total int64) *textutil.Progress {
+	if f, ok := e.Stderr.(*os.File); ok && textutil.IsTerminal(f.Fd()) {
+		return textutil.NewProgress(f, total, e.Width())
+	}
+	return textutil.NewProgress(nil, total, 0)
+}
+
 // defaultWidth is a reasonable default for the output width in runes.
 const defaultWidth = 80
 
-func (e *Env) width() int {
-	if width, err := strconv.Atoi(e.Vars["CMDLINE_WIDTH"]); err == nil && width != 0 {
+// Width returns the target width in runes of the output, resolved the same way
+// as for help; Runners that print their own tables may use it to match the
+// help.  The width is set via the CMDLINE_WIDTH environment variable if it's a
+// non-zero integer, otherwise it's the width of the terminal, or 80 if that
+// can't be determined.  Returns a negative value if the width is unlimited,
+// e.g. if CMDLINE_WIDTH is -1.
+//
+// The -width flag of the help command only applies to help.  Parse removes
+// CMDLINE_WIDTH from Vars before returning a user-specified runner, but Width
+// still reports the value that was set when parsing.
+func (e *Env) Width() int {
+	if width := e.varsWidth(); width != 0 {
 		return width
 	}
+	if e.parsedWidth != 0 {
+		return e.parsedWidth
+	}
 	if _, width, err := textutil.TerminalSize(); err == nil && width != 0 {
 		return width
 	}
 	return defaultWidth
 }
 
+// varsWidth returns the width set via the CMDLINE_WIDTH environment variable,
+// or 0 if it isn't set.
+func (e *Env) varsWidth() int {
+	if width, err := strconv.Atoi(e.Vars["CMDLINE_WIDTH"]); err == nil {
+		return width
+	}
+	return 0
+}
+
 func (e *Env) style() style {
 	style := styleCompact
 	style.Set(e.Vars["CMDLINE_STYLE"])
@@ -125,8 +399,18 @@ func (e *Env) prefix() string {
 	return e.Vars["CMDLINE_PREFIX"]
 }
 
-func (e *Env) firstCall() bool {
-	return e.Vars["CMDLINE_FIRST_CALL"] == ""
+// FirstCall returns true iff the program is the first in a chain of calls to
+// programs that use cmdline, i.e. it isn't being run as an external child by a
+// parent program to produce a composite help tree.  The parent signals this by
+// setting the CMDLINE_FIRST_CALL environment variable to a non-empty value,
+// e.g. "false"; tools that build composite help trees from several binaries
+// may do the same.  If FirstCall returns false, the help omits sections that
+// the parent already shows, like the global flags and the help command.
+//
+// Parse removes CMDLINE_FIRST_CALL from Vars before returning a user-specified
+// runner, but FirstCall still reports the value that was set when parsing.
+func (e *Env) FirstCall() bool {
+	return !e.notFirstCall && e.Vars["CMDLINE_FIRST_CALL"] == ""
 }
 
 // style describes the formatting style for usage descriptions.
@@ -136,9 +420,17 @@ const (
 	styleCompact   style = iota // Default style, good for compact cmdline output.
 	styleFull                   // Similar to compact but shows all global flags.
 	styleGoDoc                  // Good for godoc processing.
-	styleShortOnly              // Only output short description.
+	styleShortOnly              // Only output the short description.
+	styleReST                   // Good for reStructuredText processing.
+	styleJSON                   // Only output a JSON description of the command.
 )
 
+// isDocStyle returns true iff s is used for generating documentation, rather
+// than cmdline output.
+func isDocStyle(s style) bool {
+	return s == styleGoDoc || s == styleReST
+}
+
 func (s *style) String() string {
 	switch *s {
 	case styleCompact:
@@ -148,7 +440,13 @@ func (s *style) String() string {
 	case styleGoDoc:
 		return "godoc"
 	case styleShortOnly:
+		// The original name is understood by external children built with older
+		// versions of this package.
 		return "shortonly"
+	case styleReST:
+		return "rst"
+	case styleJSON:
+		return "json"
 	default:
 		panic(fmt.Errorf("unhandled style %d", *s))
 	}
@@ -163,8 +461,12 @@ func (s *style) Set(value string) error {
 		*s = styleFull
 	case "godoc":
 		*s = styleGoDoc
-	case "shortonly":
+	case "short", "shortonly":
 		*s = styleShortOnly
+	case "rst":
+		*s = styleReST
+	case "json":
+		*s = styleJSON
 	default:
 		return fmt.Errorf("unknown style %q", value)
 	}
@@ -5,9 +5,15 @@ package cmdline
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"io"
 	"os"
+	"reflect"
+	"strconv"
 	"testing"
+
+	"v.io/x/lib/envvar"
 )
 
 func writeFunc(s string) func(*Env, io.Writer) {
@@ -40,6 +46,27 @@ func TestEnvUsageErrorf(t *testing.T) {
 	}
 }
 
+func TestEnvUsageErrorfSuppressUsage(t *testing.T) {
+	defer SetHelpOptions(HelpOptions{})
+	SetHelpOptions(HelpOptions{SuppressUsageOnError: true})
+	var buf bytes.Buffer
+	env := &Env{Stderr: &buf, Usage: writeFunc("FooBar"), cmdPath: "net status"}
+	if got, want := env.UsageErrorf("bad %v", "arg"), ErrUsage; got != want {
+		t.Errorf("got error %v, want %v", got, want)
+	}
+	if got, want := buf.String(), "ERROR: bad arg\nRun \"net status -help\" for usage.\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Runner errors are reported the same way regardless of the option.
+	buf.Reset()
+	if got, want := exitCode(env, errors.New("oops")), 1; got != want {
+		t.Errorf("got exit code %v, want %v", got, want)
+	}
+	if got, want := buf.String(), "ERROR: oops\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
 func TestEnvWidth(t *testing.T) {
 	tests := []struct {
 		value string
@@ -54,19 +81,50 @@ func TestEnvWidth(t *testing.T) {
 	for _, test := range tests {
 		// Test using a fake environment.
 		env := &Env{Vars: map[string]string{"CMDLINE_WIDTH": test.value}}
-		if got, want := env.width(), test.want; got != want {
+		if got, want := env.Width(), test.want; got != want {
 			t.Errorf("%q got %v, want %v", test.value, got, want)
 		}
 		// Test using the OS environment.
 		if err := os.Setenv("CMDLINE_WIDTH", test.value); err != nil {
 			t.Errorf("Setenv(%q) failed: %v", test.value, err)
-		} else if got, want := EnvFromOS().width(), test.want; got != want {
+		} else if got, want := EnvFromOS().Width(), test.want; got != want {
 			t.Errorf("%q got %v, want %v", test.value, got, want)
 		}
 	}
 	os.Unsetenv("CMDLINE_WIDTH")
 }
 
+func TestEnvWidthRunner(t *testing.T) {
+	var got int
+	root := &Command{
+		Name:  "root",
+		Short: "root",
+		Long:  "root.",
+		Runner: RunnerFunc(func(env *Env, _ []string) error {
+			got = env.Width()
+			return nil
+		}),
+	}
+	for _, value := range []string{"123", "-1"} {
+		got = 0
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{"CMDLINE_WIDTH": value}}
+		if err := ParseAndRun(root, env, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// The runner sees the same width, although the envvar has been cleared.
+		if _, ok := env.Vars["CMDLINE_WIDTH"]; ok {
+			t.Errorf("%q: CMDLINE_WIDTH wasn't cleared", value)
+		}
+		if want, _ := strconv.Atoi(value); got != want {
+			t.Errorf("%q: got width %v in runner, want %v", value, got, want)
+		}
+		if got, want := env.clone().Width(), got; got != want {
+			t.Errorf("%q: got width %v from clone, want %v", value, got, want)
+		}
+	}
+}
+
 func TestEnvStyle(t *testing.T) {
 	tests := []struct {
 		value string
@@ -75,6 +133,9 @@ func TestEnvStyle(t *testing.T) {
 		{"compact", styleCompact},
 		{"full", styleFull},
 		{"godoc", styleGoDoc},
+		{"short", styleShortOnly},
+		{"shortonly", styleShortOnly},
+		{"json", styleJSON},
 		{"", styleCompact},
 		{"abc", styleCompact},
 		{"foobar", styleCompact},
@@ -94,3 +155,199 @@ func TestEnvStyle(t *testing.T) {
 	}
 	os.Unsetenv("CMDLINE_STYLE")
 }
+
+func TestEnvErrorFormatJSON(t *testing.T) {
+	var buf bytes.Buffer
+	env := &Env{Stderr: &buf, Usage: writeFunc("FooBar"), ErrorFormat: "json", cmdPath: "net status"}
+	if got, want := env.UsageErrorf("bad %v", "arg"), ErrUsage; got != want {
+		t.Errorf("got error %v, want %v", got, want)
+	}
+	if got, want := buf.String(), `{"error":"bad arg","command":"net status","usageError":true}`+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	buf.Reset()
+	if got, want := exitCode(env, errors.New("oops")), 1; got != want {
+		t.Errorf("got exit code %v, want %v", got, want)
+	}
+	if got, want := buf.String(), `{"error":"oops","command":"net status","usageError":false}`+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	buf.Reset()
+	if got, want := exitCode(env, ErrUsage), 2; got != want {
+		t.Errorf("got exit code %v, want %v", got, want)
+	}
+	if got, want := buf.String(), ""; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestErrorFormatFlag(t *testing.T) {
+	oldGlobalFlags, oldGlobalFlagSet, oldErrorFormat := globalFlags, globalFlagSet, errorFormat
+	defer func() { globalFlags, globalFlagSet, errorFormat = oldGlobalFlags, oldGlobalFlagSet, oldErrorFormat }()
+	SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	RegisterErrorFormatFlag()
+	root := &Command{
+		Name:   "root",
+		Short:  "Short description of root",
+		Long:   "Long description of root.",
+		Runner: RunnerFunc(func(*Env, []string) error { return errors.New("oops") }),
+	}
+	tests := []struct {
+		args []string
+		vars map[string]string
+		want string
+	}{
+		{nil, nil, "ERROR: oops\n"},
+		{[]string{"-error-format=text"}, nil, "ERROR: oops\n"},
+		{[]string{"-error-format=json"}, nil, `{"error":"oops","command":"root","usageError":false}` + "\n"},
+		{nil, map[string]string{"CMDLINE_ERROR_FORMAT": "json"}, `{"error":"oops","command":"root","usageError":false}` + "\n"},
+		// The flag takes precedence over the environment.
+		{[]string{"-error-format=text"}, map[string]string{"CMDLINE_ERROR_FORMAT": "json"}, "ERROR: oops\n"},
+		// Flag errors after -error-format are reported in the requested format.
+		{[]string{"-error-format=json", "-bad"}, nil, `{"error":"root: flag provided but not defined: -bad","command":"root","usageError":true}` + "\n"},
+	}
+	for _, test := range tests {
+		var stderr bytes.Buffer
+		env := &Env{Stderr: &stderr, Vars: test.vars}
+		exitCode(env, ParseAndRun(root, env, test.args))
+		if got, want := stderr.String(), test.want; got != want {
+			t.Errorf("%q %v: got %q, want %q", test.args, test.vars, got, want)
+		}
+		errorFormat.Set(errorFormatText)
+	}
+}
+
+func TestExitCodeFunc(t *testing.T) {
+	errConfig := errors.New("bad config")
+	root := &Command{
+		Name:   "root",
+		Short:  "Short description of root",
+		Long:   "Long description of root.",
+		Runner: RunnerFunc(func(*Env, []string) error { return errConfig }),
+		ExitCodeFunc: func(err error) int {
+			switch err {
+			case errConfig:
+				return 78 // EX_CONFIG
+			default:
+				return 0
+			}
+		},
+	}
+	var buf bytes.Buffer
+	env := &Env{Stdout: &buf, Stderr: &buf}
+	res, err := ParseCommand(root, env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = res.Runner.Run(env, res.Args)
+	if got, want := exitCode(env, err), 78; got != want {
+		t.Errorf("got exit code %v, want %v", got, want)
+	}
+	if got, want := buf.String(), "ERROR: bad config\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Non-positive codes are replaced by 1, and ErrExitCode is left alone.
+	if got, want := exitCode(env, errors.New("oops")), 1; got != want {
+		t.Errorf("got exit code %v, want %v", got, want)
+	}
+	if got, want := exitCode(env, ErrUsage), 2; got != want {
+		t.Errorf("got exit code %v, want %v", got, want)
+	}
+	if got, want := exitCode(env, ErrExitCode(3)), 3; got != want {
+		t.Errorf("got exit code %v, want %v", got, want)
+	}
+}
+
+func TestEnvClone(t *testing.T) {
+	env := &Env{
+		Vars:        map[string]string{"A": "a"},
+		flagSources: map[string]flagSource{"x": flagSourceFlag},
+	}
+	cp := env.clone()
+	cp.Vars["A"] = "changed"
+	cp.Vars["CMDLINE_STYLE"] = "godoc"
+	cp.flagSources["x"] = flagSourceEnv
+	cp.flagSources["y"] = flagSourceFlag
+	if got, want := env.Vars, map[string]string{"A": "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got vars %v, want %v", got, want)
+	}
+	if got, want := env.flagSources, map[string]flagSource{"x": flagSourceFlag}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got flag sources %v, want %v", got, want)
+	}
+}
+
+func TestEnvFirstCall(t *testing.T) {
+	var got []bool
+	root := &Command{
+		Name:  "root",
+		Short: "root",
+		Long:  "root.",
+		Runner: RunnerFunc(func(env *Env, _ []string) error {
+			got = append(got, env.FirstCall(), env.clone().FirstCall())
+			return nil
+		}),
+	}
+	for _, test := range []struct {
+		vars map[string]string
+		want bool
+	}{
+		{nil, true},
+		{map[string]string{"CMDLINE_FIRST_CALL": "false"}, false},
+	} {
+		got = nil
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(test.vars)}
+		if got, want := env.FirstCall(), test.want; got != want {
+			t.Errorf("%v: got FirstCall %v before parse, want %v", test.vars, got, want)
+		}
+		if err := ParseAndRun(root, env, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		// The runner sees the same value, although the envvar has been cleared.
+		if _, ok := env.Vars["CMDLINE_FIRST_CALL"]; ok {
+			t.Errorf("%v: CMDLINE_FIRST_CALL wasn't cleared", test.vars)
+		}
+		if want := []bool{test.want, test.want}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got FirstCall %v in runner, want %v", test.vars, got, want)
+		}
+	}
+}
+
+func TestEnvNewProgress(t *testing.T) {
+	// The progress bar is silent when Stderr isn't a terminal.
+	var buf bytes.Buffer
+	env := &Env{Stderr: &buf}
+	p := env.NewProgress(10)
+	p.Add(5)
+	p.Done()
+	if got, want := buf.String(), ""; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestEnvOnShutdown(t *testing.T) {
+	var got []string
+	root := &Command{
+		Name:  "root",
+		Short: "root",
+		Long:  "root.",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			env.OnShutdown(func() { got = append(got, "first") })
+			env.OnShutdown(func() { got = append(got, "second") })
+			return errors.New("oops")
+		}),
+	}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{}}
+	if err := ParseAndRun(root, env, nil); err == nil {
+		t.Errorf("expected an error")
+	}
+	if want := []string{"second", "first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The functions are only called once.
+	env.runShutdown()
+	if got, want := len(got), 2; got != want {
+		t.Errorf("got %d calls, want %d", got, want)
+	}
+}
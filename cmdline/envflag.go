@@ -0,0 +1,138 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// flagEnvVars holds the environment variables bound via BindEnv, keyed by the
+// FlagSet and then by the flag name.
+var flagEnvVars = make(map[*flag.FlagSet]map[string]string)
+
+// BindEnv binds the flag with the given name defined in fs to the environment
+// variable envVar.  The flag may be defined in the Flags of a Command, or in
+// flag.CommandLine for global flags.
+//
+// If the flag isn't set on the command line, and envVar is set to a non-empty
+// value in env.Vars, the flag is set to the value of envVar when the flags are
+// parsed.  The flag is not considered to be set on the command line, so it is
+// not passed to external children, which inherit the environment anyway.  The
+// help for the flag mentions envVar.
+func BindEnv(fs *flag.FlagSet, name, envVar string) {
+	vars := flagEnvVars[fs]
+	if vars == nil {
+		vars = make(map[string]string)
+		flagEnvVars[fs] = vars
+	}
+	vars[name] = envVar
+}
+
+// EnvDefault defines a string flag with the given name and usage in fs, and
+// returns the address of its value.  The default value of the flag is the value
+// of the environment variable envVar when the flag is defined, or fallback if
+// envVar is empty.  The DefValue of the flag is the literal "$envVar", so that
+// the help in the godoc style shows e.g. "-dir=$HOME", rather than the home
+// directory of whoever generated the docs, while regular help shows the actual
+// default.
+//
+// Unlike BindEnv, envVar is read from the OS environment when the flag is
+// defined, and only determines the default; the flag isn't considered to be
+// set from the environment.
+func EnvDefault(fs *flag.FlagSet, name, envVar, fallback, usage string) *string {
+	v := &envDefaultValue{def: os.Getenv(envVar)}
+	if v.def == "" {
+		v.def = fallback
+	}
+	v.value = v.def
+	fs.Var(v, name, usage)
+	fs.Lookup(name).DefValue = "$" + envVar
+	return &v.value
+}
+
+// envDefaultValue is the flag.Value of the flags defined via EnvDefault, which
+// records the actual default, since the DefValue of the flag is a placeholder.
+type envDefaultValue struct {
+	value, def string
+}
+
+func (v *envDefaultValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.value
+}
+
+func (v *envDefaultValue) Set(value string) error {
+	v.value = value
+	return nil
+}
+
+func (v *envDefaultValue) Get() interface{} {
+	return v.value
+}
+
+// defaultFlagValue returns the string form of the default value of f.
+func defaultFlagValue(f *flag.Flag) string {
+	if v, ok := f.Value.(*envDefaultValue); ok {
+		return v.def
+	}
+	return f.DefValue
+}
+
+// flagSource describes where the value of a flag came from.
+type flagSource string
+
+const (
+	flagSourceDefault flagSource = "default"
+	flagSourceEnv     flagSource = "env"
+	flagSourceFlag    flagSource = "flag"
+	flagSourceFile    flagSource = "file"
+)
+
+// flagEnvVar returns the environment variable bound to the flag with the given
+// name, for the last command in path, or "" if the flag isn't bound.
+func flagEnvVar(path []*Command, name string) string {
+	if len(flagEnvVars) == 0 {
+		return ""
+	}
+	for _, fs := range validatorFlagSets(path) {
+		if envVar, ok := flagEnvVars[fs][name]; ok {
+			return envVar
+		}
+	}
+	return ""
+}
+
+// applyEnvFlags sets each flag in flags that is bound to a non-empty
+// environment variable, unless the flag already has a source from parsing an
+// earlier command in path.  The sources are recorded in env.
+func applyEnvFlags(path []*Command, env *Env, flags *flag.FlagSet) error {
+	if len(flagEnvVars) == 0 {
+		return nil
+	}
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || env.flagSources[f.Name] != "" {
+			return
+		}
+		envVar := flagEnvVar(path, f.Name)
+		if envVar == "" {
+			return
+		}
+		value := env.Vars[envVar]
+		if value == "" {
+			return
+		}
+		if e := f.Value.Set(value); e != nil {
+			err = fmt.Errorf("invalid value %q for flag -%s from $%s: %v", value, f.Name, envVar, e)
+			return
+		}
+		env.flagSources[f.Name] = flagSourceEnv
+	})
+	return err
+}
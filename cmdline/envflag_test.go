@@ -0,0 +1,138 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
+
+func TestBindEnv(t *testing.T) {
+	var port int
+	child := &Command{
+		Name:  "child",
+		Short: "child",
+		Long:  "child.",
+		Runner: RunnerFunc(func(env *Env, _ []string) error {
+			fmt.Fprintln(env.Stdout, port)
+			return nil
+		}),
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "root",
+		Long:     "root.",
+		Children: []*Command{child},
+	}
+	root.Flags.IntVar(&port, "port", 80, "Port to listen on.")
+	BindEnv(&root.Flags, "port", "ROOT_PORT")
+	defer delete(flagEnvVars, &root.Flags)
+
+	tests := []struct {
+		args       []string
+		port       string
+		wantErr    error
+		wantStdout string
+	}{
+		{[]string{"child"}, "", nil, "80\n"},
+		{[]string{"child"}, "8080", nil, "8080\n"},
+		// The command line takes precedence over the environment.
+		{[]string{"-port=1", "child"}, "8080", nil, "1\n"},
+		{[]string{"child", "-port=2"}, "8080", nil, "2\n"},
+		{[]string{"child"}, "bad", ErrUsage, ""},
+	}
+	for _, test := range tests {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.MergeMaps(baseVars, map[string]string{"ROOT_PORT": test.port})}
+		if got, want := ParseAndRun(root, env, test.args), test.wantErr; got != want {
+			t.Errorf("%v %q: got error %v, want %v", test.args, test.port, got, want)
+		}
+		if got, want := stdout.String(), test.wantStdout; got != want {
+			t.Errorf("%v %q: got stdout %q, want %q", test.args, test.port, got, want)
+		}
+		if test.wantErr != nil {
+			if got, want := stderr.String(), `ERROR: root: invalid value "bad" for flag -port from $ROOT_PORT`; !strings.HasPrefix(got, want) {
+				t.Errorf("%v %q: got stderr %q, want prefix %q", test.args, test.port, got, want)
+			}
+		}
+		resetFlags(root)
+		// A failed Set may have changed the value, so reset it explicitly.
+		port = 80
+	}
+
+	// The help shows the environment variable, and where the value came from.
+	for _, test := range []struct {
+		style, port, want string
+	}{
+		{"full", "", " -port=80\n   Port to listen on. [env: ROOT_PORT, source: default]\n"},
+		{"full", "8080", " -port=8080\n   Port to listen on. [env: ROOT_PORT, source: env]\n"},
+		{"godoc", "8080", " -port=80\n   Port to listen on. [env: ROOT_PORT]\n"},
+	} {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		vars := map[string]string{"CMDLINE_STYLE": test.style, "ROOT_PORT": test.port}
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.MergeMaps(baseVars, vars)}
+		if err := ParseAndRun(root, env, []string{"help", "child"}); err != nil {
+			t.Errorf("%q %q: unexpected error: %v", test.style, test.port, err)
+		}
+		if got, want := stdout.String(), test.want; !strings.Contains(got, want) {
+			t.Errorf("%q %q: got help %q, want substring %q", test.style, test.port, got, want)
+		}
+		resetFlags(root)
+	}
+}
+
+func TestEnvDefault(t *testing.T) {
+	defer os.Unsetenv("CMDLINE_TEST_DIR")
+	for _, test := range []struct {
+		envValue, want string
+	}{
+		{"", "/tmp"},
+		{"/home/me", "/home/me"},
+	} {
+		os.Setenv("CMDLINE_TEST_DIR", test.envValue)
+		root := &Command{Name: "root", Short: "root", Long: "root.", Runner: RunnerFunc(runHello)}
+		dir := EnvDefault(&root.Flags, "dir", "CMDLINE_TEST_DIR", "/tmp", "The directory.")
+		if got := *dir; got != test.want {
+			t.Errorf("%q: got default %q, want %q", test.envValue, got, test.want)
+		}
+		// The godoc style shows the envvar, while other styles show the value.
+		for _, style := range []struct {
+			name, want string
+		}{
+			{"compact", " -dir=" + test.want + "\n"},
+			{"godoc", " -dir=$CMDLINE_TEST_DIR\n"},
+		} {
+			flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+			var stdout, stderr bytes.Buffer
+			vars := map[string]string{"CMDLINE_STYLE": style.name}
+			env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.MergeMaps(baseVars, vars)}
+			if err := ParseAndRun(root, env, []string{"-help"}); err != nil {
+				t.Errorf("%q %s: unexpected error: %v", test.envValue, style.name, err)
+			}
+			if got := stdout.String(); !strings.Contains(got, style.want) {
+				t.Errorf("%q %s: got help %q, want substring %q", test.envValue, style.name, got, style.want)
+			}
+		}
+		// Resetting the flags restores the actual default.
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, []string{"-dir=/other"}); err != nil {
+			t.Fatalf("%q: unexpected error: %v", test.envValue, err)
+		}
+		resetFlags(root)
+		if got := *dir; got != test.want {
+			t.Errorf("%q: got %q after reset, want %q", test.envValue, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const flagsFromName = "flags-from"
+
+// WithFlagsFrom registers the -flags-from global flag (see SetGlobalFlags),
+// which names a file of flags to apply to the command matched by the command
+// line, before it is run.  Unlike a config file, the flags are spliced into
+// the parse of that single command, and must each be defined for it, including
+// its inherited and global flags.  Flags set on the command line take
+// precedence over the file, and the file takes precedence over environment
+// variables bound via BindEnv.
+//
+// The file holds flags in the same form as the command line, e.g. "-n 3",
+// "-n=3" or "--verbose", and also accepts lines of the form "n=3".  Words are
+// split using shell-style quoting, and blank lines and lines starting with
+// "#" are ignored.  For example:
+//
+//   # Defaults for "tool deploy".
+//   -region us-east1
+//   --dry-run
+//   message="hello world"
+//
+// External children receive the -flags-from flag like other global flags, and
+// apply the file themselves if they also use WithFlagsFrom.
+func WithFlagsFrom(root *Command) {
+	root.flagsFrom = commandLine().String(flagsFromName, "", "Read additional flags for the command from the given file.")
+}
+
+// applyFlagsFile sets the flags listed in the -flags-from file on the flags of
+// the last command in path, skipping the flags in setFlags, which were set on
+// the command line.  Returns the flags that were set from the file.
+func applyFlagsFile(path []*Command, env *Env, setFlags map[string]string) (map[string]string, error) {
+	root, cmd := path[0], path[len(path)-1]
+	if root.flagsFrom == nil || *root.flagsFrom == "" || cmd.ParsedFlags == nil {
+		return nil, nil
+	}
+	file := *root.flagsFrom
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	words, err := splitFlagsFile(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	fileFlags, err := parseFlagsFile(cmd.ParsedFlags, words)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	setF := make(map[string]string)
+	for _, ff := range fileFlags {
+		if _, ok := setFlags[ff.name]; ok {
+			continue
+		}
+		if err := cmd.ParsedFlags.Set(ff.name, ff.value); err != nil {
+			return nil, fmt.Errorf("%s: invalid value %q for flag -%s: %v", file, ff.value, ff.name, err)
+		}
+		setF[ff.name] = cmd.ParsedFlags.Lookup(ff.name).Value.String()
+		env.flagSources[ff.name] = flagSourceFile
+	}
+	return setF, nil
+}
+
+// splitFlagsFile splits the contents of a -flags-from file into words,
+// skipping blank lines and comments.
+func splitFlagsFile(data string) ([]string, error) {
+	var words []string
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lineWords, err := splitShellWords(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		words = append(words, lineWords...)
+	}
+	return words, nil
+}
+
+// fileFlag is a single flag parsed from a -flags-from file.
+type fileFlag struct {
+	name, value string
+}
+
+// parseFlagsFile parses words into flags, each of which must be defined in
+// flags.  Flags without a value take the next word as the value, unless they
+// are boolean flags.
+func parseFlagsFile(flags *flag.FlagSet, words []string) ([]fileFlag, error) {
+	var result []fileFlag
+	for len(words) > 0 {
+		word := words[0]
+		words = words[1:]
+		name := strings.TrimPrefix(strings.TrimPrefix(word, "-"), "-")
+		if name == word && !strings.Contains(word, "=") {
+			return nil, fmt.Errorf("unexpected arg %q, want a flag", word)
+		}
+		name, value, hasValue := cutString(name, "=")
+		f := flags.Lookup(name)
+		switch {
+		case name == "" || strings.HasPrefix(name, "-"):
+			return nil, fmt.Errorf("bad flag syntax: %s", word)
+		case name == flagsFromName:
+			return nil, fmt.Errorf("flag -%s can't be nested", name)
+		case f == nil:
+			return nil, fmt.Errorf("flag -%s isn't defined for the command", name)
+		}
+		if !hasValue {
+			switch {
+			case isBoolFlag(f):
+				value = "true"
+			case len(words) == 0:
+				return nil, fmt.Errorf("flag needs an argument: -%s", name)
+			default:
+				value, words = words[0], words[1:]
+			}
+		}
+		result = append(result, fileFlag{name, value})
+	}
+	return result, nil
+}
@@ -0,0 +1,102 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
+
+func TestFlagsFrom(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	tmpDir, err := ioutil.TempDir("", "cmdline-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	writeFile := func(name, data string) string {
+		file := filepath.Join(tmpDir, name)
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	good := writeFile("good", `
+# Defaults for deploy.
+-region us-east1
+  --dry-run
+message="hello # world"
+`)
+	undefined := writeFile("undefined", "-region us-east1\n-port 80\n")
+	unquoted := writeFile("unquoted", "-message 'oops\n")
+	positional := writeFile("positional", "-dry-run extra\n")
+
+	var got string
+	newRoot := func() *Command {
+		deploy := &Command{
+			Name:  "deploy",
+			Short: "deploy",
+			Long:  "deploy.",
+		}
+		region := deploy.Flags.String("region", "local", "region")
+		dryRun := deploy.Flags.Bool("dry-run", false, "dry run")
+		message := deploy.Flags.String("message", "", "message")
+		deploy.Runner = RunnerFunc(func(env *Env, args []string) error {
+			got = fmt.Sprintf("%s %v %q %v", *region, *dryRun, *message, args)
+			return nil
+		})
+		deploy.ArgsName = "[args]"
+		return &Command{
+			Name:     "root",
+			Short:    "root",
+			Long:     "root.",
+			Children: []*Command{deploy},
+		}
+	}
+	tests := []struct {
+		args      []string
+		want, err string
+	}{
+		{[]string{"deploy"}, `local false "" []`, ""},
+		{[]string{"-flags-from=" + good, "deploy"}, `us-east1 true "hello # world" []`, ""},
+		{[]string{"deploy", "-flags-from", good, "a"}, `us-east1 true "hello # world" [a]`, ""},
+		{[]string{"deploy", "-flags-from=" + good, "-region=eu", "-dry-run=false"}, `eu false "hello # world" []`, ""},
+		{[]string{"-flags-from=" + undefined, "deploy"}, "", "root deploy: " + undefined + ": flag -port isn't defined for the command"},
+		{[]string{"-flags-from=" + unquoted, "deploy"}, "", "root deploy: " + unquoted + `: line 1: unterminated ' quote in "-message 'oops"`},
+		{[]string{"-flags-from=" + positional, "deploy"}, "", "root deploy: " + positional + `: unexpected arg "extra", want a flag`},
+	}
+	for _, test := range tests {
+		got = ""
+		SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+		root := newRoot()
+		WithFlagsFrom(root)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		err := ParseAndRun(root, env, test.args)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v\n%s", test.args, err, stderr.String())
+			}
+		} else {
+			if err != ErrUsage {
+				t.Errorf("%v: got error %v, want %v", test.args, err, ErrUsage)
+			}
+			if got, want := stderr.String(), "ERROR: "+test.err+"\n"; !strings.HasPrefix(got, want) {
+				t.Errorf("%v: got stderr %q, want prefix %q", test.args, got, want)
+			}
+		}
+		if got != test.want {
+			t.Errorf("%v: got %s, want %s", test.args, got, test.want)
+		}
+	}
+}
@@ -4,26 +4,53 @@
 
 // This file was auto-generated via go generate.
 // DO NOT UPDATE MANUALLY
+// Generated from v.io/x/lib/cmdline/gendoc with args: -h
 
 /*
 Usage of gendoc:
   -build-cmd string
     	Comand to use for building/installing commands whose usage is to be documented, it must accept the same flags as 'go install'.
+  -build-flags string
+    	Flags for go build, appended to the install command after -tags.  The flags are separated by spaces, with shell-style quoting for values that contain spaces, e.g. "-trimpath -ldflags='-s -X main.version=1.0'".  The install command inherits the environment of gendoc, so e.g. CGO_ENABLED and CGO_CFLAGS may be set to build commands that use cgo.
+  -check
+    	If set, the generated output is compared with the existing output files rather than written.  If they differ, a unified diff is printed to stderr, and gendoc exits with a non-zero code; e.g. to check in CI that the output is up to date.
   -copyright-notice string
     	File containing the copyright notice to be prepended to the autogenerated documentation; if specified as an empty string then no copyright notice will be used.
   -env string
     	Environment variables to set before running command.  If "os", grabs vars from the underlying OS.  If empty, doesn't set any vars.  Otherwise vars are expected to be comma-separated entries of the form KEY1=VALUE1,KEY2=VALUE2,... (default "os")
+  -env-allow string
+    	Comma-separated list of environment variable names.  If set, only these variables are passed through from -env to the command, in addition to PATH, which is always set.  Use this to avoid leaking sensitive variables into the generated output.
+  -front-matter string
+    	File containing a text/template that is executed to produce front matter prepended to each file written in -split mode, e.g. for static site generators.  The template is passed the Name, Path and Short description of the command.
   -go-flag-pkg
     	Set if the command is using the standard go flag package, it sets both use-stderr and postprocess-output to true
   -install string
     	Comma separated list of packages to install before running command.  All commands that are built will be on the PATH.
+  -mod-readonly
+    	If set, commands are built with -mod=readonly, ensuring that the documented binary matches the committed go.mod.
+  -modcache string
+    	If set, the Go module cache directory (GOMODCACHE) to use when building commands, isolating the build from the ambient module cache.
   -out string
-    	Path to the output file. (default "./doc.go")
+    	Path to the output file, or the output directory if -split is set.  If "-", the output is written to stdout, and informational messages to stderr. (default "./doc.go")
   -postprocess-output
     	If set, the help/usage output will be post processed to remove absolute path names that contain the build directory.
+  -record-exit
+    	If set, the exit code of the command is recorded in a comment at the end of the generated output file.  Typically used with use-stderr, which ignores the exit status of the command.
+  -source-info
+    	If set, a comment in the godoc output file records the package and args that the output was generated from.  Unset it for minimal output. (default true)
+  -split
+    	If set, the usage of each command is written to a separate Markdown file named after the command path in the -out directory, e.g. tool_net_status.md, with relative links to the files of its parent and children, rather than running the command with the given args.
+  -style string
+    	Style of the usage output to capture, passed via CMDLINE_STYLE; one of "godoc", "rst", "full" or "compact".  The godoc output is wrapped in a comment of a Go file declaring package main, while the output of the other styles is written as is, without the copyright notice or build constraints.  The -toc flag only applies to the godoc style. (default "godoc")
   -tags string
     	Tags for go build, also added as build constraints in the generated output file.
+  -timeout duration
+    	If positive, the maximum time that each run of the command to capture its usage may take before it is killed.
+  -toc
+    	If set, a table of contents linking to the godoc header of each command and topic is inserted before the first header.
   -use-stderr
     	If set, read usage output from stderr rather than stdout; it also ignores the exit status of the command.
+  -width int
+    	Width in runes that the command formats its usage output to, passed via CMDLINE_WIDTH, so that the output doesn't depend on the terminal of the generating machine.  The godoc style wraps text to this width like the other styles, except for verbatim blocks; if negative, text is never wrapped.  Set to 0 to pass through CMDLINE_WIDTH from -env, if any, or otherwise let the command pick the width. (default 80)
 */
 package main
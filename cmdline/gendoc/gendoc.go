@@ -3,10 +3,11 @@
 // license that can be found in the LICENSE file.
 
 // Command gendoc generates godoc comments describing the usage of tools based
-// on the cmdline package.
+// on the cmdline package.  Other styles of documentation may be generated via
+// the -style flag.
 //
 // Usage:
-//   go run gendoc.go [flags] <pkg> [args]
+//   go run v.io/x/lib/cmdline/gendoc [flags] <pkg> [args]
 //
 // <pkg> is the package path for the tool.
 //
@@ -21,37 +22,69 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"go/doc"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"text/template"
+	"time"
+	"unicode"
 )
 
 var (
 	flagEnv          string
+	flagEnvAllow     string
 	flagInstall      string
 	flagOut          string
 	flagPostProcess  bool
 	flagStderr       bool
 	flagGoFlagPkg    bool
 	flagTags         string
+	flagTOC          bool
+	flagSplit        bool
+	flagFrontMatter  string
+	flagRecordExit   bool
+	flagModCache     string
+	flagModReadonly  bool
+	flagTimeout      time.Duration
+	flagWidth        int
+	flagStyle        string
+	flagCheck        bool
+	flagBuildFlags   string
+	flagSourceInfo   bool
 	copyrightNotice  string
 	goInstallCommand string
 )
 
 func main() {
 	flag.StringVar(&flagEnv, "env", "os", `Environment variables to set before running command.  If "os", grabs vars from the underlying OS.  If empty, doesn't set any vars.  Otherwise vars are expected to be comma-separated entries of the form KEY1=VALUE1,KEY2=VALUE2,...`)
+	flag.StringVar(&flagEnvAllow, "env-allow", "", "Comma-separated list of environment variable names.  If set, only these variables are passed through from -env to the command, in addition to PATH, which is always set.  Use this to avoid leaking sensitive variables into the generated output.")
 	flag.StringVar(&flagInstall, "install", "", "Comma separated list of packages to install before running command.  All commands that are built will be on the PATH.")
-	flag.StringVar(&flagOut, "out", "./doc.go", "Path to the output file.")
+	flag.StringVar(&flagOut, "out", "./doc.go", "Path to the output file, or the output directory if -split is set.  If \"-\", the output is written to stdout, and informational messages to stderr.")
 	flag.BoolVar(&flagStderr, "use-stderr", false, "If set, read usage output from stderr rather than stdout; it also ignores the exit status of the command.")
 	flag.BoolVar(&flagPostProcess, "postprocess-output", false, "If set, the help/usage output will be post processed to remove absolute path names that contain the build directory.")
 	flag.BoolVar(&flagGoFlagPkg, "go-flag-pkg", false, "Set if the command is using the standard go flag package, it sets both use-stderr and postprocess-output to true")
+	flag.StringVar(&flagBuildFlags, "build-flags", "", "Flags for go build, appended to the install command after -tags.  The flags are separated by spaces, with shell-style quoting for values that contain spaces, e.g. \"-trimpath -ldflags='-s -X main.version=1.0'\".  The install command inherits the environment of gendoc, so e.g. CGO_ENABLED and CGO_CFLAGS may be set to build commands that use cgo.")
 	flag.StringVar(&flagTags, "tags", "", "Tags for go build, also added as build constraints in the generated output file.")
+	flag.BoolVar(&flagTOC, "toc", false, "If set, a table of contents linking to the godoc header of each command and topic is inserted before the first header.")
+	flag.BoolVar(&flagSplit, "split", false, "If set, the usage of each command is written to a separate Markdown file named after the command path in the -out directory, e.g. tool_net_status.md, with relative links to the files of its parent and children, rather than running the command with the given args.")
+	flag.StringVar(&flagFrontMatter, "front-matter", "", "File containing a text/template that is executed to produce front matter prepended to each file written in -split mode, e.g. for static site generators.  The template is passed the Name, Path and Short description of the command.")
+	flag.BoolVar(&flagRecordExit, "record-exit", false, "If set, the exit code of the command is recorded in a comment at the end of the generated output file.  Typically used with use-stderr, which ignores the exit status of the command.")
+	flag.StringVar(&flagModCache, "modcache", "", "If set, the Go module cache directory (GOMODCACHE) to use when building commands, isolating the build from the ambient module cache.")
+	flag.BoolVar(&flagModReadonly, "mod-readonly", false, "If set, commands are built with -mod=readonly, ensuring that the documented binary matches the committed go.mod.")
+	flag.IntVar(&flagWidth, "width", 80, "Width in runes that the command formats its usage output to, passed via CMDLINE_WIDTH, so that the output doesn't depend on the terminal of the generating machine.  The godoc style wraps text to this width like the other styles, except for verbatim blocks; if negative, text is never wrapped.  Set to 0 to pass through CMDLINE_WIDTH from -env, if any, or otherwise let the command pick the width.")
+	flag.StringVar(&flagStyle, "style", "godoc", `Style of the usage output to capture, passed via CMDLINE_STYLE; one of "godoc", "rst", "full" or "compact".  The godoc output is wrapped in a comment of a Go file declaring package main, while the output of the other styles is written as is, without the copyright notice or build constraints.  The -toc flag only applies to the godoc style.`)
+	flag.BoolVar(&flagSourceInfo, "source-info", true, "If set, a comment in the godoc output file records the package and args that the output was generated from.  Unset it for minimal output.")
+	flag.BoolVar(&flagCheck, "check", false, "If set, the generated output is compared with the existing output files rather than written.  If they differ, a unified diff is printed to stderr, and gendoc exits with a non-zero code; e.g. to check in CI that the output is up to date.")
+	flag.DurationVar(&flagTimeout, "timeout", 0, "If positive, the maximum time that each run of the command to capture its usage may take before it is killed.")
 	flag.StringVar(&copyrightNotice, "copyright-notice", "", "File containing the copyright notice to be prepended to the autogenerated documentation; if specified as an empty string then no copyright notice will be used.")
 	flag.StringVar(&goInstallCommand, "build-cmd", "", "Comand to use for building/installing commands whose usage is to be documented, it must accept the same flags as 'go install'.")
 	flag.Parse()
@@ -64,29 +97,37 @@ func main() {
 	}
 }
 
-func determineBinaryName(pkg string) (string, error) {
-	var listOut bytes.Buffer
+// determineImportPath returns the import path of pkg, which may be relative.
+func determineImportPath(pkg string) (string, error) {
+	var listOut, listErr bytes.Buffer
 	listCmd := exec.Command("go", "list", pkg)
 	listCmd.Stdout = &listOut
+	listCmd.Stderr = &listErr
 	if err := listCmd.Run(); err != nil {
-		msg := fmt.Sprintf("%q failed: %v\n%v\n", strings.Join(listCmd.Args, " "), err, listOut.String())
+		msg := fmt.Sprintf("%q failed: %v\n%v%v\n", strings.Join(listCmd.Args, " "), err, listOut.String(), listErr.String())
 		return "", errors.New(msg)
 	}
-	return filepath.Base(strings.TrimSpace(listOut.String())), nil
+	return strings.TrimSpace(listOut.String()), nil
 }
 
 func generate(readStderr bool, args []string) error {
 	if got, want := len(args), 1; got < want {
 		return fmt.Errorf("gendoc requires at least one argument\nusage: gendoc <pkg> [args]")
 	}
+	switch flagStyle {
+	case "", "godoc", "rst", "full", "compact":
+	default:
+		return fmt.Errorf(`unknown -style %q; must be one of "godoc", "rst", "full" or "compact"`, flagStyle)
+	}
 	pkg, args := args[0], args[1:]
 
 	// Find out the binary name from the pkg name, include a package
 	// name of '.'.
-	binName, err := determineBinaryName(pkg)
+	importPath, err := determineImportPath(pkg)
 	if err != nil {
 		return err
 	}
+	binName := filepath.Base(importPath)
 
 	// Build the binary into a temporary directory
 	tmpDir, err := ioutil.TempDir("", "")
@@ -107,40 +148,456 @@ func generate(readStderr bool, args []string) error {
 	}
 
 	for _, installPkg := range pkgs {
-		installArgs := append(installCmd, "-tags="+flagTags, installPkg)
+		installArgs, err := installArgs(installCmd, installPkg)
+		if err != nil {
+			return err
+		}
 		installCmd := exec.Command(installArgs[0], installArgs[1:]...)
-		installCmd.Env = append(os.Environ(), "GOBIN="+tmpDir)
+		installCmd.Env = installEnviron(tmpDir)
+		var installOut bytes.Buffer
+		installCmd.Stdout = &installOut
+		installCmd.Stderr = &installOut
 		if err := installCmd.Run(); err != nil {
-			msg := fmt.Sprintf("%q failed: %v\n", strings.Join(installCmd.Args, " "), err)
+			msg := fmt.Sprintf("%q failed: %v\n%v\n", strings.Join(installCmd.Args, " "), err, installOut.String())
 			return errors.New(msg)
 		}
 	}
 
+	if flagCheck && flagOut == "-" {
+		return errors.New("-check requires -out to be a file or directory, not \"-\"")
+	}
+	if flagSplit {
+		if flagOut == "-" {
+			return errors.New("-split requires -out to be a directory, not \"-\"")
+		}
+		return generateSplit(readStderr, tmpDir, binName)
+	}
+
 	// Run the binary to generate documentation.
-	var out bytes.Buffer
 	if len(args) == 0 {
 		args = []string{"help", "..."}
 	}
-	runCmd := exec.Command(filepath.Join(tmpDir, binName), args...)
-	runCmd.Dir = tmpDir
+	out, exitCode, err := runBinary(readStderr, tmpDir, binName, args)
+	if err != nil {
+		return err
+	}
+	body := postProcess(flagPostProcess, tmpDir, out)
+	if flagTOC && isGodocStyle() {
+		body = insertTableOfContents(body)
+	}
+	return writeOutput(body, exitCode, importPath, args)
+}
+
+// installArgs returns the args to install pkg via installCmd, which holds the
+// command and its initial args, with the -tags and -build-flags flags.
+func installArgs(installCmd []string, pkg string) ([]string, error) {
+	buildFlags, err := splitShellWords(flagBuildFlags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -build-flags: %v", err)
+	}
+	args := append([]string{}, installCmd...)
+	args = append(args, "-tags="+flagTags)
+	args = append(args, buildFlags...)
+	return append(args, pkg), nil
+}
+
+// splitShellWords splits line into words separated by spaces or tabs, with
+// shell-style quoting: single quotes preserve everything up to the closing
+// quote, double quotes preserve everything except for backslash escapes of \
+// and ", and a backslash outside of quotes escapes the next rune.  It matches
+// the quoting of the REPL in the cmdline package, which gendoc doesn't import.
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord, quote, escape := false, rune(0), false
+	for _, r := range line {
+		switch {
+		case escape:
+			if quote == '"' && r != '"' && r != '\\' {
+				// Within double quotes, backslash only escapes \ and ".
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escape = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escape = true
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == '\\':
+			escape, inWord = true, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	switch {
+	case quote != 0:
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, line)
+	case escape:
+		return nil, fmt.Errorf("trailing backslash in %q", line)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// runBinary runs the binary with the given args, and returns its usage output
+// and exit code.  The binary runs in its own process group, which is killed if
+// the run takes longer than -timeout, so that processes started by the binary
+// can't hold the output open.
+func runBinary(readStderr bool, binDir, binName string, args []string) (string, int, error) {
+	var out bytes.Buffer
+	runCmd := exec.Command(filepath.Join(binDir, binName), args...)
+	runCmd.Dir = binDir
 	if readStderr {
 		runCmd.Stderr = &out
 	} else {
 		runCmd.Stdout = &out
 	}
-	runCmd.Env = runEnviron(tmpDir)
-	if err := runCmd.Run(); err != nil {
+	runCmd.Env = runEnviron(binDir)
+	setProcessGroup(runCmd)
+	if err := runCmd.Start(); err != nil {
+		return "", 0, fmt.Errorf("%q failed: %v\n", strings.Join(runCmd.Args, " "), err)
+	}
+	timedOut := make(chan struct{})
+	if flagTimeout > 0 {
+		timer := time.AfterFunc(flagTimeout, func() {
+			close(timedOut)
+			killProcessGroup(runCmd)
+		})
+		defer timer.Stop()
+	}
+	if err := runCmd.Wait(); err != nil {
+		select {
+		case <-timedOut:
+			return "", 0, fmt.Errorf("%q timed out after %v\n%v\n", strings.Join(runCmd.Args, " "), flagTimeout, out.String())
+		default:
+		}
 		exitErr, ok := err.(*exec.ExitError)
 		if !ok || !readStderr {
 			msg := fmt.Sprintf("%q failed: %v\n%v\n", strings.Join(runCmd.Args, " "), err, out.String())
-			return errors.New(msg)
+			return "", 0, errors.New(msg)
+		}
+		fmt.Fprintf(os.Stderr, "ignoring exit error: %v\n", exitErr)
+		return out.String(), exitErr.ExitCode(), nil
+	}
+	return out.String(), 0, nil
+}
+
+// generateSplit walks the command tree of the binary, and writes the usage of
+// each command to a separate Markdown file in the flagOut directory.  Each file
+// is named after the command path, and links to its parent and children.  The
+// children are read from the JSON description printed by "help -style=json",
+// rather than from the usage, which may be customized.
+func generateSplit(readStderr bool, binDir, binName string) error {
+	if err := os.MkdirAll(flagOut, 0755); err != nil {
+		return err
+	}
+	var frontMatter *template.Template
+	if flagFrontMatter != "" {
+		var err error
+		if frontMatter, err = template.ParseFiles(flagFrontMatter); err != nil {
+			return err
+		}
+	}
+	var walk func(path []string, parent string) error
+	walk = func(path []string, parent string) error {
+		out, _, err := runBinary(readStderr, binDir, binName, append([]string{"help"}, path...))
+		if err != nil {
+			return err
+		}
+		children, err := splitChildren(readStderr, binDir, binName, path)
+		if err != nil {
+			return err
+		}
+		body := "```\n" + strings.TrimRight(postProcess(flagPostProcess, binDir, out), "\n") + "\n```\n"
+		file := splitFileName(binName, path)
+		var links []string
+		if parent != "" {
+			links = append(links, splitLink(binName, path[:len(path)-1]))
+		}
+		for _, child := range children {
+			links = append(links, splitLink(binName, append(path[:len(path):len(path)], child)))
+		}
+		if len(links) > 0 {
+			body += "\nSee also:\n\n" + strings.Join(links, "\n") + "\n"
+		}
+		if frontMatter != nil {
+			short, _, err := runBinary(readStderr, binDir, binName, append([]string{"help", "-style=shortonly"}, path...))
+			if err != nil {
+				return err
+			}
+			data := frontMatterData{
+				Name:  binName,
+				Path:  strings.Join(append([]string{binName}, path...), " "),
+				Short: strings.TrimSpace(short),
+			}
+			if len(path) > 0 {
+				data.Name = path[len(path)-1]
+			}
+			var buf bytes.Buffer
+			if err := frontMatter.Execute(&buf, data); err != nil {
+				return err
+			}
+			body = buf.String() + body
+		}
+		if err := writeOrCheckFile(filepath.Join(flagOut, file), body); err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := walk(append(path[:len(path):len(path)], child), file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(nil, "")
+}
+
+// frontMatterData is passed to the -front-matter template.
+type frontMatterData struct {
+	Name  string // Name of the command.
+	Path  string // Full path of the command, including the binary name.
+	Short string // Short description of the command.
+}
+
+// splitFileName returns the name of the file holding the usage of the command
+// with the given path, in -split mode.
+func splitFileName(binName string, path []string) string {
+	return strings.Join(append([]string{binName}, path...), "_") + ".md"
+}
+
+// splitLink returns a Markdown list item linking to the file of the command
+// with the given path, relative to the -out directory.
+func splitLink(binName string, path []string) string {
+	return fmt.Sprintf("- [%s](%s)", strings.Join(append([]string{binName}, path...), " "), splitFileName(binName, path))
+}
+
+// splitChildren returns the names of the children of the command with the
+// given path, including external children, from the JSON description printed
+// by "help -style=json".  Commands using the standard flag package have no
+// children.
+func splitChildren(readStderr bool, binDir, binName string, path []string) ([]string, error) {
+	if readStderr {
+		return nil, nil
+	}
+	out, _, err := runBinary(readStderr, binDir, binName, append([]string{"help", "-style=json"}, path...))
+	if err != nil {
+		return nil, err
+	}
+	var desc struct {
+		Children []struct {
+			Name string `json:"name"`
+		} `json:"children"`
+	}
+	if err := json.Unmarshal([]byte(out), &desc); err != nil {
+		return nil, fmt.Errorf("invalid JSON description of %q: %v", strings.Join(append([]string{binName}, path...), " "), err)
+	}
+	var names []string
+	for _, child := range desc.Children {
+		names = append(names, child.Name)
+	}
+	return names, nil
+}
+
+func writeFile(path, data string) error {
+	perm := os.FileMode(0644)
+	if err := ioutil.WriteFile(path, []byte(data), perm); err != nil {
+		msg := fmt.Sprintf("WriteFile(%v, %v) failed: %v\n", path, perm, err)
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// isGodocStyle returns true iff the godoc style of usage output is captured,
+// which is the default.
+func isGodocStyle() bool {
+	return flagStyle == "" || flagStyle == "godoc"
+}
+
+// writeOut writes data to the flagOut file, or to stdout if flagOut is "-".
+func writeOut(data string) error {
+	if flagOut == "-" {
+		_, err := io.WriteString(os.Stdout, data)
+		return err
+	}
+	return writeOrCheckFile(flagOut, data)
+}
+
+// writeOrCheckFile writes data to the file at path, or if flagCheck is set,
+// checks that the file already holds data.
+func writeOrCheckFile(path, data string) error {
+	if !flagCheck {
+		return writeFile(path, data)
+	}
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if diff := unifiedDiff(path, path+" (generated)", string(existing), data); diff != "" {
+		fmt.Fprint(os.Stderr, diff)
+		return fmt.Errorf("%s is out of date; regenerate it", path)
+	}
+	return nil
+}
+
+// diffContext is the number of unchanged lines shown around each change in a
+// unified diff.
+const diffContext = 3
+
+// diffLine is a line of a unified diff.
+type diffLine struct {
+	kind byte // ' ' for unchanged lines, '-' for removed lines, '+' for added lines
+	text string
+	a, b int // Index of the line in a and b respectively, before this line.
+}
+
+// unifiedDiff returns a unified diff that turns a into b, or "" if they are
+// equal.  The diff is computed from the longest common subsequence of lines,
+// which is fine for the size of generated documentation.
+func unifiedDiff(aName, bName, a, b string) string {
+	if a == b {
+		return ""
+	}
+	x, y := splitLines(a), splitLines(b)
+	// Generated docs usually only change in a few places, so the common prefix
+	// and suffix are stripped before computing the LCS table, which is
+	// quadratic in the size of what remains.
+	pre := 0
+	for pre < len(x) && pre < len(y) && x[pre] == y[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(x)-pre && suf < len(y)-pre && x[len(x)-1-suf] == y[len(y)-1-suf] {
+		suf++
+	}
+	xm, ym := x[pre:len(x)-suf], y[pre:len(y)-suf]
+	// lcs[i][j] is the length of the longest common subsequence of xm[i:] and
+	// ym[j:].
+	lcs := make([][]int, len(xm)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(ym)+1)
+	}
+	for i := len(xm) - 1; i >= 0; i-- {
+		for j := len(ym) - 1; j >= 0; j-- {
+			switch {
+			case xm[i] == ym[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var lines []diffLine
+	for i := 0; i < pre; i++ {
+		lines = append(lines, diffLine{' ', x[i], i, i})
+	}
+	for i, j := 0, 0; i < len(xm) || j < len(ym); {
+		switch {
+		case i < len(xm) && j < len(ym) && xm[i] == ym[j]:
+			lines = append(lines, diffLine{' ', xm[i], pre + i, pre + j})
+			i++
+			j++
+		case i < len(xm) && (j == len(ym) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', xm[i], pre + i, pre + j})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', ym[j], pre + i, pre + j})
+			j++
+		}
+	}
+	for k := 0; k < suf; k++ {
+		i, j := len(x)-suf+k, len(y)-suf+k
+		lines = append(lines, diffLine{' ', x[i], i, j})
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", aName, bName)
+	for start := 0; start < len(lines); {
+		for start < len(lines) && lines[start].kind == ' ' {
+			start++
 		}
-		fmt.Printf("ignoring exit error: %v\n", exitErr)
+		if start == len(lines) {
+			break
+		}
+		// The hunk ends when there are enough unchanged lines to separate it
+		// from the next change.
+		end := start + 1
+		for k := end; k < len(lines) && k-end < 2*diffContext; k++ {
+			if lines[k].kind != ' ' {
+				end = k + 1
+			}
+		}
+		lo, hi := start-diffContext, end+diffContext
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(lines) {
+			hi = len(lines)
+		}
+		var aLen, bLen int
+		for _, line := range lines[lo:hi] {
+			if line.kind != '+' {
+				aLen++
+			}
+			if line.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(lines[lo].a, aLen), hunkRange(lines[lo].b, bLen))
+		for _, line := range lines[lo:hi] {
+			fmt.Fprintf(&buf, "%c%s\n", line.kind, line.text)
+		}
+		start = hi
 	}
-	return writeOutput(postProcess(flagPostProcess, tmpDir, out.String()))
+	return buf.String()
 }
 
-func writeOutput(out string) error {
+// hunkRange returns the range of a unified diff hunk that starts after index
+// lines, and spans count lines.
+func hunkRange(index, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", index)
+	}
+	return fmt.Sprintf("%d,%d", index+1, count)
+}
+
+// splitLines splits s into lines, without their line terminators.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// writeOutput writes out, the usage output of the command built from pkg and run
+// with args, which exited with exitCode.
+func writeOutput(out string, exitCode int, pkg string, args []string) error {
+	if !isGodocStyle() {
+		// Only godoc output is wrapped in a Go file.
+		return writeOut(out)
+	}
 
 	var tagsConstraint string
 	if flagTags != "" {
@@ -168,29 +625,77 @@ func writeOutput(out string) error {
 			copyright = string(buf)
 		}
 	}
+	var sourceInfo string
+	if flagSourceInfo {
+		sourceInfo = fmt.Sprintf("// Generated from %s with args: %s\n", pkg, strings.Join(args, " "))
+	}
 	doc := fmt.Sprintf(`%s// This file was auto-generated via go generate.
 // DO NOT UPDATE MANUALLY
-
+%s
 %s/*
 %s*/
 package main
-`, copyright, tagsConstraint, out)
+`, copyright, sourceInfo, tagsConstraint, out)
+	if flagRecordExit {
+		doc += fmt.Sprintf("\n// The command exited with code %d when producing this output.\n", exitCode)
+	}
 
 	// Write the result to the output file.
-	path, perm := flagOut, os.FileMode(0644)
-	if err := ioutil.WriteFile(path, []byte(doc), perm); err != nil {
-		msg := fmt.Sprintf("WriteFile(%v, %v) failed: %v\n", path, perm, err)
-		return errors.New(msg)
-	}
-	return nil
+	return writeOut(doc)
 }
 func postProcess(postProcessFlag bool, tmpDir string, body string) string {
-	out := suppressParallelFlag(body)
+	out := stripANSI(suppressParallelFlag(body))
 	if !postProcessFlag {
 		return out
 	}
-	out = strings.ReplaceAll(out, tmpDir+string(filepath.Separator), "")
-	return out
+	return stripTmpDir(out, tmpDir)
+}
+
+// stripTmpDir removes all occurrences of tmpDir followed by a path separator
+// from body, and normalizes the separators in the remainder of each such path
+// to forward slashes.  Both forward and backward slashes are recognized as
+// separators, both in tmpDir and in body, so that the output is identical
+// regardless of the OS that generated it.
+func stripTmpDir(body, tmpDir string) string {
+	dirs := []string{tmpDir}
+	for _, dir := range []string{strings.Replace(tmpDir, `\`, "/", -1), strings.Replace(tmpDir, "/", `\`, -1)} {
+		if dir != dirs[0] {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		for _, sep := range []string{"/", `\`} {
+			prefix := dir + sep
+			for {
+				start := strings.Index(body, prefix)
+				if start == -1 {
+					break
+				}
+				pathStart := start + len(prefix)
+				pathEnd := len(body)
+				if end := strings.IndexFunc(body[pathStart:], isPathEnd); end != -1 {
+					pathEnd = pathStart + end
+				}
+				path := strings.Replace(body[pathStart:pathEnd], `\`, "/", -1)
+				body = body[:start] + path + body[pathEnd:]
+			}
+		}
+	}
+	return body
+}
+
+func isPathEnd(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune(`"'`+"`", r)
+}
+
+var ansiCSI = regexp.MustCompile("\x1b\\[[0-?]*[ -/]*[@-~]")
+
+// stripANSI removes ANSI CSI escape sequences, typically used for color, from
+// the input.  Tools run by gendoc are asked not to produce color via the
+// environment, but some ignore it, and the escape sequences would otherwise end
+// up in the generated output.
+func stripANSI(input string) string {
+	return ansiCSI.ReplaceAllString(input, "")
 }
 
 // suppressParallelFlag replaces the default value of the test.parallel flag
@@ -204,6 +709,78 @@ func suppressParallelFlag(input string) string {
 	return pattern.ReplaceAllString(input, "$1<number of threads>")
 }
 
+// insertTableOfContents returns body with a table of contents inserted before
+// the first godoc header.  The table has a "[path](#anchor)" link for every
+// header, indented according to the depth of the command path, where the
+// anchor is the id that godoc gives the section of the header.
+func insertTableOfContents(body string) string {
+	lines := strings.Split(body, "\n")
+	var headers []int
+	for i := 1; i < len(lines)-1; i++ {
+		if lines[i-1] == "" && lines[i+1] == "" && isGodocHeader(lines[i]) {
+			headers = append(headers, i)
+		}
+	}
+	if len(headers) == 0 {
+		return body
+	}
+	toc := []string{"Contents", ""}
+	for _, i := range headers {
+		path := strings.SplitN(lines[i], " - ", 2)[0]
+		depth := len(strings.Fields(path)) - 1
+		toc = append(toc, fmt.Sprintf("%s[%s](#%s)", strings.Repeat("  ", depth), path, godocHeaderID(lines[i])))
+	}
+	toc = append(toc, "")
+	first := headers[0]
+	result := append([]string{}, lines[:first]...)
+	result = append(result, toc...)
+	result = append(result, lines[first:]...)
+	return strings.Join(result, "\n")
+}
+
+// godocHeaderID returns the id of the section of the godoc header, which is
+// "hdr-" followed by the header with every rune other than a letter or digit
+// replaced by an underscore.
+func godocHeaderID(header string) string {
+	id := []rune(header)
+	for i, r := range id {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			id[i] = '_'
+		}
+	}
+	return "hdr-" + string(id)
+}
+
+// isGodocHeader returns true iff godoc would treat line as a section header, if
+// it were surrounded by blank lines.
+func isGodocHeader(line string) bool {
+	if line == "" || strings.TrimLeft(line, " \t") != line {
+		return false
+	}
+	var buf bytes.Buffer
+	doc.ToHTML(&buf, "before\n\n"+line+"\n\nafter", nil)
+	return bytes.Contains(buf.Bytes(), []byte("<h"))
+}
+
+// installEnviron returns the environment variables to use when building and
+// installing commands into binDir.
+func installEnviron(binDir string) []string {
+	env := append(os.Environ(), "GOBIN="+binDir)
+	if flagModCache != "" {
+		env = append(env, "GOMODCACHE="+flagModCache)
+	}
+	if flagModReadonly {
+		goflags := "-mod=readonly"
+		for _, f := range strings.Fields(os.Getenv("GOFLAGS")) {
+			if !strings.HasPrefix(f, "-mod=") {
+				goflags += " " + f
+			}
+		}
+		env = append(env, "GOFLAGS="+goflags)
+	}
+	return env
+}
+
 // runEnviron returns the environment variables to use when running the command
 // to retrieve full help information.
 func runEnviron(binDir string) []string {
@@ -212,9 +789,20 @@ func runEnviron(binDir string) []string {
 	if flagEnv == "os" {
 		in = os.Environ()
 	}
+	allowed := map[string]bool{"PATH": true}
+	for _, key := range strings.Split(flagEnvAllow, ",") {
+		allowed[key] = true
+	}
 	updatedPath := false
 	for _, e := range in {
-		if e == "" {
+		if e == "" || strings.HasPrefix(e, "TERM=") || strings.HasPrefix(e, "NO_COLOR=") {
+			continue
+		}
+		// The -width flag overrides the width from the environment, unless it's 0.
+		if flagWidth != 0 && strings.HasPrefix(e, "CMDLINE_WIDTH=") {
+			continue
+		}
+		if key := strings.SplitN(e, "=", 2)[0]; flagEnvAllow != "" && !allowed[key] {
 			continue
 		}
 		if strings.HasPrefix(e, "PATH=") {
@@ -227,6 +815,15 @@ func runEnviron(binDir string) []string {
 	if !updatedPath {
 		out = append(out, "PATH="+binDir)
 	}
-	out = append(out, "CMDLINE_STYLE=godoc")
+	// Ask color-aware tools not to produce color.
+	out = append(out, "TERM=dumb", "NO_COLOR=1")
+	if isGodocStyle() {
+		out = append(out, "CMDLINE_STYLE=godoc")
+	} else {
+		out = append(out, "CMDLINE_STYLE="+flagStyle)
+	}
+	if flagWidth != 0 {
+		out = append(out, fmt.Sprintf("CMDLINE_WIDTH=%d", flagWidth))
+	}
 	return out
 }
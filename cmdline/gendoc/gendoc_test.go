@@ -0,0 +1,448 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/doc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStripTmpDir(t *testing.T) {
+	tests := []struct {
+		tmpDir, body, want string
+	}{
+		{"/tmp/123", "no paths here", "no paths here"},
+		{"/tmp/123", "usage: /tmp/123/tool -x", "usage: tool -x"},
+		{"/tmp/123", "a /tmp/123/bin/tool b /tmp/123/tool\n", "a bin/tool b tool\n"},
+		// Backslash separators in the output are normalized.
+		{"/tmp/123", `usage: \tmp\123\bin\tool -x`, "usage: bin/tool -x"},
+		{`C:\Temp\123`, `usage: C:\Temp\123\bin\tool.exe -x`, "usage: bin/tool.exe -x"},
+		{`C:\Temp\123`, `"C:\Temp\123\tool.exe" -line-term=\n`, `"tool.exe" -line-term=\n`},
+		{`C:\Temp\123`, "usage: C:/Temp/123/tool.exe", "usage: tool.exe"},
+		// Backslashes outside of the stripped paths are untouched.
+		{"/tmp/123", `-line-term=\n /tmp/123/tool`, `-line-term=\n tool`},
+	}
+	for _, test := range tests {
+		if got, want := stripTmpDir(test.body, test.tmpDir), test.want; got != want {
+			t.Errorf("(%q, %q) got %q, want %q", test.body, test.tmpDir, got, want)
+		}
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	tests := []struct {
+		input, want string
+	}{
+		{"plain", "plain"},
+		{"\x1b[1mbold\x1b[0m", "bold"},
+		{"\x1b[31;1mred\x1b[m and \x1b[38;5;208morange\x1b[39m", "red and orange"},
+		{"\x1b[2Kcleared", "cleared"},
+		{"-line-term=\\n", "-line-term=\\n"},
+	}
+	for _, test := range tests {
+		if got, want := stripANSI(test.input), test.want; got != want {
+			t.Errorf("%q got %q, want %q", test.input, got, want)
+		}
+	}
+}
+
+func TestRunEnvironAllow(t *testing.T) {
+	defer func(env, allow string) { flagEnv, flagEnvAllow = env, allow }(flagEnv, flagEnvAllow)
+	flagEnv = "HOME=/home/me,MYTOOL_TOKEN=secret,LANG=C,PATH=/bin"
+	tests := []struct {
+		allow string
+		want  []string
+	}{
+		{"", []string{"HOME=/home/me", "MYTOOL_TOKEN=secret", "LANG=C", "PATH=/tmp/bin:/bin"}},
+		{"LANG", []string{"LANG=C", "PATH=/tmp/bin:/bin"}},
+		{"HOME,LANG", []string{"HOME=/home/me", "LANG=C", "PATH=/tmp/bin:/bin"}},
+	}
+	for _, test := range tests {
+		flagEnvAllow = test.allow
+		for i, e := range test.want {
+			test.want[i] = strings.Replace(e, ":", string(os.PathListSeparator), 1)
+		}
+		want := append(test.want, "TERM=dumb", "NO_COLOR=1", "CMDLINE_STYLE=godoc")
+		if got := runEnviron("/tmp/bin"); !reflect.DeepEqual(got, want) {
+			t.Errorf("%q got %q, want %q", test.allow, got, want)
+		}
+	}
+}
+
+func TestRunEnvironWidth(t *testing.T) {
+	defer func(env string, width int) { flagEnv, flagWidth = env, width }(flagEnv, flagWidth)
+	flagEnv = "CMDLINE_WIDTH=120,PATH=/bin"
+	tests := []struct {
+		width int
+		want  []string
+	}{
+		{80, []string{"CMDLINE_WIDTH=80"}},
+		{-1, []string{"CMDLINE_WIDTH=-1"}},
+		// The width from the environment is only passed through for 0.
+		{0, []string{"CMDLINE_WIDTH=120"}},
+	}
+	for _, test := range tests {
+		flagWidth = test.width
+		var got []string
+		for _, e := range runEnviron("/tmp/bin") {
+			if strings.HasPrefix(e, "CMDLINE_WIDTH=") {
+				got = append(got, e)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d got %q, want %q", test.width, got, test.want)
+		}
+	}
+}
+
+func TestWriteOutputStyle(t *testing.T) {
+	defer func(out, style string) { flagOut, flagStyle = out, style }(flagOut, flagStyle)
+	dir, err := ioutil.TempDir("", "gendoc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flagOut = filepath.Join(dir, "out")
+	// Only the godoc output is wrapped in a Go file, after the copyright notice.
+	tests := []struct {
+		style, wantSuffix string
+		wantWrapped       bool
+	}{
+		{"godoc", "/*\nUsage\n*/\npackage main\n", true},
+		{"rst", "Usage\n", false},
+	}
+	for _, test := range tests {
+		flagStyle = test.style
+		if err := writeOutput("Usage\n", 0, "v.io/x/tool", []string{"help", "..."}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(flagOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := string(data)
+		if !strings.HasSuffix(got, test.wantSuffix) {
+			t.Errorf("%s got %q, want suffix %q", test.style, got, test.wantSuffix)
+		}
+		if wrapped := got != test.wantSuffix; wrapped != test.wantWrapped {
+			t.Errorf("%s got %q, want wrapped %v", test.style, got, test.wantWrapped)
+		}
+		if got, want := runEnviron(dir), "CMDLINE_STYLE="+test.style; !containsString(got, want) {
+			t.Errorf("%s got %q, want %q", test.style, got, want)
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGenerateUnknownStyle(t *testing.T) {
+	defer func(style string) { flagStyle = style }(flagStyle)
+	flagStyle = "bogus"
+	err := generate(false, []string{"v.io/x/lib/cmdline/gendoc"})
+	if got, want := fmt.Sprint(err), `unknown -style "bogus"`; !strings.Contains(got, want) {
+		t.Errorf("got error %q, want it to contain %q", got, want)
+	}
+}
+
+func TestWriteOutStdout(t *testing.T) {
+	defer func(out string, stdout *os.File) { flagOut, os.Stdout = out, stdout }(flagOut, os.Stdout)
+	f, err := ioutil.TempFile("", "gendoc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	flagOut, os.Stdout = "-", f
+	if err := writeOut("Usage\n"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "Usage\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// No file named "-" is written.
+	if _, err := os.Stat("-"); !os.IsNotExist(err) {
+		t.Errorf("got %v, want not exist error", err)
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{"a\nb\nc\n", "a\nx\nc\n", `--- old
++++ new
+@@ -1,3 +1,3 @@
+ a
+-b
++x
+ c
+`},
+		{"", "a\n", `--- old
++++ new
+@@ -0,0 +1,1 @@
++a
+`},
+		// Changes that are far apart are in separate hunks.
+		{"1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n", `--- old
++++ new
+@@ -1,3 +1,4 @@
++0
+ 1
+ 2
+ 3
+@@ -7,4 +8,3 @@
+ 7
+ 8
+ 9
+-10
+`},
+	}
+	for _, test := range tests {
+		if got, want := unifiedDiff("old", "new", test.a, test.b), test.want; got != want {
+			t.Errorf("%q %q got %q, want %q", test.a, test.b, got, want)
+		}
+	}
+}
+
+func TestUnifiedDiffLarge(t *testing.T) {
+	// The common prefix and suffix are stripped, so a small change in a large
+	// file doesn't need a huge LCS table.
+	var a, b bytes.Buffer
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&a, "%d\n", i)
+		if i == 50000 {
+			b.WriteString("x\n")
+		} else {
+			fmt.Fprintf(&b, "%d\n", i)
+		}
+	}
+	want := `--- old
++++ new
+@@ -49998,7 +49998,7 @@
+ 49997
+ 49998
+ 49999
+-50000
++x
+ 50001
+ 50002
+ 50003
+`
+	if got := unifiedDiff("old", "new", a.String(), b.String()); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWriteOrCheckFile(t *testing.T) {
+	defer func(check bool, stderr *os.File) { flagCheck, os.Stderr = check, stderr }(flagCheck, os.Stderr)
+	dir, err := ioutil.TempDir("", "gendoc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	file := filepath.Join(dir, "doc.go")
+	if err := writeFile(file, "a\nb\n"); err != nil {
+		t.Fatal(err)
+	}
+	flagCheck, os.Stderr = true, stderr
+	if err := writeOrCheckFile(file, "a\nb\n"); err != nil {
+		t.Errorf("got error %v, want nil", err)
+	}
+	if err := writeOrCheckFile(file, "a\nc\n"); err == nil {
+		t.Errorf("got nil error, want out of date error")
+	}
+	data, err := ioutil.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "-b\n+c\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("got diff %q, want suffix %q", got, want)
+	}
+	// The file isn't modified.
+	if data, err := ioutil.ReadFile(file); err != nil || string(data) != "a\nb\n" {
+		t.Errorf("got %q, %v, want unmodified file", data, err)
+	}
+}
+
+func TestInstallArgs(t *testing.T) {
+	defer func(tags, buildFlags string) { flagTags, flagBuildFlags = tags, buildFlags }(flagTags, flagBuildFlags)
+	flagTags = "netgo"
+	tests := []struct {
+		buildFlags string
+		want       []string
+	}{
+		{"", []string{"go", "install", "-tags=netgo", "v.io/x/tool"}},
+		{" -ldflags=-s  -trimpath ", []string{"go", "install", "-tags=netgo", "-ldflags=-s", "-trimpath", "v.io/x/tool"}},
+		{`-ldflags='-X a=b -X c=d' -gcflags="all=-N -l"`, []string{"go", "install", "-tags=netgo", "-ldflags=-X a=b -X c=d", "-gcflags=all=-N -l", "v.io/x/tool"}},
+	}
+	for _, test := range tests {
+		flagBuildFlags = test.buildFlags
+		got, err := installArgs([]string{"go", "install"}, "v.io/x/tool")
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q got (%q, %v), want (%q, nil)", test.buildFlags, got, err, test.want)
+		}
+	}
+	flagBuildFlags = "-ldflags='-s"
+	if _, err := installArgs([]string{"go", "install"}, "v.io/x/tool"); err == nil {
+		t.Errorf("%q got nil error, want unterminated quote error", flagBuildFlags)
+	}
+}
+
+func TestWriteOutputSourceInfo(t *testing.T) {
+	defer func(out string, sourceInfo bool) { flagOut, flagSourceInfo = out, sourceInfo }(flagOut, flagSourceInfo)
+	dir, err := ioutil.TempDir("", "gendoc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flagOut = filepath.Join(dir, "doc.go")
+	const info = "// DO NOT UPDATE MANUALLY\n// Generated from v.io/x/tool with args: help ...\n\n/*\n"
+	for _, sourceInfo := range []bool{true, false} {
+		flagSourceInfo = sourceInfo
+		if err := writeOutput("Usage\n", 0, "v.io/x/tool", []string{"help", "..."}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(flagOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(string(data), info); got != sourceInfo {
+			t.Errorf("%v got %q, want source info %v", sourceInfo, data, sourceInfo)
+		}
+		if !strings.Contains(string(data), "// DO NOT UPDATE MANUALLY\n\n") && !sourceInfo {
+			t.Errorf("%v got %q, want no source info", sourceInfo, data)
+		}
+	}
+}
+
+func TestRunBinaryTimeout(t *testing.T) {
+	defer func(env string, timeout time.Duration) { flagEnv, flagTimeout = env, timeout }(flagEnv, flagTimeout)
+	flagEnv, flagTimeout = "os", 100*time.Millisecond
+	binDir, err := ioutil.TempDir("", "gendoc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(binDir)
+	// The backgrounded sleep inherits stdout, and keeps it open unless the
+	// whole process group is killed.
+	script := "#!/bin/sh\necho usage\nsleep 10 &\nsleep 10\n"
+	if err := ioutil.WriteFile(filepath.Join(binDir, "tool"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, _, err = runBinary(false, binDir, "tool", nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got error %v, want timed out", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("got elapsed %v, want the process group to be killed", elapsed)
+	}
+}
+
+func TestGenerateSplit(t *testing.T) {
+	defer func(env, out string) { flagEnv, flagOut = env, out }(flagEnv, flagOut)
+	dir, err := ioutil.TempDir("", "gendoc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The stub describes the "tool net" child, whose usage uses a customized
+	// header, which isn't recognized as a list of commands.
+	script := `#!/bin/sh
+case "$*" in
+"help -style=json") echo '{"name": "tool", "children": [{"name": "net"}]}' ;;
+"help -style=json net") echo '{"name": "net"}' ;;
+"help") printf 'Usage of tool.\n\nSubcommands:\n   net  Manage the network\n' ;;
+"help net") echo 'Usage of tool net.' ;;
+*) exit 1 ;;
+esac
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "tool"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	flagEnv, flagOut = "os", filepath.Join(dir, "out")
+	if err := generateSplit(false, dir, "tool"); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		file, want string
+	}{
+		{"tool.md", "```\nUsage of tool.\n\nSubcommands:\n   net  Manage the network\n```\n\nSee also:\n\n- [tool net](tool_net.md)\n"},
+		{"tool_net.md", "```\nUsage of tool net.\n```\n\nSee also:\n\n- [tool](tool.md)\n"},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(flagOut, test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(data); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.file, got, test.want)
+		}
+	}
+}
+
+func TestInsertTableOfContents(t *testing.T) {
+	body := `Tool does things.
+
+Usage:
+   tool <command>
+
+Tool net - Manage the network
+
+Net.
+
+Tool net status - Print the status
+
+Status.
+`
+	got := insertTableOfContents(body)
+	wantTOC := `Contents
+
+  [Tool net](#hdr-Tool_net___Manage_the_network)
+    [Tool net status](#hdr-Tool_net_status___Print_the_status)
+
+Tool net - Manage the network
+`
+	if !strings.Contains(got, wantTOC) {
+		t.Errorf("got %q, want substring %q", got, wantTOC)
+	}
+	// Every link resolves to the id of a section in the output of godoc.
+	var html bytes.Buffer
+	doc.ToHTML(&html, got, nil)
+	links := regexp.MustCompile(`\]\(#([^)]+)\)`).FindAllStringSubmatch(got, -1)
+	if len(links) != 2 {
+		t.Fatalf("got links %q, want 2", links)
+	}
+	for _, link := range links {
+		if !strings.Contains(html.String(), `id="`+link[1]+`"`) {
+			t.Errorf("got html %q, want id %q", html.String(), link[1])
+		}
+	}
+}
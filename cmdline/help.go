@@ -6,13 +6,23 @@ package cmdline
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"go/doc"
 	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 	"unicode"
 	"unicode/utf8"
 
@@ -30,34 +40,265 @@ type helpRunner struct {
 
 func makeHelpRunner(path []*Command, env *Env) helpRunner {
 	return helpRunner{path, &helpConfig{
-		style:     env.style(),
-		width:     env.width(),
-		prefix:    env.prefix(),
-		firstCall: env.firstCall(),
+		HelpOptions: helpOptions,
+		style:       env.style(),
+		width:       env.Width(),
+		widthSet:    env.varsWidth() != 0,
+		prefix:      env.prefix(),
+		firstCall:   env.FirstCall(),
+		sources:     env.flagSources,
 	}}
 }
 
+// HelpOptions configures the usage and help output of all commands.  The zero
+// HelpOptions produces the default output.
+type HelpOptions struct {
+	// Atomic causes the help command, the -help flag and usage errors to render
+	// all of their output into a buffer, and write it in a single call once
+	// rendering has succeeded.  Consumers either see all of the output or none
+	// of it; e.g. a file that help is redirected to is never left with partial
+	// output.
+	Atomic bool
+	// SortCommands causes the children of each command to be listed in
+	// alphabetical order, rather than the order of Command.Children.  The
+	// default help command is always listed last, and external commands found
+	// via LookPath are always listed in alphabetical order.
+	SortCommands bool
+	// MergeExternalCommands causes external commands found via LookPath to be
+	// listed together with the children of each command, in a single list
+	// sorted in alphabetical order, both in the table of commands and in the
+	// help for all commands.  By default external commands are listed after
+	// the children, in a separate table.  The default help command is always
+	// listed last.
+	MergeExternalCommands bool
+	// ShowBuildInfo causes the help of the root command to end with the build
+	// info returned by ReadBuildInfo.  The build info is never shown in the
+	// godoc style, so that generated documentation is stable across builds.
+	ShowBuildInfo bool
+	// SuppressUsageOnError causes usage errors, e.g. from Env.UsageErrorf, to
+	// print the error followed by a one-line reminder of how to get help,
+	// rather than the full usage of the command.  By default the full usage is
+	// printed.  Errors returned by a Runner that aren't usage errors never
+	// print usage.
+	SuppressUsageOnError bool
+	// ShowFlagTypes causes each flag to be listed with the type of its value,
+	// e.g. " -port int", followed by its usage and default value, similar to
+	// the standard flag package.  By default each flag is listed with its
+	// value, e.g. " -port=8080".  See FlagsJSONSchema for how types are
+	// inferred.
+	ShowFlagTypes bool
+	// GroupInheritedFlags causes the flags that a command inherits from its
+	// ancestors to be listed in the help for the command, grouped by the
+	// ancestor that defines them, after the flags of the command itself.  By
+	// default inherited flags are only listed in the full style, mixed together
+	// after the flags of the command.
+	GroupInheritedFlags bool
+	// SuppressShowAllFlags causes the help to omit the reminder of how to show
+	// all flags, e.g. `Run "tool help -style=full" to show all global flags.`,
+	// which is printed in the compact style when some flags aren't shown.  The
+	// flags that are shown are unaffected; see HideGlobalFlagsExcept for hiding
+	// global flags.
+	SuppressShowAllFlags bool
+	// MinNameWidth is the minimum width of the name column in the tables of
+	// commands and topics, which is widened as necessary to fit the names in
+	// each table.  If zero, the default of 11 is used.
+	MinNameWidth int
+	// UnknownCommandFunc, if non-nil, returns the error reported by the help
+	// command for an unknown command or topic name, e.g. to add did-you-mean
+	// suggestions or a link to the docs.  The path is the command path that the
+	// name was looked up in, e.g. "tool net" for "tool help net foo".  The error
+	// is reported as a usage error, followed by the usage of the command.  If
+	// the func returns nil, the default error is reported, which is of the form
+	// `tool net: unknown command or topic "foo"`.
+	UnknownCommandFunc func(path, name string) error
+	// Messages holds the section labels and reminders, e.g. for translation.
+	// Empty messages use the English defaults.
+	Messages HelpMessages
+}
+
+var helpOptions = HelpOptions{Messages: defaultHelpMessages}
+
+// SetHelpOptions sets the options used for all subsequent usage and help
+// output.
+func SetHelpOptions(opts HelpOptions) {
+	opts.Messages = opts.Messages.withDefaults()
+	helpOptions = opts
+}
+
 // helpConfig holds configuration data for help.  The style and width may be
 // overridden by flags if the command returned by newCommand is parsed.
 type helpConfig struct {
+	HelpOptions
 	style     style
 	width     int
+	widthSet  bool // whether the width was set explicitly
 	prefix    string
 	firstCall bool
+	sources   map[string]flagSource
+	out       *pipeWriter // the help output, or nil for usage output
+}
+
+// children returns the children of cmd, in the order they're listed in help.
+// Hidden children are skipped.
+func (config *helpConfig) children(cmd *Command) []*Command {
+	children := visibleChildren(cmd)
+	if !config.SortCommands {
+		return children
+	}
+	sorted := append([]*Command(nil), children...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	return sorted
+}
+
+// subcommand is a child of a command listed in help; either a built-in child,
+// or an external command found via LookPath.
+type subcommand struct {
+	name   string
+	child  *Command // nil for external commands
+	binary string   // path of the external command binary
+}
+
+// externalSubcommands returns the external commands in binaries, which were
+// found via LookPath for cmd.
+func externalSubcommands(cmd *Command, binaries []string) []subcommand {
+	var subs []subcommand
+	cmdPrefix := cmd.Name + "-"
+	for _, binary := range binaries {
+		name := strings.TrimPrefix(filepath.Base(binary), cmdPrefix)
+		subs = append(subs, subcommand{name: name, binary: binary})
+	}
+	return subs
+}
+
+// subcommands returns the children of cmd, in the order they're listed in
+// help, followed by the external commands in external.  If external is
+// non-empty, all subcommands are sorted by name.
+func (config *helpConfig) subcommands(cmd *Command, external []subcommand) []subcommand {
+	var subs []subcommand
+	for _, child := range config.children(cmd) {
+		subs = append(subs, subcommand{name: child.Name, child: child})
+	}
+	if len(external) == 0 {
+		return subs
+	}
+	subs = append(subs, external...)
+	sort.SliceStable(subs, func(i, j int) bool {
+		return subs[i].name < subs[j].name
+	})
+	return subs
+}
+
+// visibleChildren returns the children of cmd that aren't hidden.
+func visibleChildren(cmd *Command) []*Command {
+	for i, child := range cmd.Children {
+		if !child.hidden {
+			continue
+		}
+		// Only copy if there are hidden children, which is rare.
+		visible := append([]*Command(nil), cmd.Children[:i]...)
+		for _, child := range cmd.Children[i+1:] {
+			if !child.hidden {
+				visible = append(visible, child)
+			}
+		}
+		return visible
+	}
+	return cmd.Children
+}
+
+// pipeWriter wraps the writer of the help output, and records whether a write
+// failed because the reader went away, e.g. for "tool help ... | head".
+type pipeWriter struct {
+	w      io.Writer
+	broken bool
+}
+
+func (p *pipeWriter) Write(data []byte) (int, error) {
+	if p.broken {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := p.w.Write(data)
+	p.broken = isBrokenPipe(err)
+	return n, err
+}
+
+// notifySIGPIPE arranges for writes to w to fail with EPIPE if the reader of
+// the pipe goes away, and returns a function that undoes it.  By default the Go
+// runtime kills the process with SIGPIPE for such writes to os.Stdout and
+// os.Stderr, so the error would never be seen; the runtime returns the error
+// instead while SIGPIPE is being notified.
+func notifySIGPIPE(w io.Writer) func() {
+	if w != io.Writer(os.Stdout) && w != io.Writer(os.Stderr) {
+		return func() {}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGPIPE)
+	return func() { signal.Stop(ch) }
+}
+
+// isBrokenPipe returns true iff err indicates that the reader of a pipe went
+// away.
+func isBrokenPipe(err error) bool {
+	return err != nil && (errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe))
 }
 
-// Run implements the Runner interface method.
+// stopped returns true iff the help output should stop, since its reader went
+// away.
+func (config *helpConfig) stopped() bool {
+	return config.out != nil && config.out.broken
+}
+
+// Run implements the Runner interface method.  If the reader of the help
+// output goes away, e.g. for "tool help ... | head", the output stops and Run
+// returns nil, rather than reporting the broken pipe.
 func (h helpRunner) Run(env *Env, args []string) error {
-	w := textutil.NewUTF8WrapWriter(env.Stdout, h.width)
-	defer w.Flush()
-	return runHelp(w, env, args, h.path, h.helpConfig)
+	defer notifySIGPIPE(env.Stdout)()
+	if !h.Atomic {
+		config := *h.helpConfig
+		config.out = &pipeWriter{w: env.Stdout}
+		w := textutil.NewUTF8WrapWriter(config.out, h.width)
+		err := runHelp(w, env, args, h.path, &config)
+		w.Flush()
+		if config.stopped() {
+			return nil
+		}
+		return err
+	}
+	// Render everything into a buffer, including the output of any external
+	// subcommands, and only write it out if rendering succeeds.
+	var buffer bytes.Buffer
+	envCopy := env.clone()
+	envCopy.Stdout = &buffer
+	w := textutil.NewUTF8WrapWriter(&buffer, h.width)
+	if err := runHelp(w, envCopy, args, h.path, h.helpConfig); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := env.Stdout.Write(buffer.Bytes()); !isBrokenPipe(err) {
+		return err
+	}
+	return nil
 }
 
 // usageFunc is used as the implementation of the Env.Usage function.
 func (h helpRunner) usageFunc(env *Env, writer io.Writer) {
-	w := textutil.NewUTF8WrapWriter(writer, h.width)
+	if !h.Atomic {
+		w := textutil.NewUTF8WrapWriter(writer, h.width)
+		usage(w, env, h.path, h.helpConfig, h.helpConfig.firstCall)
+		w.Flush()
+		return
+	}
+	var buffer bytes.Buffer
+	w := textutil.NewUTF8WrapWriter(&buffer, h.width)
 	usage(w, env, h.path, h.helpConfig, h.helpConfig.firstCall)
-	w.Flush()
+	if err := w.Flush(); err != nil {
+		return
+	}
+	writer.Write(buffer.Bytes())
 }
 
 const (
@@ -65,6 +306,36 @@ const (
 	helpShort = "Display help for commands or topics"
 )
 
+// helpWidthFlag implements the -width flag of the help command, which also
+// records that the width was set explicitly.  It's used like an int flag.
+type helpWidthFlag struct {
+	config *helpConfig
+}
+
+func (f helpWidthFlag) String() string {
+	if f.config == nil {
+		return "0"
+	}
+	return strconv.Itoa(f.config.width)
+}
+
+// Get implements the flag.Getter interface method.
+func (f helpWidthFlag) Get() interface{} {
+	if f.config == nil {
+		return 0
+	}
+	return f.config.width
+}
+
+func (f helpWidthFlag) Set(value string) error {
+	width, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	f.config.width, f.config.widthSet = width, true
+	return nil
+}
+
 // newCommand returns a new help command that uses h as its Runner.
 func (h helpRunner) newCommand() *Command {
 	help := &Command{
@@ -88,10 +359,12 @@ The formatting style for help output:
    compact   - Good for compact cmdline output.
    full      - Good for cmdline output, shows all global flags.
    godoc     - Good for godoc processing.
-   shortonly - Only output short description.
+   short     - Only output the short description, e.g. for scripting.
+   rst       - Good for reStructuredText processing.
+   json      - Only output a JSON description of the command, e.g. for tools.
 Override the default by setting the CMDLINE_STYLE environment variable.
 `)
-	help.Flags.IntVar(&h.width, "width", h.width, `
+	help.Flags.Var(helpWidthFlag{h.helpConfig}, "width", `
 Format output to this target width in runes, or unlimited if width < 0.
 Defaults to the terminal width if available.  Override the default by setting
 the CMDLINE_WIDTH environment variable.
@@ -116,20 +389,20 @@ func runHelp(w *textutil.WrapWriter, env *Env, args []string, path []*Command, c
 	// Look for matching children.
 	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
 	subName, subArgs := args[0], args[1:]
-	for _, child := range cmd.Children {
-		if child.Name == subName {
-			return runHelp(w, env, subArgs, append(path, child), config)
-		}
+	fold := path[0].CaseInsensitive
+	if child := lookupChild(cmd, subName, fold); child != nil {
+		return runHelp(w, env, subArgs, append(path, child), config)
 	}
-	if helpName == subName {
+	if matchName(helpName, subName, fold) {
 		help := helpRunner{path, config}.newCommand()
 		return runHelp(w, env, subArgs, append(path, help), config)
 	}
 	if cmd.LookPath {
 		// Look for a matching executable in PATH.
-		if subCmd, _ := env.LookPath(cmd.Name + "-" + subName); subCmd != "" {
+		if subCmd, _ := env.lookPath(cmd.LookPathDirs, cmd.Name+"-"+subName); subCmd != "" {
 			runner := binaryRunner{subCmd, cmdPath}
 			envCopy := env.clone()
+			envCopy.Stdin = nil
 			envCopy.Vars["CMDLINE_STYLE"] = config.style.String()
 			if len(subArgs) == 0 {
 				return runner.Run(envCopy, []string{"-help"})
@@ -138,13 +411,16 @@ func runHelp(w *textutil.WrapWriter, env *Env, args []string, path []*Command, c
 		}
 	}
 	// Look for matching topic.
-	for _, topic := range cmd.Topics {
-		if topic.Name == subName {
-			fmt.Fprintln(w, topic.Long)
-			return nil
-		}
+	if topic := lookupTopic(cmd, subName, fold); topic != nil {
+		printTopicLong(w, topic, config.style)
+		return nil
 	}
 	fn := helpRunner{path, config}.usageFunc
+	if config.UnknownCommandFunc != nil {
+		if err := config.UnknownCommandFunc(cmdPath, subName); err != nil {
+			return usageErrorf(env, fn, "%v", err)
+		}
+	}
 	return usageErrorf(env, fn, "%s: unknown command or topic %q", cmdPath, subName)
 }
 
@@ -196,16 +472,48 @@ func lineBreak(w *textutil.WrapWriter, style style) {
 			width = defaultWidth
 		}
 		fmt.Fprintln(w, strings.Repeat("=", width))
-	case styleGoDoc:
+	case styleGoDoc, styleReST:
 		fmt.Fprintln(w)
 	}
 	w.Flush()
 }
 
+// restAdornments holds the characters used to underline reStructuredText
+// section titles, indexed by the depth of the section.
+const restAdornments = "=-~^\"'"
+
+// restTitle returns a reStructuredText section title for the given path and
+// short description, underlined according to the depth of the section.
+func restTitle(path, short string, depth int) string {
+	title := path
+	if short != "" {
+		title += " - " + short
+	}
+	if depth >= len(restAdornments) {
+		depth = len(restAdornments) - 1
+	}
+	return title + "\n" + strings.Repeat(restAdornments[depth:depth+1], utf8.RuneCountInString(title))
+}
+
+// printBlockIntro prints intro, which introduces an indented block, e.g. the
+// usage lines or a table of commands.  In the rst style the block is marked as
+// a literal block, so that its lines are preserved.
+func printBlockIntro(w *textutil.WrapWriter, style style, intro string) {
+	if style == styleReST {
+		fmt.Fprintln(w, intro+":")
+		fmt.Fprintln(w)
+		return
+	}
+	fmt.Fprintln(w, intro)
+}
+
 // needsHelpChild returns true if cmd needs a default help command to be
 // appended to its children.  Every command that has children and doesn't
-// already have a "help" command needs a help child.
+// already have a "help" command needs a help child, unless it sets NoHelpChild.
 func needsHelpChild(cmd *Command) bool {
+	if cmd.NoHelpChild {
+		return false
+	}
 	for _, child := range cmd.Children {
 		if child.Name == helpName {
 			return false
@@ -216,63 +524,178 @@ func needsHelpChild(cmd *Command) bool {
 
 // usageAll prints usage recursively via DFS from the path onward.
 func usageAll(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig, firstCall bool) {
+	if config.stopped() {
+		return
+	}
 	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
 	usage(w, env, path, config, firstCall)
-	for _, child := range cmd.Children {
-		usageAll(w, env, append(path, child), config, false)
+	if config.stopped() {
+		return
+	}
+	var external, merged []subcommand
+	if cmd.LookPath {
+		cmdPrefix := cmd.Name + "-"
+		binaries, _ := env.lookPathPrefix(cmd.LookPathDirs, cmdPrefix, cmd.subNames(cmdPrefix))
+		external = externalSubcommands(cmd, binaries)
+	}
+	if config.MergeExternalCommands {
+		merged, external = external, nil
+	}
+	// Capture the help of all external children up front, concurrently.
+	helps := captureExternalHelp(env, path, append(merged, external...), config)
+	for _, sub := range config.subcommands(cmd, merged) {
+		if sub.child != nil {
+			usageAll(w, env, append(path, sub.child), config, false)
+		} else {
+			usageExternal(w, path, sub, helps[sub.binary], config)
+		}
 	}
 	if firstCall && needsHelpChild(cmd) {
 		help := helpRunner{path, config}.newCommand()
 		usageAll(w, env, append(path, help), config, false)
 	}
-	if cmd.LookPath {
-		cmdPrefix := cmd.Name + "-"
-		subCmds, _ := env.LookPathPrefix(cmdPrefix, cmd.subNames(cmdPrefix))
-		for _, subCmd := range subCmds {
-			runner := binaryRunner{subCmd, cmdPath}
-			var buffer bytes.Buffer
-			envCopy := env.clone()
-			envCopy.Stdout = &buffer
-			envCopy.Stderr = &buffer
-			envCopy.Vars["CMDLINE_FIRST_CALL"] = "false"
-			envCopy.Vars["CMDLINE_STYLE"] = config.style.String()
-			if err := runner.Run(envCopy, []string{helpName, "..."}); err == nil {
-				// The external child supports "help".
-				if config.style == styleGoDoc {
-					// The textutil package will discard any leading empty lines
-					// produced by the child process output, so we need to
-					// output it here.
-					fmt.Fprintln(w)
-				}
-				fmt.Fprint(w, buffer.String())
-				continue
-			}
-			buffer.Reset()
-			if err := runner.Run(envCopy, []string{"-help"}); err == nil {
-				// The external child supports "-help".
-				if config.style == styleGoDoc {
-					// The textutil package will discard any leading empty lines
-					// produced by the child process output, so we need to
-					// output it here.
-					fmt.Fprintln(w)
-				}
-				fmt.Fprint(w, buffer.String())
-				continue
-			}
-			// The external child does not support "help" or "-help".
-			lineBreak(w, config.style)
-			subName := strings.TrimPrefix(filepath.Base(subCmd), cmdPrefix)
-			fmt.Fprintln(w, godocHeader(cmdPath+" "+subName, missingDescription))
-		}
+	for _, sub := range external {
+		usageExternal(w, path, sub, helps[sub.binary], config)
 	}
 	for _, topic := range cmd.Topics {
 		lineBreak(w, config.style)
 		w.ForceVerbatim(true)
-		fmt.Fprintln(w, godocHeader(cmdPath+" "+topic.Name, topic.Short))
+		if config.style == styleReST {
+			fmt.Fprintln(w, restTitle(cmdPath+" "+topic.Name, topic.Short, len(path)))
+		} else {
+			fmt.Fprintln(w, godocHeader(cmdPath+" "+topic.Name, topic.Short))
+		}
 		w.ForceVerbatim(false)
 		fmt.Fprintln(w)
-		fmt.Fprintln(w, topic.Long)
+		printTopicLong(w, &topic, config.style)
+	}
+}
+
+// externalHelp holds the captured help of an external child.
+type externalHelp struct {
+	output string
+	ok     bool // false if the child doesn't support "help" or "-help"
+}
+
+// maxExternalHelpWorkers is the maximum number of external children that are
+// run concurrently to capture their help.
+var maxExternalHelpWorkers = runtime.NumCPU()
+
+// captureExternalHelp captures the help of each of subs, which are external
+// children of the last command in path, keyed by binary.  The children are run
+// concurrently, by at most maxExternalHelpWorkers workers.
+func captureExternalHelp(env *Env, path []*Command, subs []subcommand, config *helpConfig) map[string]externalHelp {
+	if len(subs) == 0 {
+		return nil
+	}
+	workers := maxExternalHelpWorkers
+	if workers > len(subs) {
+		workers = len(subs)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	helps := make([]externalHelp, len(subs))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				helps[index] = runExternalHelp(env, path, subs[index], config)
+			}
+		}()
+	}
+	for index := range subs {
+		indices <- index
+	}
+	close(indices)
+	wg.Wait()
+	result := make(map[string]externalHelp, len(subs))
+	for index, sub := range subs {
+		result[sub.binary] = helps[index]
+	}
+	return result
+}
+
+// runExternalHelp runs sub, an external child of the last command in path, to
+// capture its help.  It may be called concurrently, so the child doesn't use
+// the Timer of env.
+func runExternalHelp(env *Env, path []*Command, sub subcommand, config *helpConfig) externalHelp {
+	runner := binaryRunner{sub.binary, pathName(config.prefix, path)}
+	var buffer bytes.Buffer
+	envCopy := env.clone()
+	envCopy.Stdin = nil
+	envCopy.Stdout = &buffer
+	envCopy.Stderr = &buffer
+	envCopy.Timer = nil
+	envCopy.Vars["CMDLINE_FIRST_CALL"] = "false"
+	envCopy.Vars["CMDLINE_STYLE"] = config.style.String()
+	if err := runner.Run(envCopy, []string{helpName, "..."}); err == nil {
+		// The external child supports "help".
+		return externalHelp{buffer.String(), true}
+	}
+	buffer.Reset()
+	if err := runner.Run(envCopy, []string{"-help"}); err == nil {
+		// The external child supports "-help".
+		return externalHelp{buffer.String(), true}
+	}
+	return externalHelp{}
+}
+
+// usageExternal prints the usage of sub, an external child of the last command
+// in path, to w, given its captured help.
+func usageExternal(w *textutil.WrapWriter, path []*Command, sub subcommand, help externalHelp, config *helpConfig) {
+	cmdPath := pathName(config.prefix, path)
+	if help.ok {
+		if isDocStyle(config.style) {
+			// The textutil package will discard any leading empty lines
+			// produced by the child process output, so we need to
+			// output it here.
+			fmt.Fprintln(w)
+		}
+		fmt.Fprint(w, help.output)
+		return
 	}
+	// The external child does not support "help" or "-help".
+	lineBreak(w, config.style)
+	if config.style == styleReST {
+		fmt.Fprintln(w, restTitle(cmdPath+" "+sub.name, config.Messages.MissingDescription, len(path)))
+		return
+	}
+	fmt.Fprintln(w, godocHeader(cmdPath+" "+sub.name, config.Messages.MissingDescription))
+}
+
+// shortManifestSuffix is the suffix of the file next to the binary of an
+// external child, which holds its short description.
+const shortManifestSuffix = ".short"
+
+// externalShort returns the short description of sub, an external child of the
+// command at cmdPath.  The first line of the manifest file next to the binary is
+// used if it's non-empty, to avoid running the binary.
+func externalShort(env *Env, cmdPath string, sub subcommand, config *helpConfig) string {
+	if data, err := ioutil.ReadFile(sub.binary + shortManifestSuffix); err == nil {
+		short := strings.TrimSpace(string(data))
+		if index := strings.IndexByte(short, '\n'); index != -1 {
+			short = strings.TrimSpace(short[:index])
+		}
+		if short != "" {
+			return short
+		}
+	}
+	runner := binaryRunner{sub.binary, cmdPath}
+	var buffer bytes.Buffer
+	envCopy := env.clone()
+	envCopy.Stdin = nil
+	envCopy.Stdout = &buffer
+	envCopy.Stderr = &buffer
+	envCopy.Vars["CMDLINE_STYLE"] = "shortonly"
+	if err := runner.Run(envCopy, []string{"-help"}); err != nil {
+		return config.Messages.MissingDescription
+	}
+	// The external child supports "-help".
+	return buffer.String()
 }
 
 // usage prints the usage of the last command in path to w.  The bool firstCall
@@ -287,96 +710,97 @@ func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig
 		fmt.Fprintln(w, cmd.Short)
 		return
 	}
-	if !firstCall {
+	if config.style == styleJSON {
+		usageJSON(w, env, path, config)
+		return
+	}
+	switch {
+	case config.style == styleReST:
+		// Every command has a section, so that the sections nest by depth.
+		if !firstCall {
+			lineBreak(w, config.style)
+		}
+		w.ForceVerbatim(true)
+		fmt.Fprintln(w, restTitle(cmdPath, cmd.Short, len(path)-1))
+		w.ForceVerbatim(false)
+		fmt.Fprintln(w)
+	case !firstCall:
 		lineBreak(w, config.style)
 		w.ForceVerbatim(true)
 		fmt.Fprintln(w, godocHeader(cmdPath, cmd.Short))
 		w.ForceVerbatim(false)
 		fmt.Fprintln(w)
 	}
+	if cmd.HelpWidth != 0 && !config.widthSet {
+		defer w.SetWidth(w.Width())
+		w.SetWidth(cmd.HelpWidth)
+	}
 	fmt.Fprintln(w, cmd.Long)
 	fmt.Fprintln(w)
 	// Usage line.
-	fmt.Fprintln(w, "Usage:")
-	cmdPathF := "   " + cmdPath
-	if countFlags(pathFlags(path), nil, true) > 0 || countFlags(globalFlags, nil, true) > 0 {
-		cmdPathF += " [flags]"
+	printBlockIntro(w, config.style, config.Messages.Usage)
+	var flagsF string
+	if countFlags(pathFlags(path), nil) > 0 || countFlags(globalFlags, showGlobalFlag) > 0 {
+		flagsF = "[flags]"
 	}
 	if cmd.Runner != nil {
-		if cmd.ArgsName != "" {
-			fmt.Fprintln(w, cmdPathF, cmd.ArgsName)
-		} else {
-			fmt.Fprintln(w, cmdPathF)
-		}
+		printSynopsis(w, cmdPath, flagsF, cmd.ArgsName)
 	}
-	var extChildren []string
-	cmdPrefix := cmd.Name + "-"
+	var external []subcommand
 	if cmd.LookPath {
-		extChildren, _ = env.LookPathPrefix(cmdPrefix, cmd.subNames(cmdPrefix))
+		cmdPrefix := cmd.Name + "-"
+		extChildren, _ := env.lookPathPrefix(cmd.LookPathDirs, cmdPrefix, cmd.subNames(cmdPrefix))
+		external = externalSubcommands(cmd, extChildren)
 	}
-	hasSubcommands := len(cmd.Children) > 0 || len(extChildren) > 0
+	hasSubcommands := len(cmd.Children) > 0 || len(external) > 0
 	if hasSubcommands {
-		fmt.Fprintln(w, cmdPathF, "<command>")
+		printSynopsis(w, cmdPath, flagsF, "<command>")
 		fmt.Fprintln(w)
 	}
-	printShort := func(width int, name, short string) {
-		fmt.Fprintf(w, "%-[1]*[2]s %[3]s", width, name, short)
-		w.Flush()
+	var names []string
+	for _, child := range visibleChildren(cmd) {
+		names = append(names, child.Name)
 	}
-	const minNameWidth = 11
-	nameWidth := minNameWidth
-	for _, child := range cmd.Children {
-		if w := len(child.Name); w > nameWidth {
-			nameWidth = w
-		}
+	for _, sub := range external {
+		names = append(names, sub.name)
 	}
-	for _, extCmd := range extChildren {
-		extName := strings.TrimPrefix(filepath.Base(extCmd), cmdPrefix)
-		if w := len(extName); w > nameWidth {
-			nameWidth = w
-		}
+	if firstCall && needsHelpChild(cmd) {
+		names = append(names, helpName)
 	}
-	// Built-in commands.
-	if len(cmd.Children) > 0 {
+	table := newShortTable(w, names, config.minNameWidth())
+	var merged []subcommand
+	if config.MergeExternalCommands {
+		merged, external = external, nil
+	}
+	// Built-in commands, and merged external commands.
+	if len(cmd.Children) > 0 || len(merged) > 0 {
 		w.SetIndents()
-		fmt.Fprintln(w, "The", cmdPath, "commands are:")
-		// Print as a table with aligned columns Name and Short.
-		w.SetIndents(spaces(3), spaces(3+nameWidth+1))
-		for _, child := range cmd.Children {
-			printShort(nameWidth, child.Name, child.Short)
+		printBlockIntro(w, config.style, fmt.Sprintf(config.Messages.Commands, cmdPath))
+		for _, sub := range config.subcommands(cmd, merged) {
+			if sub.child != nil {
+				table.row(sub.name, sub.child.Short)
+			} else {
+				table.row(sub.name, externalShort(env, cmdPath, sub, config))
+			}
 		}
 		// Default help command.
 		if firstCall && needsHelpChild(cmd) {
-			printShort(nameWidth, helpName, helpShort)
+			table.row(helpName, helpShort)
 		}
 	}
 	// External commands.
-	if len(extChildren) > 0 {
+	if len(external) > 0 {
 		w.SetIndents()
-		fmt.Fprintln(w, "The", cmdPath, "external commands are:")
-		// Print as a table with aligned columns Name and Short.
-		w.SetIndents(spaces(3), spaces(3+nameWidth+1))
-		for _, extCmd := range extChildren {
-			runner := binaryRunner{extCmd, cmdPath}
-			var buffer bytes.Buffer
-			envCopy := env.clone()
-			envCopy.Stdout = &buffer
-			envCopy.Stderr = &buffer
-			envCopy.Vars["CMDLINE_STYLE"] = "shortonly"
-			short := missingDescription
-			if err := runner.Run(envCopy, []string{"-help"}); err == nil {
-				// The external child supports "-help".
-				short = buffer.String()
-			}
-			extName := strings.TrimPrefix(filepath.Base(extCmd), cmdPrefix)
-			printShort(nameWidth, extName, short)
+		printBlockIntro(w, config.style, fmt.Sprintf(config.Messages.ExternalCommands, cmdPath))
+		for _, sub := range external {
+			table.row(sub.name, externalShort(env, cmdPath, sub, config))
 		}
 	}
 	// Command footer.
 	if hasSubcommands {
 		w.SetIndents()
-		if firstCall && config.style != styleGoDoc {
-			fmt.Fprintf(w, "Run \"%s help [command]\" for command usage.\n", cmdPath)
+		if firstCall && !isDocStyle(config.style) && !cmd.NoHelpChild {
+			fmt.Fprintf(w, config.Messages.CommandHelp+"\n", cmdPath)
 		}
 	}
 	// Args.
@@ -387,125 +811,358 @@ func usage(w *textutil.WrapWriter, env *Env, path []*Command, config *helpConfig
 	// Help topics.
 	if len(cmd.Topics) > 0 {
 		fmt.Fprintln(w)
-		fmt.Fprintln(w, "The", cmdPath, "additional help topics are:")
-		nameWidth := minNameWidth
+		printBlockIntro(w, config.style, fmt.Sprintf(config.Messages.Topics, cmdPath))
+		var names []string
 		for _, topic := range cmd.Topics {
-			if w := len(topic.Name); w > nameWidth {
-				nameWidth = w
-			}
+			names = append(names, topic.Name)
 		}
-		// Print as a table with aligned columns Name and Short.
-		w.SetIndents(spaces(3), spaces(3+nameWidth+1))
+		table := newShortTable(w, names, config.minNameWidth())
 		for _, topic := range cmd.Topics {
-			printShort(nameWidth, topic.Name, topic.Short)
+			table.row(topic.Name, topic.Short)
 		}
 		w.SetIndents()
-		if firstCall && config.style != styleGoDoc {
-			fmt.Fprintf(w, "Run \"%s help [topic]\" for topic details.\n", cmdPath)
+		if firstCall && !isDocStyle(config.style) && !cmd.NoHelpChild {
+			fmt.Fprintf(w, config.Messages.TopicHelp+"\n", cmdPath)
 		}
 	}
 	hidden := flagsUsage(w, path, config)
 	// Only show global flags on the first call.
 	if firstCall {
-		hidden = globalFlagsUsage(w, config) || hidden
+		hidden = globalFlagsUsage(w, path, config) || hidden
 	}
-	if hidden {
+	if hidden && !config.SuppressShowAllFlags {
 		fmt.Fprintln(w)
-		fullhelp := fmt.Sprintf(`Run "%s help -style=full" to show all flags.`, cmdPath)
-		if len(cmd.Children) == 0 {
-			if len(path) > 1 {
-				parentPath := pathName(config.prefix, path[:len(path)-1])
-				fullhelp = fmt.Sprintf(`Run "%s help -style=full %s" to show all flags.`, parentPath, cmd.Name)
-			} else {
-				fullhelp = fmt.Sprintf(`Run "CMDLINE_STYLE=full %s -help" to show all flags.`, cmdPath)
-			}
+		// Use the help command of cmd or its parent, if there is one.
+		fullhelp := "CMDLINE_STYLE=full " + cmdPath + " -help"
+		switch {
+		case len(cmd.Children) > 0 && !cmd.NoHelpChild:
+			fullhelp = cmdPath + " help -style=full"
+		case len(cmd.Children) == 0 && len(path) > 1 && !path[len(path)-2].NoHelpChild:
+			parentPath := pathName(config.prefix, path[:len(path)-1])
+			fullhelp = parentPath + " help -style=full " + cmd.Name
 		}
-		fmt.Fprintln(w, fullhelp)
+		fmt.Fprintf(w, config.Messages.ShowAllFlags+"\n", fullhelp)
+	}
+	if config.ShowBuildInfo && len(path) == 1 && !isDocStyle(config.style) {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, cmdPath, versionName, ReadBuildInfo())
 	}
 }
 
 func flagsUsage(w *textutil.WrapWriter, path []*Command, config *helpConfig) bool {
+	if config.GroupInheritedFlags {
+		groupedFlagsUsage(w, path, config)
+		return false
+	}
 	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
-	allFlags := pathFlags(path)
-	numCompact := countFlags(&cmd.Flags, nil, true)
-	numFull := countFlags(allFlags, nil, true) - numCompact
+	allFlags, ownFlags := pathFlags(path), commandFlags(cmd)
+	numCompact := countFlags(ownFlags, nil)
+	numFull := countFlags(allFlags, func(name string) bool { return ownFlags.Lookup(name) == nil })
 	if config.style == styleCompact {
 		// Compact style, only show compact flags.
 		if numCompact > 0 {
 			fmt.Fprintln(w)
-			fmt.Fprintln(w, "The", cmdPath, "flags are:")
-			printFlags(w, &cmd.Flags, nil, config.style, nil, true)
+			printFlagsIntro(w, config.style, fmt.Sprintf(config.Messages.Flags, cmdPath))
+			printFlags(w, path, ownFlags, nil, config, nil)
+			flagGroupsUsage(w, cmd)
 		}
 		return numFull > 0
 	}
 	// Non-compact style, always show all flags.
 	if numCompact > 0 || numFull > 0 {
 		fmt.Fprintln(w)
-		fmt.Fprintln(w, "The", cmdPath, "flags are:")
-		printFlags(w, &cmd.Flags, nil, config.style, nil, true)
+		printFlagsIntro(w, config.style, fmt.Sprintf(config.Messages.Flags, cmdPath))
+		printFlags(w, path, ownFlags, nil, config, nil)
 		if numCompact > 0 && numFull > 0 {
 			fmt.Fprintln(w)
 		}
-		printFlags(w, allFlags, &cmd.Flags, config.style, nil, true)
+		printFlags(w, path, allFlags, ownFlags, config, nil)
+		flagGroupsUsage(w, cmd)
 	}
 	return false
 }
 
-func globalFlagsUsage(w *textutil.WrapWriter, config *helpConfig) bool {
-	numCompact := countFlags(globalFlags, nonHiddenGlobalFlags, true)
-	numFull := countFlags(globalFlags, nonHiddenGlobalFlags, false)
+// commandFlags returns the flags of cmd, including the flags that cmd defines
+// via ContributeGlobalFlags, which are shown with the flags of cmd rather than
+// with the global flags.
+func commandFlags(cmd *Command) *flag.FlagSet {
+	contributed := contributedFlags([]*Command{cmd})
+	if contributed == nil {
+		return &cmd.Flags
+	}
+	flags := copyFlags(&cmd.Flags)
+	mergeFlags(flags, contributed)
+	return flags
+}
+
+// groupedFlagsUsage prints the flags of the last command in path, followed by
+// the flags it inherits from each of its ancestors, grouped by ancestor.
+func groupedFlagsUsage(w *textutil.WrapWriter, path []*Command, config *helpConfig) {
+	cmd, cmdPath := path[len(path)-1], pathName(config.prefix, path)
+	ownFlags := commandFlags(cmd)
+	printed := false
+	if countFlags(ownFlags, nil) > 0 {
+		fmt.Fprintln(w)
+		printFlagsIntro(w, config.style, fmt.Sprintf(config.Messages.Flags, cmdPath))
+		printFlags(w, path, ownFlags, nil, config, nil)
+		printed = true
+	}
+	// Flags that are shadowed by closer commands are skipped.
+	seen := copyFlags(ownFlags)
+	for _, p := range inheritedFlagLevels(path) {
+		flags := &path[p].Flags
+		unseen := func(name string) bool { return seen.Lookup(name) == nil }
+		if countFlags(flags, unseen) == 0 {
+			continue
+		}
+		fmt.Fprintln(w)
+		printFlagsIntro(w, config.style, fmt.Sprintf(config.Messages.InheritedFlags, pathName(config.prefix, path[:p+1])))
+		printFlags(w, path, flags, seen, config, nil)
+		mergeFlags(seen, flags)
+		printed = true
+	}
+	if printed {
+		flagGroupsUsage(w, cmd)
+	}
+}
+
+// flagGroupsUsage describes the flag groups of cmd, after its flags.
+func flagGroupsUsage(w *textutil.WrapWriter, cmd *Command) {
+	if len(cmd.flagGroups) == 0 {
+		return
+	}
+	fmt.Fprintln(w)
+	for _, g := range cmd.flagGroups {
+		fmt.Fprintln(w, g)
+	}
+}
+
+func globalFlagsUsage(w *textutil.WrapWriter, path []*Command, config *helpConfig) bool {
+	globalFlags := pathGlobalFlags(path)
+	// Flags excluded by the Full filter are never shown, and the flags contributed
+	// by the last command in path are shown with its own flags.
+	full := showGlobalFlag
+	if contributed := contributedFlags(path[len(path)-1:]); contributed != nil {
+		full = func(name string) bool { return showGlobalFlag(name) && contributed.Lookup(name) == nil }
+	}
+	compact := func(name string) bool { return full(name) && globalFlagsPolicy.Compact.show(name) }
+	fullOnly := func(name string) bool { return full(name) && !compact(name) }
 	if config.style == styleCompact {
 		// Compact style, only show compact flags.
-		if numCompact > 0 {
+		if countFlags(globalFlags, compact) > 0 {
 			fmt.Fprintln(w)
-			fmt.Fprintln(w, "The global flags are:")
-			printFlags(w, globalFlags, nil, config.style, nonHiddenGlobalFlags, true)
+			printFlagsIntro(w, config.style, config.Messages.GlobalFlags)
+			printFlags(w, path, globalFlags, nil, config, compact)
 		}
-		return numFull > 0
+		return countFlags(globalFlags, fullOnly) > 0
 	}
-	// Non-compact style, always show all global flags.
-	if numCompact > 0 || numFull > 0 {
+	// Non-compact style, show the compact flags followed by the others.
+	numCompact, numFullOnly := countFlags(globalFlags, compact), countFlags(globalFlags, fullOnly)
+	if numCompact > 0 || numFullOnly > 0 {
 		fmt.Fprintln(w)
-		fmt.Fprintln(w, "The global flags are:")
-		printFlags(w, globalFlags, nil, config.style, nonHiddenGlobalFlags, true)
-		if numCompact > 0 && numFull > 0 {
+		printFlagsIntro(w, config.style, config.Messages.GlobalFlags)
+		printFlags(w, path, globalFlags, nil, config, compact)
+		if numCompact > 0 && numFullOnly > 0 {
 			fmt.Fprintln(w)
 		}
-		printFlags(w, globalFlags, nil, config.style, nonHiddenGlobalFlags, false)
+		printFlags(w, path, globalFlags, nil, config, fullOnly)
 	}
 	return false
 }
 
-func countFlags(flags *flag.FlagSet, regexps []*regexp.Regexp, match bool) (num int) {
+// printFlagsIntro prints intro, which introduces a list of flags.  In the rst
+// style, the flags are a field list, which must be separated by a blank line.
+func printFlagsIntro(w *textutil.WrapWriter, style style, intro string) {
+	fmt.Fprintln(w, intro)
+	if style == styleReST {
+		fmt.Fprintln(w)
+	}
+}
+
+// countFlags returns the number of flags for which show returns true; a nil show
+// counts all flags.
+func countFlags(flags *flag.FlagSet, show func(name string) bool) (num int) {
 	flags.VisitAll(func(f *flag.Flag) {
-		if match == matchRegexps(regexps, f.Name) {
+		if show == nil || show(f.Name) {
 			num++
 		}
 	})
 	return
 }
 
-func printFlags(w *textutil.WrapWriter, flags, filter *flag.FlagSet, style style, regexps []*regexp.Regexp, match bool) {
+// printFlags prints the flags that aren't in filter, and for which show returns
+// true; a nil show prints all flags.
+func printFlags(w *textutil.WrapWriter, path []*Command, flags, filter *flag.FlagSet, config *helpConfig, show func(name string) bool) {
 	flags.VisitAll(func(f *flag.Flag) {
 		if filter != nil && filter.Lookup(f.Name) != nil {
 			return
 		}
-		if match != matchRegexps(regexps, f.Name) {
+		if show != nil && !show(f.Name) {
 			return
 		}
-		value := f.Value.String()
-		if style == styleGoDoc {
-			// When using styleGoDoc we use the default value, so that e.g. regular
+		value, usage := f.Value.String(), f.Usage
+		if config.ShowFlagTypes {
+			// Remove the back quotes around the name of the value, if any.
+			_, usage = flag.UnquoteUsage(f)
+		}
+		if isDocStyle(config.style) {
+			// When generating docs we use the default value, so that e.g. regular
 			// help will show "/usr/home/me/foo" while godoc will show "$HOME/foo".
 			value = f.DefValue
 		}
-		fmt.Fprintf(w, " -%s=%v", f.Name, value)
+		if envVar := flagEnvVar(path, f.Name); envVar != "" {
+			if isDocStyle(config.style) {
+				usage += fmt.Sprintf(" [env: %s]", envVar)
+			} else {
+				// Also show where the current value came from.
+				source := config.sources[f.Name]
+				if source == "" {
+					source = flagSourceDefault
+				}
+				usage += fmt.Sprintf(" [env: %s, source: %s]", envVar, source)
+			}
+		}
+		name := f.Name + "=" + value
+		if config.ShowFlagTypes {
+			name = f.Name + " " + flagTypeName(f)
+			if !isZeroFlagValue(value) {
+				usage += fmt.Sprintf(" (default %s)", value)
+			}
+		}
+		if config.style == styleReST {
+			// Each flag is a field, with the usage as its indented body.
+			w.SetIndents("", spaces(3))
+			fmt.Fprintf(w, ":option -%s: %s\n", name, usage)
+			w.SetIndents()
+			return
+		}
+		fmt.Fprintf(w, " -%s", name)
 		w.SetIndents(spaces(3))
-		fmt.Fprintln(w, f.Usage)
+		fmt.Fprintln(w, usage)
 		w.SetIndents()
 	})
 }
 
+// flagTypeName returns the name of the type of the value of f, inferred from
+// the value returned by flag.Getter: bool, int, uint, float, string or
+// duration.  Flags that implement an Options method, like EnumFlag, are named
+// by their options, e.g. "json|yaml".  Other flags are named by a back-quoted
+// name in their usage, as with flag.UnquoteUsage, or "value" otherwise.
+func flagTypeName(f *flag.Flag) string {
+	if enum, ok := f.Value.(enumOptions); ok {
+		return strings.Join(enum.Options(), "|")
+	}
+	if getter, ok := f.Value.(flag.Getter); ok {
+		switch getter.Get().(type) {
+		case bool:
+			return "bool"
+		case int, int64:
+			return "int"
+		case uint, uint64:
+			return "uint"
+		case float64:
+			return "float"
+		case string:
+			return "string"
+		case time.Duration:
+			return "duration"
+		}
+	}
+	if name, _ := flag.UnquoteUsage(f); name != "" {
+		return name
+	}
+	return "value"
+}
+
+// isZeroFlagValue returns true iff value is the zero value of a standard flag
+// type, which isn't worth showing as the default.
+func isZeroFlagValue(value string) bool {
+	switch value {
+	case "", "0", "false", "0s":
+		return true
+	}
+	return false
+}
+
+// printSynopsis prints a usage line for cmdPath followed by args, which are
+// wrapped with a hanging indent under the end of the command path, unless the
+// command path takes up more than half of the width.  Empty args are skipped.
+func printSynopsis(w *textutil.WrapWriter, cmdPath string, args ...string) {
+	hanging := 3 + textutil.DisplayWidth(cmdPath) + 1
+	if width := w.Width(); width >= 0 && hanging > width/2 {
+		hanging = 6
+	}
+	line := cmdPath
+	for _, arg := range args {
+		if arg != "" {
+			line += " " + arg
+		}
+	}
+	w.SetIndents(spaces(3), spaces(hanging))
+	fmt.Fprintln(w, line)
+	w.SetIndents()
+}
+
+// defaultMinNameWidth is the default minimum width of the name column in
+// tables printed by shortTable, and minShortWidth is the minimum width of the
+// short column.
+const (
+	defaultMinNameWidth = 11
+	minShortWidth       = 20
+)
+
+// minNameWidth returns the minimum width of the name column in tables printed
+// by shortTable.
+func (config *helpConfig) minNameWidth() int {
+	if config.MinNameWidth > 0 {
+		return config.MinNameWidth
+	}
+	return defaultMinNameWidth
+}
+
+// shortTable prints a table with aligned columns of names and short
+// descriptions, e.g. for commands and topics.  Long descriptions are wrapped
+// within the short column.
+type shortTable struct {
+	w         *textutil.WrapWriter
+	nameWidth int
+}
+
+// newShortTable returns a table written to w, with a name column that fits
+// names, and is at least minNameWidth wide.  The name column is narrowed if
+// necessary to leave at least minShortWidth columns for the descriptions; rows
+// with names that don't fit start their description on the next line.
+func newShortTable(w *textutil.WrapWriter, names []string, minNameWidth int) *shortTable {
+	nameWidth := minNameWidth
+	for _, name := range names {
+		if w := textutil.DisplayWidth(name); w > nameWidth {
+			nameWidth = w
+		}
+	}
+	if width := w.Width(); width >= 0 && 3+nameWidth+1+minShortWidth > width {
+		nameWidth = width - 3 - 1 - minShortWidth
+		if nameWidth < minNameWidth {
+			nameWidth = minNameWidth
+		}
+	}
+	return &shortTable{w, nameWidth}
+}
+
+// row prints a row of the table, with the given name and short description.
+func (t *shortTable) row(name, short string) {
+	t.w.SetIndents(spaces(3), spaces(3+t.nameWidth+1))
+	// Pad by display width, so that non-ASCII names are aligned.
+	pad := t.nameWidth - textutil.DisplayWidth(name)
+	switch {
+	case pad < 0:
+		// The description starts on the next line, in the short column.
+		fmt.Fprintf(t.w, "%s%c%s", name, textutil.LineSeparator, short)
+	default:
+		fmt.Fprintf(t.w, "%s%s %s", name, spaces(pad), short)
+	}
+	t.w.Flush()
+}
+
 func spaces(count int) string {
 	return strings.Repeat(" ", count)
 }
@@ -524,19 +1181,82 @@ func matchRegexps(regexps []*regexp.Regexp, name string) bool {
 	return false
 }
 
-var nonHiddenGlobalFlags []*regexp.Regexp
+// GlobalFlagsFilter selects the global flags shown in usage messages.  A flag
+// is shown if its name matches any of the Include regexps, and none of the
+// Exclude regexps.  A nil Include matches all names, while an empty non-nil
+// Include matches no names.
+type GlobalFlagsFilter struct {
+	Include, Exclude []*regexp.Regexp
+}
+
+func (f GlobalFlagsFilter) show(name string) bool {
+	return matchRegexps(f.Include, name) && (f.Exclude == nil || !matchRegexps(f.Exclude, name))
+}
+
+// GlobalFlagsPolicy selects the global flags shown in usage messages for each
+// style.  E.g. the following policy shows only -v in the compact style, all
+// flags except -metadata in the other styles, and never shows -metadata:
+//
+//   cmdline.SetGlobalFlagsPolicy(cmdline.GlobalFlagsPolicy{
+//     Compact: cmdline.GlobalFlagsFilter{Include: []*regexp.Regexp{regexp.MustCompile(`^v$`)}},
+//     Full:    cmdline.GlobalFlagsFilter{Exclude: []*regexp.Regexp{regexp.MustCompile(`^metadata$`)}},
+//   })
+//
+// In the non-compact styles, the flags shown by both filters are listed first,
+// followed by the flags only shown by Full.  If the compact style hides flags
+// that the Full filter would show, the usage message describes how to show
+// them.  The zero GlobalFlagsPolicy shows all global flags in all styles.
+type GlobalFlagsPolicy struct {
+	// Compact selects the flags shown in the default compact style.
+	Compact GlobalFlagsFilter
+	// Full selects the flags shown in all other styles, i.e. full, godoc and
+	// rst.  Flags excluded by Full are never shown.
+	Full GlobalFlagsFilter
+}
+
+var globalFlagsPolicy GlobalFlagsPolicy
+
+// hiddenGlobalFlags holds the names of the global flags registered by this
+// package that are never shown in usage messages, regardless of the policy.
+var hiddenGlobalFlags = make(map[string]bool)
+
+// showGlobalFlag returns true iff the global flag with the given name is shown
+// by the Full filter of the policy.
+func showGlobalFlag(name string) bool {
+	return !hiddenGlobalFlags[name] && globalFlagsPolicy.Full.show(name)
+}
+
+// SetGlobalFlagsPolicy sets the policy used to select the global flags shown in
+// all subsequent usage messages, replacing the effect of any previous calls to
+// HideGlobalFlagsExcept and HideAllGlobalFlags.
+func SetGlobalFlagsPolicy(policy GlobalFlagsPolicy) {
+	globalFlagsPolicy = policy
+}
 
 // HideGlobalFlagsExcept hides global flags from the default compact-style usage
 // message, except for the given regexps.  Global flag names that match any of
 // the regexps will still be shown in the compact usage message.  Multiple calls
 // behave as if all regexps were provided in a single call.
 //
-// All global flags are always shown in non-compact style usage messages.
+// All global flags are always shown in non-compact style usage messages, unless
+// HideAllGlobalFlags has been called.  HideGlobalFlagsExcept is equivalent to
+// adding the regexps to the Compact.Include filter of the GlobalFlagsPolicy.
 func HideGlobalFlagsExcept(regexps ...*regexp.Regexp) {
-	// NOTE: nonHiddenGlobalFlags is used as the argument to matchRegexps, where
-	// nil means "all names match" and empty means "no names match".
-	nonHiddenGlobalFlags = append(nonHiddenGlobalFlags, regexps...)
-	if nonHiddenGlobalFlags == nil {
-		nonHiddenGlobalFlags = []*regexp.Regexp{}
+	// NOTE: Include is used as the argument to matchRegexps, where nil means "all
+	// names match" and empty means "no names match".
+	include := append(globalFlagsPolicy.Compact.Include, regexps...)
+	if include == nil {
+		include = []*regexp.Regexp{}
 	}
+	globalFlagsPolicy.Compact.Include = include
+}
+
+// HideAllGlobalFlags hides global flags from usage messages in all styles,
+// e.g. for embedded tools where the global flags are irrelevant.  It takes
+// precedence over HideGlobalFlagsExcept; no global flags are shown, and there
+// is no reminder of how to show all flags.  The global flags may still be set
+// on the command line.  HideAllGlobalFlags is equivalent to excluding all flags
+// in the Full filter of the GlobalFlagsPolicy.
+func HideAllGlobalFlags() {
+	globalFlagsPolicy.Full.Exclude = []*regexp.Regexp{regexp.MustCompile(``)}
 }
@@ -4,7 +4,20 @@
 
 package cmdline
 
-import "testing"
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
 
 func TestGodocHeader(t *testing.T) {
 	tests := []struct {
@@ -28,3 +41,821 @@ func TestGodocHeader(t *testing.T) {
 		}
 	}
 }
+
+// countingWriter counts the number of calls to Write.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(data)
+}
+
+func TestHelpAtomic(t *testing.T) {
+	defer SetHelpOptions(HelpOptions{})
+	child := &Command{
+		Name:   "child",
+		Short:  "Child command",
+		Long:   "Child command.",
+		Runner: RunnerFunc(runHello),
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "Root command",
+		Long:     "Root command.",
+		Children: []*Command{child},
+	}
+	tests := []struct {
+		args       []string
+		wantWrites int
+		wantErr    error
+	}{
+		{[]string{"help"}, 1, nil},
+		{[]string{"help", "..."}, 1, nil},
+		{[]string{"help", "child"}, 1, nil},
+		{[]string{"help", "unknown"}, 0, ErrUsage},
+	}
+	for _, test := range tests {
+		SetHelpOptions(HelpOptions{Atomic: true})
+		var stdout countingWriter
+		var stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if got, want := ParseAndRun(root, env, test.args), test.wantErr; got != want {
+			t.Errorf("%v: got error %v, want %v", test.args, got, want)
+		}
+		if got, want := stdout.writes, test.wantWrites; got != want {
+			t.Errorf("%v: got %d writes, want %d", test.args, got, want)
+		}
+		// The buffered output must match the regular unbuffered output.
+		SetHelpOptions(HelpOptions{})
+		var want bytes.Buffer
+		env = &Env{Stdout: &want, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		ParseAndRun(root, env, test.args)
+		if got, want := stdout.String(), want.String(); got != want {
+			t.Errorf("%v: got output %q, want %q", test.args, got, want)
+		}
+	}
+}
+
+func TestHelpAtomicUsage(t *testing.T) {
+	defer SetHelpOptions(HelpOptions{})
+	child := &Command{
+		Name:   "child",
+		Short:  "Child command",
+		Long:   "Child command.",
+		Runner: RunnerFunc(runHello),
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "Root command",
+		Long:     "Root command.",
+		Children: []*Command{child},
+	}
+	tests := [][]string{
+		{"-help"},
+		{"child", "-help"},
+		{"unknown"},
+		{"child", "-unknown"},
+	}
+	for _, args := range tests {
+		SetHelpOptions(HelpOptions{Atomic: true})
+		var stdout, stderr countingWriter
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		ParseAndRun(root, env, args)
+		if got, want := stdout.writes+stderr.writes, 1; got != want {
+			t.Errorf("%v: got %d writes, want %d", args, got, want)
+		}
+		// The buffered output must match the regular unbuffered output.
+		SetHelpOptions(HelpOptions{})
+		var wantStdout, wantStderr bytes.Buffer
+		env = &Env{Stdout: &wantStdout, Stderr: &wantStderr, Vars: envvar.CopyMap(baseVars)}
+		ParseAndRun(root, env, args)
+		if got, want := stdout.String(), wantStdout.String(); got != want {
+			t.Errorf("%v: got stdout %q, want %q", args, got, want)
+		}
+		if got, want := stderr.String(), wantStderr.String(); got != want {
+			t.Errorf("%v: got stderr %q, want %q", args, got, want)
+		}
+	}
+}
+
+func TestHelpWidthFlagZero(t *testing.T) {
+	// The flag package creates zero values of flag types, e.g. to determine if
+	// the default is the zero value.
+	var f helpWidthFlag
+	if got, want := f.String(), "0"; got != want {
+		t.Errorf("got String %q, want %q", got, want)
+	}
+	if got, want := f.Get(), 0; got != want {
+		t.Errorf("got Get %v, want %v", got, want)
+	}
+}
+
+func TestHelpSortCommands(t *testing.T) {
+	defer SetHelpOptions(HelpOptions{})
+	newCmd := func(name string) *Command {
+		return &Command{Name: name, Short: "Short " + name, Long: "Long " + name + ".", Runner: RunnerFunc(runHello)}
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "Root command",
+		Long:     "Root command.",
+		Children: []*Command{newCmd("zeta"), newCmd("alpha"), newCmd("a-very-long-name"), newCmd("mid")},
+	}
+	tests := []struct {
+		sort bool
+		want string
+	}{
+		{false, `The root commands are:
+   zeta             Short zeta
+   alpha            Short alpha
+   a-very-long-name Short a-very-long-name
+   mid              Short mid
+   help             Display help for commands or topics
+`},
+		{true, `The root commands are:
+   a-very-long-name Short a-very-long-name
+   alpha            Short alpha
+   mid              Short mid
+   zeta             Short zeta
+   help             Display help for commands or topics
+`},
+	}
+	for _, test := range tests {
+		SetHelpOptions(HelpOptions{SortCommands: test.sort})
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, []string{"help"}); err != nil {
+			t.Errorf("sort %v: unexpected error: %v", test.sort, err)
+		}
+		if got, want := stdout.String(), test.want; !strings.Contains(got, want) {
+			t.Errorf("sort %v: got %q, want substring %q", test.sort, got, want)
+		}
+		// The recursive help must follow the same order.
+		stdout.Reset()
+		if err := ParseAndRun(root, env, []string{"help", "..."}); err != nil {
+			t.Errorf("sort %v: unexpected error: %v", test.sort, err)
+		}
+		var order []string
+		for _, line := range strings.Split(stdout.String(), "\n") {
+			if strings.HasPrefix(line, "Root ") && strings.Contains(line, " - Short ") {
+				order = append(order, strings.Fields(line)[1])
+			}
+		}
+		var want []string
+		for _, line := range strings.Split(test.want, "\n")[1:] {
+			if fields := strings.Fields(line); len(fields) > 0 && fields[0] != helpName {
+				want = append(want, fields[0])
+			}
+		}
+		if !reflect.DeepEqual(order, want) {
+			t.Errorf("sort %v: got recursive order %q, want %q", test.sort, order, want)
+		}
+	}
+}
+
+func TestHelpNonASCIINames(t *testing.T) {
+	newCmd := func(name string) *Command {
+		return &Command{Name: name, Short: "Short " + name, Long: "Long " + name + ".", Runner: RunnerFunc(runHello)}
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "Root command",
+		Long:     "Root command.",
+		Children: []*Command{newCmd("データベース操作"), newCmd("café"), newCmd("list")},
+	}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{"help"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// The names are padded by their display width.
+	want := `The root commands are:
+   データベース操作 Short データベース操作
+   café             Short café
+   list             Short list
+   help             Display help for commands or topics
+`
+	if got := stdout.String(); !strings.Contains(got, want) {
+		t.Errorf("got %q, want substring %q", got, want)
+	}
+}
+
+func TestHelpLongNames(t *testing.T) {
+	long := strings.Repeat("x", 60)
+	root := &Command{
+		Name:  "root",
+		Short: "Root command",
+		Long:  "Root command.",
+		Children: []*Command{
+			{Name: long, Short: "Short description of the command with the long name", Long: "Long.", Runner: RunnerFunc(runHello)},
+			{Name: "short", Short: "Short description of the command with the short name", Long: "Long.", Runner: RunnerFunc(runHello)},
+		},
+		Topics: []Topic{
+			{Name: "topic-" + long, Short: "Short description of the topic with the long name", Long: "Long."},
+			{Name: "topic", Short: "Short description of the topic with the short name", Long: "Long."},
+		},
+	}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{"help"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// The descriptions of long names start on the next line, and all
+	// descriptions wrap within the short column.
+	want := `The root commands are:
+   ` + long + `
+                                                            Short description of
+                                                            the command with the
+                                                            long name
+   short                                                    Short description of
+                                                            the command with the
+                                                            short name
+   help                                                     Display help for
+                                                            commands or topics
+Run "root help [command]" for command usage.
+
+The root additional help topics are:
+   topic-` + long + `
+                                                            Short description of
+                                                            the topic with the
+                                                            long name
+   topic                                                    Short description of
+                                                            the topic with the
+                                                            short name
+`
+	if got := stdout.String(); !strings.Contains(got, want) {
+		t.Errorf("got %q, want substring %q", got, want)
+	}
+}
+
+func TestHelpMessages(t *testing.T) {
+	defer SetHelpOptions(HelpOptions{})
+	SetHelpOptions(HelpOptions{Messages: HelpMessages{
+		Usage:       "Uso:",
+		Commands:    "Los comandos de %s son:",
+		CommandHelp: "Ejecute \"%s help [comando]\" para ver el uso.",
+	}})
+	child := &Command{Name: "child", Short: "Short child", Long: "Long child.", Runner: RunnerFunc(runHello)}
+	child.Flags.Bool("x", false, "Flag x.")
+	root := &Command{
+		Name:     "root",
+		Short:    "Root command",
+		Long:     "Root command.",
+		Children: []*Command{child},
+	}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{"help"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, want := stdout.String(), `Root command.
+
+Uso:
+   root [flags] <command>
+
+Los comandos de root son:
+   child       Short child
+   help        Display help for commands or topics
+Ejecute "root help [comando]" para ver el uso.
+`; !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want prefix %q", got, want)
+	}
+	// Messages that aren't set use the defaults.
+	stdout.Reset()
+	if err := ParseAndRun(root, env, []string{"help", "child"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, want := stdout.String(), "The root child flags are:\n"; !strings.Contains(got, want) {
+		t.Errorf("got %q, want substring %q", got, want)
+	}
+}
+
+func TestHelpShowFlagTypes(t *testing.T) {
+	defer SetHelpOptions(HelpOptions{})
+	SetHelpOptions(HelpOptions{ShowFlagTypes: true})
+	defer func(fs *flag.FlagSet) { globalFlags = fs }(globalFlags)
+	globalFlags = new(flag.FlagSet)
+	root := &Command{
+		Name:   "root",
+		Short:  "Root command",
+		Long:   "Root command.",
+		Runner: RunnerFunc(runHello),
+	}
+	root.Flags.Int("port", 8080, "The port to listen on.")
+	root.Flags.Bool("v", false, "Verbose output.")
+	root.Flags.Duration("timeout", 0, "The timeout.")
+	root.Flags.Var(NewEnumFlag("info", "debug", "info"), "level", "The log level.")
+	root.Flags.Var(schemaCustom{}, "custom", "A custom `spec`.")
+	root.Flags.Var(schemaCustom{}, "other", "Another custom flag.")
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{"-help"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if got, want := stdout.String(), `The root flags are:
+ -custom spec
+   A custom spec. (default custom)
+ -level debug|info
+   The log level. (default info)
+ -other value
+   Another custom flag. (default custom)
+ -port int
+   The port to listen on. (default 8080)
+ -timeout duration
+   The timeout.
+ -v bool
+   Verbose output.
+`; !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, want suffix %q", got, want)
+	}
+}
+
+func TestHelpReST(t *testing.T) {
+	leaf := &Command{
+		Name:     "leaf",
+		Short:    "Leaf command",
+		Long:     "Leaf long.",
+		ArgsName: "[args]",
+		ArgsLong: "[args] are args.",
+		Runner:   RunnerFunc(runHello),
+	}
+	var port int
+	leaf.Flags.IntVar(&port, "port", 80, "Port to listen on.")
+	mid := &Command{
+		Name:     "mid",
+		Short:    "Mid command",
+		Long:     "Mid long.",
+		Children: []*Command{leaf},
+		Topics:   []Topic{{Name: "topic", Short: "Topic short", Long: "Topic long."}},
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "Root command",
+		Long:     "Root long.",
+		Children: []*Command{mid},
+	}
+	// Avoid depending on the global flags captured by other tests.
+	defer func(flags *flag.FlagSet) { globalFlags = flags }(globalFlags)
+	globalFlags = new(flag.FlagSet)
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var stdout, stderr bytes.Buffer
+	vars := envvar.MergeMaps(baseVars, map[string]string{"CMDLINE_STYLE": "rst"})
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: vars}
+	if err := ParseAndRun(root, env, []string{"help", "..."}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The sections are underlined by depth, with the help command last.
+	want := `root - Root command
+===================
+
+Root long.
+
+Usage::
+
+   root <command>
+
+The root commands are::
+
+   mid         Mid command
+   help        Display help for commands or topics
+
+root mid - Mid command
+----------------------
+
+Mid long.
+
+Usage::
+
+   root mid <command>
+
+The root mid commands are::
+
+   leaf        Leaf command
+
+The root mid additional help topics are::
+
+   topic       Topic short
+
+root mid leaf - Leaf command
+~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+Leaf long.
+
+Usage::
+
+   root mid leaf [flags] [args]
+
+[args] are args.
+
+The root mid leaf flags are:
+
+:option -port=80: Port to listen on.
+
+root mid topic - Topic short
+~~~~~~~~~~~~~~~~~~~~~~~~~~~~
+
+Topic long.
+
+root help - Display help for commands or topics
+-----------------------------------------------
+`
+	if got := stdout.String(); !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want prefix %q", got, want)
+	}
+}
+
+func TestHelpTopicMarkdown(t *testing.T) {
+	long := "# Title\n\nSome **bold** text that is long enough to wrap around the configured width of forty, with a [link](http://x.io).\n\n## Items\n\n- first item that is also long enough to wrap around the width\n- second\n1. numbered\n\n```\ncode  block\n  indented\n```\nAfter code."
+	child := &Command{Name: "child", Short: "Child", Long: "Child.", Runner: RunnerFunc(runHello)}
+	root := &Command{
+		Name:     "root",
+		Short:    "Root",
+		Long:     "Root.",
+		Children: []*Command{child},
+		Topics:   []Topic{{Name: "md", Short: "Markdown", Long: long, Format: TopicMarkdown}},
+	}
+	tests := []struct {
+		style, want string
+	}{
+		{"compact", `Title
+=====
+
+Some bold text that is long enough to
+wrap around the configured width of
+forty, with a link (http://x.io).
+
+Items
+-----
+
+  - first item that is also long enough
+    to wrap around the width
+  - second
+  1. numbered
+
+    code  block
+      indented
+
+After code.
+`},
+		// The godoc style doesn't render the Markdown, like plain topics.
+		{"godoc", "# Title\n\nSome **bold** text that is long enough\nto wrap around the configured width of\nforty, with a [link](http://x.io).\n\n## Items\n\n- first item that is also long enough to\nwrap around the width - second 1.\nnumbered\n\n``` code  block\n  indented\n``` After code.\n"},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		vars := map[string]string{"CMDLINE_STYLE": test.style, "CMDLINE_WIDTH": "40"}
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.MergeMaps(baseVars, vars)}
+		if err := ParseAndRun(root, env, []string{"help", "md"}); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.style, err)
+		}
+		if got, want := stdout.String(), test.want; got != want {
+			t.Errorf("%s: got %q, want %q", test.style, got, want)
+		}
+	}
+}
+
+// brokenPipe is a writer that accepts limit bytes, and then fails with EPIPE.
+type brokenPipe struct {
+	limit, failures int
+	buf             bytes.Buffer
+}
+
+func (b *brokenPipe) Write(data []byte) (int, error) {
+	if b.buf.Len()+len(data) > b.limit {
+		b.failures++
+		return 0, &os.PathError{Op: "write", Path: "|1", Err: syscall.EPIPE}
+	}
+	return b.buf.Write(data)
+}
+
+func TestHelpBrokenPipe(t *testing.T) {
+	var children []*Command
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("child%d", i)
+		children = append(children, &Command{Name: name, Short: "Short " + name, Long: "Long " + name + ".", Runner: RunnerFunc(runHello)})
+	}
+	root := &Command{Name: "root", Short: "Root command", Long: "Root command.", Children: children}
+	defer SetHelpOptions(helpOptions)
+	for _, atomic := range []bool{false, true} {
+		SetHelpOptions(HelpOptions{Atomic: atomic})
+		stdout := &brokenPipe{limit: 100}
+		var stderr bytes.Buffer
+		env := &Env{Stdout: stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, []string{"help", "..."}); err != nil {
+			t.Errorf("atomic %v: got error %v, want nil", atomic, err)
+		}
+		if got := stderr.String(); got != "" {
+			t.Errorf("atomic %v: got stderr %q, want empty", atomic, got)
+		}
+		// The output stops after the first failed write.
+		if got, want := stdout.failures, 1; got != want {
+			t.Errorf("atomic %v: got %d failed writes, want %d", atomic, got, want)
+		}
+	}
+}
+
+func TestHelpStdoutBrokenPipe(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("SIGPIPE isn't supported on windows")
+	}
+	var children []*Command
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("child%d", i)
+		children = append(children, &Command{Name: name, Short: "Short " + name, Long: "Long " + name + ".", Runner: RunnerFunc(runHello)})
+	}
+	root := &Command{Name: "root", Short: "Root command", Long: "Root command.", Children: children}
+	if os.Getenv("CMDLINE_TEST_BROKEN_PIPE") != "" {
+		// Write help to the real stdout, whose reader goes away early.  Exit right
+		// away, since the test framework also writes to stdout.
+		env := &Env{Stdout: os.Stdout, Stderr: os.Stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, []string{"help", "..."}); err != nil {
+			fmt.Fprintf(os.Stderr, "got error %v, want nil", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	// Run the test binary with the help writing to a pipe that's closed after
+	// reading a little of the output, like "tool help ... | head".  The process
+	// must not be killed by SIGPIPE.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelpStdoutBrokenPipe$")
+	cmd.Env = append(os.Environ(), "CMDLINE_TEST_BROKEN_PIPE=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdout.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	stdout.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("got error %v, want nil; stderr: %s", err, stderr.String())
+	}
+}
+
+func TestHelpGroupInheritedFlags(t *testing.T) {
+	defer SetHelpOptions(helpOptions)
+	SetHelpOptions(HelpOptions{GroupInheritedFlags: true})
+	status := &Command{Name: "status", Short: "Show status", Long: "Show status.", Runner: RunnerFunc(runHello)}
+	net := &Command{Name: "net", Short: "Network", Long: "Network.", Children: []*Command{status}}
+	root := &Command{Name: "root", Short: "Root", Long: "Root.", Children: []*Command{net}}
+	root.Flags.Bool("verbose", false, "Verbose output.")
+	root.Flags.Int("port", 80, "Root port.")
+	net.Flags.String("iface", "eth0", "Network interface.")
+	status.Flags.Bool("json", false, "JSON output.")
+	status.Flags.Int("port", 8080, "Status port.")
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{"help", "net", "status"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// The -port flag of root is shadowed by status.
+	want := `The root net status flags are:
+ -json=false
+   JSON output.
+ -port=8080
+   Status port.
+
+The flags inherited from root net are:
+ -iface=eth0
+   Network interface.
+
+The flags inherited from root are:
+ -verbose=false
+   Verbose output.
+
+The global flags are:
+`
+	if got := stdout.String(); !strings.Contains(got, want) {
+		t.Errorf("got %q, want substring %q", got, want)
+	}
+}
+
+func TestHelpMinNameWidth(t *testing.T) {
+	defer SetHelpOptions(helpOptions)
+	root := &Command{
+		Name:     "root",
+		Short:    "Root",
+		Long:     "Root.",
+		Children: []*Command{{Name: "ls", Short: "List", Long: "List.", Runner: RunnerFunc(runHello)}},
+		Topics:   []Topic{{Name: "topic", Short: "Topic", Long: "Topic."}},
+	}
+	tests := []struct {
+		min  int
+		want string
+	}{
+		{0, `The root commands are:
+   ls          List
+   help        Display help for commands or topics
+Run "root help [command]" for command usage.
+
+The root additional help topics are:
+   topic       Topic
+`},
+		// Each table is widened independently to fit its names.
+		{2, `The root commands are:
+   ls   List
+   help Display help for commands or topics
+Run "root help [command]" for command usage.
+
+The root additional help topics are:
+   topic Topic
+`},
+		{15, `The root commands are:
+   ls              List
+   help            Display help for commands or topics
+Run "root help [command]" for command usage.
+
+The root additional help topics are:
+   topic           Topic
+`},
+	}
+	for _, test := range tests {
+		SetHelpOptions(HelpOptions{MinNameWidth: test.min})
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, []string{"help"}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got := stdout.String(); !strings.Contains(got, test.want) {
+			t.Errorf("min %d: got %q, want substring %q", test.min, got, test.want)
+		}
+	}
+}
+
+func TestHelpWidth(t *testing.T) {
+	child := &Command{
+		Name:      "child",
+		Short:     "Child",
+		Long:      "The child command has a long description that is pinned to a narrow width.",
+		Runner:    RunnerFunc(runHello),
+		HelpWidth: 40,
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "Root",
+		Long:     "The root command.",
+		Children: []*Command{child},
+	}
+	tests := []struct {
+		args []string
+		vars map[string]string
+		want string
+	}{
+		{[]string{"help", "child"}, nil, "The child command has a long description\nthat is pinned to a narrow width.\n"},
+		{[]string{"help", "..."}, nil, "The child command has a long description\nthat is pinned to a narrow width.\n"},
+		// An explicit width takes precedence.
+		{[]string{"help", "-width=60", "child"}, nil, "The child command has a long description that is pinned to a\nnarrow width.\n"},
+		{[]string{"help", "child"}, map[string]string{"CMDLINE_WIDTH": "60"}, "The child command has a long description that is pinned to a\nnarrow width.\n"},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(test.vars)}
+		if err := ParseAndRun(root, env, test.args); err != nil {
+			t.Errorf("%v: unexpected error: %v", test.args, err)
+		}
+		if got := stdout.String(); !strings.Contains(got, test.want) {
+			t.Errorf("%v: got %q, want substring %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestHelpWrapSynopsis(t *testing.T) {
+	child := &Command{
+		Name:     "child",
+		Short:    "Child",
+		Long:     "Child.",
+		ArgsName: "<source> <destination> [<more sources and destinations>] [<options>]",
+		Runner:   RunnerFunc(runHello),
+	}
+	root := &Command{Name: "root", Short: "Root", Long: "Root.", Children: []*Command{child}}
+	tests := []struct {
+		width string
+		want  string
+	}{
+		{"80", `Usage:
+   root child [flags] <source> <destination> [<more sources and destinations>]
+              [<options>]
+`},
+		// The synopsis isn't wrapped if it fits.
+		{"100", `Usage:
+   root child [flags] <source> <destination> [<more sources and destinations>] [<options>]
+`},
+		// The hanging indent is reduced if the command path is too long.
+		{"20", `Usage:
+   root child
+      [flags]
+      <source>
+      <destination>
+      [<more sources
+      and
+      destinations>]
+      [<options>]
+`},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{"CMDLINE_WIDTH": test.width}}
+		if err := ParseAndRun(root, env, []string{"help", "child"}); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if got := stdout.String(); !strings.Contains(got, test.want) {
+			t.Errorf("width %s: got %q, want substring %q", test.width, got, test.want)
+		}
+	}
+}
+
+func TestHelpStyleShort(t *testing.T) {
+	child := &Command{Name: "child", Short: "Short description of child", Long: "Child.", Runner: RunnerFunc(runHello)}
+	root := &Command{
+		Name:     "root",
+		Short:    "Short description of root",
+		Long:     "Root.",
+		Children: []*Command{child},
+		Topics:   []Topic{{Name: "topic", Short: "Short description of topic", Long: "Topic."}},
+	}
+	tests := []struct {
+		args []string
+		vars map[string]string
+		want string
+	}{
+		{[]string{"help", "-style=short"}, nil, "Short description of root\n"},
+		{[]string{"help", "-style=short", "child"}, nil, "Short description of child\n"},
+		{[]string{"help", "-style=short", "topic"}, nil, "Short description of topic\n"},
+		{[]string{"help", "-style=shortonly", "child"}, nil, "Short description of child\n"},
+		{[]string{"-help"}, map[string]string{"CMDLINE_STYLE": "short"}, "Short description of root\n"},
+		{[]string{"child", "-help"}, map[string]string{"CMDLINE_STYLE": "short"}, "Short description of child\n"},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.MergeMaps(baseVars, test.vars)}
+		if err := ParseAndRun(root, env, test.args); err != nil {
+			t.Errorf("%v: unexpected error: %v", test.args, err)
+		}
+		if got := stdout.String(); got != test.want {
+			t.Errorf("%v: got %q, want %q", test.args, got, test.want)
+		}
+	}
+}
+
+func TestHelpUnknownCommandFunc(t *testing.T) {
+	defer SetHelpOptions(helpOptions)
+	child := &Command{Name: "status", Short: "Status", Long: "Status.", Runner: RunnerFunc(runHello)}
+	root := &Command{Name: "root", Short: "Root", Long: "Root.", Children: []*Command{child}}
+	tests := []struct {
+		fn   func(path, name string) error
+		want string
+	}{
+		{nil, `ERROR: root: unknown command or topic "stats"`},
+		{func(path, name string) error {
+			return fmt.Errorf("%s: no command %q, did you mean \"status\"? Run '%s help' to list commands", path, name, path)
+		}, `ERROR: root: no command "stats", did you mean "status"? Run 'root help' to list commands`},
+		// Returning nil falls back to the default message.
+		{func(string, string) error { return nil }, `ERROR: root: unknown command or topic "stats"`},
+	}
+	for i, test := range tests {
+		SetHelpOptions(HelpOptions{UnknownCommandFunc: test.fn})
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, []string{"help", "stats"}); err != ErrUsage {
+			t.Errorf("%d: got error %v, want %v", i, err, ErrUsage)
+		}
+		if got, want := stderr.String(), test.want+"\n\nRoot.\n\nUsage:"; !strings.HasPrefix(got, want) {
+			t.Errorf("%d: got stderr %q, want prefix %q", i, got, want)
+		}
+	}
+}
+
+func TestHelpSuppressShowAllFlags(t *testing.T) {
+	defer SetHelpOptions(helpOptions)
+	status := &Command{Name: "status", Short: "Show status", Long: "Show status.", Runner: RunnerFunc(runHello)}
+	root := &Command{Name: "root", Short: "Root", Long: "Root.", Children: []*Command{status}}
+	root.Flags.Bool("verbose", false, "Verbose output.")
+	status.Flags.Bool("json", false, "JSON output.")
+	reminder := `Run "root help -style=full status" to show all flags.`
+	for _, suppress := range []bool{false, true} {
+		SetHelpOptions(HelpOptions{SuppressShowAllFlags: suppress})
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		if err := ParseAndRun(root, env, []string{"help", "status"}); err != nil {
+			t.Errorf("%v: unexpected error: %v", suppress, err)
+		}
+		got := stdout.String()
+		if want := "The root status flags are:\n -json=false\n   JSON output.\n"; !strings.Contains(got, want) {
+			t.Errorf("%v: got %q, want substring %q", suppress, got, want)
+		}
+		if strings.Contains(got, "-verbose") {
+			t.Errorf("%v: got %q, want the inherited flag hidden", suppress, got)
+		}
+		if got, want := strings.Contains(got, reminder), !suppress; got != want {
+			t.Errorf("%v: got reminder %v, want %v\n%s", suppress, got, want, stdout.String())
+		}
+	}
+}
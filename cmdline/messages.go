@@ -0,0 +1,70 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+// HelpMessages holds the section labels and reminders used in usage and help
+// output, so that tools may translate them.  Each message is a fmt format
+// string, where %s is replaced by the command path, or by the command line to
+// run for ShowAllFlags and UsageReminder.  Empty messages use the English
+// defaults, which are listed below.
+type HelpMessages struct {
+	Usage            string // "Usage:"
+	Commands         string // "The %s commands are:"
+	ExternalCommands string // "The %s external commands are:"
+	Topics           string // "The %s additional help topics are:"
+	Flags            string // "The %s flags are:"
+	InheritedFlags   string // "The flags inherited from %s are:"
+	GlobalFlags      string // "The global flags are:"
+	CommandHelp      string // "Run \"%s help [command]\" for command usage."
+	TopicHelp        string // "Run \"%s help [topic]\" for topic details."
+	ShowAllFlags     string // "Run \"%s\" to show all flags."
+	UsageReminder    string // "Run \"%s\" for usage."
+	// MissingDescription is shown in place of the short description of external
+	// commands that don't support -help.  It isn't a format string.
+	MissingDescription string // "No description available"
+}
+
+var defaultHelpMessages = HelpMessages{
+	Usage:            "Usage:",
+	Commands:         "The %s commands are:",
+	ExternalCommands: "The %s external commands are:",
+	Topics:           "The %s additional help topics are:",
+	Flags:            "The %s flags are:",
+	InheritedFlags:   "The flags inherited from %s are:",
+	GlobalFlags:      "The global flags are:",
+	CommandHelp:      "Run \"%s help [command]\" for command usage.",
+	TopicHelp:        "Run \"%s help [topic]\" for topic details.",
+	ShowAllFlags:     "Run \"%s\" to show all flags.",
+	UsageReminder:    "Run \"%s\" for usage.",
+
+	MissingDescription: missingDescription,
+}
+
+// withDefaults returns m, with the empty messages set to the defaults.
+func (m HelpMessages) withDefaults() HelpMessages {
+	d := defaultHelpMessages
+	for _, msg := range []struct {
+		value *string
+		def   string
+	}{
+		{&m.Usage, d.Usage},
+		{&m.Commands, d.Commands},
+		{&m.ExternalCommands, d.ExternalCommands},
+		{&m.Topics, d.Topics},
+		{&m.Flags, d.Flags},
+		{&m.InheritedFlags, d.InheritedFlags},
+		{&m.GlobalFlags, d.GlobalFlags},
+		{&m.CommandHelp, d.CommandHelp},
+		{&m.TopicHelp, d.TopicHelp},
+		{&m.ShowAllFlags, d.ShowAllFlags},
+		{&m.UsageReminder, d.UsageReminder},
+		{&m.MissingDescription, d.MissingDescription},
+	} {
+		if *msg.value == "" {
+			*msg.value = msg.def
+		}
+	}
+	return m
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+)
+
+// OutputFormat is the format of the output written by Env.Encode.  It
+// implements the flag.Value interface, so that commands may offer an -output
+// flag:
+//
+//   var flagOutput = cmdline.OutputTable
+//   cmd.Flags.Var(&flagOutput, "output", "Output format; one of json, yaml or table.")
+type OutputFormat string
+
+const (
+	OutputJSON  OutputFormat = "json"  // Indented JSON.
+	OutputYAML  OutputFormat = "yaml"  // YAML, using the json tags for keys.
+	OutputTable OutputFormat = "table" // Aligned columns, with a header row.
+)
+
+// String implements the flag.Value interface method.
+func (f *OutputFormat) String() string {
+	return string(*f)
+}
+
+// Set implements the flag.Value interface method.
+func (f *OutputFormat) Set(value string) error {
+	switch format := OutputFormat(value); format {
+	case OutputJSON, OutputYAML, OutputTable:
+		*f = format
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, must be one of json, yaml or table", value)
+}
+
+// Options returns the formats accepted by Set.
+func (f *OutputFormat) Options() []string {
+	return []string{string(OutputJSON), string(OutputYAML), string(OutputTable)}
+}
+
+// Encode writes v to e.Stdout in the given format.
+//
+// The table format writes a slice of structs or maps as one row per element,
+// with a header row of the upper-cased keys; a single struct or map is written
+// as a single row.  Struct keys are taken from the json tags, as for the yaml
+// format.  Slices of other values are written one per line, without a header.
+func (e *Env) Encode(format OutputFormat, v interface{}) error {
+	switch format {
+	case OutputJSON:
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(e.Stdout, "%s\n", data)
+		return err
+	case OutputYAML:
+		_, err := e.Stdout.Write(marshalYAML(v))
+		return err
+	case OutputTable:
+		return writeTable(e.Stdout, v)
+	}
+	return fmt.Errorf("unknown output format %q", format)
+}
+
+func writeTable(w io.Writer, v interface{}) error {
+	rows := yamlIndirect(reflect.ValueOf(v))
+	if !yamlIsSequence(rows) {
+		if !rows.IsValid() {
+			return nil
+		}
+		// A single value is written as a table with one row.
+		rows = reflect.Append(reflect.MakeSlice(reflect.SliceOf(rows.Type()), 0, 1), rows)
+	}
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	var header []string
+	for i := 0; i < rows.Len(); i++ {
+		row := yamlIndirect(rows.Index(i))
+		keys, vals, ok := tableRow(row)
+		if !ok {
+			fmt.Fprintf(tw, "%s\n", tableCell(row))
+			continue
+		}
+		if header == nil {
+			header = keys
+			fmt.Fprintf(tw, "%s\n", strings.ToUpper(strings.Join(header, "\t")))
+		}
+		byKey := make(map[string]reflect.Value, len(keys))
+		for k, key := range keys {
+			byKey[key] = vals[k]
+		}
+		cells := make([]string, len(header))
+		for k, key := range header {
+			if val, ok := byKey[key]; ok {
+				cells[k] = tableCell(yamlIndirect(val))
+			}
+		}
+		fmt.Fprintf(tw, "%s\n", strings.Join(cells, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	// Trim the padding written after empty trailing cells.
+	for _, line := range strings.SplitAfter(buf.String(), "\n") {
+		if line == "" {
+			continue
+		}
+		if _, err := io.WriteString(w, strings.TrimRight(line, " \n")+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableRow returns the keys and values of row, if it is a struct or map.  Unlike
+// the yaml format, empty fields are kept, so that all rows have the same keys.
+func tableRow(row reflect.Value) ([]string, []reflect.Value, bool) {
+	if row.Kind() != reflect.Struct {
+		return yamlMapping(row)
+	}
+	var keys []string
+	var vals []reflect.Value
+	for i := 0; i < row.NumField(); i++ {
+		field := row.Type().Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		switch {
+		case name == "-":
+			continue
+		case name == "":
+			name = field.Name
+		}
+		keys, vals = append(keys, name), append(vals, row.Field(i))
+	}
+	return keys, vals, true
+}
+
+// tableCell returns the representation of v in a single table cell.  Nested
+// values are written as compact JSON; newlines and tabs are replaced by spaces
+// so that they don't break the table layout.
+func tableCell(v reflect.Value) string {
+	if !v.IsValid() || ((v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.IsNil()) {
+		return ""
+	}
+	var cell string
+	if _, _, ok := yamlMapping(v); ok || yamlIsSequence(v) {
+		data, err := json.Marshal(v.Interface())
+		if err != nil {
+			return fmt.Sprint(v.Interface())
+		}
+		cell = string(data)
+	} else {
+		cell = fmt.Sprint(v.Interface())
+	}
+	return strings.NewReplacer("\n", " ", "\t", " ").Replace(cell)
+}
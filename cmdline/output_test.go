@@ -0,0 +1,76 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"testing"
+)
+
+type outputHost struct {
+	Name  string   `json:"name"`
+	Port  int      `json:"port"`
+	Tags  []string `json:"tags,omitempty"`
+	Owner string   `json:"-"`
+}
+
+func TestEnvEncode(t *testing.T) {
+	hosts := []outputHost{
+		{Name: "alpha", Port: 80, Tags: []string{"web", "prod"}},
+		{Name: "beta-long-name", Port: 8080},
+	}
+	tests := []struct {
+		format OutputFormat
+		v      interface{}
+		want   string
+	}{
+		{OutputJSON, hosts[1], `{
+  "name": "beta-long-name",
+  "port": 8080
+}
+`},
+		{OutputYAML, hosts, `- name: alpha
+  port: 80
+  tags:
+  - web
+  - prod
+- name: beta-long-name
+  port: 8080
+`},
+		{OutputYAML, map[string]int{"b": 2, "a": 1}, "a: 1\nb: 2\n"},
+		{OutputTable, hosts, `NAME            PORT  TAGS
+alpha           80    ["web","prod"]
+beta-long-name  8080
+`},
+		{OutputTable, &hosts[0], `NAME   PORT  TAGS
+alpha  80    ["web","prod"]
+`},
+		{OutputTable, []string{"x", "y"}, "x\ny\n"},
+	}
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		env := &Env{Stdout: &stdout}
+		if err := env.Encode(test.format, test.v); err != nil {
+			t.Errorf("%s: %v", test.format, err)
+			continue
+		}
+		if got, want := stdout.String(), test.want; got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", test.format, got, want)
+		}
+	}
+}
+
+func TestOutputFormatSet(t *testing.T) {
+	format := OutputTable
+	if err := format.Set("yaml"); err != nil || format != OutputYAML {
+		t.Errorf("got (%v, %v), want (%v, nil)", format, err, OutputYAML)
+	}
+	if err := format.Set("xml"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+	if got, want := format.String(), "yaml"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// argParsers holds the supported types of positional args declared via
+// Command.Args, keyed by type name.  Each parser converts the string form of
+// an arg into a value of the type.
+var argParsers = map[string]func(string) (interface{}, error){
+	"string": func(s string) (interface{}, error) {
+		return s, nil
+	},
+	"int": func(s string) (interface{}, error) {
+		v, err := strconv.ParseInt(s, 0, strconv.IntSize)
+		return int(v), err
+	},
+	"int64": func(s string) (interface{}, error) {
+		return strconv.ParseInt(s, 0, 64)
+	},
+	"uint": func(s string) (interface{}, error) {
+		v, err := strconv.ParseUint(s, 0, strconv.IntSize)
+		return uint(v), err
+	},
+	"uint64": func(s string) (interface{}, error) {
+		return strconv.ParseUint(s, 0, 64)
+	},
+	"float64": func(s string) (interface{}, error) {
+		return strconv.ParseFloat(s, 64)
+	},
+	"bool": func(s string) (interface{}, error) {
+		return strconv.ParseBool(s)
+	},
+	"duration": func(s string) (interface{}, error) {
+		return time.ParseDuration(s)
+	},
+}
+
+// argTypes holds the Go types of the values produced by argParsers.
+var argTypes = map[string]reflect.Type{
+	"string":   reflect.TypeOf(""),
+	"int":      reflect.TypeOf(int(0)),
+	"int64":    reflect.TypeOf(int64(0)),
+	"uint":     reflect.TypeOf(uint(0)),
+	"uint64":   reflect.TypeOf(uint64(0)),
+	"float64":  reflect.TypeOf(float64(0)),
+	"bool":     reflect.TypeOf(false),
+	"duration": reflect.TypeOf(time.Duration(0)),
+}
+
+// argSpec describes a single positional arg declared via Command.Args.
+type argSpec struct {
+	name     string
+	typ      string
+	optional bool // the arg may be omitted
+	variadic bool // the arg collects all remaining args
+}
+
+// parseArgSpec parses spec, which is of the form "name type", where name may
+// be followed by "?" for an optional arg, "..." for a variadic arg that takes
+// one or more values, or "?..." for a variadic arg that takes zero or more.
+func parseArgSpec(spec string) (argSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 2 {
+		return argSpec{}, fmt.Errorf("arg spec %q must be of the form \"name type\"", spec)
+	}
+	a := argSpec{name: fields[0], typ: fields[1]}
+	if strings.HasSuffix(a.name, "...") {
+		a.name, a.variadic = strings.TrimSuffix(a.name, "..."), true
+	}
+	if strings.HasSuffix(a.name, "?") {
+		a.name, a.optional = strings.TrimSuffix(a.name, "?"), true
+	}
+	if a.name == "" || strings.ContainsAny(a.name, "?.") {
+		return argSpec{}, fmt.Errorf("arg spec %q has an invalid name", spec)
+	}
+	if argParsers[a.typ] == nil {
+		return argSpec{}, fmt.Errorf("arg spec %q has unsupported type %q", spec, a.typ)
+	}
+	return a, nil
+}
+
+// usage returns the description of the arg in the usage line, e.g. "<src>",
+// "[<count>]" or "<files> ...".
+func (a argSpec) usage() string {
+	usage := "<" + a.name + ">"
+	if a.variadic {
+		usage += " ..."
+	}
+	if a.optional {
+		usage = "[" + usage + "]"
+	}
+	return usage
+}
+
+// Args declares the positional args taken by the Runner of cmd, which are
+// parsed and validated before the Runner is run.  Each spec is of the form
+// "name type", e.g. "src string" or "count int".  The supported types are
+// string, int, int64, uint, uint64, float64, bool and duration.
+//
+// The name may be followed by a marker: "?" for an optional arg, "..." for a
+// variadic arg that collects one or more values, or "?..." for a variadic arg
+// that collects zero or more values.  Optional args must follow the required
+// args, and only the last arg may be variadic.
+//
+// If the args are missing, extra, or can't be converted to their types, Parse
+// returns a usage error.  Otherwise the Runner retrieves the parsed values via
+// Env.Arg.  If ArgsName is empty, it's set to describe the args.  Invalid
+// specs are reported as an error from Parse.
+func (cmd *Command) Args(specs ...string) {
+	cmd.argSpecs, cmd.argSpecsErr = nil, nil
+	var names []string
+	seen := make(map[string]bool)
+	for i, spec := range specs {
+		a, err := parseArgSpec(spec)
+		switch {
+		case err != nil:
+		case seen[a.name]:
+			err = fmt.Errorf("arg %q is declared multiple times", a.name)
+		case a.variadic && i != len(specs)-1:
+			err = fmt.Errorf("variadic arg %q must be the last arg", a.name)
+		case !a.optional && i > 0 && cmd.argSpecs[i-1].optional:
+			err = fmt.Errorf("required arg %q must precede the optional args", a.name)
+		}
+		if err != nil {
+			cmd.argSpecsErr = err
+			return
+		}
+		seen[a.name] = true
+		cmd.argSpecs = append(cmd.argSpecs, a)
+		names = append(names, a.usage())
+	}
+	if cmd.ArgsName == "" {
+		cmd.ArgsName = strings.Join(names, " ")
+	}
+}
+
+// parseArgs parses args according to specs, returning the parsed values keyed
+// by arg name.  Optional args that are omitted aren't included.
+func parseArgs(specs []argSpec, args []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, a := range specs {
+		if len(args) == 0 {
+			if !a.optional {
+				return nil, fmt.Errorf("missing arg <%s>", a.name)
+			}
+			break
+		}
+		if a.variadic {
+			slice := reflect.MakeSlice(reflect.SliceOf(argTypes[a.typ]), 0, len(args))
+			for _, arg := range args {
+				value, err := parseArg(a, arg)
+				if err != nil {
+					return nil, err
+				}
+				slice = reflect.Append(slice, reflect.ValueOf(value))
+			}
+			values[a.name], args = slice.Interface(), nil
+			break
+		}
+		value, err := parseArg(a, args[0])
+		if err != nil {
+			return nil, err
+		}
+		values[a.name], args = value, args[1:]
+	}
+	if len(args) > 0 {
+		return nil, fmt.Errorf("too many args, starting at %q", args[0])
+	}
+	return values, nil
+}
+
+// parseArg converts arg into a value of the type of a.
+func parseArg(a argSpec, arg string) (interface{}, error) {
+	value, err := argParsers[a.typ](arg)
+	if err != nil {
+		var numErr *strconv.NumError
+		if errors.As(err, &numErr) {
+			err = numErr.Err
+		}
+		return nil, fmt.Errorf("invalid value %q for arg <%s> of type %s: %v", arg, a.name, a.typ, err)
+	}
+	return value, nil
+}
+
+// Arg returns the value of the positional arg with the given name, declared
+// via Command.Args on the command most recently parsed.  The value has the Go
+// type corresponding to the declared type, e.g. int for "int" and
+// time.Duration for "duration"; variadic args are returned as a slice of that
+// type, e.g. []string.  Returns nil if the arg was optional and omitted, or
+// wasn't declared.
+func (e *Env) Arg(name string) interface{} {
+	return e.args[name]
+}
@@ -0,0 +1,152 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"v.io/x/lib/envvar"
+)
+
+func TestArgs(t *testing.T) {
+	var got string
+	cmd := &Command{
+		Name:  "copy",
+		Short: "copy",
+		Long:  "copy.",
+		Runner: RunnerFunc(func(env *Env, _ []string) error {
+			got = fmt.Sprintf("%#v %#v %#v %#v", env.Arg("src"), env.Arg("dst"), env.Arg("count"), env.Arg("wait"))
+			return nil
+		}),
+	}
+	cmd.Args("src string", "dst string", "count? int", "wait?... duration")
+	if got, want := cmd.ArgsName, "<src> <dst> [<count>] [<wait> ...]"; got != want {
+		t.Errorf("got ArgsName %q, want %q", got, want)
+	}
+	tests := []struct {
+		args      []string
+		want, err string
+	}{
+		{[]string{"a", "b"}, `"a" "b" <nil> <nil>`, ""},
+		{[]string{"a", "b", "0x10"}, `"a" "b" 16 <nil>`, ""},
+		{[]string{"a", "b", "3", "1s", "2m"}, `"a" "b" 3 []time.Duration{1000000000, 120000000000}`, ""},
+		{nil, "", "copy: missing arg <src>"},
+		{[]string{"a"}, "", "copy: missing arg <dst>"},
+		{[]string{"a", "b", "x"}, "", `copy: invalid value "x" for arg <count> of type int: invalid syntax`},
+		{[]string{"a", "b", "3", "1s", "x"}, "", `copy: invalid value "x" for arg <wait> of type duration: time: invalid duration "x"`},
+	}
+	for _, test := range tests {
+		got = ""
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		err := ParseAndRun(cmd, env, test.args)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", test.args, err)
+			}
+		} else {
+			if err != ErrUsage {
+				t.Errorf("%v: got error %v, want %v", test.args, err, ErrUsage)
+			}
+			if got, want := stderr.String(), "ERROR: "+test.err+"\n"; !strings.HasPrefix(got, want) {
+				t.Errorf("%v: got stderr %q, want prefix %q", test.args, got, want)
+			}
+		}
+		if got != test.want {
+			t.Errorf("%v: got %s, want %s", test.args, got, test.want)
+		}
+	}
+}
+
+func TestArgsVariadic(t *testing.T) {
+	cmd := &Command{Name: "sum", Short: "sum", Long: "sum."}
+	var sum int
+	cmd.Runner = RunnerFunc(func(env *Env, _ []string) error {
+		for _, n := range env.Arg("nums").([]int) {
+			sum += n
+		}
+		return nil
+	})
+	cmd.Args("nums... int")
+	if got, want := cmd.ArgsName, "<nums> ..."; got != want {
+		t.Errorf("got ArgsName %q, want %q", got, want)
+	}
+	var stderr bytes.Buffer
+	env := &Env{Stdout: &stderr, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	if err := ParseAndRun(cmd, env, []string{"1", "2", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sum, 6; got != want {
+		t.Errorf("got sum %d, want %d", got, want)
+	}
+	if err := ParseAndRun(cmd, env, nil); err != ErrUsage {
+		t.Errorf("got error %v, want %v", err, ErrUsage)
+	}
+	if got, want := stderr.String(), "ERROR: sum: missing arg <nums>"; !strings.HasPrefix(got, want) {
+		t.Errorf("got stderr %q, want prefix %q", got, want)
+	}
+	if got := env.Arg("nums"); got != nil {
+		t.Errorf("got stale arg %v after failed parse", got)
+	}
+}
+
+func TestArgsInvalidSpecs(t *testing.T) {
+	tests := []struct {
+		specs []string
+		want  string
+	}{
+		{[]string{"src"}, `arg spec "src" must be of the form "name type"`},
+		{[]string{"src complex128"}, `arg spec "src complex128" has unsupported type "complex128"`},
+		{[]string{"? int"}, `arg spec "? int" has an invalid name`},
+		{[]string{"a string", "a int"}, `arg "a" is declared multiple times`},
+		{[]string{"a... string", "b string"}, `variadic arg "a" must be the last arg`},
+		{[]string{"a? string", "b string"}, `required arg "b" must precede the optional args`},
+	}
+	for _, test := range tests {
+		cmd := &Command{Name: "cmd", Short: "cmd", Long: "cmd.", Runner: RunnerFunc(runHello)}
+		cmd.Args(test.specs...)
+		var stderr bytes.Buffer
+		env := &Env{Stdout: &stderr, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		_, _, err := Parse(cmd, env, nil)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: got error %v, want %q", test.specs, err, test.want)
+		}
+	}
+}
+
+func TestArgsTypes(t *testing.T) {
+	specs := []argSpec{
+		{name: "b", typ: "bool"},
+		{name: "f", typ: "float64"},
+		{name: "u", typ: "uint"},
+		{name: "d", typ: "duration"},
+	}
+	values, err := parseArgs(specs, []string{"true", "1.5", "7", "1h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := values["b"], interface{}(true); got != want {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if got, want := values["f"], interface{}(1.5); got != want {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if got, want := values["u"], interface{}(uint(7)); got != want {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if got, want := values["d"], interface{}(time.Hour); got != want {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if _, err := parseArgs(specs[:1], []string{"true", "extra"}); err == nil || err.Error() != `too many args, starting at "extra"` {
+		t.Errorf("got error %v, want too many args", err)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// WithProfiling registers the -cpuprofile and -memprofile global flags (see
+// SetGlobalFlags), and arranges for ParseAndRun and Main with the given root
+// command to write the corresponding profiles.  CPU profiling covers the run of
+// the command, and the heap profile is written after the command has run.
+// Profiling is disabled when the flags are empty, which is the default.
+func WithProfiling(root *Command) {
+	cpuProfile := commandLine().String("cpuprofile", "", "Write a CPU profile to the given file.")
+	memProfile := commandLine().String("memprofile", "", "Write a heap profile to the given file before exiting the program.")
+	root.addRunHook(func(env *Env, run func() error) error {
+		return runWithProfiling(*cpuProfile, *memProfile, run)
+	})
+}
+
+// runWithProfiling calls run, writing a CPU profile to cpuFile and a heap
+// profile to memFile, if they are non-empty.
+func runWithProfiling(cpuFile, memFile string, run func() error) (e error) {
+	if cpuFile != "" {
+		f, err := os.Create(cpuFile)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+		defer func() {
+			pprof.StopCPUProfile()
+			if err := f.Close(); err != nil && e == nil {
+				e = err
+			}
+		}()
+	}
+	if memFile != "" {
+		defer func() {
+			if err := writeHeapProfile(memFile); err != nil && e == nil {
+				e = err
+			}
+		}()
+	}
+	return run()
+}
+
+func writeHeapProfile(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	// Run a garbage collection to get up-to-date statistics.
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
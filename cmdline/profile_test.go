@@ -0,0 +1,40 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunWithProfiling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmdline-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cpuFile, memFile := filepath.Join(dir, "cpu"), filepath.Join(dir, "mem")
+	ran := false
+	if err := runWithProfiling(cpuFile, memFile, func() error { ran = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if !ran {
+		t.Errorf("run wasn't called")
+	}
+	for _, file := range []string{cpuFile, memFile} {
+		if info, err := os.Stat(file); err != nil || info.Size() == 0 {
+			t.Errorf("%v: missing or empty profile: %v", file, err)
+		}
+	}
+	// Profiling is a no-op when the files are empty.
+	if err := runWithProfiling("", "", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := runWithProfiling("", "", func() error { return ErrUsage }), ErrUsage; got != want {
+		t.Errorf("got error %v, want %v", got, want)
+	}
+}
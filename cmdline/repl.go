@@ -0,0 +1,193 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+const historyName = "history"
+
+// REPL runs an interactive read-eval-print loop for the command tree rooted at
+// root.  Each line read from env.Stdin is split into args with shell-style
+// quoting, and parsed and run via ParseAndRun as if the args were passed to the
+// program.  Errors are reported to env.Stderr, and the loop continues.  The
+// loop ends at the end of env.Stdin, e.g. when the user types Ctrl-D.
+//
+// Unless root has a child named "history", the "history" line prints the lines
+// that were previously run.  Flags that are set on a line are restored to the
+// values they had when REPL was called, e.g. from the command line that started
+// the REPL, before the next line is run.
+//
+// REPL is typically called from the Runner of a child command, e.g.:
+//
+//   var cmdShell = &cmdline.Command{
+//     Name:   "shell",
+//     Short:  "Start an interactive shell",
+//     Long:   "Start an interactive shell.",
+//     Runner: cmdline.RunnerFunc(func(env *cmdline.Env, _ []string) error {
+//       return cmdline.REPL(cmdRoot, env)
+//     }),
+//   }
+func REPL(root *Command, env *Env) error {
+	if env.Stdin == nil {
+		return errors.New("cmdline: REPL requires env.Stdin")
+	}
+	var history []string
+	snapshot := snapshotFlags(root)
+	scanner := bufio.NewScanner(env.Stdin)
+	for {
+		fmt.Fprintf(env.Stdout, "%s> ", root.Name)
+		if !scanner.Scan() {
+			fmt.Fprintln(env.Stdout)
+			return scanner.Err()
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		history = append(history, line)
+		args, err := splitShellWords(line)
+		switch {
+		case err != nil:
+			fmt.Fprintf(env.Stderr, "ERROR: %v\n", err)
+			continue
+		case len(args) == 1 && args[0] == historyName && lookupChild(root, historyName, false) == nil:
+			for i, prev := range history {
+				fmt.Fprintf(env.Stdout, "%5d  %s\n", i+1, prev)
+			}
+			continue
+		}
+		// Each line runs with its own copy of env, since parsing and running may
+		// modify it.
+		lineEnv := env.clone()
+		if err := ParseAndRun(root, lineEnv, args); err != nil {
+			exitCode(lineEnv, err)
+		}
+		snapshot.restore(root)
+	}
+}
+
+// flagSnapshot records the values of the global flags and the flags of a
+// command tree, so that REPL and RunBatch can restore them after each line.
+type flagSnapshot map[*flag.Flag]string
+
+// snapshotFlags returns the current values of the global flags and the flags of
+// the command tree rooted at root.
+func snapshotFlags(root *Command) flagSnapshot {
+	snapshot := make(flagSnapshot)
+	visitTreeFlags(root, func(f *flag.Flag) {
+		snapshot[f] = f.Value.String()
+	})
+	return snapshot
+}
+
+// restore restores the flags of the command tree rooted at root to the values
+// in the snapshot, and clears the ParsedFlags of the tree.  Flags defined after
+// the snapshot was taken, via ContributeGlobalFlags, are reset to their default
+// values.  Values that haven't changed aren't set again, since Set may
+// accumulate values for some flags.
+func (snapshot flagSnapshot) restore(root *Command) {
+	visitTreeFlags(root, func(f *flag.Flag) {
+		value, ok := snapshot[f]
+		if !ok {
+			value = defaultFlagValue(f)
+		}
+		if f.Value.String() != value {
+			// Ignore errors; the flag keeps its current value.
+			f.Value.Set(value)
+		}
+	})
+	var clear func(cmd *Command)
+	clear = func(cmd *Command) {
+		cmd.ParsedFlags = nil
+		for _, child := range cmd.Children {
+			clear(child)
+		}
+	}
+	clear(root)
+}
+
+// visitTreeFlags calls fn for each global flag, and each flag of the commands
+// in the tree rooted at root, including the flags defined so far via
+// ContributeGlobalFlags.
+func visitTreeFlags(root *Command, fn func(f *flag.Flag)) {
+	commandLine().VisitAll(fn)
+	var visit func(cmd *Command)
+	visit = func(cmd *Command) {
+		cmd.Flags.VisitAll(fn)
+		if cmd.contributed != nil {
+			cmd.contributed.VisitAll(fn)
+		}
+		for _, child := range cmd.Children {
+			visit(child)
+		}
+	}
+	visit(root)
+}
+
+// splitShellWords splits line into words, using shell-style quoting.  Words are
+// separated by unquoted spaces.  Single quotes preserve the literal value of all
+// runes within the quotes.  Double quotes preserve the literal value of all
+// runes within the quotes, except for backslash escapes of \ and ".  A
+// backslash outside of quotes preserves the literal value of the next rune.
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord, quote, escape := false, rune(0), false
+	for _, r := range line {
+		switch {
+		case escape:
+			if quote == '"' && r != '"' && r != '\\' {
+				// Within double quotes, backslash only escapes \ and ".
+				word.WriteRune('\\')
+			}
+			word.WriteRune(r)
+			escape = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escape = true
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == '\\':
+			escape, inWord = true, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	switch {
+	case quote != 0:
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, line)
+	case escape:
+		return nil, fmt.Errorf("trailing backslash in %q", line)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
+
+func TestREPL(t *testing.T) {
+	var upper bool
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Echo args",
+		Long:     "Echo args.",
+		ArgsName: "[args]",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			out := fmt.Sprintf("%q", args)
+			if upper {
+				out = strings.ToUpper(out)
+			}
+			fmt.Fprintln(env.Stdout, out)
+			return nil
+		}),
+	}
+	echo.Flags.BoolVar(&upper, "upper", false, "Echo in upper case.")
+	root := &Command{
+		Name:     "tool",
+		Short:    "Tool",
+		Long:     "Tool.",
+		Children: []*Command{echo},
+	}
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	input := `echo a 'b c' "d \"e\""
+
+echo -upper f
+echo f
+history
+bogus
+echo 'unterminated
+`
+	var stdout, stderr bytes.Buffer
+	env := &Env{
+		Stdin:  strings.NewReader(input),
+		Stdout: &stdout,
+		Stderr: &stderr,
+		Vars:   envvar.CopyMap(baseVars),
+	}
+	if err := REPL(root, env); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	wantStdout := `tool> ["a" "b c" "d \"e\""]
+tool> tool> ["F"]
+tool> ["f"]
+tool>     1  echo a 'b c' "d \"e\""
+    2  echo -upper f
+    3  echo f
+    4  history
+tool> tool> tool> 
+`
+	if got, want := stdout.String(), wantStdout; got != want {
+		t.Errorf("got stdout %q, want %q", got, want)
+	}
+	for _, want := range []string{`ERROR: tool: unknown command "bogus"`, `ERROR: unterminated ' quote`} {
+		if got := stderr.String(); !strings.Contains(got, want) {
+			t.Errorf("got stderr %q, want substring %q", got, want)
+		}
+	}
+}
+
+func TestREPLLaunchFlags(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	global := flag.NewFlagSet("test", flag.ContinueOnError)
+	SetGlobalFlags(global)
+	verbose := global.Int("verbose", 0, "Verbosity.")
+	var upper bool
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Echo args",
+		Long:     "Echo args.",
+		ArgsName: "[args]",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			fmt.Fprintf(env.Stdout, "%q verbose=%d upper=%v\n", args, *verbose, upper)
+			return nil
+		}),
+	}
+	echo.Flags.BoolVar(&upper, "upper", false, "Echo in upper case.")
+	root := &Command{
+		Name:  "tool",
+		Short: "Tool",
+		Long:  "Tool.",
+	}
+	shell := &Command{
+		Name:  "shell",
+		Short: "Shell",
+		Long:  "Shell.",
+		Runner: RunnerFunc(func(env *Env, _ []string) error {
+			return REPL(root, env)
+		}),
+	}
+	root.Children = []*Command{echo, shell}
+	var stdout, stderr bytes.Buffer
+	env := &Env{
+		Stdin:  strings.NewReader("echo a\necho -upper -verbose=1 b\necho c\n"),
+		Stdout: &stdout,
+		Stderr: &stderr,
+		Vars:   envvar.CopyMap(baseVars),
+	}
+	if err := ParseAndRun(root, env, []string{"-verbose=3", "shell"}); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+	}
+	// The flags from the command line that started the REPL apply to every line.
+	wantStdout := `tool> ["a"] verbose=3 upper=false
+tool> ["b"] verbose=1 upper=true
+tool> ["c"] verbose=3 upper=false
+tool> 
+`
+	if got, want := stdout.String(), wantStdout; got != want {
+		t.Errorf("got stdout %q, want %q", got, want)
+	}
+	// The FlagSet passed to SetGlobalFlags is never replaced or reconfigured.
+	if got, want := commandLine(), global; got != want {
+		t.Errorf("got global FlagSet %p, want %p", got, want)
+	}
+	if got, want := global.ErrorHandling(), flag.ContinueOnError; got != want {
+		t.Errorf("got ErrorHandling %v, want %v", got, want)
+	}
+	if !global.Parsed() {
+		t.Errorf("global FlagSet isn't parsed")
+	}
+}
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		err  bool
+	}{
+		{"", nil, false},
+		{"  a  b\tc ", []string{"a", "b", "c"}, false},
+		{`'a b' "c d"`, []string{"a b", "c d"}, false},
+		{`a'b'"c"`, []string{"abc"}, false},
+		{`''`, []string{""}, false},
+		{`'a\b' "a\b" "a\"b" "a\\b" a\ b`, []string{`a\b`, `a\b`, `a"b`, `a\b`, "a b"}, false},
+		{`'a`, nil, true},
+		{`"a`, nil, true},
+		{`a\`, nil, true},
+	}
+	for _, test := range tests {
+		got, err := splitShellWords(test.line)
+		if (err != nil) != test.err {
+			t.Errorf("%q: got error %v, want error %v", test.line, err, test.err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.line, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RunBatch runs each of the lines via ParseAndRun on the command tree rooted at
+// root, as if the args were passed to the program.  Each line is split into
+// args with the same shell-style quoting as REPL.  Empty lines and lines
+// starting with "#" are skipped.  Before the next line is run, flags that are
+// set on a line are restored to the values they had when RunBatch was called.
+//
+// The error from each failing line is reported to env.Stderr along with its
+// line number, starting at 1.  For an ErrExitCode, e.g. ErrUsage, only the line
+// number and exit code are noted, since the line reported any message itself.
+// RunBatch stops at the first failing line, unless keepGoing is true, in which
+// case all lines are run.  Either way, the error from the first failing line is
+// returned unchanged, so that it determines the exit code of the program.
+//
+// RunBatch is typically called from the Runner of a child command, e.g.:
+//
+//   var cmdBatch = &cmdline.Command{
+//     Name:     "batch",
+//     Short:    "Run the commands in a script",
+//     Long:     "Run the commands in a script, one per line.",
+//     ArgsName: "<script>",
+//     Runner: cmdline.RunnerFunc(func(env *cmdline.Env, args []string) error {
+//       data, err := ioutil.ReadFile(args[0])
+//       if err != nil {
+//         return err
+//       }
+//       return cmdline.RunBatch(cmdRoot, env, strings.Split(string(data), "\n"), flagKeepGoing)
+//     }),
+//   }
+func RunBatch(root *Command, env *Env, lines []string, keepGoing bool) error {
+	var first error
+	snapshot := snapshotFlags(root)
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Each line runs with its own copy of env, since parsing and running may
+		// modify it.
+		lineEnv := env.clone()
+		args, err := splitShellWords(line)
+		if err == nil {
+			err = ParseAndRun(root, lineEnv, args)
+			snapshot.restore(root)
+		}
+		if err == nil {
+			continue
+		}
+		if _, ok := err.(ErrExitCode); ok {
+			// The line already reported its error, if any, so only note the line
+			// number, rather than reporting the exit code as an error message.
+			note := fmt.Sprintf("line %d: %v", i+1, err)
+			if lineEnv.ErrorFormat == errorFormatJSON {
+				lineEnv.writeJSONError(note, err == ErrUsage)
+			} else {
+				fmt.Fprintln(lineEnv.Stderr, note)
+			}
+		} else {
+			exitCode(lineEnv, fmt.Errorf("line %d: %v", i+1, err))
+		}
+		if first == nil {
+			first = err
+		}
+		if !keepGoing {
+			break
+		}
+	}
+	return first
+}
@@ -0,0 +1,112 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRunBatch(t *testing.T) {
+	var flagLoud bool
+	echo := &Command{
+		Name:     "echo",
+		Short:    "Print args",
+		Long:     "Print args.",
+		ArgsName: "[args]",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			out := strings.Join(args, ",")
+			if flagLoud {
+				out = strings.ToUpper(out)
+			}
+			_, err := env.Stdout.Write([]byte(out + "\n"))
+			return err
+		}),
+	}
+	echo.Flags.BoolVar(&flagLoud, "loud", false, "Print in upper case.")
+	fail := &Command{
+		Name:  "fail",
+		Short: "Fail",
+		Long:  "Fail.",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			return errors.New("oops")
+		}),
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "Root",
+		Long:     "Root.",
+		Children: []*Command{echo, fail},
+	}
+	lines := []string{
+		"# comment",
+		"echo -loud 'a b' c",
+		"",
+		"fail",
+		"echo \"unterminated",
+		"echo d",
+	}
+	tests := []struct {
+		keepGoing           bool
+		wantStdout, wantErr string
+	}{
+		{false, "A B,C\n", "ERROR: line 4: oops\n"},
+		{true, "A B,C\nd\n", "ERROR: line 4: oops\nERROR: line 5: unterminated \" quote in \"echo \\\"unterminated\"\n"},
+	}
+	for _, test := range tests {
+		flag.CommandLine = flag.NewFlagSet("", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{}}
+		if err := RunBatch(root, env, lines, test.keepGoing); err == nil || err.Error() != "oops" {
+			t.Errorf("keepGoing=%v: got error %v, want oops", test.keepGoing, err)
+		}
+		if got, want := stdout.String(), test.wantStdout; got != want {
+			t.Errorf("keepGoing=%v: got stdout %q, want %q", test.keepGoing, got, want)
+		}
+		if got, want := stderr.String(), test.wantErr; got != want {
+			t.Errorf("keepGoing=%v: got stderr %q, want %q", test.keepGoing, got, want)
+		}
+	}
+}
+
+func TestRunBatchExitCode(t *testing.T) {
+	exit := &Command{
+		Name:  "exit",
+		Short: "Exit",
+		Long:  "Exit.",
+		Runner: RunnerFunc(func(env *Env, args []string) error {
+			fmt.Fprintln(env.Stderr, "exiting")
+			return ErrExitCode(3)
+		}),
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "Root",
+		Long:     "Root.",
+		Children: []*Command{exit},
+	}
+	defer SetHelpOptions(helpOptions)
+	SetHelpOptions(HelpOptions{SuppressUsageOnError: true})
+	flag.CommandLine = flag.NewFlagSet("", flag.ContinueOnError)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: map[string]string{}}
+	// The original errors are kept, rather than wrapped into generic errors.
+	if got, want := RunBatch(root, env, []string{"exit -bogus", "exit"}, true), ErrUsage; got != want {
+		t.Errorf("got error %v, want %v", got, want)
+	}
+	want := `ERROR: root exit: flag provided but not defined: -bogus
+Run "root exit -help" for usage.
+line 1: exit code 2
+exiting
+line 2: exit code 3
+`
+	if got := stderr.String(); got != want {
+		t.Errorf("got stderr %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"encoding/json"
+	"flag"
+	"strconv"
+	"strings"
+)
+
+// FlagsJSONSchema returns a JSON Schema describing the flags of cmd and all of
+// its descendants, e.g. for a UI that drives the command remotely.  The schema
+// of each command is an object with a "flags" property, whose properties are
+// the flags of the command, and a "commands" property, whose properties are the
+// schemas of the children.  Hidden children are skipped.
+//
+// The type of each flag is inferred from its flag.Value:
+//
+//   bool                 boolean
+//   int, int64, uint...  integer
+//   float64              number
+//   time.Duration        string, with format "duration"
+//   string               string
+//
+// Flags that implement an Options method, like EnumFlag and OutputFormat, are
+// constrained to those options via "enum".  Other custom flag.Value types are
+// treated as strings, with the default taken from their String method.
+func FlagsJSONSchema(cmd *Command) ([]byte, error) {
+	schema := commandSchema(cmd)
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+type jsonSchema map[string]interface{}
+
+func commandSchema(cmd *Command) jsonSchema {
+	flags := jsonSchema{}
+	cmd.Flags.VisitAll(func(f *flag.Flag) {
+		flags[f.Name] = flagSchema(f)
+	})
+	props := jsonSchema{
+		"flags": jsonSchema{
+			"type":                 "object",
+			"properties":           flags,
+			"additionalProperties": false,
+		},
+	}
+	if children := visibleChildren(cmd); len(children) > 0 {
+		commands := jsonSchema{}
+		for _, child := range children {
+			commands[child.Name] = commandSchema(child)
+		}
+		props["commands"] = jsonSchema{
+			"type":                 "object",
+			"properties":           commands,
+			"additionalProperties": false,
+		}
+	}
+	schema := jsonSchema{
+		"title":      cmd.Name,
+		"type":       "object",
+		"properties": props,
+	}
+	if short := strings.TrimSpace(cmd.Short); short != "" {
+		schema["description"] = short
+	}
+	return schema
+}
+
+// flagSchema returns the schema of the value of f.
+func flagSchema(f *flag.Flag) jsonSchema {
+	schema := jsonSchema{"type": "string", "default": f.DefValue}
+	if usage := strings.TrimSpace(f.Usage); usage != "" {
+		schema["description"] = usage
+	}
+	if enum, ok := f.Value.(enumOptions); ok {
+		schema["enum"] = enum.Options()
+		return schema
+	}
+	// The type is inferred from the value, but the default is parsed from
+	// DefValue, since the flag may already have been set.
+	switch flagTypeName(f) {
+	case "bool":
+		if value, err := strconv.ParseBool(f.DefValue); err == nil {
+			schema["type"], schema["default"] = "boolean", value
+		}
+	case "int":
+		if value, err := strconv.ParseInt(f.DefValue, 0, 64); err == nil {
+			schema["type"], schema["default"] = "integer", value
+		}
+	case "uint":
+		if value, err := strconv.ParseUint(f.DefValue, 0, 64); err == nil {
+			schema["type"], schema["default"] = "integer", value
+		}
+	case "float":
+		if value, err := strconv.ParseFloat(f.DefValue, 64); err == nil {
+			schema["type"], schema["default"] = "number", value
+		}
+	case "duration":
+		schema["format"] = "duration"
+	}
+	return schema
+}
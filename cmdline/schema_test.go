@@ -0,0 +1,72 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type schemaCustom struct{}
+
+func (schemaCustom) String() string   { return "custom" }
+func (schemaCustom) Set(string) error { return nil }
+
+func TestFlagsJSONSchema(t *testing.T) {
+	child := &Command{
+		Name:   "child",
+		Short:  "Child command",
+		Long:   "Child command.",
+		Runner: RunnerFunc(runHello),
+	}
+	child.Flags.Bool("dry-run", false, "Dry run.")
+	child.Flags.Var(NewEnumFlag("info", "debug", "info"), "level", "Log level.")
+	root := &Command{
+		Name:     "root",
+		Short:    "Root command",
+		Long:     "Root command.",
+		Children: []*Command{child},
+	}
+	root.Flags.Int("port", 80, "Port.")
+	root.Flags.Duration("timeout", time.Minute, "Timeout.")
+	root.Flags.Var(schemaCustom{}, "custom", "Custom.")
+	// The default is used, rather than the current value.
+	root.Flags.Set("port", "8080")
+
+	data, err := FlagsJSONSchema(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	flags := func(schema interface{}) map[string]interface{} {
+		props := schema.(map[string]interface{})["properties"].(map[string]interface{})
+		return props["flags"].(map[string]interface{})["properties"].(map[string]interface{})
+	}
+	want := map[string]interface{}{
+		"port":    map[string]interface{}{"type": "integer", "default": 80.0, "description": "Port."},
+		"timeout": map[string]interface{}{"type": "string", "format": "duration", "default": "1m0s", "description": "Timeout."},
+		"custom":  map[string]interface{}{"type": "string", "default": "custom", "description": "Custom."},
+	}
+	if got := flags(got); !reflect.DeepEqual(got, want) {
+		t.Errorf("got root flags %v, want %v", got, want)
+	}
+	commands := got["properties"].(map[string]interface{})["commands"].(map[string]interface{})["properties"].(map[string]interface{})
+	gotChild := commands["child"].(map[string]interface{})
+	if got, want := gotChild["description"], "Child command"; got != want {
+		t.Errorf("got description %v, want %v", got, want)
+	}
+	want = map[string]interface{}{
+		"dry-run": map[string]interface{}{"type": "boolean", "default": false, "description": "Dry run."},
+		"level":   map[string]interface{}{"type": "string", "enum": []interface{}{"debug", "info"}, "default": "info", "description": "Log level."},
+	}
+	if got := flags(gotChild); !reflect.DeepEqual(got, want) {
+		t.Errorf("got child flags %v, want %v", got, want)
+	}
+}
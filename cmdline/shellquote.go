@@ -0,0 +1,81 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"regexp"
+	"strings"
+)
+
+// ShellQuoting describes the quoting rules of a shell, used to render command
+// lines that may be copied and pasted by users.
+type ShellQuoting int
+
+const (
+	QuotePOSIX   ShellQuoting = iota // POSIX sh rules; the default.
+	QuoteWindows                     // Windows CommandLineToArgvW rules.
+)
+
+// ShellQuote returns args joined by spaces into a command line, where each arg
+// is quoted following POSIX sh rules if necessary.  It is the inverse of the
+// shell-style splitting used by REPL.
+func ShellQuote(args ...string) string {
+	return QuotePOSIX.Quote(args...)
+}
+
+// Quote returns args joined by spaces into a command line, where each arg is
+// quoted following the rules described by q if necessary.
+func (q ShellQuoting) Quote(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if q == QuoteWindows {
+			quoted[i] = quoteWindowsArg(arg)
+		} else {
+			quoted[i] = quotePOSIXArg(arg)
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellSafe matches args that don't need quoting in any POSIX shell.
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// quotePOSIXArg returns arg in single quotes unless it only contains safe runes.
+// Single quotes within arg are closed, escaped and reopened.
+func quotePOSIXArg(arg string) string {
+	if shellSafe.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// quoteWindowsArg returns arg in double quotes unless it contains no spaces,
+// tabs or double quotes.  Backslashes are only special when they precede a
+// double quote, in which case they are doubled.
+func quoteWindowsArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"") {
+		return arg
+	}
+	var buf strings.Builder
+	buf.WriteByte('"')
+	slashes := 0
+	for _, r := range arg {
+		switch r {
+		case '\\':
+			slashes++
+			continue
+		case '"':
+			buf.WriteString(strings.Repeat(`\`, 2*slashes+1))
+		default:
+			buf.WriteString(strings.Repeat(`\`, slashes))
+		}
+		slashes = 0
+		buf.WriteRune(r)
+	}
+	// Backslashes before the closing quote are doubled.
+	buf.WriteString(strings.Repeat(`\`, 2*slashes))
+	buf.WriteByte('"')
+	return buf.String()
+}
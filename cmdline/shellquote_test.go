@@ -0,0 +1,40 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		args           []string
+		posix, windows string
+	}{
+		{[]string{"tool", "-x=1", "a/b.txt"}, `tool -x=1 a/b.txt`, `tool -x=1 a/b.txt`},
+		{[]string{""}, `''`, `""`},
+		{[]string{"hello world"}, `'hello world'`, `"hello world"`},
+		{[]string{"it's"}, `'it'\''s'`, `it's`},
+		{[]string{`say "hi"`}, `'say "hi"'`, `"say \"hi\""`},
+		{[]string{`C:\dir name\`}, `'C:\dir name\'`, `"C:\dir name\\"`},
+		{[]string{"$HOME", "a;b", "*"}, `'$HOME' 'a;b' '*'`, `$HOME a;b *`},
+	}
+	for _, test := range tests {
+		if got, want := ShellQuote(test.args...), test.posix; got != want {
+			t.Errorf("ShellQuote(%q) got %s, want %s", test.args, got, want)
+		}
+		if got, want := QuoteWindows.Quote(test.args...), test.windows; got != want {
+			t.Errorf("QuoteWindows.Quote(%q) got %s, want %s", test.args, got, want)
+		}
+		// The POSIX quoting round-trips through the REPL's splitting.
+		got, err := splitShellWords(ShellQuote(test.args...))
+		if err != nil {
+			t.Errorf("splitShellWords(%q) failed: %v", test.args, err)
+		} else if !reflect.DeepEqual(got, test.args) {
+			t.Errorf("splitShellWords round-trip got %q, want %q", got, test.args)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// main copies stdin to stdout, and describes the size of stdin for -help.
+func main() {
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		os.Exit(1)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "-help" {
+		fmt.Printf("Read %d bytes from stdin\n", len(data))
+		return
+	}
+	os.Stdout.Write(data)
+}
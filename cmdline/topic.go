@@ -0,0 +1,129 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"v.io/x/lib/textutil"
+)
+
+// TopicFormat describes the format of the Long description of a Topic.
+type TopicFormat int
+
+const (
+	// TopicPlain is plain text, which is printed as-is.  It is the default.
+	TopicPlain TopicFormat = iota
+	// TopicMarkdown is Markdown, which is rendered for terminal display by the
+	// compact and full styles, and printed as-is by the godoc style.
+	TopicMarkdown
+)
+
+// TopicRenderer renders the Long description of a topic to w, which wraps
+// paragraphs to the help width.
+type TopicRenderer func(w *textutil.WrapWriter, long string)
+
+var topicRenderers = map[TopicFormat]TopicRenderer{
+	TopicMarkdown: renderMarkdown,
+}
+
+// SetTopicRenderer sets the renderer for topics with the given format,
+// replacing the default renderer.  A nil renderer causes topics with the format
+// to be printed as-is.  The renderer is not used for the godoc style, which
+// always prints topics as-is.
+func SetTopicRenderer(format TopicFormat, renderer TopicRenderer) {
+	if renderer == nil {
+		delete(topicRenderers, format)
+		return
+	}
+	topicRenderers[format] = renderer
+}
+
+// printTopicLong prints the Long description of topic to w, rendered according
+// to its format, or only the Short description in the short style.
+func printTopicLong(w *textutil.WrapWriter, topic *Topic, style style) {
+	if style == styleShortOnly {
+		fmt.Fprintln(w, topic.Short)
+		return
+	}
+	renderer := topicRenderers[topic.Format]
+	if renderer == nil || isDocStyle(style) {
+		fmt.Fprintln(w, topic.Long)
+		return
+	}
+	renderer(w, topic.Long)
+	w.SetIndents()
+	w.ForceVerbatim(false)
+}
+
+var (
+	markdownHeading  = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	markdownListItem = regexp.MustCompile(`^([-*+]|\d+[.)])\s+(.*)$`)
+	markdownStrong   = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	markdownLink     = regexp.MustCompile(`\[([^\]]+)\]\(([^)]+)\)`)
+)
+
+// renderMarkdown is the default TopicRenderer for TopicMarkdown.  It handles the
+// common subset of Markdown: headings are underlined, list items are indented,
+// fenced code blocks are printed verbatim, strong emphasis markers are removed,
+// and links are printed as "text (url)".  Other text is wrapped as paragraphs.
+func renderMarkdown(w *textutil.WrapWriter, long string) {
+	inCode := false
+	for _, line := range strings.Split(long, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			// Code blocks are separate paragraphs.
+			w.SetIndents()
+			fmt.Fprintln(w)
+			inCode = !inCode
+			w.ForceVerbatim(inCode)
+			continue
+		}
+		if inCode {
+			fmt.Fprintln(w, "    "+line)
+			continue
+		}
+		switch {
+		case trimmed == "":
+			w.SetIndents()
+			fmt.Fprintln(w)
+		case markdownHeading.MatchString(trimmed):
+			match := markdownHeading.FindStringSubmatch(trimmed)
+			title, underline := markdownInline(match[2]), "-"
+			if len(match[1]) == 1 {
+				underline = "="
+			}
+			w.SetIndents()
+			fmt.Fprintln(w)
+			fmt.Fprintln(w, title)
+			w.Flush()
+			fmt.Fprintln(w, strings.Repeat(underline, utf8.RuneCountInString(title)))
+			fmt.Fprintln(w)
+		case markdownListItem.MatchString(trimmed):
+			match := markdownListItem.FindStringSubmatch(trimmed)
+			bullet := match[1]
+			if len(bullet) == 1 && strings.ContainsAny(bullet, "-*+") {
+				bullet = "-"
+			}
+			// Each item is its own paragraph, with wrapped lines aligned after
+			// the bullet.
+			w.Flush()
+			w.SetIndents("  "+bullet+" ", spaces(3+len(bullet)))
+			fmt.Fprintln(w, markdownInline(match[2]))
+		default:
+			// Continuation of a paragraph or list item.
+			fmt.Fprintln(w, markdownInline(trimmed))
+		}
+	}
+}
+
+// markdownInline returns s with inline Markdown rendered as plain text.
+func markdownInline(s string) string {
+	s = markdownStrong.ReplaceAllString(s, "$1$2")
+	return markdownLink.ReplaceAllString(s, "$1 ($2)")
+}
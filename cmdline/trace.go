@@ -0,0 +1,65 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"fmt"
+)
+
+// Tracer starts the spans recorded by WithTracing.  The cmdline package doesn't
+// depend on any tracing library; implementations typically adapt an
+// OpenTelemetry tracer, with an OTLP exporter configured via the standard
+// OTEL_EXPORTER_OTLP_* environment variables.
+type Tracer interface {
+	// StartSpan starts a span with the given name, which is the path of the
+	// command being run, e.g. "tool net status".  The vars are the environment
+	// variables of the Env, from which the exporter may be configured.
+	StartSpan(name string, vars map[string]string) Span
+}
+
+// Span is a single span started by a Tracer.
+type Span interface {
+	// End ends the span, recording the error returned by the command, which is
+	// nil on success, and the exit code of the program.
+	End(err error, exitCode int)
+}
+
+// tracer is the Tracer set via SetTracer.
+var tracer Tracer
+
+// SetTracer sets the Tracer used by WithTracing.  It's typically called from
+// the init function of a package that adapts OpenTelemetry, so that only the
+// programs that import that package depend on it.
+func SetTracer(t Tracer) {
+	tracer = t
+}
+
+// WithTracing registers the -trace global flag (see SetGlobalFlags), and
+// arranges for ParseAndRun and Main with the given root command to wrap the run
+// of the command in a span started by the Tracer set via SetTracer, when the
+// flag is set.  The span is named after the command path, and records the error
+// and exit code of the command.  A warning is printed if the flag is set and
+// there is no Tracer.
+func WithTracing(root *Command) {
+	trace := commandLine().Bool("trace", false, "Record a trace span for the run of the command.")
+	root.addRunHook(func(env *Env, run func() error) error {
+		if !*trace {
+			return run()
+		}
+		return runWithTracing(env, tracer, run)
+	})
+}
+
+// runWithTracing calls run within a span started by t.
+func runWithTracing(env *Env, t Tracer, run func() error) error {
+	if t == nil {
+		fmt.Fprintln(env.Stderr, "WARNING: -trace is set, but no tracer has been set via cmdline.SetTracer")
+		return run()
+	}
+	span := t.StartSpan(env.cmdPath, env.Vars)
+	err := run()
+	span.End(err, env.mapExitCode(err, ExitCode(err, nil)))
+	return err
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
+
+// fakeTracer records the spans it starts and ends.
+type fakeTracer struct {
+	spans []string
+}
+
+func (t *fakeTracer) StartSpan(name string, vars map[string]string) Span {
+	t.spans = append(t.spans, "start "+name+" "+vars["OTEL_EXPORTER_OTLP_ENDPOINT"])
+	return fakeSpan{t}
+}
+
+type fakeSpan struct {
+	t *fakeTracer
+}
+
+func (s fakeSpan) End(err error, exitCode int) {
+	s.t.spans = append(s.t.spans, fmt.Sprintf("end %v %d", err, exitCode))
+}
+
+func TestWithTracing(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	defer SetTracer(nil)
+	errConfig := errors.New("bad config")
+	newRoot := func() *Command {
+		status := &Command{Name: "status", Short: "status", Long: "status.", Runner: RunnerFunc(runHello)}
+		fail := &Command{
+			Name:   "fail",
+			Short:  "fail",
+			Long:   "fail.",
+			Runner: RunnerFunc(func(*Env, []string) error { return errConfig }),
+		}
+		return &Command{
+			Name:         "root",
+			Short:        "root",
+			Long:         "root.",
+			Children:     []*Command{status, fail},
+			ExitCodeFunc: func(error) int { return 78 },
+		}
+	}
+	tests := []struct {
+		args []string
+		err  error
+		want []string
+	}{
+		{[]string{"status"}, nil, nil},
+		{[]string{"-trace", "status"}, nil, []string{"start root status localhost:4317", "end <nil> 0"}},
+		{[]string{"fail", "-trace"}, errConfig, []string{"start root fail localhost:4317", "end bad config 78"}},
+	}
+	for _, test := range tests {
+		SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+		tracer := &fakeTracer{}
+		SetTracer(tracer)
+		root := newRoot()
+		WithTracing(root)
+		var stdout, stderr bytes.Buffer
+		vars := envvar.MergeMaps(baseVars, map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "localhost:4317"})
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: vars}
+		if err := ParseAndRun(root, env, test.args); err != test.err {
+			t.Errorf("%v: got error %v, want %v", test.args, err, test.err)
+		}
+		if got := tracer.spans; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%v: got spans %q, want %q", test.args, got, test.want)
+		}
+	}
+	// A warning is printed if there is no tracer.
+	SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	SetTracer(nil)
+	root := newRoot()
+	WithTracing(root)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{"-trace", "status"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stderr.String(), "WARNING: -trace is set, but no tracer has been set via cmdline.SetTracer\n"; got != want {
+		t.Errorf("got stderr %q, want %q", got, want)
+	}
+}
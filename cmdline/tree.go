@@ -0,0 +1,139 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// treeCommand is the representation of a command shared by the JSON and YAML
+// marshallers of the command tree.  The YAML marshaller uses the json tags, so
+// that both formats have the same keys, in the same order.
+type treeCommand struct {
+	Name     string         `json:"name"`
+	Short    string         `json:"short,omitempty"`
+	Long     string         `json:"long,omitempty"`
+	ArgsName string         `json:"argsName,omitempty"`
+	ArgsLong string         `json:"argsLong,omitempty"`
+	Flags    []treeFlag     `json:"flags,omitempty"`
+	Topics   []treeTopic    `json:"topics,omitempty"`
+	Children []*treeCommand `json:"children,omitempty"`
+}
+
+type treeFlag struct {
+	Name    string `json:"name"`
+	Default string `json:"default"`
+	Usage   string `json:"usage,omitempty"`
+}
+
+type treeTopic struct {
+	Name  string `json:"name"`
+	Short string `json:"short,omitempty"`
+	Long  string `json:"long,omitempty"`
+}
+
+// newTreeCommand returns the representation of the tree rooted at cmd.  Hidden
+// children are skipped.
+func newTreeCommand(cmd *Command) *treeCommand {
+	tc := &treeCommand{
+		Name:     strings.TrimSpace(cmd.Name),
+		Short:    strings.TrimSpace(cmd.Short),
+		Long:     strings.TrimSpace(cmd.Long),
+		ArgsName: strings.TrimSpace(cmd.ArgsName),
+		ArgsLong: strings.TrimSpace(cmd.ArgsLong),
+	}
+	cmd.Flags.VisitAll(func(f *flag.Flag) {
+		tc.Flags = append(tc.Flags, treeFlag{f.Name, f.DefValue, strings.TrimSpace(f.Usage)})
+	})
+	for _, topic := range cmd.Topics {
+		tc.Topics = append(tc.Topics, treeTopic{topic.Name, strings.TrimSpace(topic.Short), strings.TrimSpace(topic.Long)})
+	}
+	for _, child := range visibleChildren(cmd) {
+		tc.Children = append(tc.Children, newTreeCommand(child))
+	}
+	return tc
+}
+
+// MarshalCommandTreeJSON returns the command tree rooted at root as indented
+// JSON.  Each command has its name, descriptions, flags, topics and children.
+func MarshalCommandTreeJSON(root *Command) ([]byte, error) {
+	return json.MarshalIndent(newTreeCommand(root), "", "  ")
+}
+
+// MarshalCommandTreeYAML returns the command tree rooted at root as YAML, with
+// the same information as MarshalCommandTreeJSON.  Keys are in a stable order,
+// and multi-line strings are written as literal block scalars.
+func MarshalCommandTreeYAML(root *Command) ([]byte, error) {
+	return marshalYAML(newTreeCommand(root)), nil
+}
+
+const commandsName = "__commands"
+
+// WithCommandList adds a hidden __commands child to root, which prints the
+// path of every command in the tree rooted at root, and every flag of each
+// command, one per line; e.g. "root child" and "root child -flag".  The global
+// flags are listed with the root command.  The output is intended for shell
+// completion frameworks and fuzzy finders like fzf, and is much lighter than
+// MarshalCommandTreeJSON.  Hidden commands aren't listed, and external children
+// found via LookPath are listed without flags.
+//
+// If root has a Runner and no children, a hidden -__commands global flag is
+// registered instead of the child, since a child would conflict with the args
+// of the Runner.  The children of root must be set before calling
+// WithCommandList.
+//
+// WithCommandList must be called at most once, before Main or Parse.
+func WithCommandList(root *Command) {
+	runner := RunnerFunc(func(env *Env, _ []string) error {
+		writeCommandList(env.Stdout, env, []*Command{root})
+		return nil
+	})
+	if isLeafRoot(root) {
+		list := commandLine().Bool(commandsName, false, "List all commands and flags, one per line.")
+		hiddenGlobalFlags[commandsName] = true
+		root.addFlagRunner(func() bool { return *list }, runner)
+		return
+	}
+	root.Children = append(root.Children, &Command{
+		Name:   commandsName,
+		Short:  "List all commands and flags",
+		Long:   "List all commands and flags, one per line.",
+		Runner: runner,
+		hidden: true,
+	})
+}
+
+// writeCommandList writes the lines for the last command in path, and
+// recursively its children, via DFS in the same order as usageAll.
+func writeCommandList(w io.Writer, env *Env, path []*Command) {
+	cmd, cmdPath := path[len(path)-1], pathName("", path)
+	fmt.Fprintln(w, cmdPath)
+	flags := &cmd.Flags
+	if len(path) == 1 {
+		flags = copyFlags(globalFlags)
+		mergeFlags(flags, &cmd.Flags)
+	}
+	flags.VisitAll(func(f *flag.Flag) {
+		if hiddenGlobalFlags[f.Name] && cmd.Flags.Lookup(f.Name) == nil {
+			return
+		}
+		fmt.Fprintf(w, "%s -%s\n", cmdPath, f.Name)
+	})
+	for _, child := range visibleChildren(cmd) {
+		writeCommandList(w, env, append(path, child))
+	}
+	if cmd.LookPath {
+		cmdPrefix := cmd.Name + "-"
+		subCmds, _ := env.lookPathPrefix(cmd.LookPathDirs, cmdPrefix, cmd.subNames(cmdPrefix))
+		for _, subCmd := range subCmds {
+			fmt.Fprintln(w, cmdPath, strings.TrimPrefix(filepath.Base(subCmd), cmdPrefix))
+		}
+	}
+}
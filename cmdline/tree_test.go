@@ -0,0 +1,165 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
+
+func newTreeTestRoot() *Command {
+	leaf := &Command{
+		Name:     "leaf",
+		Short:    "Leaf command",
+		Long:     "Leaf long.\n\nSecond paragraph.",
+		ArgsName: "[args]",
+		ArgsLong: "[args] are args.",
+		Runner:   RunnerFunc(runHello),
+	}
+	leaf.Flags.Int("port", 80, "Port to listen on.")
+	leaf.Flags.String("mode", "on", "The mode: fast or slow.")
+	return &Command{
+		Name:     "root",
+		Short:    "Root command",
+		Long:     "Root long.",
+		Children: []*Command{leaf},
+		Topics:   []Topic{{Name: "topic", Short: "Topic short", Long: "Topic long."}},
+	}
+}
+
+func TestMarshalCommandTreeYAML(t *testing.T) {
+	got, err := MarshalCommandTreeYAML(newTreeTestRoot())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `name: root
+short: Root command
+long: Root long.
+topics:
+- name: topic
+  short: Topic short
+  long: Topic long.
+children:
+- name: leaf
+  short: Leaf command
+  long: |-
+    Leaf long.
+
+    Second paragraph.
+  argsName: "[args]"
+  argsLong: "[args] are args."
+  flags:
+  - name: mode
+    default: "on"
+    usage: "The mode: fast or slow."
+  - name: port
+    default: "80"
+    usage: Port to listen on.
+`
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestMarshalCommandTreeJSON(t *testing.T) {
+	data, err := MarshalCommandTreeJSON(newTreeTestRoot())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got treeCommand
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := newTreeCommand(newTreeTestRoot()); !reflect.DeepEqual(&got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got, want := got.Children[0].Flags[1], (treeFlag{"port", "80", "Port to listen on."}); got != want {
+		t.Errorf("got flag %+v, want %+v", got, want)
+	}
+}
+
+func TestCommandList(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	commandLine().Bool("global", false, "Global flag.")
+	root := newTreeTestRoot()
+	root.Flags.Bool("verbose", false, "Verbose output.")
+	WithCommandList(root)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{commandsName}); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+	}
+	want := `root
+root -global
+root -verbose
+root leaf
+root leaf -mode
+root leaf -port
+`
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// The hidden command isn't shown in the help.
+	stdout.Reset()
+	if err := ParseAndRun(root, env, []string{"-help"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := stdout.String(); strings.Contains(got, commandsName) {
+		t.Errorf("got help %q, want no %s", got, commandsName)
+	}
+}
+
+func TestCommandListLeafRoot(t *testing.T) {
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	var gotArgs []string
+	root := &Command{
+		Name:     "root",
+		Short:    "Root command",
+		Long:     "Root command.",
+		ArgsName: "<arg>",
+		Runner: RunnerFunc(func(_ *Env, args []string) error {
+			gotArgs = args
+			return nil
+		}),
+	}
+	root.Flags.Bool("verbose", false, "Verbose output.")
+	WithCommandList(root)
+	if len(root.Children) != 0 {
+		t.Fatalf("got children %v, want none", root.Children)
+	}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	// The args are still passed to the Runner.
+	if err := ParseAndRun(root, env, []string{"a"}); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+	}
+	if got, want := gotArgs, []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got args %v, want %v", got, want)
+	}
+	resetFlags(root)
+	if err := ParseAndRun(root, env, []string{"-" + commandsName}); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+	}
+	if got, want := stdout.String(), "root\nroot -verbose\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// The hidden flag isn't shown in the help, and no help command is added.
+	resetFlags(root)
+	stdout.Reset()
+	if err := ParseAndRun(root, env, []string{"-help"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := stdout.String(); strings.Contains(got, commandsName) || strings.Contains(got, "help [command]") {
+		t.Errorf("got help %q, want no %s or help command", got, commandsName)
+	}
+}
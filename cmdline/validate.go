@@ -0,0 +1,232 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// flagValidators holds the validators registered via AddFlagValidator, keyed by
+// the FlagSet and then by the flag name.
+var flagValidators = make(map[*flag.FlagSet]map[string]func(string) error)
+
+// AddFlagValidator registers fn to validate the value of the flag with the
+// given name defined in fs.  The flag may be defined in the Flags of a Command,
+// or in flag.CommandLine for global flags.
+//
+// Validators are only run for flags that are explicitly set on the command
+// line, after the flags for each command have been parsed.  The fn is called
+// with the string value of the flag; all failures are collected and reported
+// together as a single usage error.
+func AddFlagValidator(fs *flag.FlagSet, name string, fn func(value string) error) {
+	validators := flagValidators[fs]
+	if validators == nil {
+		validators = make(map[string]func(string) error)
+		flagValidators[fs] = validators
+	}
+	validators[name] = fn
+}
+
+// validatorFlagSets returns the FlagSets that may hold validators for the flags
+// of the last command in path, in order of precedence.  The order mirrors the
+// merging performed by parseFlags.
+func validatorFlagSets(path []*Command) []*flag.FlagSet {
+	cmd := path[len(path)-1]
+	// Flags defined via ContributeGlobalFlags may also have validators.
+	var contributed []*flag.FlagSet
+	for p := len(path) - 1; p >= 0; p-- {
+		if path[p].contributed != nil {
+			contributed = append(contributed, path[p].contributed)
+		}
+	}
+	if len(path) == 1 {
+		// Global flags take precedence over command flags for the root command.
+		sets := []*flag.FlagSet{commandLine(), globalFlags, &cmd.Flags}
+		return append(sets, contributed...)
+	}
+	sets := []*flag.FlagSet{&cmd.Flags}
+	for p := len(path) - 2; p >= 0; p-- {
+		sets = append(sets, &path[p].Flags)
+	}
+	sets = append(sets, globalFlags)
+	sets = append(sets, contributed...)
+	return append(sets, commandLine())
+}
+
+// validateFlags runs the validators for each flag in setFlags, which holds the
+// flags that were set when parsing the last command in path.  Returns a single
+// error describing all failures, or nil if all validators succeeded.
+func validateFlags(path []*Command, setFlags map[string]string) error {
+	if len(flagValidators) == 0 {
+		return nil
+	}
+	sets := validatorFlagSets(path)
+	var names []string
+	for name := range setFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var failures []string
+	for _, name := range names {
+		for _, fs := range sets {
+			fn := flagValidators[fs][name]
+			if fn == nil {
+				continue
+			}
+			if err := fn(setFlags[name]); err != nil {
+				failures = append(failures, fmt.Sprintf("invalid value %q for flag -%s: %v", setFlags[name], name, err))
+			}
+			break
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(failures, "; "))
+}
+
+// flagGroupKind describes the constraint imposed by a flagGroup.
+type flagGroupKind int
+
+const (
+	flagsOneRequired flagGroupKind = iota
+	flagsMutuallyExclusive
+	flagsRequiredTogether
+	flagRequires
+)
+
+// flagGroup is a constraint on which of a group of flags may be set together.
+// For flagRequires, the first name is the flag with the dependency, and the
+// remaining names are the flags it requires.
+type flagGroup struct {
+	kind  flagGroupKind
+	names []string
+}
+
+// MarkFlagsOneRequired requires at least one of the flags with the given names
+// to be set on the command line.  Combined with MarkFlagsMutuallyExclusive on
+// the same names, exactly one of the flags must be set.
+//
+// The constraint is checked once the entire command line has been parsed, when
+// cmd or one of its descendants is run, so the flags may be set after the names
+// of descendants.  Flags set from the environment variable bound via BindEnv,
+// or from the file given by -flags-from, count as set.  It isn't checked for
+// help, or for external children, and is described in the help for cmd.
+func (cmd *Command) MarkFlagsOneRequired(names ...string) {
+	cmd.flagGroups = append(cmd.flagGroups, flagGroup{flagsOneRequired, names})
+}
+
+// MarkFlagsMutuallyExclusive allows at most one of the flags with the given
+// names to be set on the command line.  The constraint is checked like
+// MarkFlagsOneRequired.
+func (cmd *Command) MarkFlagsMutuallyExclusive(names ...string) {
+	cmd.flagGroups = append(cmd.flagGroups, flagGroup{flagsMutuallyExclusive, names})
+}
+
+// MarkFlagsRequiredTogether requires the flags with the given names to be set
+// together; if any of them is set on the command line, all of them must be set.
+// The constraint is checked like MarkFlagsOneRequired.
+func (cmd *Command) MarkFlagsRequiredTogether(names ...string) {
+	cmd.flagGroups = append(cmd.flagGroups, flagGroup{flagsRequiredTogether, names})
+}
+
+// MarkFlagRequires requires the flags named by requires to be set on the
+// command line whenever the flag with the given name is set.  Unlike
+// MarkFlagsRequiredTogether, the dependency is one-directional.  The constraint
+// is checked like MarkFlagsOneRequired.
+func (cmd *Command) MarkFlagRequires(name string, requires ...string) {
+	cmd.flagGroups = append(cmd.flagGroups, flagGroup{flagRequires, append([]string{name}, requires...)})
+}
+
+// check returns a description of the failure if the group is violated by
+// setFlags, which holds the flags that were set, or "" otherwise.
+func (g flagGroup) check(setFlags map[string]string) string {
+	var set, unset []string
+	for _, name := range g.names {
+		if _, ok := setFlags[name]; ok {
+			set = append(set, name)
+		} else {
+			unset = append(unset, name)
+		}
+	}
+	switch g.kind {
+	case flagsOneRequired:
+		if len(set) == 0 {
+			return fmt.Sprintf("at least one of the flags %s must be set", joinFlagNames(g.names))
+		}
+	case flagsMutuallyExclusive:
+		if len(set) > 1 {
+			return fmt.Sprintf("at most one of the flags %s may be set, got %s", joinFlagNames(g.names), joinFlagNames(set))
+		}
+	case flagsRequiredTogether:
+		if len(set) > 0 && len(unset) > 0 {
+			return fmt.Sprintf("the flags %s must be set together, missing %s", joinFlagNames(g.names), joinFlagNames(unset))
+		}
+	case flagRequires:
+		if _, ok := setFlags[g.names[0]]; ok && len(unset) > 0 {
+			return fmt.Sprintf("flag -%s requires %s", g.names[0], joinFlagNames(unset))
+		}
+	}
+	return ""
+}
+
+// String returns a description of the group, for the help.
+func (g flagGroup) String() string {
+	switch g.kind {
+	case flagsOneRequired:
+		return fmt.Sprintf("At least one of the flags %s must be set.", joinFlagNames(g.names))
+	case flagsMutuallyExclusive:
+		return fmt.Sprintf("At most one of the flags %s may be set.", joinFlagNames(g.names))
+	case flagsRequiredTogether:
+		return fmt.Sprintf("The flags %s must be set together.", joinFlagNames(g.names))
+	case flagRequires:
+		return fmt.Sprintf("The flag -%s requires %s.", g.names[0], joinFlagNames(g.names[1:]))
+	}
+	return ""
+}
+
+// joinFlagNames returns names as flags, e.g. "-a, -b, -c".
+func joinFlagNames(names []string) string {
+	flags := make([]string, len(names))
+	for i, name := range names {
+		flags[i] = "-" + name
+	}
+	return strings.Join(flags, ", ")
+}
+
+// validateFlagGroups checks the flag groups of every command in path against
+// setFlags, which holds all flags that were set on the command line or from the
+// -flags-from file, along with the flags that env records as set from the
+// environment.  Returns a single error describing all violations, or nil if
+// there are none.
+func validateFlagGroups(path []*Command, env *Env, setFlags map[string]string) error {
+	// The flags set from the environment aren't in setFlags, since they aren't
+	// passed to external children.
+	set := make(map[string]string, len(setFlags))
+	for name, val := range setFlags {
+		set[name] = val
+	}
+	for name, source := range env.flagSources {
+		if _, ok := set[name]; !ok && source == flagSourceEnv {
+			set[name] = ""
+		}
+	}
+	var failures []string
+	for _, cmd := range path {
+		for _, g := range cmd.flagGroups {
+			if failure := g.check(set); failure != "" {
+				failures = append(failures, failure)
+			}
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(failures, "; "))
+}
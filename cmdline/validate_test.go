@@ -0,0 +1,352 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"strconv"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
+
+func validatePort(value string) error {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return errors.New("port must be 1-65535")
+	}
+	return nil
+}
+
+func TestFlagValidator(t *testing.T) {
+	child := &Command{
+		Name:   "child",
+		Short:  "child",
+		Long:   "child.",
+		Runner: RunnerFunc(runHello),
+	}
+	root := &Command{
+		Name:     "root",
+		Short:    "root",
+		Long:     "root.",
+		Children: []*Command{child},
+	}
+	var port, childPort int
+	root.Flags.IntVar(&port, "port", 80, "port")
+	child.Flags.IntVar(&childPort, "child-port", 80, "child port")
+	AddFlagValidator(&root.Flags, "port", validatePort)
+	AddFlagValidator(&child.Flags, "child-port", validatePort)
+	defer delete(flagValidators, &root.Flags)
+	defer delete(flagValidators, &child.Flags)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"child"}, ""},
+		{[]string{"-port=8080", "child", "-child-port=443"}, ""},
+		{[]string{"-port=0", "child"}, `root: invalid value "0" for flag -port: port must be 1-65535`},
+		{[]string{"child", "-child-port=99999"}, `root child: invalid value "99999" for flag -child-port: port must be 1-65535`},
+		{[]string{"child", "-port=0", "-child-port=0"}, `root child: invalid value "0" for flag -child-port: port must be 1-65535; invalid value "0" for flag -port: port must be 1-65535`},
+	}
+	for _, test := range tests {
+		// Start with a fresh flag.CommandLine, since it records the set flags.
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		_, _, err := Parse(root, env, test.args)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", test.args, err)
+			}
+			continue
+		}
+		if got, want := err, ErrUsage; got != want {
+			t.Errorf("%v: got error %v, want %v", test.args, got, want)
+		}
+		if got, want := stderr.String(), "ERROR: "+test.want+"\n"; !strings.HasPrefix(got, want) {
+			t.Errorf("%v: got stderr %q, want prefix %q", test.args, got, want)
+		}
+	}
+}
+
+func TestFlagGroups(t *testing.T) {
+	child := &Command{
+		Name:   "child",
+		Short:  "child",
+		Long:   "child.",
+		Runner: RunnerFunc(runHello),
+	}
+	var file, url string
+	var stdin bool
+	child.Flags.StringVar(&file, "file", "", "file")
+	child.Flags.BoolVar(&stdin, "stdin", false, "stdin")
+	child.Flags.StringVar(&url, "url", "", "url")
+	child.MarkFlagsOneRequired("file", "stdin", "url")
+	child.MarkFlagsMutuallyExclusive("file", "stdin", "url")
+	var cert, key, ca string
+	child.Flags.StringVar(&cert, "tls-cert", "", "tls-cert")
+	child.Flags.StringVar(&key, "tls-key", "", "tls-key")
+	child.Flags.StringVar(&ca, "tls-ca", "", "tls-ca")
+	child.MarkFlagsRequiredTogether("tls-cert", "tls-key")
+	child.MarkFlagRequires("tls-ca", "tls-cert")
+	root := &Command{
+		Name:     "root",
+		Short:    "root",
+		Long:     "root.",
+		Children: []*Command{child},
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"child", "-file=x"}, ""},
+		{[]string{"child", "-stdin"}, ""},
+		{[]string{"child"}, `root child: at least one of the flags -file, -stdin, -url must be set`},
+		{[]string{"child", "-url=x", "-file=y"}, `root child: at most one of the flags -file, -stdin, -url may be set, got -file, -url`},
+		{[]string{"child", "-stdin", "-tls-cert=c", "-tls-key=k"}, ""},
+		{[]string{"child", "-stdin", "-tls-key=k"}, `root child: the flags -tls-cert, -tls-key must be set together, missing -tls-cert`},
+		{[]string{"child", "-stdin", "-tls-ca=a"}, `root child: flag -tls-ca requires -tls-cert`},
+		{[]string{"child", "-stdin", "-tls-ca=a", "-tls-cert=c", "-tls-key=k"}, ""},
+		// All violations are reported together.
+		{[]string{"child", "-tls-ca=a", "-tls-key=k"}, `root child: at least one of the flags -file, -stdin, -url must be set; the flags -tls-cert, -tls-key must be set together, missing -tls-cert; flag -tls-ca requires -tls-cert`},
+	}
+	for _, test := range tests {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		_, _, err := Parse(root, env, test.args)
+		resetFlags(root)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", test.args, err)
+			}
+			continue
+		}
+		if got, want := err, ErrUsage; got != want {
+			t.Errorf("%v: got error %v, want %v", test.args, got, want)
+		}
+		if got, want := stderr.String(), "ERROR: "+test.want+"\n"; !strings.HasPrefix(got, want) {
+			t.Errorf("%v: got stderr %q, want prefix %q", test.args, got, want)
+		}
+	}
+
+	// The constraints are described after the flags in the help.
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{"help", "child"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := ` -url=
+   url
+
+At least one of the flags -file, -stdin, -url must be set. At most one of the
+flags -file, -stdin, -url may be set. The flags -tls-cert, -tls-key must be set
+together. The flag -tls-ca requires -tls-cert.
+`
+	if got := stdout.String(); !strings.Contains(got, want) {
+		t.Errorf("got help %q, want substring %q", got, want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var since, until int
+	var ran bool
+	child := &Command{
+		Name:     "child",
+		Short:    "child",
+		Long:     "child.",
+		ArgsName: "[name]",
+		Validate: func(env *Env, args []string) error {
+			if since > until {
+				return errors.New("-since must be before -until")
+			}
+			if len(args) > 1 {
+				return errors.New("at most one name may be given")
+			}
+			return nil
+		},
+		Runner: RunnerFunc(func(*Env, []string) error {
+			ran = true
+			return nil
+		}),
+	}
+	child.Flags.IntVar(&since, "since", 0, "since")
+	child.Flags.IntVar(&until, "until", 0, "until")
+	child.MarkFlagsRequiredTogether("since", "until")
+	root := &Command{
+		Name:     "root",
+		Short:    "root",
+		Long:     "root.",
+		Children: []*Command{child},
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"child"}, ""},
+		{[]string{"child", "-since=1", "-until=2", "a"}, ""},
+		{[]string{"child", "-since=2", "-until=1"}, `root child: -since must be before -until`},
+		{[]string{"child", "a", "b"}, `root child: at most one name may be given`},
+		// Flag groups are checked first.
+		{[]string{"child", "-since=2"}, `root child: the flags -since, -until must be set together, missing -until`},
+		// Validate isn't called for help.
+		{[]string{"help", "child"}, ""},
+		{[]string{"child", "-since=2", "-until=1", "-help"}, ""},
+	}
+	for _, test := range tests {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		since, until, ran = 0, 0, false
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		err := ParseAndRun(root, env, test.args)
+		resetFlags(root)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", test.args, err)
+			}
+			continue
+		}
+		if got, want := err, ErrUsage; got != want {
+			t.Errorf("%v: got error %v, want %v", test.args, got, want)
+		}
+		if ran {
+			t.Errorf("%v: runner was run", test.args)
+		}
+		if got, want := stderr.String(), "ERROR: "+test.want+"\n"; !strings.HasPrefix(got, want) {
+			t.Errorf("%v: got stderr %q, want prefix %q", test.args, got, want)
+		}
+	}
+}
+
+func TestFlagGroupsInherited(t *testing.T) {
+	status := &Command{
+		Name:   "status",
+		Short:  "status",
+		Long:   "status.",
+		Runner: RunnerFunc(runHello),
+	}
+	net := &Command{
+		Name:     "net",
+		Short:    "net",
+		Long:     "net.",
+		Children: []*Command{status},
+	}
+	var file, url, cert, key string
+	net.Flags.StringVar(&file, "file", "", "file")
+	net.Flags.StringVar(&url, "url", "", "url")
+	net.Flags.StringVar(&cert, "tls-cert", "", "tls-cert")
+	net.Flags.StringVar(&key, "tls-key", "", "tls-key")
+	net.MarkFlagsOneRequired("file", "url")
+	net.MarkFlagsMutuallyExclusive("file", "url")
+	net.MarkFlagsRequiredTogether("tls-cert", "tls-key")
+	root := &Command{
+		Name:     "root",
+		Short:    "root",
+		Long:     "root.",
+		Children: []*Command{net},
+	}
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"net", "-file=x", "status"}, ""},
+		// Inherited flags may be set after the child.
+		{[]string{"net", "status", "-file=x"}, ""},
+		{[]string{"net", "-tls-cert=c", "status", "-url=x", "-tls-key=k"}, ""},
+		{[]string{"net", "status"}, `root net status: at least one of the flags -file, -url must be set`},
+		{[]string{"net", "-file=x", "status", "-url=y"}, `root net status: at most one of the flags -file, -url may be set, got -file, -url`},
+		{[]string{"net", "status", "-file=x", "-tls-key=k"}, `root net status: the flags -tls-cert, -tls-key must be set together, missing -tls-cert`},
+		// Help doesn't require the flags.
+		{[]string{"net", "help", "status"}, ""},
+		{[]string{"help", "net", "status"}, ""},
+		{[]string{"net", "status", "-help"}, ""},
+	}
+	for _, test := range tests {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+		_, _, err := Parse(root, env, test.args)
+		resetFlags(root)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v\n%s", test.args, err, stderr.String())
+			}
+			continue
+		}
+		if got, want := err, ErrUsage; got != want {
+			t.Errorf("%v: got error %v, want %v", test.args, got, want)
+		}
+		if got, want := stderr.String(), "ERROR: "+test.want+"\n"; !strings.HasPrefix(got, want) {
+			t.Errorf("%v: got stderr %q, want prefix %q", test.args, got, want)
+		}
+	}
+}
+
+func TestFlagGroupsEnv(t *testing.T) {
+	child := &Command{
+		Name:   "child",
+		Short:  "child",
+		Long:   "child.",
+		Runner: RunnerFunc(runHello),
+	}
+	var file, url, cert, key string
+	child.Flags.StringVar(&file, "file", "", "file")
+	child.Flags.StringVar(&url, "url", "", "url")
+	child.Flags.StringVar(&cert, "tls-cert", "", "tls-cert")
+	child.Flags.StringVar(&key, "tls-key", "", "tls-key")
+	child.MarkFlagsOneRequired("file", "url")
+	child.MarkFlagsMutuallyExclusive("file", "url")
+	child.MarkFlagsRequiredTogether("tls-cert", "tls-key")
+	BindEnv(&child.Flags, "url", "CHILD_URL")
+	BindEnv(&child.Flags, "tls-key", "CHILD_TLS_KEY")
+	defer delete(flagEnvVars, &child.Flags)
+	root := &Command{
+		Name:     "root",
+		Short:    "root",
+		Long:     "root.",
+		Children: []*Command{child},
+	}
+
+	tests := []struct {
+		vars map[string]string
+		args []string
+		want string
+	}{
+		// Flags set from the environment count as set.
+		{map[string]string{"CHILD_URL": "x"}, []string{"child"}, ""},
+		{map[string]string{"CHILD_URL": "x"}, []string{"child", "-file=y"}, `root child: at most one of the flags -file, -url may be set, got -file, -url`},
+		{map[string]string{"CHILD_URL": "x", "CHILD_TLS_KEY": "k"}, []string{"child", "-tls-cert=c"}, ""},
+		{map[string]string{"CHILD_URL": "x", "CHILD_TLS_KEY": "k"}, []string{"child"}, `root child: the flags -tls-cert, -tls-key must be set together, missing -tls-cert`},
+		// Empty variables don't set the flag.
+		{map[string]string{"CHILD_URL": ""}, []string{"child"}, `root child: at least one of the flags -file, -url must be set`},
+	}
+	for _, test := range tests {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.MergeMaps(baseVars, test.vars)}
+		_, _, err := Parse(root, env, test.args)
+		resetFlags(root)
+		if test.want == "" {
+			if err != nil {
+				t.Errorf("%v %v: unexpected error: %v\n%s", test.vars, test.args, err, stderr.String())
+			}
+			continue
+		}
+		if got, want := err, ErrUsage; got != want {
+			t.Errorf("%v %v: got error %v, want %v", test.vars, test.args, got, want)
+		}
+		if got, want := stderr.String(), "ERROR: "+test.want+"\n"; !strings.HasPrefix(got, want) {
+			t.Errorf("%v %v: got stderr %q, want prefix %q", test.vars, test.args, got, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+const versionName = "version"
+
+// The build metadata, which may be set at link time, e.g.:
+//
+//   go build -ldflags "-X v.io/x/lib/cmdline.buildVersion=v1.2.3 -X v.io/x/lib/cmdline.buildCommit=$(git rev-parse HEAD)"
+//
+// Metadata that isn't set at link time is read from the module build info.
+var buildVersion, buildCommit, buildTime string
+
+// BuildInfo describes how the program was built.  Any field may be empty if the
+// information isn't available.
+type BuildInfo struct {
+	// Version is the version of the program, e.g. "v1.2.3".
+	Version string `json:"version"`
+	// Commit is the VCS revision the program was built from.
+	Commit string `json:"commit"`
+	// BuildTime is the time the program was built, or for module builds, the
+	// time of the VCS revision.
+	BuildTime string `json:"buildTime"`
+	// GoVersion is the version of Go used to build the program.
+	GoVersion string `json:"goVersion"`
+}
+
+// ReadBuildInfo returns the build info of the program.  The info set at link
+// time via -ldflags -X takes precedence; any remaining fields are filled in
+// from runtime/debug.ReadBuildInfo for programs built in module mode, which
+// includes VCS information when built with Go 1.18 or later.
+func ReadBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   buildVersion,
+		Commit:    buildCommit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+	if mod, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && mod.Main.Version != "(devel)" {
+			info.Version = mod.Main.Version
+		}
+		readVCSInfo(mod, &info)
+	}
+	return info
+}
+
+// String returns a single-line description of the build info, e.g.
+// "v1.2.3 (commit 0123abc, built 2020-01-02T03:04:05Z, go1.18)".
+func (info BuildInfo) String() string {
+	version := info.Version
+	if version == "" {
+		version = "(devel)"
+	}
+	var details []string
+	if info.Commit != "" {
+		details = append(details, "commit "+info.Commit)
+	}
+	if info.BuildTime != "" {
+		details = append(details, "built "+info.BuildTime)
+	}
+	if info.GoVersion != "" {
+		details = append(details, info.GoVersion)
+	}
+	if len(details) == 0 {
+		return version
+	}
+	return fmt.Sprintf("%s (%s)", version, strings.Join(details, ", "))
+}
+
+// WithBuildInfo adds a "version" child to root that prints the build info
+// returned by ReadBuildInfo, unless root already has a "version" child.  The
+// -json flag of the child prints the build info as a single JSON object
+// instead, for machine consumption.  Set HelpOptions.ShowBuildInfo to also show
+// the build info in the help of root.
+//
+// If root has a Runner and no children, a -version global flag that prints the
+// build info is registered instead of the child, since a child would conflict
+// with the args of the Runner, unless a -version flag is already defined.  The
+// children of root must be set before calling WithBuildInfo.
+//
+// WithBuildInfo must be called at most once, before Main or Parse.
+func WithBuildInfo(root *Command) {
+	if isLeafRoot(root) {
+		if commandLine().Lookup(versionName) != nil || root.Flags.Lookup(versionName) != nil {
+			return
+		}
+		show := commandLine().Bool(versionName, false, "Print the version and build info of "+root.Name+".")
+		root.addFlagRunner(func() bool { return *show }, RunnerFunc(func(env *Env, _ []string) error {
+			return writeBuildInfo(env, root, false)
+		}))
+		return
+	}
+	if lookupChild(root, versionName, false) != nil {
+		return
+	}
+	var asJSON bool
+	version := &Command{
+		Name:  versionName,
+		Short: "Print the version and build info",
+		Long: `
+Print the version of ` + root.Name + `, along with the VCS commit and time it was
+built from, and the version of Go it was built with.
+`,
+		Runner: RunnerFunc(func(env *Env, _ []string) error {
+			return writeBuildInfo(env, root, asJSON)
+		}),
+	}
+	version.Flags.BoolVar(&asJSON, "json", false, "Print the build info as a JSON object, for machine consumption.")
+	root.Children = append(root.Children, version)
+}
+
+// writeBuildInfo writes the build info of root to env.Stdout, as a line of text,
+// or a single JSON object if asJSON is true.
+func writeBuildInfo(env *Env, root *Command, asJSON bool) error {
+	info := ReadBuildInfo()
+	if !asJSON {
+		fmt.Fprintln(env.Stdout, root.Name, versionName, info)
+		return nil
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(env.Stdout, "%s\n", data)
+	return err
+}
@@ -0,0 +1,34 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build go1.18
+
+package cmdline
+
+import "runtime/debug"
+
+// readVCSInfo fills in the empty VCS fields of info from the settings stamped
+// into mod by the go command.  A "-dirty" suffix is added to the commit read
+// from mod if the working tree had local modifications.
+func readVCSInfo(mod *debug.BuildInfo, info *BuildInfo) {
+	var revision, modified string
+	for _, setting := range mod.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.time":
+			if info.BuildTime == "" {
+				info.BuildTime = setting.Value
+			}
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if info.Commit == "" && revision != "" {
+		info.Commit = revision
+		if modified == "true" {
+			info.Commit += "-dirty"
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !go1.18
+
+package cmdline
+
+import "runtime/debug"
+
+// readVCSInfo is a no-op, since VCS information is only stamped into the build
+// info by Go 1.18 and later.
+func readVCSInfo(mod *debug.BuildInfo, info *BuildInfo) {}
@@ -0,0 +1,144 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"flag"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"v.io/x/lib/envvar"
+)
+
+func TestBuildInfoString(t *testing.T) {
+	tests := []struct {
+		info BuildInfo
+		want string
+	}{
+		{BuildInfo{}, "(devel)"},
+		{BuildInfo{Version: "v1.2.3"}, "v1.2.3"},
+		{BuildInfo{GoVersion: "go1.18"}, "(devel) (go1.18)"},
+		{BuildInfo{"v1.2.3", "0123abc", "2020-01-02T03:04:05Z", "go1.18"}, "v1.2.3 (commit 0123abc, built 2020-01-02T03:04:05Z, go1.18)"},
+	}
+	for _, test := range tests {
+		if got, want := test.info.String(), test.want; got != want {
+			t.Errorf("%#v: got %q, want %q", test.info, got, want)
+		}
+	}
+}
+
+func TestWithBuildInfo(t *testing.T) {
+	defer func(version, commit, time string) {
+		buildVersion, buildCommit, buildTime = version, commit, time
+	}(buildVersion, buildCommit, buildTime)
+	buildVersion, buildCommit, buildTime = "v1.2.3", "0123abc", "2020-01-02T03:04:05Z"
+	defer SetHelpOptions(HelpOptions{})
+	SetHelpOptions(HelpOptions{ShowBuildInfo: true})
+
+	root := &Command{
+		Name:  "root",
+		Short: "root",
+		Long:  "root.",
+		Children: []*Command{{
+			Name:   "hello",
+			Short:  "hello",
+			Long:   "hello.",
+			Runner: RunnerFunc(runHello),
+		}},
+	}
+	WithBuildInfo(root)
+	want := "root version v1.2.3 (commit 0123abc, built 2020-01-02T03:04:05Z, " + runtime.Version() + ")\n"
+	for _, test := range []struct {
+		args   []string
+		style  string
+		suffix bool
+	}{
+		{[]string{"version"}, "compact", true},
+		{[]string{"help"}, "compact", true},
+		{[]string{"help"}, "godoc", false},
+		{[]string{"help", "version"}, "compact", false},
+	} {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		var stdout, stderr bytes.Buffer
+		vars := envvar.MergeMaps(baseVars, map[string]string{"CMDLINE_STYLE": test.style})
+		env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: vars}
+		if err := ParseAndRun(root, env, test.args); err != nil {
+			t.Errorf("%q: unexpected error: %v", test.args, err)
+		}
+		if got := strings.HasSuffix(stdout.String(), want); got != test.suffix {
+			t.Errorf("%q %s: got %q, want suffix %q %v", test.args, test.style, stdout.String(), want, test.suffix)
+		}
+	}
+	// The -json flag prints the build info for machine consumption.
+	flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	if err := ParseAndRun(root, env, []string{"version", "-json"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	wantJSON := `{"version":"v1.2.3","commit":"0123abc","buildTime":"2020-01-02T03:04:05Z","goVersion":"` + runtime.Version() + `"}` + "\n"
+	if got := stdout.String(); got != wantJSON {
+		t.Errorf("got %q, want %q", got, wantJSON)
+	}
+	resetFlags(root)
+}
+
+func TestWithBuildInfoLeafRoot(t *testing.T) {
+	defer func(version, commit, time string) {
+		buildVersion, buildCommit, buildTime = version, commit, time
+	}(buildVersion, buildCommit, buildTime)
+	buildVersion, buildCommit, buildTime = "v1.2.3", "0123abc", "2020-01-02T03:04:05Z"
+	defer func(fs, global *flag.FlagSet) { globalFlagSet, globalFlags = fs, global }(globalFlagSet, globalFlags)
+	SetGlobalFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+
+	var gotArgs []string
+	root := &Command{
+		Name:     "root",
+		Short:    "root",
+		Long:     "root.",
+		ArgsName: "<arg>",
+		Runner: RunnerFunc(func(_ *Env, args []string) error {
+			gotArgs = args
+			return nil
+		}),
+	}
+	WithBuildInfo(root)
+	if len(root.Children) != 0 {
+		t.Fatalf("got children %v, want none", root.Children)
+	}
+	var stdout, stderr bytes.Buffer
+	env := &Env{Stdout: &stdout, Stderr: &stderr, Vars: envvar.CopyMap(baseVars)}
+	// The args are still passed to the Runner, including "version".
+	if err := ParseAndRun(root, env, []string{"version"}); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+	}
+	if got, want := gotArgs, []string{"version"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got args %v, want %v", got, want)
+	}
+	resetFlags(root)
+	gotArgs = nil
+	if err := ParseAndRun(root, env, []string{"-version"}); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, stderr.String())
+	}
+	if gotArgs != nil {
+		t.Errorf("got args %v, want Runner not run", gotArgs)
+	}
+	want := "root version v1.2.3 (commit 0123abc, built 2020-01-02T03:04:05Z, " + runtime.Version() + ")\n"
+	if got := stdout.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// The flag is shown in the help.
+	resetFlags(root)
+	stdout.Reset()
+	if err := ParseAndRun(root, env, []string{"-help"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := stdout.String(); !strings.Contains(got, "-version=false") {
+		t.Errorf("got help %q, want -version flag", got)
+	}
+}
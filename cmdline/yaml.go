@@ -0,0 +1,236 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// marshalYAML returns v as YAML.  Structs are written as mappings, using the
+// json tags for the keys in field order, and respecting omitempty and "-".
+// Maps are written as mappings with sorted keys.  Multi-line strings are
+// written as literal block scalars.  This is sufficient for the data written by
+// this package; it is not a general YAML encoder.
+func marshalYAML(v interface{}) []byte {
+	var buf bytes.Buffer
+	rv := yamlIndirect(reflect.ValueOf(v))
+	if keys, vals, ok := yamlMapping(rv); ok && len(keys) > 0 {
+		writeYAMLMapping(&buf, keys, vals, "", "")
+		return buf.Bytes()
+	}
+	if yamlIsSequence(rv) && rv.Len() > 0 {
+		for i := 0; i < rv.Len(); i++ {
+			writeYAMLItem(&buf, rv.Index(i), "")
+		}
+		return buf.Bytes()
+	}
+	writeYAMLValue(&buf, rv, "")
+	// Remove the leading space written after the key, since there's no key.
+	return bytes.TrimPrefix(buf.Bytes(), []byte(" "))
+}
+
+// yamlIndirect returns v with pointers and interfaces removed.
+func yamlIndirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+func yamlIsSequence(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice:
+		return v.Type().Elem().Kind() != reflect.Uint8
+	case reflect.Array:
+		return true
+	}
+	return false
+}
+
+// yamlMapping returns the keys and values of v, if it is a struct or map.
+func yamlMapping(v reflect.Value) (keys []string, vals []reflect.Value, ok bool) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+			tag := strings.Split(field.Tag.Get("json"), ",")
+			name := tag[0]
+			switch {
+			case name == "-":
+				continue
+			case name == "":
+				name = field.Name
+			}
+			if len(tag) > 1 && tag[1] == "omitempty" && yamlIsEmpty(v.Field(i)) {
+				continue
+			}
+			keys, vals = append(keys, name), append(vals, v.Field(i))
+		}
+		return keys, vals, true
+	case reflect.Map:
+		byKey := make(map[string]reflect.Value)
+		for _, key := range v.MapKeys() {
+			name := fmt.Sprint(key.Interface())
+			keys, byKey[name] = append(keys, name), v.MapIndex(key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			vals = append(vals, byKey[key])
+		}
+		return keys, vals, true
+	}
+	return nil, nil, false
+}
+
+// yamlIsEmpty mirrors the definition of empty values used by encoding/json for
+// omitempty.
+func yamlIsEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// writeYAMLMapping writes the given keys and values as a YAML mapping.  The
+// first key is prefixed by first, e.g. "- " for a sequence item, and the
+// remaining keys by indent.
+func writeYAMLMapping(buf *bytes.Buffer, keys []string, vals []reflect.Value, first, indent string) {
+	for i, key := range keys {
+		prefix := indent
+		if i == 0 {
+			prefix = first
+		}
+		fmt.Fprintf(buf, "%s%s:", prefix, yamlQuote(key))
+		writeYAMLValue(buf, vals[i], indent)
+	}
+}
+
+// writeYAMLItem writes v as an item of a YAML sequence, with the "-" indicator
+// prefixed by indent.
+func writeYAMLItem(buf *bytes.Buffer, v reflect.Value, indent string) {
+	v = yamlIndirect(v)
+	if keys, vals, ok := yamlMapping(v); ok && len(keys) > 0 {
+		writeYAMLMapping(buf, keys, vals, indent+"- ", indent+"  ")
+		return
+	}
+	buf.WriteString(indent + "-")
+	if yamlIsSequence(v) {
+		// Nested sequences are indented under the "-" indicator.
+		indent += "  "
+	}
+	writeYAMLValue(buf, v, indent)
+}
+
+// writeYAMLValue writes v following a "key:" or "-" prefixed by indent.
+func writeYAMLValue(buf *bytes.Buffer, v reflect.Value, indent string) {
+	v = yamlIndirect(v)
+	if !v.IsValid() {
+		buf.WriteString(" null\n")
+		return
+	}
+	if keys, vals, ok := yamlMapping(v); ok {
+		if len(keys) == 0 {
+			buf.WriteString(" {}\n")
+			return
+		}
+		buf.WriteString("\n")
+		writeYAMLMapping(buf, keys, vals, indent+"  ", indent+"  ")
+		return
+	}
+	if yamlIsSequence(v) {
+		if v.Len() == 0 {
+			buf.WriteString(" []\n")
+			return
+		}
+		buf.WriteString("\n")
+		for i := 0; i < v.Len(); i++ {
+			writeYAMLItem(buf, v.Index(i), indent)
+		}
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		writeYAMLString(buf, v.String(), indent+"  ")
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		fmt.Fprintf(buf, " %v\n", v.Interface())
+	default:
+		writeYAMLString(buf, fmt.Sprint(v.Interface()), indent+"  ")
+	}
+}
+
+// writeYAMLString writes s as a YAML scalar following a key.  Multi-line
+// strings are written as literal block scalars, with each line prefixed by
+// indent, and the chomping indicator chosen so that the trailing newlines are
+// kept exactly.
+func writeYAMLString(buf *bytes.Buffer, s, indent string) {
+	// The indentation of a block scalar is detected from its first non-empty
+	// line, so strings whose first non-empty line is indented are quoted.
+	first := strings.TrimLeft(s, "\n")
+	if !strings.Contains(s, "\n") || first == "" || strings.HasPrefix(first, " ") {
+		fmt.Fprintf(buf, " %s\n", yamlQuote(s))
+		return
+	}
+	body := strings.TrimRight(s, "\n")
+	switch len(s) - len(body) {
+	case 0:
+		// The "|-" indicator strips the final newline.
+		buf.WriteString(" |-\n")
+	case 1:
+		// The "|" indicator keeps a single final newline.
+		buf.WriteString(" |\n")
+	default:
+		// The "|+" indicator keeps all the final newlines, which are written as
+		// empty lines.
+		buf.WriteString(" |+\n")
+		body = strings.TrimSuffix(s, "\n")
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if line == "" {
+			buf.WriteString("\n")
+			continue
+		}
+		buf.WriteString(indent + line + "\n")
+	}
+}
+
+// yamlQuote returns s as a plain YAML scalar if that's unambiguous, otherwise
+// as a double-quoted scalar.
+func yamlQuote(s string) string {
+	if s == "" || strings.TrimSpace(s) != s || strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`<=") || strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.ContainsAny(s, "\n\t\\\"") {
+		return strconv.Quote(s)
+	}
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "~":
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	return s
+}
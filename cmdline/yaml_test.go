@@ -0,0 +1,71 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cmdline
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseYAMLString parses the scalar written by writeYAMLString, following the
+// chomping rules of YAML for literal block scalars.
+func parseYAMLString(t *testing.T, data, indent string) string {
+	header, rest := data, ""
+	if index := strings.IndexByte(data, '\n'); index != -1 {
+		header, rest = data[:index], data[index+1:]
+	}
+	header = strings.TrimPrefix(header, " ")
+	if !strings.HasPrefix(header, "|") {
+		s, err := strconv.Unquote(header)
+		if err != nil {
+			return header
+		}
+		return s
+	}
+	lines := strings.Split(strings.TrimSuffix(rest, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, indent)
+	}
+	content := strings.Join(lines, "\n") + "\n"
+	body := strings.TrimRight(content, "\n")
+	switch header {
+	case "|-":
+		return body
+	case "|":
+		return body + "\n"
+	case "|+":
+		return content
+	}
+	t.Fatalf("unknown block scalar header %q", header)
+	return ""
+}
+
+func TestWriteYAMLStringRoundTrip(t *testing.T) {
+	tests := []struct {
+		s, header string
+	}{
+		{"a", ""},
+		{"a\nb", "|-"},
+		{"a\nb\n", "|"},
+		{"a\nb\n\n", "|+"},
+		{"a\n\nb\n\n\n", "|+"},
+		{"\nb\n", "|"},
+		{"  a\nb\n", ""},
+		{"\n\n", ""},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writeYAMLString(&buf, test.s, "  ")
+		data := buf.String()
+		if test.header != "" && !strings.HasPrefix(data, " "+test.header+"\n") {
+			t.Errorf("%q: got %q, want header %q", test.s, data, test.header)
+		}
+		if got := parseYAMLString(t, data, "  "); got != test.s {
+			t.Errorf("%q: got %q after round trip of %q", test.s, got, data)
+		}
+	}
+}
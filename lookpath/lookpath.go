@@ -8,6 +8,7 @@ package lookpath
 // TODO(toddw): implement for non-unix systems.
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -26,6 +27,16 @@ func splitPath(env map[string]string) []string {
 	return dirs
 }
 
+var (
+	// ErrNotExecutable is reported by LookFunc and LookPrefixFunc for a file
+	// that matches, but isn't executable, or is a directory.
+	ErrNotExecutable = errors.New("not executable")
+	// ErrShadowed is reported by LookPrefixFunc for an executable that matches,
+	// but whose name has already been matched in an earlier directory, or was
+	// passed in the names.
+	ErrShadowed = errors.New("shadowed by an earlier match")
+)
+
 func isExecutable(info os.FileInfo) bool {
 	mode := info.Mode()
 	return !mode.IsDir() && mode&0111 != 0
@@ -39,6 +50,18 @@ func isExecutable(info os.FileInfo) bool {
 // The behavior is the same as LookPath in the os/exec package, but allows the
 // env to be passed in explicitly.
 func Look(env map[string]string, name string) (string, error) {
+	return LookFunc(env, name, nil)
+}
+
+// LookFunc is like Look, but also calls report, if it's non-nil, for each file
+// that is considered, e.g. to diagnose why an executable isn't found.  The err
+// passed to report is nil for the file that is returned, and otherwise is the
+// reason the file was skipped, e.g. ErrNotExecutable.  Files that don't exist
+// aren't reported.
+func LookFunc(env map[string]string, name string, report func(file string, err error)) (string, error) {
+	if report == nil {
+		report = func(string, error) {}
+	}
 	var dirs []string
 	base := filepath.Base(name)
 	if base == name {
@@ -53,11 +76,16 @@ func Look(env map[string]string, name string) (string, error) {
 		}
 		info, err := os.Stat(file)
 		if err != nil {
+			if !os.IsNotExist(err) {
+				report(file, err)
+			}
 			continue
 		}
 		if !isExecutable(info) {
+			report(file, ErrNotExecutable)
 			continue
 		}
+		report(file, nil)
 		return file, nil
 	}
 	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
@@ -74,6 +102,19 @@ func Look(env map[string]string, name string) (string, error) {
 // property.  As a consequence, you may pass in a pre-populated names map to
 // prevent matching those names.  It is fine to pass in a nil names map.
 func LookPrefix(env map[string]string, prefix string, names map[string]bool) ([]string, error) {
+	return LookPrefixFunc(env, prefix, names, nil)
+}
+
+// LookPrefixFunc is like LookPrefix, but also calls report, if it's non-nil,
+// for each file that matches the prefix, e.g. to diagnose why an executable
+// isn't found.  The err passed to report is nil for the files that are
+// returned, and otherwise is the reason the file was skipped, e.g.
+// ErrNotExecutable or ErrShadowed.  Directories that can't be read are
+// reported with the error from reading them.
+func LookPrefixFunc(env map[string]string, prefix string, names map[string]bool, report func(file string, err error)) ([]string, error) {
+	if report == nil {
+		report = func(string, error) {}
+	}
 	if names == nil {
 		names = make(map[string]bool)
 	}
@@ -91,22 +132,26 @@ func LookPrefix(env map[string]string, prefix string, names map[string]bool) ([]
 		}
 		infos, err := ioutil.ReadDir(dir)
 		if err != nil {
+			report(dir, err)
 			continue
 		}
 		for _, info := range infos {
-			if !isExecutable(info) {
-				continue
-			}
 			name := info.Name()
 			file := filepath.Join(dir, name)
 			index := strings.LastIndex(file, prefix)
 			if index == -1 || strings.ContainsRune(file[index+len(prefix):], filepath.Separator) {
 				continue
 			}
+			if !isExecutable(info) {
+				report(file, ErrNotExecutable)
+				continue
+			}
 			if names[name] {
+				report(file, ErrShadowed)
 				continue
 			}
 			names[name] = true
+			report(file, nil)
 			all = append(all, file)
 		}
 	}
@@ -177,3 +177,75 @@ func TestLookPrefix(t *testing.T) {
 		}
 	}
 }
+
+// reporter records the candidates reported by LookFunc and LookPrefixFunc.
+type reporter []string
+
+func (r *reporter) report(file string, err error) {
+	if err != nil {
+		*r = append(*r, file+": "+err.Error())
+	} else {
+		*r = append(*r, file)
+	}
+}
+
+func TestLookFunc(t *testing.T) {
+	tmpDir, cleanup := initTmpDir(t)
+	defer cleanup()
+	dirA, dirB, dirC := mkdir(t, tmpDir, "a"), mkdir(t, tmpDir, "b"), mkdir(t, tmpDir, "c")
+	aExe, bExe := mkfile(t, dirA, "exe", 0644), mkfile(t, dirB, "exe", 0755)
+	cExe := mkdir(t, dirC, "exe")
+	var r reporter
+	look, err := lookpath.LookFunc(pathEnv(dirC, dirA, dirB), "exe", r.report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := look, bExe; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	want := reporter{cExe + ": not executable", aExe + ": not executable", bExe}
+	if got := r; !reflect.DeepEqual(got, want) {
+		t.Errorf("got reports %v, want %v", got, want)
+	}
+	// Missing files aren't reported.
+	r = nil
+	if _, err := lookpath.LookFunc(pathEnv(dirA, dirB), "missing", r.report); err == nil {
+		t.Errorf("expected an error")
+	}
+	if got := r; len(got) != 0 {
+		t.Errorf("got reports %v, want none", got)
+	}
+}
+
+func TestLookPrefixFunc(t *testing.T) {
+	tmpDir, cleanup := initTmpDir(t)
+	defer cleanup()
+	dirA, dirB := mkdir(t, tmpDir, "a"), mkdir(t, tmpDir, "b")
+	dirMissing := filepath.Join(tmpDir, "missing")
+	aBar, aBaz := mkfile(t, dirA, "bar", 0644), mkfile(t, dirA, "baz", 0755)
+	bBar, bBaz := mkfile(t, dirB, "bar", 0755), mkfile(t, dirB, "baz", 0755)
+	bBzz := mkfile(t, dirB, "bzz", 0755)
+	// Files that don't match the prefix aren't reported.
+	mkfile(t, dirB, "foo", 0755)
+	var r reporter
+	look, err := lookpath.LookPrefixFunc(pathEnv(dirMissing, dirA, dirB), "b", map[string]bool{"bzz": true}, r.report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := look, []string{bBar, aBaz}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(r) == 0 || !strings.HasPrefix(r[0], dirMissing+": ") {
+		t.Fatalf("got reports %v, want the missing dir first", r)
+	}
+	want := reporter{
+		aBar + ": not executable",
+		aBaz,
+		bBar,
+		bBaz + ": shadowed by an earlier match",
+		bBzz + ": shadowed by an earlier match",
+	}
+	if got := r[1:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got reports %v, want %v", got, want)
+	}
+}
@@ -6,8 +6,12 @@
 //
 // This package includes a combination of low-level and high-level utilities.
 // The main high-level utilities are:
-//   NewUTF8WrapWriter: Text formatter with line-based word wrapping.
-//   PrefixWriter:      Add prefix to output.
-//   PrefixLineWriter:  Add prefix to each line in output.
-//   ByteReplaceWriter: Replace single byte with bytes in output.
+//   NewUTF8WrapWriter:     Text formatter with line-based word wrapping.
+//   PrefixWriter:          Add prefix to output.
+//   PrefixLineWriter:      Add prefix to each line in output.
+//   NewNumberedLineWriter: Add line numbers to wrapped output.
+//   ByteReplaceWriter:     Replace single byte with bytes in output.
+//   NewProgress:           Progress bar redrawn on a single terminal line.
+//   Indent, Dedent:        Add or remove leading whitespace of each line.
+//   DisplayWidth:          Number of terminal columns occupied by a string.
 package textutil
@@ -0,0 +1,66 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"strings"
+)
+
+// Indent returns s with prefix added to the beginning of each line that
+// contains non-whitespace runes.  Lines are separated by "\n".
+func Indent(s, prefix string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			lines[i] = prefix + line
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// Dedent returns s with the leading whitespace that is common to all lines
+// removed, similar to Python's textwrap.dedent.  Lines that only contain
+// whitespace are ignored when computing the common whitespace, and are
+// normalized to empty lines.  Tabs and spaces are not considered equal.
+//
+// Dedent allows multi-line raw strings to be indented naturally in Go source:
+//
+//   long := textutil.Dedent(`
+//       First line.
+//         Indented line.
+//   `)
+func Dedent(s string) string {
+	lines := strings.SplitAfter(s, "\n")
+	var margin string
+	first := true
+	for i, line := range lines {
+		content := strings.TrimRight(line, "\n")
+		if strings.TrimSpace(content) == "" {
+			lines[i] = line[len(content):]
+			continue
+		}
+		indent := content[:len(content)-len(strings.TrimLeft(content, " \t"))]
+		switch {
+		case first:
+			margin, first = indent, false
+		case strings.HasPrefix(indent, margin):
+			// The margin is unchanged.
+		default:
+			margin = commonPrefix(margin, indent)
+		}
+	}
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, margin)
+	}
+	return strings.Join(lines, "")
+}
+
+func commonPrefix(a, b string) string {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
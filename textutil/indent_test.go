@@ -0,0 +1,46 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"testing"
+)
+
+func TestIndent(t *testing.T) {
+	tests := []struct {
+		s, prefix, want string
+	}{
+		{"", "  ", ""},
+		{"a", "  ", "  a"},
+		{"a\nb\n", "> ", "> a\n> b\n"},
+		{"a\n\n \nb", "  ", "  a\n\n \n  b"},
+	}
+	for _, test := range tests {
+		if got, want := Indent(test.s, test.prefix), test.want; got != want {
+			t.Errorf("Indent(%q, %q) got %q, want %q", test.s, test.prefix, got, want)
+		}
+	}
+}
+
+func TestDedent(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"", ""},
+		{"a", "a"},
+		{"  a\n  b\n", "a\nb\n"},
+		{"  a\n    b\n  c", "a\n  b\nc"},
+		{"\n    a\n  \n    b\n  ", "\na\n\nb\n"},
+		{"\ta\n\t\tb", "a\n\tb"},
+		// Tabs and spaces aren't equal, so there's no common whitespace.
+		{"\ta\n  b", "\ta\n  b"},
+		{"   a\n  b", " a\nb"},
+	}
+	for _, test := range tests {
+		if got, want := Dedent(test.s), test.want; got != want {
+			t.Errorf("Dedent(%q) got %q, want %q", test.s, got, want)
+		}
+	}
+}
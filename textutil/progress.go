@@ -0,0 +1,110 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// minProgressBarWidth is the minimum width in runes of the bar drawn by
+// Progress, not including the brackets.
+const minProgressBarWidth = 10
+
+// Progress draws a progress bar on a single terminal line, which is redrawn
+// with a leading carriage return each time the progress changes, e.g.:
+//
+//   [=========>          ]  47% 47/100
+//
+// Progress is silent if it is created with a nil writer, so callers may use it
+// unconditionally.  The methods of Progress may be called concurrently.
+type Progress struct {
+	w     io.Writer
+	width int
+
+	mu      sync.Mutex
+	total   int64
+	current int64
+	last    string
+	done    bool
+}
+
+// NewProgress returns a Progress that draws a bar for total units of work to w,
+// fitting the line in width runes.  If total is not positive, only the number
+// of completed units is shown.  If w is nil, the Progress draws nothing.
+func NewProgress(w io.Writer, total int64, width int) *Progress {
+	return &Progress{w: w, total: total, width: width}
+}
+
+// Add records n more completed units of work, and redraws the bar if it has
+// changed.
+func (p *Progress) Add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.current += n
+	p.draw()
+}
+
+// Done redraws the bar a final time and ends the line.  Subsequent calls to
+// Add and Done have no effect.
+func (p *Progress) Done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.done = true
+	p.draw()
+	if p.w != nil {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// draw writes the current line, unless it's the same as the last line.
+func (p *Progress) draw() {
+	if p.w == nil {
+		return
+	}
+	line := p.line()
+	if line == p.last {
+		return
+	}
+	p.last = line
+	fmt.Fprint(p.w, "\r"+line)
+}
+
+// line returns the current line, without the leading carriage return.
+func (p *Progress) line() string {
+	if p.total <= 0 {
+		return fmt.Sprint(p.current)
+	}
+	current := p.current
+	if current > p.total {
+		current = p.total
+	}
+	suffix := fmt.Sprintf(" %3d%% %d/%d", current*100/p.total, current, p.total)
+	// Leave room for the brackets, and avoid the last column, since writing to
+	// it causes some terminals to wrap the line.
+	width := p.width - len(suffix) - 3
+	if width < minProgressBarWidth {
+		width = minProgressBarWidth
+	}
+	filled := int(int64(width) * current / p.total)
+	var bar string
+	switch {
+	case filled == width:
+		bar = strings.Repeat("=", width)
+	case filled > 0:
+		bar = strings.Repeat("=", filled-1) + ">" + strings.Repeat(" ", width-filled)
+	default:
+		bar = strings.Repeat(" ", width)
+	}
+	return "[" + bar + "]" + suffix
+}
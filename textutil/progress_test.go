@@ -0,0 +1,44 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewProgress(&buf, 4, 30)
+	p.Add(1)
+	p.Add(0) // unchanged, not redrawn
+	p.Add(1)
+	p.Add(2)
+	p.Done()
+	p.Add(1) // ignored after Done
+	want := "\r[===>              ]  25% 1/4" +
+		"\r[========>         ]  50% 2/4" +
+		"\r[==================] 100% 4/4\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestProgressNoTotal(t *testing.T) {
+	var buf bytes.Buffer
+	p := NewProgress(&buf, 0, 30)
+	p.Add(3)
+	p.Add(4)
+	p.Done()
+	if got, want := buf.String(), "\r3\r7\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestProgressSilent(t *testing.T) {
+	p := NewProgress(nil, 10, 80)
+	p.Add(5)
+	p.Done()
+}
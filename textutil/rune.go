@@ -85,10 +85,14 @@ type bytePos int
 type runePos int
 
 // byteRuneBuffer maintains a buffer with both byte and rune based positions.
+// If display is true, the rune based positions count display columns rather
+// than runes.
 type byteRuneBuffer struct {
 	enc     RuneEncoder
 	buf     bytes.Buffer
 	runeLen runePos
+	display bool
+	state   displayWidthState
 }
 
 func (b *byteRuneBuffer) ByteLen() bytePos { return bytePos(b.buf.Len()) }
@@ -98,12 +102,31 @@ func (b *byteRuneBuffer) Bytes() []byte    { return b.buf.Bytes() }
 func (b *byteRuneBuffer) Reset() {
 	b.buf.Reset()
 	b.runeLen = 0
+	b.state = displayWidthState{}
+}
+
+// RuneWidth returns the amount that writing r would add to the rune length.
+func (b *byteRuneBuffer) RuneWidth(r rune) runePos {
+	if !b.display {
+		return 1
+	}
+	return b.state.width(r)
 }
 
 // WriteRune writes r into b.
 func (b *byteRuneBuffer) WriteRune(r rune) {
 	b.enc.Encode(r, &b.buf)
-	b.runeLen++
+	b.runeLen += b.RuneWidth(r)
+	if b.display {
+		b.state.next(r)
+	}
+}
+
+// Truncate discards all but the first n bytes of b, which had the rune length
+// runeLen.
+func (b *byteRuneBuffer) Truncate(n bytePos, runeLen runePos) {
+	b.buf.Truncate(int(n))
+	b.runeLen = runeLen
 }
 
 // WriteString writes str into b.
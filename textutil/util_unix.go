@@ -44,3 +44,9 @@ func terminalSize(fd int) (int, int, error) {
 type winsize struct {
 	row, col, xpixel, ypixel uint16
 }
+
+// IsTerminal returns true iff fd refers to a terminal.
+func IsTerminal(fd uintptr) bool {
+	_, _, err := terminalSize(int(fd))
+	return err == nil
+}
@@ -10,4 +10,10 @@ import "fmt"
 
 func TerminalSize() (row, col int, _ error) {
 	return 0, 0, fmt.Errorf("not implemented")
-}
\ No newline at end of file
+}
+
+// IsTerminal returns true iff fd refers to a terminal.  It is not implemented,
+// and always returns false.
+func IsTerminal(fd uintptr) bool {
+	return false
+}
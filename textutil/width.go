@@ -0,0 +1,170 @@
+// Copyright 2015 The Vanadium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package textutil
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+const zeroWidthJoiner = '\u200d'
+
+// wideRanges holds the ranges of runes that are displayed in two columns; this
+// covers the East Asian Wide and Fullwidth characters, as well as the blocks
+// that are commonly rendered as emoji.
+var wideRanges = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x1100, 0x115f, 1}, // Hangul Jamo initial consonants
+		{0x231a, 0x231b, 1}, // Watch, hourglass
+		{0x2329, 0x232a, 1}, // Angle brackets
+		{0x23e9, 0x23ec, 1}, // Media control emoji
+		{0x23f0, 0x23f0, 1},
+		{0x23f3, 0x23f3, 1},
+		{0x25fd, 0x25fe, 1},
+		{0x2614, 0x2615, 1},
+		{0x2648, 0x2653, 1}, // Zodiac emoji
+		{0x267f, 0x267f, 1},
+		{0x2693, 0x2693, 1},
+		{0x26a1, 0x26a1, 1},
+		{0x26aa, 0x26ab, 1},
+		{0x26bd, 0x26be, 1},
+		{0x26c4, 0x26c5, 1},
+		{0x26ce, 0x26ce, 1},
+		{0x26d4, 0x26d4, 1},
+		{0x26ea, 0x26ea, 1},
+		{0x26f2, 0x26f3, 1},
+		{0x26f5, 0x26f5, 1},
+		{0x26fa, 0x26fa, 1},
+		{0x26fd, 0x26fd, 1},
+		{0x2705, 0x2705, 1},
+		{0x270a, 0x270b, 1},
+		{0x2728, 0x2728, 1},
+		{0x274c, 0x274c, 1},
+		{0x274e, 0x274e, 1},
+		{0x2753, 0x2755, 1},
+		{0x2757, 0x2757, 1},
+		{0x2795, 0x2797, 1},
+		{0x27b0, 0x27b0, 1},
+		{0x27bf, 0x27bf, 1},
+		{0x2b1b, 0x2b1c, 1},
+		{0x2b50, 0x2b50, 1},
+		{0x2b55, 0x2b55, 1},
+		{0x2e80, 0x303e, 1}, // CJK radicals, symbols and punctuation
+		{0x3041, 0x33ff, 1}, // Hiragana, Katakana, CJK compatibility
+		{0x3400, 0x4dbf, 1}, // CJK unified ideographs extension A
+		{0x4e00, 0x9fff, 1}, // CJK unified ideographs
+		{0xa000, 0xa4cf, 1}, // Yi syllables and radicals
+		{0xa960, 0xa97f, 1}, // Hangul Jamo extended A
+		{0xac00, 0xd7a3, 1}, // Hangul syllables
+		{0xf900, 0xfaff, 1}, // CJK compatibility ideographs
+		{0xfe10, 0xfe19, 1}, // Vertical forms
+		{0xfe30, 0xfe6f, 1}, // CJK compatibility forms, small form variants
+		{0xff00, 0xff60, 1}, // Fullwidth forms
+		{0xffe0, 0xffe6, 1}, // Fullwidth signs
+	},
+	R32: []unicode.Range32{
+		{0x16fe0, 0x16fe4, 1},
+		{0x17000, 0x18cff, 1}, // Tangut
+		{0x1b000, 0x1b2ff, 1}, // Kana supplement and extensions
+		{0x1f004, 0x1f004, 1},
+		{0x1f0cf, 0x1f0cf, 1},
+		{0x1f18e, 0x1f18e, 1},
+		{0x1f191, 0x1f19a, 1},
+		{0x1f1e6, 0x1f1ff, 1}, // Regional indicators
+		{0x1f200, 0x1f2ff, 1}, // Enclosed ideographic supplement
+		{0x1f300, 0x1f64f, 1}, // Misc symbols and pictographs, emoticons
+		{0x1f680, 0x1f6ff, 1}, // Transport and map symbols
+		{0x1f7e0, 0x1f7eb, 1},
+		{0x1f90c, 0x1f9ff, 1}, // Supplemental symbols and pictographs
+		{0x1fa70, 0x1faff, 1}, // Symbols and pictographs extended A
+		{0x20000, 0x2fffd, 1}, // CJK unified ideographs extensions B..F
+		{0x30000, 0x3fffd, 1}, // CJK unified ideographs extension G
+	},
+}
+
+// isRegionalIndicator returns true iff r is a regional indicator symbol; pairs
+// of these are displayed as a single flag.
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// isClusterExtender returns true iff r extends the preceding grapheme cluster
+// without taking up any columns of its own.
+func isClusterExtender(r rune) bool {
+	switch {
+	case r == zeroWidthJoiner:
+		return true
+	case r >= 0x1f3fb && r <= 0x1f3ff:
+		// Emoji skin tone modifiers.
+		return true
+	case r >= 0x1160 && r <= 0x11ff:
+		// Hangul Jamo medial vowels and final consonants.
+		return true
+	}
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf)
+}
+
+// displayWidthState tracks the grapheme cluster that is currently being
+// measured, so that each cluster is counted only once.
+type displayWidthState struct {
+	prev     rune
+	riPaired bool // true iff prev is a regional indicator that completes a flag
+	joining  bool // true iff a ZWJ joins the next rune to the previous cluster
+}
+
+// width returns the number of display columns that r adds, given the runes
+// that were previously passed to next.
+func (s *displayWidthState) width(r rune) runePos {
+	switch {
+	case isClusterExtender(r):
+		return 0
+	case s.joining:
+		// The rune is joined to the previous cluster, e.g. in family emoji.
+		return 0
+	case isRegionalIndicator(r) && isRegionalIndicator(s.prev) && !s.riPaired:
+		// The second regional indicator completes the flag.
+		return 0
+	case unicode.Is(wideRanges, r):
+		return 2
+	}
+	return 1
+}
+
+// next updates the state after r has been written.
+func (s *displayWidthState) next(r rune) {
+	s.riPaired = isRegionalIndicator(r) && isRegionalIndicator(s.prev) && !s.riPaired
+	// A ZWJ only joins the single rune that follows it, after any other cluster
+	// extenders, and there's nothing to join at the start.
+	switch {
+	case r == zeroWidthJoiner:
+		s.joining = s.prev != 0
+	case !isClusterExtender(r):
+		s.joining = false
+	}
+	s.prev = r
+}
+
+// stringWidth returns the width of s, in display columns if display is true,
+// or in runes otherwise.
+func stringWidth(s string, display bool) runePos {
+	if !display {
+		return runePos(utf8.RuneCountInString(s))
+	}
+	var state displayWidthState
+	var width runePos
+	for _, r := range s {
+		width += state.width(r)
+		state.next(r)
+	}
+	return width
+}
+
+// DisplayWidth returns the number of columns that s occupies on a terminal,
+// measured in the same way as a WrapWriter with SetDisplayWidth(true); e.g.
+// combining marks take no columns, while East Asian wide characters and most
+// emoji take two columns.  Use it to align columns of text.
+func DisplayWidth(s string) int {
+	return int(stringWidth(s, true))
+}
@@ -7,6 +7,9 @@ package textutil
 import (
 	"fmt"
 	"io"
+	"strings"
+	"sync"
+	"time"
 	"unicode"
 )
 
@@ -22,25 +25,30 @@ import (
 // letters.  Sequences of words form paragraphs, where paragraphs are separated
 // by either blank lines (that contain no letters), or an explicit U+2029
 // ParagraphSeparator.  Input lines with leading spaces are treated verbatim.
+// Any number of consecutive blank lines results in a single paragraph separator
+// in the output, regardless of how the input is split across Write calls.  Note
+// that Flush ends the current output line, so a blank line written after Flush
+// always terminates the paragraph.
 //
 // Paragraphs are output as word-wrapped lines; line breaks only occur at word
 // boundaries.  Output lines are usually no longer than the target width.  The
 // exceptions are single words longer than the target width, which are output on
-// their own line, and verbatim lines, which may be arbitrarily longer or
-// shorter than the width.
+// their own line unless SetBreakLongWords is enabled, and verbatim lines, which
+// may be arbitrarily longer or shorter than the width.
 //
-// Output lines never contain trailing spaces.  Only verbatim output lines may
-// contain leading spaces.  Spaces separating input words are output verbatim,
-// unless it would result in a line with leading or trailing spaces.
+// Output lines never contain trailing spaces, unless SetPreserveTrailingSpace
+// is enabled.  Only verbatim output lines may contain leading spaces.  Spaces
+// separating input words are output verbatim, unless it would result in a line
+// with leading or trailing spaces.
 //
 // EOL runes within the input text are never written to the output; the output
 // line terminator and paragraph separator may be configured, and some EOL may
 // be output as a single space ' ' to maintain word separation.
 //
 // The algorithm greedily fills each output line with as many words as it can,
-// assuming that all Unicode code points have the same width.  Invalid UTF-8 is
-// silently transformed to the replacement character U+FFFD and treated as a
-// single rune.
+// assuming that all Unicode code points have the same width, unless display
+// widths are enabled via SetDisplayWidth.  Invalid UTF-8 is silently
+// transformed to the replacement character U+FFFD and treated as a single rune.
 //
 // Flush must be called after the last call to Write; the input is buffered.
 //
@@ -57,10 +65,21 @@ type WrapWriter struct {
 	w             io.Writer
 	runeDecoder   RuneChunkDecoder
 	width         runePos
+	rightMargin   runePos
 	lineTerm      []byte
 	paragraphSep  string
 	indents       []string
 	forceVerbatim bool
+	preserveSpace bool
+	breakWords    bool
+	onLine        func(string)
+	flushPartial  bool
+
+	// Guards the state below when flushPartial is enabled, since partial lines
+	// are flushed by partialTimer in a separate goroutine.
+	mu           sync.Mutex
+	partialTimer *time.Timer
+	partialErr   error // error from flushing on partialTimer
 
 	// The buffer contains a single output line.
 	lineBuf byteRuneBuffer
@@ -72,12 +91,27 @@ type WrapWriter struct {
 	// Keep track of blank input lines.
 	inputLineHasLetter bool
 
-	// lineBuf positions where the line starts (after separators and indents), a
-	// new word has started and the last word has ended.
+	// lineBuf positions where the paragraph separator ends, the line starts (after
+	// separators and indents), a new word has started and the last word has
+	// ended.
+	sepEnd       bytePos
 	lineStart    bytePos
 	newWordStart bytePos
 	lastWordEnd  bytePos
 
+	// lineBuf position up to which the line has already been written by
+	// FlushLine.
+	partialEnd bytePos
+
+	// lineBuf positions where the current run of spaces starts and ends, and
+	// where the last run of spaces before an input EOL ends; used to preserve
+	// trailing spaces.  The rune length of lineBuf at the start of the run is
+	// kept so that the run can be trimmed.
+	spaceRunStart    bytePos
+	spaceRunStartLen runePos
+	spaceRunEnd      bytePos
+	trailingSpaceEnd bytePos
+
 	// Keep track of paragraph terminations and line indices, so we can output the
 	// paragraph separator and indents correctly.
 	terminateParagraph bool
@@ -121,6 +155,76 @@ func NewUTF8WrapWriter(w io.Writer, width int) *WrapWriter {
 // unlimited; each paragraph is output as a single line.
 func (w *WrapWriter) Width() int { return int(w.width) }
 
+// SetWidth sets the target width in runes for subsequent Write calls; e.g. to
+// wrap nested content at different indents to different widths, without
+// creating a new WrapWriter.  If width < 0 the width is unlimited.  Text that
+// was buffered before the call is wrapped to the old width.
+//
+// Calls Flush internally, and returns any Flush error.
+func (w *WrapWriter) SetWidth(width int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	w.width = runePos(width)
+	return nil
+}
+
+// SetRightMargin sets the right margin for subsequent Write calls.  Lines are
+// word-wrapped to the target width minus the margin, leaving the margin free
+// for other uses, e.g. a border or scroll indicator.  Indents consume runes
+// from the remaining width as usual.  The margin has no effect if the width is
+// unlimited; if the margin is at least the width, each word is output on its
+// own line, as if the width were 0.
+//
+// A new WrapWriter instance has no right margin by default.
+//
+// Calls Flush internally, and returns any Flush error.
+func (w *WrapWriter) SetRightMargin(margin int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	w.rightMargin = runePos(margin)
+	return nil
+}
+
+// wrapWidth returns the width that lines are word-wrapped to, taking the right
+// margin into account.
+func (w *WrapWriter) wrapWidth() runePos {
+	switch {
+	case w.width < 0:
+		return w.width
+	case w.width < w.rightMargin:
+		return 0
+	}
+	return w.width - w.rightMargin
+}
+
+// SetDisplayWidth sets whether the width is measured in display columns for
+// subsequent Write calls.  If display is false, every rune counts as a single
+// column, which is fast and correct for ASCII text.  If display is true, the
+// text is segmented into grapheme clusters, and each cluster counts as the
+// number of columns it occupies on a terminal; e.g. combining marks take no
+// columns, while East Asian wide characters and most emoji take two columns.
+// The width of indents is measured in the same way.
+//
+// A new WrapWriter instance measures the width in runes by default.
+//
+// Calls Flush internally, and returns any Flush error.
+func (w *WrapWriter) SetDisplayWidth(display bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	w.lineBuf.display = display
+	w.resetLine()
+	return nil
+}
+
 // SetLineTerminator sets the line terminator for subsequent Write calls.  Every
 // output line is terminated with term; EOL runes from the input are never
 // written to the output.  A new WrapWriter instance uses "\n" as the default
@@ -128,7 +232,9 @@ func (w *WrapWriter) Width() int { return int(w.width) }
 //
 // Calls Flush internally, and returns any Flush error.
 func (w *WrapWriter) SetLineTerminator(term string) error {
-	if err := w.Flush(); err != nil {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
 		return err
 	}
 	w.lineTerm = []byte(term)
@@ -143,7 +249,9 @@ func (w *WrapWriter) SetLineTerminator(term string) error {
 //
 // Calls Flush internally, and returns any Flush error.
 func (w *WrapWriter) SetParagraphSeparator(sep string) error {
-	if err := w.Flush(); err != nil {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
 		return err
 	}
 	w.paragraphSep = sep
@@ -164,7 +272,9 @@ func (w *WrapWriter) SetParagraphSeparator(sep string) error {
 //
 // Calls Flush internally, and returns any Flush error.
 func (w *WrapWriter) SetIndents(indents ...string) error {
-	if err := w.Flush(); err != nil {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
 		return err
 	}
 	// Copy indents in case the user passed the slice via SetIndents(p...), and
@@ -191,8 +301,153 @@ func (w *WrapWriter) SetIndents(indents ...string) error {
 //
 // Calls Flush internally, and returns any Flush error.
 func (w *WrapWriter) ForceVerbatim(v bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	w.forceVerbatim = v
-	return w.Flush()
+	return w.flushLocked()
+}
+
+// WriteCentered writes s as a single line, padded with leading spaces to
+// center it within the target width, after subtracting the right margin and the
+// indent for the line.  Leading and trailing spaces in s are ignored, and s
+// should not contain EOL runes.  The width is measured as configured by
+// SetDisplayWidth.  If s doesn't fit within the width, or if the width is
+// unlimited, s is written without padding.
+//
+// Calls Flush internally, and returns any Flush error.
+func (w *WrapWriter) WriteCentered(s string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	s = strings.TrimSpace(s)
+	// After Flush the line buffer only holds the indent for the next line.
+	width, n := w.wrapWidth()-w.lineBuf.RuneLen(), stringWidth(s, w.lineBuf.display)
+	if n < width {
+		s = strings.Repeat(" ", int(width-n)/2) + s
+	}
+	// Write s in verbatim mode, so that the padding is retained.  The runes are
+	// added directly, since s is a UTF-8 string regardless of w.runeDecoder.
+	defer func(verbatim bool) { w.forceVerbatim = verbatim }(w.forceVerbatim)
+	w.forceVerbatim = true
+	for _, r := range s {
+		if err := w.addRune(r); err != nil {
+			return err
+		}
+	}
+	return w.flushLocked()
+}
+
+// SetPreserveTrailingSpace sets whether trailing spaces are preserved for
+// subsequent Write calls.  If preserve is true, spaces at the end of each input
+// line are kept at the end of the corresponding output line, as long as they
+// fit within the target width.  Spaces at word-wrapping line breaks are never
+// preserved, and are never carried over to the start of the next line.  If an
+// input line is joined with the next one, its trailing spaces are replaced with
+// a single space.
+//
+// A new WrapWriter instance trims trailing spaces by default.
+//
+// Calls Flush internally, and returns any Flush error.
+func (w *WrapWriter) SetPreserveTrailingSpace(preserve bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	w.preserveSpace = preserve
+	return nil
+}
+
+// SetBreakLongWords sets whether words longer than the target width are broken
+// for subsequent Write calls.  If brk is true, such words are broken at the
+// width boundary, and the rest of the word continues on the next line, so that
+// no word-wrapped output line exceeds the width.  Words are only broken between
+// runes, or between grapheme clusters if SetDisplayWidth is enabled.  Verbatim
+// lines are never broken.
+//
+// A new WrapWriter instance outputs long words on their own line by default,
+// exceeding the width.
+//
+// Calls Flush internally, and returns any Flush error.
+func (w *WrapWriter) SetBreakLongWords(brk bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	w.breakWords = brk
+	return nil
+}
+
+// OnLine sets fn to be called with each output line, before it is written to
+// the underlying writer.  The line includes its indent, but not the line
+// terminator.  The fn is called exactly once per output line, including the
+// last line written by Flush, and each newline-terminated line of the paragraph
+// separator; e.g. the blank line between paragraphs is reported as "".  A nil
+// fn disables the callback.
+func (w *WrapWriter) OnLine(fn func(line string)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onLine = fn
+}
+
+// flushPartialDelay is how long a partial line is buffered when SetFlushPartial
+// is enabled, before it's written by FlushLine.
+var flushPartialDelay = 100 * time.Millisecond
+
+// SetFlushPartial sets whether partial lines are flushed for subsequent Write
+// calls.  If flush is true and a Write leaves a partial line buffered, the
+// partial line is written via FlushLine if no other Write occurs within a short
+// delay.  This trades perfect word-wrapping for responsiveness, e.g. when
+// wrapping the live output of a long-running command.
+//
+// A new WrapWriter instance buffers partial lines until they're complete by
+// default.
+//
+// Calls Flush internally, and returns any Flush error.
+func (w *WrapWriter) SetFlushPartial(flush bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.flushLocked(); err != nil {
+		return err
+	}
+	w.flushPartial = flush
+	return nil
+}
+
+// FlushLine writes the partial line that is currently buffered to the
+// underlying writer, without terminating the line.  Subsequent writes continue
+// the same line, but the written part of the line can no longer be wrapped;
+// e.g. a word that is split across the FlushLine call isn't moved to the next
+// line, even if the line becomes too wide.  Lines that don't contain any
+// letters yet aren't written.
+func (w *WrapWriter) FlushLine() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLine()
+}
+
+func (w *WrapWriter) flushLine() error {
+	if w.lastWordEnd == -1 && w.newWordStart == -1 {
+		return nil
+	}
+	end := w.lineBuf.ByteLen()
+	if _, err := w.w.Write(w.lineBuf.Bytes()[w.partialEnd:end]); err != nil {
+		return err
+	}
+	w.partialEnd = end
+	return nil
+}
+
+// flushPartialTimeout is called by partialTimer to flush the partial line.
+func (w *WrapWriter) flushPartialTimeout() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.flushPartial && w.partialErr == nil {
+		w.partialErr = w.flushLine()
+	}
 }
 
 // Write implements io.Writer by buffering data into the WrapWriter w.  Actual
@@ -201,7 +456,31 @@ func (w *WrapWriter) ForceVerbatim(v bool) error {
 //
 // Flush must be called after the last call to Write.
 func (w *WrapWriter) Write(data []byte) (int, error) {
-	return WriteRuneChunk(w.runeDecoder, w.addRune, data)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.takePartialErr(); err != nil {
+		return 0, err
+	}
+	n, err := WriteRuneChunk(w.runeDecoder, w.addRune, data)
+	if err == nil && w.flushPartial && w.lineBuf.ByteLen() > w.partialEnd {
+		if w.partialTimer == nil {
+			w.partialTimer = time.AfterFunc(flushPartialDelay, w.flushPartialTimeout)
+		} else {
+			w.partialTimer.Reset(flushPartialDelay)
+		}
+	}
+	return n, err
+}
+
+// takePartialErr stops partialTimer, and returns and clears the error from
+// flushing on partialTimer, if any.
+func (w *WrapWriter) takePartialErr() error {
+	if w.partialTimer != nil {
+		w.partialTimer.Stop()
+	}
+	err := w.partialErr
+	w.partialErr = nil
+	return err
 }
 
 // Flush flushes any remaining buffered text, and resets the paragraph line
@@ -212,6 +491,22 @@ func (w *WrapWriter) Write(data []byte) (int, error) {
 // Flush must be called after the last call to Write, and may be called an
 // arbitrary number of times before the last Write.
 func (w *WrapWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushLocked()
+}
+
+// flushLocked implements Flush, and must be called with w.mu held.  The setters
+// hold w.mu across the flush and their state change, so that the change can't
+// race with the timer that flushes partial lines.
+func (w *WrapWriter) flushLocked() error {
+	if err := w.takePartialErr(); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+func (w *WrapWriter) flush() error {
 	if err := FlushRuneChunk(w.runeDecoder, w.addRune); err != nil {
 		return err
 	}
@@ -227,8 +522,18 @@ func (w *WrapWriter) Flush() error {
 
 // addRune is called every time w.runeDecoder decodes a full rune.
 func (w *WrapWriter) addRune(r rune) error {
+	if w.preserveSpace && runeKind(r) == kindLetter {
+		w.trimJoinedSpace()
+	}
 	state, lineBreak := w.nextState(r, w.updateRune(r))
-	if lineBreak {
+	if !lineBreak && w.breakWord(r, state) {
+		// End the line within the word, and continue the word on the next line.
+		w.newWordStart, w.lastWordEnd = -1, w.lineBuf.ByteLen()
+		if err := w.writeLine(); err != nil {
+			return err
+		}
+		w.newWordStart = w.lineBuf.ByteLen()
+	} else if lineBreak {
 		if err := w.writeLine(); err != nil {
 			return err
 		}
@@ -268,6 +573,10 @@ func (w *WrapWriter) updateRune(r rune) bool {
 			w.newWordStart = -1
 			w.lastWordEnd = w.lineBuf.ByteLen()
 		}
+		// Update trailingSpaceEnd if the input line ended with spaces.
+		if w.spaceRunEnd != -1 {
+			w.trailingSpaceEnd = w.spaceRunEnd
+		}
 		switch {
 		case w.prevRune == '\r' && r == '\n':
 			// Treat "\r\n" as a single EOL; we've already handled the logic for '\r',
@@ -372,7 +681,8 @@ func (w *WrapWriter) nextState(r rune, forceLineBreak bool) (state, bool) {
 		return stateVerbatim, true
 	}
 	// Break on EOL or space when the line is too wide.  See above table.
-	if w.width >= 0 && w.width <= w.lineBuf.RuneLen()+1 {
+	width := w.wrapWidth()
+	if width >= 0 && width <= w.lineBuf.RuneLen()+1 {
 		switch kind {
 		case kindEOL:
 			return stateWordWrap, true
@@ -382,13 +692,26 @@ func (w *WrapWriter) nextState(r rune, forceLineBreak bool) (state, bool) {
 		// case kindLetter falls through
 	}
 	// Handle the newWordStart case in the above table.
-	if w.width >= 0 && w.width < w.lineBuf.RuneLen()+1 && w.newWordStart != w.lineStart {
+	// A word that was already partially written by FlushLine can't be moved.
+	if width >= 0 && width < w.lineBuf.RuneLen()+w.lineBuf.RuneWidth(r) && w.newWordStart != w.lineStart && w.newWordStart >= w.partialEnd {
 		return stateWordWrap, true
 	}
 	// Stay in the wordWrap state and don't break the line.
 	return stateWordWrap, false
 }
 
+// breakWord returns true iff the letter r would make the line too wide, and
+// SetBreakLongWords is enabled, and the line only contains the word that r is
+// part of.  Words that don't start the line are moved to the next line by the
+// regular word-wrapping, before they are broken.
+func (w *WrapWriter) breakWord(r rune, state state) bool {
+	if !w.breakWords || state != stateWordWrap || runeKind(r) != kindLetter || w.newWordStart != w.lineStart {
+		return false
+	}
+	width := w.wrapWidth()
+	return width >= 0 && w.lineBuf.ByteLen() > w.lineStart && width < w.lineBuf.RuneLen()+w.lineBuf.RuneWidth(r)
+}
+
 func (w *WrapWriter) writeLine() error {
 	if w.lastWordEnd == -1 {
 		// Don't write blank lines, but we must reset the line in case the paragraph
@@ -396,8 +719,29 @@ func (w *WrapWriter) writeLine() error {
 		w.resetLine()
 		return nil
 	}
-	// Write the line (without trailing spaces) followed by the line terminator.
-	line := w.lineBuf.Bytes()[:w.lastWordEnd]
+	// Write the line (without trailing spaces, unless they're preserved) followed
+	// by the line terminator.
+	end := w.lastWordEnd
+	if w.preserveSpace && w.trailingSpaceEnd > end {
+		end = w.trailingSpaceEnd
+	}
+	line := w.lineBuf.Bytes()[:end]
+	if w.onLine != nil {
+		// Each line of the paragraph separator is also an output line, e.g. the
+		// blank line between paragraphs for the default "\n" separator.
+		sep := string(line[:w.sepEnd])
+		for i := strings.IndexByte(sep, '\n'); i != -1; i = strings.IndexByte(sep, '\n') {
+			w.onLine(strings.TrimSuffix(sep[:i], "\r"))
+			sep = sep[i+1:]
+		}
+		w.onLine(sep + string(line[w.sepEnd:]))
+	}
+	// Skip the part of the line that was already written by FlushLine.
+	if w.partialEnd < end {
+		line = line[w.partialEnd:]
+	} else {
+		line = nil
+	}
 	if _, err := w.w.Write(line); err != nil {
 		return err
 	}
@@ -422,14 +766,18 @@ func (w *WrapWriter) writeLine() error {
 
 func (w *WrapWriter) resetLine() {
 	w.lineBuf.Reset()
+	w.partialEnd = 0
 	w.newWordStart = -1
 	w.lastWordEnd = -1
+	w.spaceRunEnd = -1
+	w.trailingSpaceEnd = -1
 	// Write the paragraph separator if the previous paragraph has terminated.
 	// This consumes no runes from the line width.
 	if w.wroteFirstLine && w.terminateParagraph {
 		w.lineBuf.WriteString0Runes(w.paragraphSep)
 		w.paragraphLineIndex = 0
 	}
+	w.sepEnd = w.lineBuf.ByteLen()
 	// Add indent; a non-empty indent consumes runes from the line width.
 	var indent string
 	switch {
@@ -442,6 +790,19 @@ func (w *WrapWriter) resetLine() {
 	w.lineStart = w.lineBuf.ByteLen()
 }
 
+// trimJoinedSpace replaces the trailing spaces of the previous input line with
+// a single space, if the line was joined with the word that starts with the
+// next letter.  Trailing spaces are only preserved at the end of output lines;
+// spaces that were already written by FlushLine are kept.
+func (w *WrapWriter) trimJoinedSpace() {
+	if runeKind(w.prevRune) != kindEOL || w.prevState != stateWordWrap || w.trailingSpaceEnd == -1 || w.trailingSpaceEnd != w.lineBuf.ByteLen() || w.spaceRunStart < w.partialEnd {
+		return
+	}
+	w.lineBuf.Truncate(w.spaceRunStart, w.spaceRunStartLen)
+	w.lineBuf.WriteRune(' ')
+	w.trailingSpaceEnd = -1
+}
+
 func (w *WrapWriter) bufferRune(r rune, state state, lineBreak bool) {
 	// Never add leading spaces to the buffer in the wordWrap state.
 	wordWrapNoLeadingSpaces := state == stateWordWrap && !lineBreak
@@ -453,12 +814,18 @@ func (w *WrapWriter) bufferRune(r rune, state state, lineBreak bool) {
 		if wordWrapNoLeadingSpaces && runeKind(w.prevRune) == kindLetter {
 			w.lineBuf.WriteRune(' ')
 		}
+		w.spaceRunEnd = -1
 	case kindSpace:
 		if wordWrapNoLeadingSpaces || state == stateVerbatim {
+			if w.spaceRunEnd == -1 {
+				w.spaceRunStart, w.spaceRunStartLen = w.lineBuf.ByteLen(), w.lineBuf.RuneLen()
+			}
 			w.lineBuf.WriteRune(r)
+			w.spaceRunEnd = w.lineBuf.ByteLen()
 		}
 	case kindLetter:
 		w.lineBuf.WriteRune(r)
+		w.spaceRunEnd = -1
 	default:
 		panic(fmt.Errorf("textutil: bufferRune unhandled kind %d", kind))
 	}
@@ -7,8 +7,11 @@ package textutil
 import (
 	"bytes"
 	"io"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type lp struct {
@@ -216,6 +219,335 @@ func TestWrapWriterForceVerbatim(t *testing.T) {
 	}
 }
 
+func TestWrapWriterRightMargin(t *testing.T) {
+	tests := []struct {
+		Width, Margin int
+		Indents       [][]int
+		In            string // See xlateIn for details on the format
+		Want          string // See xlateWant for details on the format
+	}{
+		{4, 0, [][]int{nil}, "a cd", "0a cd."},
+		{6, 2, [][]int{nil}, "a cd", "0a cd."},
+		{6, 2, [][]int{nil}, "a cde", "0a.1cde."},
+		{6, 2, allIndents1, "a cd", "0a.1cd."},
+		{6, 2, allIndents, "abc e ghi", "0abc.1e.2ghi."},
+		// The margin consumes the entire width.
+		{2, 2, allIndents, "a c e", "0a.1c.2e."},
+		{2, 3, allIndents, "a c e", "0a.1c.2e."},
+		// The margin has no effect on unlimited width.
+		{-1, 2, allIndents, "a c e", "0a c e."},
+	}
+	for _, test := range tests {
+		for _, indents := range test.Indents {
+			var buf bytes.Buffer
+			w := newUTF8WrapWriter(t, &buf, test.Width, lp{}, indents)
+			if err := w.SetRightMargin(test.Margin); err != nil {
+				t.Errorf("SetRightMargin(%d) got %v, want nil", test.Margin, err)
+			}
+			wrapWriterWriteFlush(t, w, xlateIn(test.In), nil)
+			if got, want := buf.String(), xlateWant(test.Want, lp{}, indents); got != want {
+				t.Errorf("%q width:%d margin:%d indents:%v got %q, want %q", test.In, test.Width, test.Margin, indents, got, want)
+			}
+		}
+	}
+}
+
+func TestWrapWriterSetWidth(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewUTF8WrapWriter(&buf, 7)
+	if _, err := w.Write([]byte("aaa bbb ccc\na b c d")); err != nil {
+		t.Fatal(err)
+	}
+	// The partial line "a b c d" is flushed at the old width.
+	if err := w.SetWidth(3); err != nil {
+		t.Fatalf("SetWidth(3) got %v, want nil", err)
+	}
+	if got, want := w.Width(), 3; got != want {
+		t.Errorf("got width %d, want %d", got, want)
+	}
+	wrapWriterWriteFlush(t, w, "e f g", nil)
+	if err := w.SetWidth(-1); err != nil {
+		t.Fatalf("SetWidth(-1) got %v, want nil", err)
+	}
+	wrapWriterWriteFlush(t, w, "h i j k l", nil)
+	if got, want := buf.String(), "aaa bbb\nccc a b\nc d\ne f\ng\nh i j k l\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWrapWriterCentered(t *testing.T) {
+	tests := []struct {
+		Width, Margin int
+		Indents       []string
+		In, Want      string
+	}{
+		{10, 0, nil, "abcd", "   abcd\n"},
+		{10, 0, nil, "  abcd  ", "   abcd\n"},
+		{9, 0, nil, "abcd", "  abcd\n"},
+		{10, 2, nil, "abcd", "  abcd\n"},
+		{10, 0, []string{"AA"}, "abcd", "AA  abcd\n"},
+		{10, 0, nil, "語語語語", "   語語語語\n"},
+		{10, 0, nil, "a b c", "  a b c\n"},
+		// Too wide or unlimited width; don't pad.
+		{4, 0, nil, "abcd", "abcd\n"},
+		{4, 0, nil, "abcdef", "abcdef\n"},
+		{-1, 0, nil, "abcd", "abcd\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewUTF8WrapWriter(&buf, test.Width)
+		if err := w.SetRightMargin(test.Margin); err != nil {
+			t.Errorf("SetRightMargin(%d) got %v, want nil", test.Margin, err)
+		}
+		if err := w.SetIndents(test.Indents...); err != nil {
+			t.Errorf("SetIndents(%v) got %v, want nil", test.Indents, err)
+		}
+		if err := w.WriteCentered(test.In); err != nil {
+			t.Errorf("WriteCentered(%q) got %v, want nil", test.In, err)
+		}
+		if got, want := buf.String(), test.Want; got != want {
+			t.Errorf("%q width:%d margin:%d indents:%q got %q, want %q", test.In, test.Width, test.Margin, test.Indents, got, want)
+		}
+	}
+}
+
+func TestWrapWriterCenteredSurrounded(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewUTF8WrapWriter(&buf, 10)
+	wrapWriterWriteFlush(t, w, "abc def ghi", nil)
+	if err := w.WriteCentered("TITLE"); err != nil {
+		t.Errorf("WriteCentered got %v, want nil", err)
+	}
+	wrapWriterWriteFlush(t, w, "jkl", nil)
+	if got, want := buf.String(), "abc def\nghi\n  TITLE\njkl\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWrapWriterDisplayWidth(t *testing.T) {
+	const (
+		eAcute = "e\u0301"                    // e + combining acute accent
+		flag   = "\U0001f1ef\U0001f1f5"       // regional indicators J + P
+		thumb  = "\U0001f44d\U0001f3fd"       // thumbs up + skin tone modifier
+		family = "\U0001f468\u200d\U0001f469" // man + ZWJ + woman
+	)
+	tests := []struct {
+		Width    int
+		Display  bool
+		In, Want string
+	}{
+		// Every rune counts as one column by default.
+		{4, false, "語 語", "語 語\n"},
+		{4, false, eAcute + eAcute + " a", eAcute + eAcute + "\na\n"},
+		// Wide runes count as two columns.
+		{4, true, "語 語", "語\n語\n"},
+		{5, true, "語 語", "語 語\n"},
+		{5, true, "a 語語", "a\n語語\n"},
+		// Grapheme clusters count once.
+		{4, true, eAcute + eAcute + " a", eAcute + eAcute + " a\n"},
+		{5, true, flag + " " + flag + " a", flag + " " + flag + "\na\n"},
+		{5, true, thumb + " " + thumb + " a", thumb + " " + thumb + "\na\n"},
+		{5, true, family + " " + family + " a", family + " " + family + "\na\n"},
+		// Three regional indicators are a flag followed by a single indicator.
+		{4, true, flag + "\U0001f1fa a", flag + "\U0001f1fa\na\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewUTF8WrapWriter(&buf, test.Width)
+		if err := w.SetDisplayWidth(test.Display); err != nil {
+			t.Errorf("SetDisplayWidth(%v) got %v, want nil", test.Display, err)
+		}
+		wrapWriterWriteFlush(t, w, test.In, nil)
+		if got, want := buf.String(), test.Want; got != want {
+			t.Errorf("%q width:%d display:%v got %q, want %q", test.In, test.Width, test.Display, got, want)
+		}
+	}
+}
+
+func TestDisplayWidth(t *testing.T) {
+	tests := []struct {
+		In   string
+		Want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"café", 4},
+		{"e\u0301", 1},
+		{"語語", 4},
+		{"a語", 3},
+		{"\U0001f1ef\U0001f1f5", 2},
+		{"\U0001f468\u200d\U0001f469", 2},
+		// Only the rune right after the ZWJ is joined, even if other cluster
+		// extenders come in between.
+		{"\U0001f468\u200d\U0001f469abc", 5},
+		{"a\u200dbcd", 3},
+		{"a\u200d\u0301bcd", 3},
+		{"\u200dabc", 3},
+	}
+	for _, test := range tests {
+		if got, want := DisplayWidth(test.In), test.Want; got != want {
+			t.Errorf("%q got %d, want %d", test.In, got, want)
+		}
+	}
+}
+
+func TestWrapWriterPreserveTrailingSpace(t *testing.T) {
+	tests := []struct {
+		Width    int
+		Preserve bool
+		In, Want string
+	}{
+		{-1, false, "abc  ", "abc\n"},
+		{-1, true, "abc  ", "abc  \n"},
+		// Trailing spaces are trimmed to a single space when lines are joined.
+		{-1, true, "abc  \ndef ", "abc def \n"},
+		{-1, true, "abc\t \ndef  \nghi", "abc def ghi\n"},
+		{9, true, "abc    \ndef", "abc def\n"},
+		{-1, true, "abc\n\ndef  \n\n", "abc\n\ndef  \n"},
+		{-1, true, "  abc  \ndef", "  abc  \ndef\n"},
+		{-1, true, "   \nabc", "abc\n"},
+		// Spaces at word-wrapping line breaks aren't preserved.
+		{6, true, "abc def", "abc\ndef\n"},
+		{6, true, "abc  \ndefgh", "abc  \ndefgh\n"},
+		{6, true, "abc       \ndef", "abc\ndef\n"},
+		{6, true, "ab  \n cd  ", "ab  \n cd  \n"},
+		{6, false, "ab  \n cd  ", "ab\n cd\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewUTF8WrapWriter(&buf, test.Width)
+		if err := w.SetPreserveTrailingSpace(test.Preserve); err != nil {
+			t.Errorf("SetPreserveTrailingSpace(%v) got %v, want nil", test.Preserve, err)
+		}
+		wrapWriterWriteFlush(t, w, test.In, nil)
+		if got, want := buf.String(), test.Want; got != want {
+			t.Errorf("%q width:%d preserve:%v got %q, want %q", test.In, test.Width, test.Preserve, got, want)
+		}
+	}
+}
+
+func TestWrapWriterBreakLongWords(t *testing.T) {
+	tests := []struct {
+		Width   int
+		Display bool
+		In      string
+		Want    string
+	}{
+		{4, false, "abcdefghij", "abcd\nefgh\nij\n"},
+		{4, false, "ab cdefghij k", "ab\ncdef\nghij\nk\n"},
+		{4, false, "abcd efgh", "abcd\nefgh\n"},
+		{4, false, "  verbatim", "  verbatim\n"},
+		{-1, false, "abcdefghij", "abcdefghij\n"},
+		{0, false, "abc", "a\nb\nc\n"},
+		// Wide runes and grapheme clusters aren't split.
+		{5, true, "世界世界", "世界\n世界\n"},
+		{2, true, "e\u0301e\u0301e\u0301", "e\u0301e\u0301\ne\u0301\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewUTF8WrapWriter(&buf, test.Width)
+		w.SetDisplayWidth(test.Display)
+		if err := w.SetBreakLongWords(true); err != nil {
+			t.Errorf("SetBreakLongWords(true) got %v, want nil", err)
+		}
+		wrapWriterWriteFlush(t, w, test.In, nil)
+		if got, want := buf.String(), test.Want; got != want {
+			t.Errorf("%q width:%d got %q, want %q", test.In, test.Width, got, want)
+		}
+	}
+	// Indents count towards the width.
+	var buf bytes.Buffer
+	w := NewUTF8WrapWriter(&buf, 6)
+	w.SetBreakLongWords(true)
+	w.SetIndents("> ", "  ")
+	wrapWriterWriteFlush(t, w, "abcdefghij", nil)
+	if got, want := buf.String(), "> abcd\n  efgh\n  ij\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWrapWriterParagraphChunks(t *testing.T) {
+	tests := []struct {
+		In, Want string
+	}{
+		{"abc\n\ndef", "abc\n\ndef\n"},
+		{"abc\n\n\n\ndef\n\n", "abc\n\ndef\n"},
+		{"\n\nabc\ndef\n \n\t\nghi", "abc def\n\nghi\n"},
+		{"abc\r\n\r\ndef\r\nghi", "abc\n\ndef ghi\n"},
+		{"abc\u2029\n\ndef", "abc\n\ndef\n"},
+		{"abc\n\n  verbatim\n\n\ndef", "abc\n\n  verbatim\n\ndef\n"},
+	}
+	for _, test := range tests {
+		// Split the input across two Write calls at every possible position.
+		for split := 0; split <= len(test.In); split++ {
+			var buf bytes.Buffer
+			w := NewUTF8WrapWriter(&buf, 80)
+			w.Write([]byte(test.In[:split]))
+			w.Write([]byte(test.In[split:]))
+			w.Flush()
+			if got, want := buf.String(), test.Want; got != want {
+				t.Errorf("%q split at %d got %q, want %q", test.In, split, got, want)
+			}
+		}
+		// Write the input one line at a time, as with repeated Fprintln calls.
+		var buf bytes.Buffer
+		w := NewUTF8WrapWriter(&buf, 80)
+		for _, line := range strings.SplitAfter(test.In, "\n") {
+			w.Write([]byte(line))
+		}
+		w.Flush()
+		if got, want := buf.String(), test.Want; got != want {
+			t.Errorf("%q by line got %q, want %q", test.In, got, want)
+		}
+	}
+}
+
+func TestWrapWriterOnLine(t *testing.T) {
+	var buf bytes.Buffer
+	var lines []string
+	w := NewUTF8WrapWriter(&buf, 7)
+	w.SetIndents("", "  ")
+	w.OnLine(func(line string) { lines = append(lines, line) })
+	wrapWriterWriteFlush(t, w, "abc def ghi\n\njkl\n  verbatim\nmno", nil)
+	if got, want := buf.String(), "abc def\n  ghi\n\njkl\n    verbatim\n  mno\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := lines, []string{"abc def", "  ghi", "", "jkl", "    verbatim", "  mno"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got lines %q, want %q", got, want)
+	}
+	// Every line of a multi-paragraph output is reported, including the lines
+	// of the paragraph separator.
+	for _, test := range []struct {
+		sep, want string
+	}{
+		{"\n", "a\n\nb\n\nc\n"},
+		{"\n\n", "a\n\n\nb\n\n\nc\n"},
+		{"--\n", "a\n--\nb\n--\nc\n"},
+		{"--", "a\n--b\n--c\n"},
+	} {
+		buf.Reset()
+		lines = nil
+		w := NewUTF8WrapWriter(&buf, 7)
+		w.SetParagraphSeparator(test.sep)
+		w.OnLine(func(line string) { lines = append(lines, line) })
+		wrapWriterWriteFlush(t, w, "a\n\nb\n\n\nc", nil)
+		if got, want := buf.String(), test.want; got != want {
+			t.Errorf("sep %q: got %q, want %q", test.sep, got, want)
+		}
+		if got, want := strings.Join(lines, "\n")+"\n", test.want; got != want {
+			t.Errorf("sep %q: got lines %q, want %q", test.sep, got, want)
+		}
+	}
+	// Nothing is reported for an empty Flush, or after disabling the callback.
+	lines = nil
+	w.Flush()
+	w.OnLine(nil)
+	wrapWriterWriteFlush(t, w, "pqr", nil)
+	if len(lines) != 0 {
+		t.Errorf("got lines %q, want none", lines)
+	}
+}
+
 // xlateIn translates our test.In pattern into an actual input string to feed
 // into the writer.  The point is to make it easy to specify the various control
 // sequences in a single character, so it's easier to understand.
@@ -349,3 +681,80 @@ func BenchmarkUTF8WrapWriter_Sizes_1_2_3_Width_10(b *testing.B) {
 func BenchmarkUTF8WrapWriter_Sizes_1_2_3_Width_Inf(b *testing.B) {
 	benchUTF8WrapWriter(b, -1, []int{1, 2, 3})
 }
+
+func TestWrapWriterFlushLine(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewUTF8WrapWriter(&buf, 7)
+	w.SetIndents("", "  ")
+	write := func(s string) {
+		if _, err := w.Write([]byte(s)); err != nil {
+			t.Fatalf("Write(%q) got %v, want nil", s, err)
+		}
+	}
+	// Nothing is written for a line without letters.
+	write("\n")
+	if err := w.FlushLine(); err != nil {
+		t.Fatalf("FlushLine() got %v, want nil", err)
+	}
+	if got := buf.String(); got != "" {
+		t.Errorf("got %q, want empty", got)
+	}
+	write("abc de")
+	if err := w.FlushLine(); err != nil {
+		t.Fatalf("FlushLine() got %v, want nil", err)
+	}
+	if got, want := buf.String(), "abc de"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// The partially written word "defg" can't be moved to the next line, but
+	// subsequent words are wrapped as usual.
+	write("fg hij kl")
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() got %v, want nil", err)
+	}
+	if got, want := buf.String(), "abc defg\n  hij\n  kl\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWrapWriterFlushPartial(t *testing.T) {
+	defer func(delay time.Duration) { flushPartialDelay = delay }(flushPartialDelay)
+	flushPartialDelay = time.Millisecond
+	var buf syncBuffer
+	w := NewUTF8WrapWriter(&buf, 80)
+	if err := w.SetFlushPartial(true); err != nil {
+		t.Fatalf("SetFlushPartial(true) got %v, want nil", err)
+	}
+	if _, err := w.Write([]byte("abc\ndef")); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for buf.String() != "abc def" {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %q, want partial line %q", buf.String(), "abc def")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	wrapWriterWriteFlush(t, w, " ghi", nil)
+	if got, want := buf.String(), "abc def ghi\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -6,7 +6,9 @@ package textutil
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"strings"
 	"unicode/utf8"
 )
 
@@ -108,6 +110,76 @@ func (w *prefixLineWriter) Flush() (e error) {
 	return nil
 }
 
+// NewNumberedLineWriter returns a WriteFlusher that wraps w.  Each input line
+// is word-wrapped to the target width in runes, and prefixed with its line
+// number and a " | " separator.  Line numbers start at start, and are right
+// aligned in a field of 4 runes, which grows for larger numbers.  Continuation
+// lines produced by wrapping are prefixed with spaces in place of the number, so
+// that they align under the content.  The prefix consumes runes from the width.
+//
+// As with PrefixLineWriter, data without EOL is buffered until the next EOL or
+// Flush call, and Flush appends \n to buffered data that doesn't end in EOL.
+func NewNumberedLineWriter(w io.Writer, width, start int) WriteFlusher {
+	return &numberedLineWriter{w: w, width: width, next: start}
+}
+
+type numberedLineWriter struct {
+	w     io.Writer
+	width int
+	next  int
+	buf   []byte
+}
+
+func (w *numberedLineWriter) Write(data []byte) (int, error) {
+	totalLen := len(data)
+	for len(data) > 0 {
+		index := bytes.IndexByte(data, '\n')
+		if index == -1 {
+			w.buf = append(w.buf, data...)
+			return totalLen, nil
+		}
+		w.buf = append(w.buf, data[:index]...)
+		data = data[index+1:]
+		err := w.writeLine()
+		if err != nil {
+			return totalLen - len(data), err
+		}
+	}
+	return totalLen, nil
+}
+
+func (w *numberedLineWriter) Flush() (e error) {
+	defer func() {
+		if f, ok := w.w.(WriteFlusher); ok {
+			if err := f.Flush(); err != nil && e == nil {
+				e = err
+			}
+		}
+	}()
+	if len(w.buf) > 0 {
+		return w.writeLine()
+	}
+	return nil
+}
+
+// writeLine writes the buffered line, and resets the buffer.
+func (w *numberedLineWriter) writeLine() error {
+	line := string(w.buf)
+	w.buf = w.buf[:0]
+	number := fmt.Sprintf("%4d | ", w.next)
+	w.next++
+	if strings.TrimSpace(line) == "" {
+		_, err := io.WriteString(w.w, strings.TrimRight(number, " ")+"\n")
+		return err
+	}
+	wrap := NewUTF8WrapWriter(w.w, w.width)
+	wrap.SetIndents(number, strings.Repeat(" ", len(number)-2)+"| ")
+	if _, err := io.WriteString(wrap, line); err != nil {
+		return err
+	}
+	return wrap.Flush()
+}
+
 // ByteReplaceWriter returns an io.Writer that wraps w, where all occurrences of
 // the old byte are replaced with the new string on Write calls.
 func ByteReplaceWriter(w io.Writer, old byte, new string) io.Writer {
@@ -316,3 +316,32 @@ func TestByteReplaceWriter(t *testing.T) {
 		}
 	}
 }
+
+func TestNumberedLineWriter(t *testing.T) {
+	tests := []struct {
+		Width, Start int
+		Writes       []string
+		Want         string
+	}{
+		{80, 1, nil, ""},
+		{80, 1, []string{"abc"}, "   1 | abc\n"},
+		{80, 9, []string{"a\n\nb", "c\n", "d"}, "   9 | a\n  10 |\n  11 | bc\n  12 | d\n"},
+		{16, 1, []string{"aaa bbb ccc ddd\n"}, "   1 | aaa bbb\n     | ccc ddd\n"},
+		{16, 1, []string{"  verbatim line is not wrapped\n"}, "   1 |   verbatim line is not wrapped\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := NewNumberedLineWriter(&buf, test.Width, test.Start)
+		for _, write := range test.Writes {
+			if n, err := w.Write([]byte(write)); n != len(write) || err != nil {
+				t.Errorf("%q got (%d, %v), want (%d, nil)", write, n, err, len(write))
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Errorf("%v Flush got error %v", test.Writes, err)
+		}
+		if got, want := buf.String(), test.Want; got != want {
+			t.Errorf("%v got %q, want %q", test.Writes, got, want)
+		}
+	}
+}